@@ -4,6 +4,8 @@ package cgroups
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 // Resources assembles the supported cgroup configs.
@@ -15,6 +17,7 @@ type Resources struct {
 	CpuPeriodUs      CpuPeriodUs
 	CpuSetCpus       CpuSetCpus
 	MemoryLimitBytes MemoryLimitBytes
+	NetClsClassid    NetClsClassid
 }
 
 // ⬇️ stupid things for v1fs
@@ -23,10 +26,17 @@ const (
 	SubsystemCpu    = "cpu"
 	SubsystemCpuSet = "cpuset"
 	SubsystemMemory = "memory"
+	SubsystemNetCls = "net_cls"
 )
 
 func supportedSubsystem() []string {
-	return []string{SubsystemCpu, SubsystemCpuSet, SubsystemMemory}
+	return []string{SubsystemCpu, SubsystemCpuSet, SubsystemMemory, SubsystemNetCls}
+}
+
+// V1fsSubsystems returns the cgroup v1 subsystems (controllers) that
+// the V1fsManager creates cgroups in.
+func V1fsSubsystems() []string {
+	return supportedSubsystem()
 }
 
 // ⬇️ Resources items
@@ -85,3 +95,43 @@ func (m MemoryLimitBytes) Value() string {
 func (m MemoryLimitBytes) V1fsPath(basePath string, containerId string) string {
 	return v1fsPath(basePath, SubsystemMemory, containerId, "memory.limit_in_bytes")
 }
+
+// NetClsClassid sets net_cls.classid: the packets from the tasks are
+// tagged with the class id (0xAAAABBBB for the tc class AAAA:BBBB),
+// which can be used by tc filters (cgroup) and iptables (-m cgroup).
+type NetClsClassid uint32
+
+func (c NetClsClassid) Value() string {
+	return fmt.Sprint(uint32(c))
+}
+
+func (c NetClsClassid) V1fsPath(basePath string, containerId string) string {
+	return v1fsPath(basePath, SubsystemNetCls, containerId, "net_cls.classid")
+}
+
+// String is the tc class handle: "major:minor" in hex.
+func (c NetClsClassid) String() string {
+	return fmt.Sprintf("%x:%x", uint32(c)>>16, uint32(c)&0xffff)
+}
+
+// ParseNetClsClassid parses a tc class handle "major:minor" (in hex,
+// e.g. 10:1), or a number (e.g. 0x100001 or 1048577).
+func ParseNetClsClassid(s string) (NetClsClassid, error) {
+	if major, minor, ok := strings.Cut(s, ":"); ok {
+		maj, err := strconv.ParseUint(major, 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("bad net_cls classid %q: %w", s, err)
+		}
+		mnr, err := strconv.ParseUint(minor, 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("bad net_cls classid %q: %w", s, err)
+		}
+		return NetClsClassid(maj<<16 | mnr), nil
+	}
+
+	n, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad net_cls classid %q: %w", s, err)
+	}
+	return NetClsClassid(n), nil
+}
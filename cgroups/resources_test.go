@@ -207,3 +207,44 @@ func TestMemoryLimitBytes_V1fsPath(t *testing.T) {
 		})
 	}
 }
+
+func TestNetClsClassid_V1fsPath(t *testing.T) {
+	c := NetClsClassid(0x100001)
+	if got, want := c.Value(), "1048577"; got != want {
+		t.Errorf("NetClsClassid.Value() = %v, want %v", got, want)
+	}
+	if got, want := c.V1fsPath("/sys/fs/cgroup", "testgroup"), "/sys/fs/cgroup/net_cls/testgroup/net_cls.classid"; got != want {
+		t.Errorf("NetClsClassid.V1fsPath() = %v, want %v", got, want)
+	}
+	if got, want := c.String(), "10:1"; got != want {
+		t.Errorf("NetClsClassid.String() = %v, want %v", got, want)
+	}
+}
+
+func TestParseNetClsClassid(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    NetClsClassid
+		wantErr bool
+	}{
+		{"10:1", 0x100001, false},
+		{"ffff:ffff", 0xffffffff, false},
+		{"0x100001", 0x100001, false},
+		{"1048577", 0x100001, false},
+		{"10:", 0, true},
+		{"10000:1", 0, true},
+		{"0x100000000", 0, true},
+		{"abc", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseNetClsClassid(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseNetClsClassid() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseNetClsClassid() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -42,6 +42,16 @@ func NewV1fsManager(basePath string, cgroupName string) (Manager, error) {
 	return m, err
 }
 
+// LoadV1fsManager returns the manager of the existing cgroup of the
+// name, e.g. created by another hind process. Unlike NewV1fsManager,
+// nothing is created or reset.
+func LoadV1fsManager(basePath string, cgroupName string) *V1fsManager {
+	return &V1fsManager{
+		BasePath:   basePath,
+		cgroupName: cgroupName,
+	}
+}
+
 // -- implement Manager interface --
 
 func (v *V1fsManager) Create(name string) error {
@@ -56,7 +66,7 @@ func (v *V1fsManager) Create(name string) error {
 	}
 
 	v.cgroupName = name
-	for _, subsystem := range supportedSubsystem() {
+	for _, subsystem := range v.mountedSubsystems() {
 		p := v.subsystemDir(subsystem)
 		if err := mkdirIfNotExists(p); err != nil {
 			return err
@@ -65,13 +75,36 @@ func (v *V1fsManager) Create(name string) error {
 
 	// In my practice, the cpuset.cpus and cpuset.mems are required
 	// to be set first, or any other resources will fail to set.
-	if err := v.setResource(CpuSetCpus("0")); err != nil {
-		return fmt.Errorf("error init cpuset.cpus: %w", err)
+	if err := v.initCpuset(); err != nil {
+		return err
 	}
-	if err := v.setResource(CpuSetMems("0")); err != nil {
-		return fmt.Errorf("error init cpuset.mems: %w", err)
+
+	return nil
+}
+
+// initCpuset sets the empty cpuset.cpus and cpuset.mems of a new cgroup
+// to the ones of its parent. The parent may be a pod restricted to some
+// cpus (not always including cpu 0): a child can only use a subset of
+// them. The values of an existing cgroup are kept.
+func (v *V1fsManager) initCpuset() error {
+	if _, err := os.Stat(path.Join(v.BasePath, SubsystemCpuSet)); err != nil {
+		return nil // not mounted, see mountedSubsystems
 	}
 
+	for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+		own := v1fsPath(v.BasePath, SubsystemCpuSet, v.cgroupName, file)
+		if value, err := os.ReadFile(own); err == nil && strings.TrimSpace(string(value)) != "" {
+			continue
+		}
+		value, err := os.ReadFile(v1fsPath(v.BasePath, SubsystemCpuSet, path.Dir(v.cgroupName), file))
+		if err != nil {
+			return fmt.Errorf("error init %s: %w", file, err)
+		}
+		slog.Info("[cgroups] V1fsManager init cpuset from the parent", "value", strings.TrimSpace(string(value)), "target", own)
+		if err := overwriteFile(own, strings.TrimSpace(string(value))); err != nil {
+			return fmt.Errorf("error init %s: %w", file, err)
+		}
+	}
 	return nil
 }
 
@@ -83,7 +116,7 @@ func (v *V1fsManager) Apply(pid int) error {
 		return err
 	}
 
-	for _, subsystem := range supportedSubsystem() {
+	for _, subsystem := range v.mountedSubsystems() {
 		tasksFile := v.taskFile(subsystem)
 		if err := appendFile(tasksFile, fmt.Sprint(pid)); err != nil {
 			return err
@@ -134,7 +167,7 @@ func (v *V1fsManager) setResource(r Resource) error {
 func (v *V1fsManager) Destroy() {
 	slog.Info("[cgroups] Destroy: do cgdelete.", "cgroupName", v.cgroupName)
 
-	subsustems := strings.Join(supportedSubsystem(), ",")
+	subsustems := strings.Join(v.mountedSubsystems(), ",")
 
 	delete := exec.Command("cgdelete", "--recursive", subsustems+":"+v.cgroupName)
 	if err := delete.Run(); err != nil {
@@ -144,6 +177,21 @@ func (v *V1fsManager) Destroy() {
 	v.cgroupName = ""
 }
 
+// mountedSubsystems returns the supported subsystems whose hierarchy
+// is mounted under the BasePath. The others (e.g. net_cls is not
+// mounted on some hosts) are skipped: setting a resource of them fails.
+func (v *V1fsManager) mountedSubsystems() []string {
+	var mounted []string
+	for _, subsystem := range supportedSubsystem() {
+		if _, err := os.Stat(path.Join(v.BasePath, subsystem)); err != nil {
+			slog.Debug("[cgroups] subsystem not mounted, skipped.", "subsystem", subsystem, "err", err)
+			continue
+		}
+		mounted = append(mounted, subsystem)
+	}
+	return mounted
+}
+
 // -- path methods --
 
 // subsystemDir returns /sys/fs/cgroup/<subsystem>/<CgroupName>/
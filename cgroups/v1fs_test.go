@@ -3,6 +3,9 @@ package cgroups
 import (
 	"os"
 	"os/exec"
+	"path"
+	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -45,6 +48,86 @@ func TestV1fsManager_Create(t *testing.T) {
 	}
 }
 
+// fakeV1fs makes a cgroup v1 like hierarchy of cpuset and cpu on a tmpfs,
+// with the files (path relative to the base -> content). Root is needed to
+// mount the tmpfs.
+func fakeV1fs(t *testing.T, files map[string]string) string {
+	t.Helper()
+	base := t.TempDir()
+	if err := syscall.Mount("tmpfs", base, "tmpfs", 0, ""); err != nil {
+		t.Skipf("mount tmpfs (needs root): %v", err)
+	}
+	t.Cleanup(func() { syscall.Unmount(base, syscall.MNT_DETACH) })
+
+	for _, dir := range []string{SubsystemCpu, SubsystemCpuSet} {
+		if err := os.MkdirAll(path.Join(base, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(path.Dir(path.Join(base, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path.Join(base, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return base
+}
+
+func TestV1fsManager_Create_cpuset(t *testing.T) {
+	root := map[string]string{
+		"cpuset/cpuset.cpus": "0-3\n",
+		"cpuset/cpuset.mems": "0\n",
+	}
+	// a pod with a cpuset that excludes cpu 0
+	pod := map[string]string{
+		"cpuset/cpuset.cpus":          "0-3\n",
+		"cpuset/cpuset.mems":          "0-1\n",
+		"cpuset/hind/cpuset.cpus":     "0-3\n",
+		"cpuset/hind/cpuset.mems":     "0-1\n",
+		"cpuset/hind/pod/cpuset.cpus": "2-3\n",
+		"cpuset/hind/pod/cpuset.mems": "1\n",
+	}
+	// an existing cgroup: its cpuset is kept
+	existing := map[string]string{
+		"cpuset/cpuset.cpus":      "0-3\n",
+		"cpuset/cpuset.mems":      "0\n",
+		"cpuset/hind/cpuset.cpus": "1\n",
+		"cpuset/hind/cpuset.mems": "0\n",
+	}
+
+	tests := []struct {
+		name       string
+		files      map[string]string
+		cgroupName string
+		wantCpus   string
+		wantMems   string
+	}{
+		{"top", root, "hind", "0-3", "0"},
+		{"pod_member", pod, "hind/pod/c1", "2-3", "1"},
+		{"existing", existing, "hind", "1", "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := fakeV1fs(t, tt.files)
+			v := &V1fsManager{BasePath: base}
+			if err := v.Create(tt.cgroupName); err != nil {
+				t.Fatalf("V1fsManager.Create() error = %v", err)
+			}
+			for file, want := range map[string]string{"cpuset.cpus": tt.wantCpus, "cpuset.mems": tt.wantMems} {
+				got, err := os.ReadFile(path.Join(base, SubsystemCpuSet, tt.cgroupName, file))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.TrimSpace(string(got)) != want {
+					t.Errorf("%s = %q, want %q", file, got, want)
+				}
+			}
+		})
+	}
+}
+
 func TestV1fsManager_subsystemDir(t *testing.T) {
 	t.Log("This test needs to be run as root (to v1fsManager.Create) for the first time:\n sudo go test -timeout 30s -run ^TestV1fsManager_subsystemDir$ hind/cgroups")
 
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"hind/container"
+	"hind/image"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slog"
+)
+
+func buildCommand() *cobra.Command {
+	var opts container.BuildOptions
+
+	var cmd = &cobra.Command{
+		Use:   "build [flags] CONTEXT",
+		Short: "Build an image from a Hindfile",
+		Long: `Build an image in the store from a Hindfile: a subset of the Dockerfile.
+
+	FROM alpine:3.18
+	RUN apk add --no-cache curl
+	COPY app.sh /usr/local/bin/
+	ENV MODE=prod
+	WORKDIR /srv
+	USER nobody
+	ENTRYPOINT ["app.sh"]
+	CMD ["--serve"]
+
+FROM takes an image in the store (see "hind image import|load"), or
+scratch. RUN runs the command in a container (on the overlay or
+fuse-overlayfs storage driver) and commits its changes as a layer. COPY
+copies files from the CONTEXT directory. There is no variable
+substitution, no multi-stage build and no flags of the instructions.
+
+Each step is cached by the instruction and the step before it, and the
+files copied: unchanged steps are not run again, unless --no-cache.`,
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			opts.Context = args[0]
+			for _, ref := range opts.Refs {
+				if _, err := image.ParseReference(ref); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if _, err := container.Build(opts); err != nil {
+				slog.Error("[cmd/build] build failed.", "err", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVarP(&opts.Hindfile, "file", "f", "", "Path of the Hindfile (default: CONTEXT/Hindfile)")
+	flags.StringArrayVarP(&opts.Refs, "tag", "t", nil, "Name and optionally a tag of the image: name[:tag]. Can be repeated.")
+	flags.BoolVar(&opts.NoCache, "no-cache", false, "Do not use the cached steps")
+	flags.StringSliceVar(&opts.Networks, "network", []string{container.NetworkBridge}, "Networks of the RUN containers: bridge | none | <network>. Can be repeated or comma separated.")
+
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(buildCommand())
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"hind/container"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slog"
+)
+
+func commitCommand() *cobra.Command {
+	var opts container.CommitOptions
+	var cmdFlag string
+
+	var cmd = &cobra.Command{
+		Use:   "commit [flags] CONTAINER [REPOSITORY[:TAG]]",
+		Short: "Create a new image from a container's changes",
+		Long: `Create a new image in the store from the changes in a container's
+writable layer, on top of the container's image (which must be in the
+store). The deleted files are recorded as whiteouts.
+
+The config of the new image is the config of the container's image,
+with the command, environment variables, working dir and user of the
+container, unless changed by the flags:
+
+	hind commit -e DEBUG=1 --cmd '["/bin/app", "--serve"]' mycontainer app:v2
+
+The container is not paused while committing.`,
+		Args: cobra.RangeArgs(1, 2),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 1 {
+				opts.Refs = []string{args[1]}
+			}
+			if cmdFlag != "" {
+				command, err := parseCmd(cmdFlag)
+				if err != nil {
+					return err
+				}
+				opts.Cmd = command
+			}
+			for _, kv := range opts.Env {
+				if !strings.Contains(kv, "=") {
+					return fmt.Errorf("bad env %q: expected KEY=VALUE", kv)
+				}
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			c, err := container.LoadContainer(args[0])
+			if err != nil {
+				slog.Error("[cmd/commit] load container failed.", "err", err)
+				os.Exit(1)
+			}
+
+			img, err := container.Commit(c, opts)
+			if err != nil {
+				slog.Error("[cmd/commit] commit failed.", "container", args[0], "err", err)
+				os.Exit(1)
+			}
+			fmt.Println(img.ID)
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&cmdFlag, "cmd", "", `Set the CMD of the image: a JSON array (exec form, e.g. '["sh", "-c", "echo hi"]'), or a command line run by /bin/sh -c. Resets the ENTRYPOINT.`)
+	flags.StringArrayVarP(&opts.Env, "env", "e", nil, "Set an environment variable of the image: KEY=VALUE. Can be repeated.")
+
+	return cmd
+}
+
+// parseCmd parses a command in the exec form (a JSON array of strings)
+// or the shell form (run by /bin/sh -c), as the CMD in a Dockerfile.
+func parseCmd(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "[") {
+		return []string{"/bin/sh", "-c", s}, nil
+	}
+	var command []string
+	if err := json.Unmarshal([]byte(s), &command); err != nil {
+		return nil, fmt.Errorf("bad command %q: expected a JSON array of strings: %w", s, err)
+	}
+	return command, nil
+}
+
+func init() {
+	rootCmd.AddCommand(commitCommand())
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"errors"
+	"hind/container"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slog"
+)
+
+func cpCommand() *cobra.Command {
+	var followLink bool
+
+	var cmd = &cobra.Command{
+		Use:   "cp [flags] CONTAINER:SRC_PATH DEST_PATH | SRC_PATH CONTAINER:DEST_PATH",
+		Short: "Copy files between a container and the host",
+		Long: `Copy a file or a directory (recursively) out of or into a container,
+running or stopped:
+
+	hind cp mycontainer:/etc/hosts ./hosts
+	hind cp ./conf mycontainer:/etc/app/
+
+The paths in the container are resolved in its filesystem: the symlinks
+never lead out of it. A local path containing a colon can be written
+as ./a:b. Copied into an existing directory, the file keeps its name;
+otherwise it is copied as the DEST_PATH.
+
+The owners, modes and times are kept. A read-only container can not be
+copied into.`,
+		Args: cobra.ExactArgs(2),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			_, _, srcInContainer := splitContainerPath(args[0])
+			_, _, dstInContainer := splitContainerPath(args[1])
+			if srcInContainer == dstInContainer {
+				return errors.New("exactly one of the paths must be CONTAINER:PATH")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			id, src, fromContainer := splitContainerPath(args[0])
+			dst := args[1]
+			if !fromContainer {
+				id, dst, _ = splitContainerPath(args[1])
+				src = args[0]
+			}
+
+			c, err := container.LoadContainer(id)
+			if err != nil {
+				slog.Error("[cmd/cp] load container failed.", "err", err)
+				os.Exit(1)
+			}
+
+			if fromContainer {
+				err = container.CopyFromContainer(c, src, dst, followLink)
+			} else {
+				err = container.CopyToContainer(c, src, dst, followLink)
+			}
+			if err != nil {
+				slog.Error("[cmd/cp] copy failed.", "src", args[0], "dst", args[1], "err", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().BoolVarP(&followLink, "follow-link", "L", false, "always follow the symbolic link in SRC_PATH")
+	return cmd
+}
+
+// splitContainerPath splits the CONTAINER:PATH argument. A path with no
+// colon, or a slash before the colon, is a local one.
+func splitContainerPath(arg string) (id string, p string, ok bool) {
+	id, p, ok = strings.Cut(arg, ":")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return "", arg, false
+	}
+	if p == "" {
+		p = "/"
+	}
+	return id, p, true
+}
+
+func init() {
+	rootCmd.AddCommand(cpCommand())
+}
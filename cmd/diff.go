@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+	"hind/container"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slog"
+)
+
+func diffCommand() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "diff CONTAINER",
+		Short: "Inspect changes to files on a container's filesystem",
+		Long: `List the files added (A), changed (C) or deleted (D) in a container's
+filesystem, compared to its image:
+
+	A /new/file
+	C /etc
+	D /etc/passwd
+
+Only the containers on the overlay or fuse-overlayfs storage drivers
+keep their changes apart from the image.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			c, err := container.LoadContainer(args[0])
+			if err != nil {
+				slog.Error("[cmd/diff] load container failed.", "err", err)
+				os.Exit(1)
+			}
+
+			changes, err := container.Diff(c)
+			if err != nil {
+				slog.Error("[cmd/diff] diff failed.", "container", args[0], "err", err)
+				os.Exit(1)
+			}
+			for _, change := range changes {
+				fmt.Println(change)
+			}
+		},
+	}
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(diffCommand())
+}
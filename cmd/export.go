@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"errors"
+	"hind/container"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slog"
+	"golang.org/x/sys/unix"
+)
+
+func exportCommand() *cobra.Command {
+	var output string
+
+	var cmd = &cobra.Command{
+		Use:   "export [flags] CONTAINER",
+		Short: "Export a container's filesystem as a tar archive",
+		Long: `Write the filesystem of a container, the image with the container's
+changes flattened, as an uncompressed tar archive to the file, or to
+STDOUT:
+
+	hind export -o rootfs.tar mycontainer
+	hind export mycontainer | tar -t
+
+The volumes and other mounts are not exported. The archive can be run
+as an image: hind run --image rootfs.tar ...`,
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if output == "" && isTerminal(os.Stdout) {
+				return errors.New("refusing to write the archive to a terminal: use -o or redirect STDOUT")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			c, err := container.LoadContainer(args[0])
+			if err != nil {
+				slog.Error("[cmd/export] load container failed.", "err", err)
+				os.Exit(1)
+			}
+
+			var w io.Writer = os.Stdout
+			if output != "" {
+				f, err := os.Create(output)
+				if err != nil {
+					slog.Error("[cmd/export] create output file failed.", "err", err)
+					os.Exit(1)
+				}
+				defer f.Close()
+				w = f
+			}
+
+			if err := container.Export(c, w); err != nil {
+				slog.Error("[cmd/export] export failed.", "container", args[0], "err", err)
+				if output != "" {
+					os.Remove(output)
+				}
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "", "write to the file, instead of STDOUT")
+	return cmd
+}
+
+// isTerminal reports whether the file is a terminal.
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+func init() {
+	rootCmd.AddCommand(exportCommand())
+}
@@ -0,0 +1,320 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hind/container"
+	"hind/image"
+	"hind/internal/stringid"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slog"
+)
+
+func imageCommand() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "image",
+		Short: "Manage images",
+		Long: `Manage images in the local image store.
+
+An image is imported (unpacked) once, and run by its name[:tag] or id:
+
+	hind image import rootfs.tar --name foo:v1
+	hind run foo:v1 sh
+
+Multi-layer images are loaded from OCI image layouts or docker save
+archives, sharing the layers among images:
+
+	hind image load busybox.tar
+
+An image can be pinned by a digest, and signed with a local ed25519 key:
+
+	hind run rootfs.tar@sha256:<hex> sh
+	hind image sign --key release foo:v1`,
+	}
+
+	cmd.AddCommand(
+		imageImportCommand(),
+		imageLoadCommand(),
+		imageLsCommand(),
+		imageRmCommand(),
+		imageInspectCommand(),
+		imageSignCommand(),
+		imageVerifyCommand(),
+	)
+
+	return cmd
+}
+
+func imageImportCommand() *cobra.Command {
+	var names []string
+
+	var cmd = &cobra.Command{
+		Use:   "import [flags] FILE",
+		Short: "Import an image from a tar archive of the rootfs",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			img, err := container.ImageStore().Import(args[0], names...)
+			if err != nil {
+				slog.Error("[cmd/image] import image failed.", "err", err)
+				os.Exit(1)
+			}
+			fmt.Println(img.ID)
+		},
+	}
+
+	cmd.Flags().StringArrayVarP(&names, "name", "n", nil, "Name the image: name[:tag] (default tag: latest). Can be repeated.")
+
+	return cmd
+}
+
+func imageLoadCommand() *cobra.Command {
+	var names []string
+
+	var cmd = &cobra.Command{
+		Use:   "load [flags] PATH",
+		Short: "Load images from an OCI image layout or a docker save archive",
+		Long: `Load images from an OCI image layout or a docker save archive.
+
+PATH is a directory or a tar file of:
+  - an OCI image layout (index.json + blobs/), e.g. skopeo copy docker://busybox oci-archive:busybox.tar
+  - a docker save archive (manifest.json), e.g. docker save busybox -o busybox.tar
+
+The layers (maybe gzip compressed) are unpacked into the store once, and
+shared by all the images using them.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			images, err := container.ImageStore().Load(args[0], names...)
+			for _, img := range images {
+				if len(img.RepoTags) == 0 {
+					fmt.Println("Loaded image ID:", img.ID)
+				}
+				for _, ref := range img.RepoTags {
+					fmt.Println("Loaded image:", ref)
+				}
+			}
+			if err != nil {
+				slog.Error("[cmd/image] load image failed.", "err", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().StringArrayVarP(&names, "name", "n", nil, "Name the image: name[:tag] (default tag: latest). Can be repeated. Only for a single image.")
+
+	return cmd
+}
+
+func imageLsCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "List images",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			images, err := container.ImageStore().List()
+			if err != nil {
+				slog.Error("[cmd/image] list images failed.", "err", err)
+				os.Exit(1)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE")
+			for _, img := range images {
+				id := stringid.TruncateID(img.ID)
+				created := img.Created.Format(time.DateTime)
+				if len(img.RepoTags) == 0 {
+					fmt.Fprintf(w, "<none>\t<none>\t%s\t%s\t%s\n", id, created, humanSize(img.Size))
+				}
+				for _, ref := range img.RepoTags {
+					r, _ := image.ParseReference(ref)
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Name, r.Tag, id, created, humanSize(img.Size))
+				}
+			}
+			w.Flush()
+		},
+	}
+}
+
+func imageRmCommand() *cobra.Command {
+	var force bool
+
+	var cmd = &cobra.Command{
+		Use:     "rm [flags] IMAGE [IMAGE...]",
+		Aliases: []string{"remove", "rmi"},
+		Short:   "Remove images",
+		Long: `Remove images by name[:tag] or id.
+
+Removing a name untags it, and the image is deleted if no other name
+refers to it. Removing by the id deletes the image and all its names
+(--force is required if there are more than one).
+An image used by a container (running or exited) can not be deleted:
+remove the container first.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store := container.ImageStore()
+			failed := false
+			for _, refOrID := range args {
+				untagged, deleted, err := store.Remove(refOrID, force)
+				if err != nil {
+					slog.Error("[cmd/image] remove image failed.", "image", refOrID, "err", err)
+					failed = true
+					continue
+				}
+				for _, ref := range untagged {
+					fmt.Println("Untagged:", ref)
+				}
+				if deleted != "" {
+					fmt.Println("Deleted:", deleted)
+				}
+			}
+			if failed {
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Remove the image by id even if it has more than one names")
+
+	return cmd
+}
+
+func imageInspectCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "inspect IMAGE [IMAGE...]",
+		Short: "Display detailed information on images",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store := container.ImageStore()
+			images := []*image.Image{}
+			failed := false
+			for _, refOrID := range args {
+				img, err := store.Get(refOrID)
+				if err != nil {
+					slog.Error("[cmd/image] inspect image failed.", "image", refOrID, "err", err)
+					failed = true
+					continue
+				}
+				images = append(images, img)
+			}
+
+			out, _ := json.MarshalIndent(images, "", "    ")
+			fmt.Println(string(out))
+			if failed {
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+func imageSignCommand() *cobra.Command {
+	var key string
+
+	var cmd = &cobra.Command{
+		Use:   "sign [flags] IMAGE",
+		Short: "Sign an image with a local ed25519 key",
+		Long: `Sign an image with a local ed25519 key.
+
+IMAGE is a name[:tag] or id of an image in the store, or a tar file,
+maybe pinned by a digest: IMAGE@sha256:<hex>. The signature is of the
+image id (the digest of its config), or the digest of the tar file.
+
+The keys and signatures are in <data-root>/trust:
+
+	keys/<name>.key                      the private key
+	keys/<name>.pub                      the public key
+	signatures/sha256/<hex>/<name>.sig   the signatures
+
+The key is generated if it does not exist. Copy the public key (and the
+signatures) to trust the images signed by it on other hosts.
+
+The images required to be signed to run are listed in
+<data-root>/trust/policy.json, by the prefixes of their names (name:tag,
+or the absolute path of a tar file):
+
+	{"rules": [{"prefix": "prod/", "keys": ["release"]}]}
+
+Any trusted key is accepted if the rule has no keys. A container is not
+created or started if its image fails the verification.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			digest, err := container.ImageDigest(args[0])
+			if err != nil {
+				slog.Error("[cmd/image] sign image failed.", "image", args[0], "err", err)
+				os.Exit(1)
+			}
+
+			trust := container.TrustStore()
+			sig, err := trust.Sign(digest, key)
+			if errors.Is(err, image.ErrNoSuchKey) {
+				var pub string
+				if pub, err = trust.GenerateKey(key); err == nil {
+					fmt.Println("Generated key:", pub)
+					sig, err = trust.Sign(digest, key)
+				}
+			}
+			if err != nil {
+				slog.Error("[cmd/image] sign image failed.", "image", args[0], "err", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Signed: %s by %s\n", sig.Digest, sig.Key)
+		},
+	}
+
+	cmd.Flags().StringVarP(&key, "key", "k", "default", "The name of the key to sign with")
+
+	return cmd
+}
+
+func imageVerifyCommand() *cobra.Command {
+	var keys []string
+
+	var cmd = &cobra.Command{
+		Use:   "verify [flags] IMAGE",
+		Short: "Verify the signatures of an image",
+		Long: `Verify the signatures of an image by the trusted keys.
+
+IMAGE is a name[:tag] or id of an image in the store, or a tar file,
+maybe pinned by a digest: IMAGE@sha256:<hex>. See 'hind image sign'.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			digest, err := container.ImageDigest(args[0])
+			if err != nil {
+				slog.Error("[cmd/image] verify image failed.", "image", args[0], "err", err)
+				os.Exit(1)
+			}
+			sigs, err := container.TrustStore().Verify(digest, keys...)
+			if err != nil {
+				slog.Error("[cmd/image] verify image failed.", "image", args[0], "err", err)
+				os.Exit(1)
+			}
+			for _, sig := range sigs {
+				fmt.Printf("Verified: %s by %s (signed %s)\n", sig.Digest, sig.Key, sig.Created.Format(time.DateTime))
+			}
+		},
+	}
+
+	cmd.Flags().StringArrayVarP(&keys, "key", "k", nil, "Accept only the signatures by the key. Can be repeated. Default: any trusted key")
+
+	return cmd
+}
+
+// humanSize formats the bytes as docker does: 4.26MB
+func humanSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	f := float64(size)
+	i := 0
+	for f >= 1000 && i < len(units)-1 {
+		f /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.3g%s", f, units[i])
+}
+
+func init() {
+	rootCmd.AddCommand(imageCommand())
+}
@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"hind/container"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func infraCommand() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:    "infra POD",
+		Short:  "run the infra process of a pod (interal use only! do not call it)",
+		Args:   cobra.ExactArgs(1),
+		Hidden: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := container.RunPodInfraProcess(args[0]); err != nil {
+				os.Exit(1)
+			}
+		},
+	}
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(infraCommand())
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hind/container"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slog"
+)
+
+func inspectCommand() *cobra.Command {
+	var typ string
+
+	var cmd = &cobra.Command{
+		Use:   "inspect [flags] NAME|ID [NAME|ID...]",
+		Short: "Display detailed information on containers or images",
+		Long: `Display detailed information on containers or images, as a JSON array.
+
+A NAME|ID is looked up in the containers first, then the images in the
+store, unless --type is given. The config (labels, exposed ports...) of
+the image is in the "ImageConfig" of a container, and in the "Config"
+of an image.`,
+		Args: cobra.MinimumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			switch typ {
+			case "", "container", "image":
+				return nil
+			default:
+				return fmt.Errorf("bad type %q: expected container or image", typ)
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			objects := []any{}
+			failed := false
+			for _, nameOrID := range args {
+				obj, err := inspectObject(nameOrID, typ)
+				if err != nil {
+					slog.Error("[cmd/inspect] inspect failed.", "object", nameOrID, "err", err)
+					failed = true
+					continue
+				}
+				objects = append(objects, obj)
+			}
+
+			out, _ := json.MarshalIndent(objects, "", "    ")
+			fmt.Println(string(out))
+			if failed {
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().StringVar(&typ, "type", "", "Only inspect the objects of the type: container | image")
+
+	return cmd
+}
+
+// inspectObject finds the container, or the image, by the name or id.
+func inspectObject(nameOrID string, typ string) (any, error) {
+	if typ != "image" {
+		c, err := container.LoadContainer(nameOrID)
+		if err == nil {
+			return c, nil
+		}
+		if typ == "container" || !errors.Is(err, container.ErrNoSuchContainer) {
+			return nil, err
+		}
+	}
+
+	img, err := container.ImageStore().Get(nameOrID)
+	if err != nil && typ == "" {
+		return nil, fmt.Errorf("no such container or image: %s", nameOrID)
+	}
+	return img, err
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCommand())
+}
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"fmt"
+	"hind/container"
+	"hind/internal/stringid"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slog"
+)
+
+func networkCommand() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "network",
+		Short: "Manage networks",
+		Long: `Manage networks: named bridges with their own subnets.
+
+Containers on different networks are isolated from each other.
+Containers on the same network resolve each other by name (/etc/hosts).
+Use "hind run --network NETWORK" to run a container in a network,
+and "hind network connect" to connect a running container to more.`,
+	}
+
+	cmd.AddCommand(
+		networkCreateCommand(),
+		networkLsCommand(),
+		networkRmCommand(),
+		networkConnectCommand(),
+		networkDisconnectCommand(),
+		networkCheckCommand(),
+	)
+
+	return cmd
+}
+
+func networkCreateCommand() *cobra.Command {
+	var subnet string
+
+	var cmd = &cobra.Command{
+		Use:   "create [flags] NETWORK",
+		Short: "Create a network",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			n, err := container.CreateNetwork(args[0], subnet)
+			if err != nil {
+				slog.Error("[cmd/network] create network failed.", "err", err)
+				os.Exit(1)
+			}
+			fmt.Println(n.ID)
+		},
+	}
+
+	cmd.Flags().StringVar(&subnet, "subnet", "", "Subnet in CIDR format, e.g. 10.10.0.0/24. Allocated from 172.30.0.0/15 if not specified.")
+
+	return cmd
+}
+
+func networkLsCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "List networks",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			networks, err := container.ListNetworks()
+			if err != nil {
+				slog.Error("[cmd/network] list networks failed.", "err", err)
+				os.Exit(1)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NETWORK ID\tNAME\tBRIDGE\tSUBNET\t# OF CONTAINERS")
+			for _, n := range networks {
+				containers, _ := n.Containers()
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n",
+					stringid.TruncateID(n.ID), n.Name, n.Bridge, n.Subnet, len(containers))
+			}
+			w.Flush()
+		},
+	}
+}
+
+func networkRmCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "rm NETWORK [NETWORK...]",
+		Aliases: []string{"remove"},
+		Short:   "Remove networks",
+		Args:    cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			failed := false
+			for _, idOrName := range args {
+				n, err := container.LoadNetwork(idOrName)
+				if err == nil {
+					err = n.Remove()
+				}
+				if err != nil {
+					slog.Error("[cmd/network] remove network failed.", "network", idOrName, "err", err)
+					failed = true
+					continue
+				}
+				fmt.Println(idOrName)
+			}
+			if failed {
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+func networkConnectCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "connect NETWORK CONTAINER",
+		Short: "Connect a running container to a network",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := container.ConnectNetwork(args[1], args[0]); err != nil {
+				slog.Error("[cmd/network] connect failed.", "err", err)
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+func networkDisconnectCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "disconnect NETWORK CONTAINER",
+		Short: "Disconnect a running container from a network",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := container.DisconnectNetwork(args[1], args[0]); err != nil {
+				slog.Error("[cmd/network] disconnect failed.", "err", err)
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+func networkCheckCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "check CONTAINER",
+		Short: "Check the cni networks of a running container",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := container.CheckNetwork(args[0]); err != nil {
+				slog.Error("[cmd/network] check failed.", "err", err)
+				os.Exit(1)
+			}
+			fmt.Println("ok")
+		},
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(networkCommand())
+}
@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"fmt"
+	"hind/cgroups"
+	"hind/container"
+	"hind/internal/stringid"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slog"
+)
+
+func podCommand() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "pod",
+		Short: "Manage pods",
+		Long: `Manage pods: groups of containers sharing the net, ipc and uts namespaces.
+
+A pod has an infra process holding the shared namespaces and a
+pod-level cgroup limiting the resources of all its members.
+Use "hind run --pod POD" to run a container in a pod.`,
+	}
+
+	cmd.AddCommand(
+		podCreateCommand(),
+		podStartCommand(),
+		podStopCommand(),
+		podRmCommand(),
+		podPsCommand(),
+	)
+
+	return cmd
+}
+
+type podCreateOptions struct {
+	Name      string
+	Start     bool
+	Resources cgroups.Resources
+}
+
+func podCreateCommand() *cobra.Command {
+	opts := podCreateOptions{}
+
+	var cmd = &cobra.Command{
+		Use:   "create [flags]",
+		Short: "Create a new pod",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			p, err := container.CreatePod(opts.Name, &opts.Resources)
+			if err != nil {
+				slog.Error("[cmd/pod] create pod failed.", "err", err)
+				os.Exit(1)
+			}
+			if opts.Start {
+				if err := p.Start(); err != nil {
+					slog.Error("[cmd/pod] start pod failed.", "err", err)
+					os.Exit(1)
+				}
+			}
+			fmt.Println(p.ID)
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&opts.Name, "name", "", "Assign a name to the pod")
+	flags.BoolVar(&opts.Start, "start", false, "Start the pod after creating it")
+	addResourcesFlags(flags, &opts.Resources)
+
+	return cmd
+}
+
+func podStartCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "start POD [POD...]",
+		Short: "Start the infra process of pods",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			forEachPod(args, func(p *container.Pod) error {
+				return p.Start()
+			})
+		},
+	}
+}
+
+func podStopCommand() *cobra.Command {
+	var timeout time.Duration
+
+	var cmd = &cobra.Command{
+		Use:   "stop POD [POD...]",
+		Short: "Stop the members and the infra process of pods",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			forEachPod(args, func(p *container.Pod) error {
+				return p.Stop(timeout)
+			})
+		},
+	}
+
+	cmd.Flags().DurationVarP(&timeout, "time", "t", container.DefaultStopTimeout, "Time to wait before killing the processes")
+
+	return cmd
+}
+
+func podRmCommand() *cobra.Command {
+	var force bool
+
+	var cmd = &cobra.Command{
+		Use:   "rm POD [POD...]",
+		Short: "Remove stopped pods",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			forEachPod(args, func(p *container.Pod) error {
+				return p.Remove(force)
+			})
+		},
+	}
+
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Stop and remove running pods")
+
+	return cmd
+}
+
+func podPsCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "ps",
+		Aliases: []string{"ls"},
+		Short:   "List pods",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			pods, err := container.ListPods()
+			if err != nil {
+				slog.Error("[cmd/pod] list pods failed.", "err", err)
+				os.Exit(1)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "POD ID\tNAME\tSTATUS\tCREATED\tINFRA PID\t# OF CONTAINERS")
+			for _, p := range pods {
+				members, _ := p.Members()
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\n",
+					stringid.TruncateID(p.ID), p.Name, p.Status, p.Created.Format(time.DateTime), p.InfraPid, len(members))
+			}
+			w.Flush()
+		},
+	}
+}
+
+// forEachPod loads the pods by id or name and calls fn on each.
+// It exits with 1 if any of them fails, after trying all.
+func forEachPod(idOrNames []string, fn func(p *container.Pod) error) {
+	failed := false
+	for _, idOrName := range idOrNames {
+		p, err := container.LoadPod(idOrName)
+		if err == nil {
+			err = fn(p)
+		}
+		if err != nil {
+			slog.Error("[cmd/pod] failed.", "pod", idOrName, "err", err)
+			failed = true
+			continue
+		}
+		fmt.Println(idOrName)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(podCommand())
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"hind/container"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slog"
+)
+
+func portCommand() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "port CONTAINER [PRIVATE_PORT[/PROTO]]",
+		Short: "List port mappings or a specific mapping for the container",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			c, err := container.LoadContainer(args[0])
+			if err != nil {
+				slog.Error("[cmd/port] load container failed.", "err", err)
+				os.Exit(1)
+			}
+
+			// the ports are published by the hind process running the container.
+			if !c.IsRunning() {
+				slog.Warn("[cmd/port] container is not running.", "container", args[0], "status", c.Status)
+				return
+			}
+
+			var port, proto string
+			if len(args) > 1 {
+				port, proto, _ = strings.Cut(args[1], "/")
+			}
+
+			found := false
+			for _, m := range c.Ports {
+				if port != "" && port != strconv.Itoa(int(m.ContainerPort)) {
+					continue
+				}
+				if proto != "" && proto != m.Protocol {
+					continue
+				}
+				fmt.Println(m)
+				found = true
+			}
+
+			if port != "" && !found {
+				slog.Error("[cmd/port] no public port published.", "container", args[0], "port", args[1])
+				os.Exit(1)
+			}
+		},
+	}
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(portCommand())
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+	"hind/container"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slog"
+)
+
+func rmCommand() *cobra.Command {
+	var force bool
+
+	var cmd = &cobra.Command{
+		Use:   "rm [flags] CONTAINER [CONTAINER...]",
+		Short: "Remove one or more containers",
+		Long: `Remove exited containers, with their rootfs: the changes in the writable
+layer are lost. Commit them first (hind commit) to keep them in an image.
+
+A running container is not removed, unless --force: it is killed first.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			failed := false
+			for _, idOrName := range args {
+				c, err := container.LoadContainer(idOrName)
+				if err == nil {
+					err = container.Remove(c, force)
+				}
+				if err != nil {
+					slog.Error("[cmd/rm] remove container failed.", "container", idOrName, "err", err)
+					failed = true
+					continue
+				}
+				fmt.Println(idOrName)
+			}
+			if failed {
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Kill and remove running containers")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(rmCommand())
+}
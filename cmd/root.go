@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"hind/container"
 	"os"
 
 	"github.com/spf13/cobra"
@@ -32,6 +33,7 @@ func init() {
 	// will be global for your application.
 
 	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.hind.yaml)")
+	rootCmd.PersistentFlags().StringVar(&container.DataRoot, "data-root", container.DefaultDataRoot, "Root directory of persistent data (container states...)")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -4,28 +4,78 @@ import (
 	"fmt"
 	"hind/cgroups"
 	"hind/container"
+	"hind/network"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"golang.org/x/exp/slog"
 )
 
 type runOptions struct {
-	Name        string
-	Tty         bool
-	Interactive bool
-	Image       string
-	NoOverlay   bool
-	Command     []string // COMMAND ARG...
-	Resources   cgroups.Resources
+	Name          string
+	Pod           string
+	Rm            bool
+	Tty           bool
+	Interactive   bool
+	Image         string
+	NoOverlay     bool
+	StorageDriver string
+	ReadOnly      bool
+	Tmpfs         []string // path[:options]
+	mounts        []container.Mount
+	Command       []string // COMMAND ARG...
+	Entrypoint    string
+	entrypoint    []string // nil if not --entrypoint
+	Env           []string // KEY[=VALUE]
+	env           []string // KEY=VALUE
+	Workdir       string
+	User          string // user[:group]
+	Resources     cgroups.Resources
+
+	Networks            []string // bridge | none | user-defined networks
+	NetworkDriver       string   // bridge | cni
+	CNIConfDir          string
+	CNIPath             string // colon separated
+	cni                 *network.CNI
+	Hostname            string
+	DNS                 []string
+	DNSSearch           []string
+	DNSOptions          []string
+	AddHosts            []string // name:ip
+	extraHosts          []container.HostEntry
+	Publish             []string // [[hostIP:]hostPort:]containerPort[/protocol]
+	ports               []network.PortMapping
+	NetworkRate         string // tc rate, e.g. 10mbit
+	NetworkBurst        string // tc size, e.g. 32kb
+	bandwidth           *network.Bandwidth
+	Net                 string // private | host | container:<id>
+	Pid                 string
+	Ipc                 string
+	Uts                 string
+	namespaces          container.Namespaces
+	Cgroupns            string // private | host
+	TimeOffsetMonotonic time.Duration
+	TimeOffsetBoottime  time.Duration
+	timeOffsets         *container.TimeOffsets
+
+	Ulimits         []string // type=soft[:hard]
+	OomScoreAdj     int
+	SecurityOpts    []string // key[=value]
+	rlimits         []container.Rlimit
+	noNewPrivileges bool
+	oomScoreAdj     *int
 }
 
 func runCommand() *cobra.Command {
 	opts := runOptions{}
 
 	var cmd = &cobra.Command{
-		Use: `run [flags] IMAGE COMMAND [ARG...]
+		Use: `run [flags] IMAGE [COMMAND] [ARG...]
 
 Args:
   IMAGE       The image to run. Can be a directory or a tar file. 
@@ -33,13 +83,27 @@ Args:
               the container; if it is a tar file, it is extracted 
               to a temporary directory and used as the rootfs of 
               the container. See also --no-overlay.
+              If no such path exists, IMAGE is a name[:tag] or an
+              id of an image in the store (see "hind image").
+              IMAGE@sha256:<hex> pins the digest of the tar file,
+              or the id of the image in the store: the container
+              is not created if the image has another digest.
+              Images may be required to be signed, see
+              "hind image sign".
   COMMAND     The command to run in the container. 
-              Different from docker, the command is required.
+              Optional if the image (loaded into the store) defines
+              the Cmd or Entrypoint. Otherwise, it is required.
+              With an Entrypoint in the image, COMMAND ARG... are
+              the arguments to it. See also --entrypoint.
   [ARG...]    The arguments to the command.
 		`,
 		Short: "Create and run a new container",
-		Long:  `Create and run a new container with namespace and cgroups limit.`,
-		Args:  cobra.MinimumNArgs(1),
+		Long: `Create and run a new container with namespace and cgroups limit.
+
+The container is kept after it exits, with the changes in its rootfs:
+restart it by "hind start", or remove it by "hind rm". Or run it with
+--rm to remove it automatically.`,
+		Args: cobra.MinimumNArgs(1),
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			opts.Image = args[0]
 
@@ -51,13 +115,124 @@ Args:
 				}
 			}
 
-			if _, err := os.Stat(opts.Image); err != nil {
-				return fmt.Errorf("bad image: %w", err)
-			}
-
 			if len(args) > 1 {
 				opts.Command = args[1:]
 			}
+
+			if cmd.Flags().Changed("entrypoint") {
+				opts.entrypoint = []string{}
+				if opts.Entrypoint != "" {
+					opts.entrypoint = []string{opts.Entrypoint}
+				}
+			}
+
+			for _, e := range opts.Env {
+				if e == "" || strings.HasPrefix(e, "=") {
+					return fmt.Errorf("bad env %q: expected KEY[=VALUE]", e)
+				}
+				if !strings.Contains(e, "=") { // KEY: the value on the host, if any
+					value, ok := os.LookupEnv(e)
+					if !ok {
+						continue
+					}
+					e += "=" + value
+				}
+				opts.env = append(opts.env, e)
+			}
+
+			for _, t := range opts.Tmpfs {
+				m, err := container.ParseTmpfs(t)
+				if err != nil {
+					return err
+				}
+				opts.mounts = append(opts.mounts, m)
+			}
+
+			for _, ns := range []struct {
+				flag string
+				mode *container.NamespaceMode
+			}{
+				{opts.Net, &opts.namespaces.Net},
+				{opts.Pid, &opts.namespaces.Pid},
+				{opts.Ipc, &opts.namespaces.Ipc},
+				{opts.Uts, &opts.namespaces.Uts},
+			} {
+				mode, err := container.ParseNamespaceMode(ns.flag)
+				if err != nil {
+					return err
+				}
+				*ns.mode = mode
+			}
+
+			if opts.NetworkDriver == container.NetworkDriverCNI {
+				opts.cni = &network.CNI{ConfDir: opts.CNIConfDir, Path: filepath.SplitList(opts.CNIPath)}
+				if !cmd.Flags().Changed("network") {
+					opts.Networks = nil // the first cni network config
+				}
+			}
+
+			for _, h := range opts.AddHosts {
+				entry, err := container.ParseExtraHost(h)
+				if err != nil {
+					return err
+				}
+				opts.extraHosts = append(opts.extraHosts, entry)
+			}
+
+			for _, p := range opts.Publish {
+				m, err := network.ParsePortMapping(p)
+				if err != nil {
+					return err
+				}
+				opts.ports = append(opts.ports, m)
+			}
+
+			if opts.NetworkRate != "" {
+				rate, err := network.ParseRate(opts.NetworkRate)
+				if err != nil {
+					return err
+				}
+				opts.bandwidth = &network.Bandwidth{Rate: rate}
+				if opts.NetworkBurst != "" {
+					if opts.bandwidth.Burst, err = network.ParseSize(opts.NetworkBurst); err != nil {
+						return err
+					}
+				}
+			} else if opts.NetworkBurst != "" {
+				return fmt.Errorf("--network-burst requires --network-rate")
+			}
+
+			switch opts.Cgroupns {
+			case "private", "host":
+			default:
+				return fmt.Errorf("bad cgroupns %q: expected private or host", opts.Cgroupns)
+			}
+
+			if cmd.Flags().Changed("time-offset-monotonic") || cmd.Flags().Changed("time-offset-boottime") {
+				opts.timeOffsets = &container.TimeOffsets{
+					Monotonic: opts.TimeOffsetMonotonic,
+					Boottime:  opts.TimeOffsetBoottime,
+				}
+			}
+
+			for _, u := range opts.Ulimits {
+				rl, err := container.ParseRlimit(u)
+				if err != nil {
+					return err
+				}
+				opts.rlimits = append(opts.rlimits, rl)
+			}
+
+			if cmd.Flags().Changed("oom-score-adj") {
+				opts.oomScoreAdj = &opts.OomScoreAdj
+			}
+
+			noNewPrivileges, err := parseSecurityOpts(opts.SecurityOpts)
+			if err != nil {
+				return err
+			}
+			opts.noNewPrivileges = noNewPrivileges
+
 			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
@@ -72,15 +247,47 @@ Args:
 	flags := cmd.Flags()
 
 	flags.StringVar(&opts.Name, "name", "", "Assign a name to the container")
+	flags.StringVar(&opts.Pod, "pod", "", "Run the container in a running pod (id or name), sharing its net, ipc and uts namespaces")
+	flags.BoolVar(&opts.Rm, "rm", false, "Automatically remove the container (and its writable layer) when it exits. Otherwise, it is kept to be restarted by hind start.")
 	flags.BoolVarP(&opts.Tty, "tty", "t", false, "Allocate a pseudo-TTY")
 	flags.BoolVarP(&opts.Interactive, "interactive", "i", false, "Keep STDIN open")
 	flags.BoolVar(&opts.NoOverlay, "no-overlay", false, "Do not use overlayfs. Directly use the IMAGE as rootfs (read-write). Require IMAGE to be a directory.")
+	flags.StringVar(&opts.StorageDriver, "storage-driver", "", "Storage driver of the rootfs: overlay | fuse-overlayfs (requires the fuse-overlayfs binary) | vfs (a full copy of the image) | reflink (a copy cloned by FICLONE, on btrfs, xfs...). Default: overlay, falling back to fuse-overlayfs (if installed), reflink then vfs if the overlayfs can not be mounted.")
+	flags.BoolVar(&opts.ReadOnly, "read-only", false, "Mount the container's root filesystem as read only. No writable container layer is created.")
+	flags.StringVar(&opts.Entrypoint, "entrypoint", "", "Overwrite the default ENTRYPOINT of the image. An empty string resets it. The CMD of the image is dropped too.")
+	flags.StringArrayVarP(&opts.Env, "env", "e", nil, "Set an environment variable: KEY=VALUE, or KEY to pass the value on the host. Overrides the ENV of the image. Can be repeated.")
+	flags.StringVarP(&opts.Workdir, "workdir", "w", "", "Working directory inside the container (default: the WORKDIR of the image, or /)")
+	flags.StringVarP(&opts.User, "user", "u", "", "Username or UID, and optionally the group: <name|uid>[:<group|gid>] (default: the USER of the image, or root)")
+	flags.StringArrayVar(&opts.Tmpfs, "tmpfs", nil, "Mount a tmpfs directory: <path>[:<options>], e.g. /tmp:size=64m,mode=1777. Can be repeated.")
 
 	// resources
-	flags.Int64Var((*int64)(&opts.Resources.CpuQuotaUs), "cpu-quota-us", 0, "The CPU hardcap limit (in usecs). Allowed cpu time in a given period.")
-	flags.Uint64Var((*uint64)(&opts.Resources.CpuPeriodUs), "cpu-period-us", 0, "CPU period to be used for hardcapping (in usecs). 0 to use system default.")
-	flags.StringVar((*string)(&opts.Resources.CpuSetCpus), "cpuset-cpus", "", "The requested CPUs to be used by tasks within this cgroup: 0-4,6,8-10")
-	flags.Uint64Var((*uint64)(&opts.Resources.MemoryLimitBytes), "memory-limit-bytes", 0, "Memory limit in bytes")
+	addResourcesFlags(flags, &opts.Resources)
+
+	// namespaces
+	flags.StringSliceVar(&opts.Networks, "network", []string{container.NetworkBridge}, "Networks to connect the private network namespace to: bridge | none | <network>. Can be repeated or comma separated.")
+	flags.StringVar(&opts.NetworkDriver, "network-driver", container.NetworkDriverBridge, "Network driver: bridge (built-in) | cni. With cni, --network names the cni networks (default: the first config).")
+	flags.StringVar(&opts.CNIConfDir, "cni-conf-dir", network.DefaultCNIConfDir, "Directory of the cni network configs")
+	flags.StringVar(&opts.CNIPath, "cni-path", network.DefaultCNIPath, "Colon separated directories of the cni plugins")
+	flags.StringArrayVarP(&opts.Publish, "publish", "p", nil, "Publish a container's port to the host: [[hostIP:]hostPort:]containerPort[/tcp|udp], e.g. 8080:80. Can be repeated.")
+	flags.StringVar(&opts.NetworkRate, "network-rate", "", "Limit the bandwidth of each network of the container, in both directions: <rate> in the tc style, e.g. 10mbit, 500kbps")
+	flags.StringVar(&opts.NetworkBurst, "network-burst", "", "The burst of --network-rate: <size> in the tc style, e.g. 32kb (default: 10ms at the rate, at least 32kb)")
+	flags.StringVar(&opts.Hostname, "hostname", "", "Container host name (default: the container name)")
+	flags.StringArrayVar(&opts.DNS, "dns", nil, "Set custom DNS servers. Can be repeated. (default: the host's, except the loopback ones)")
+	flags.StringArrayVar(&opts.DNSSearch, "dns-search", nil, "Set custom DNS search domains. Can be repeated.")
+	flags.StringArrayVar(&opts.DNSOptions, "dns-option", nil, "Set DNS options, e.g. ndots:2. Can be repeated.")
+	flags.StringArrayVar(&opts.AddHosts, "add-host", nil, "Add a custom host-to-IP mapping: <name>:<ip>. Can be repeated.")
+	flags.StringVar(&opts.Net, "net", "private", "Network namespace to use: private | host | container:<id|name>")
+	flags.StringVar(&opts.Pid, "pid", "private", "PID namespace to use: private | host | container:<id|name>")
+	flags.StringVar(&opts.Ipc, "ipc", "private", "IPC namespace to use: private | host | container:<id|name>")
+	flags.StringVar(&opts.Uts, "uts", "private", "UTS namespace to use: private | host | container:<id|name>")
+	flags.StringVar(&opts.Cgroupns, "cgroupns", "private", "Cgroup namespace to use: private | host")
+	flags.DurationVar(&opts.TimeOffsetMonotonic, "time-offset-monotonic", 0, "Run in a time namespace with the CLOCK_MONOTONIC offset, e.g. 24h")
+	flags.DurationVar(&opts.TimeOffsetBoottime, "time-offset-boottime", 0, "Run in a time namespace with the CLOCK_BOOTTIME offset, e.g. 24h")
+
+	// security
+	flags.StringArrayVar(&opts.Ulimits, "ulimit", nil, "Ulimit options: <type>=<soft>[:<hard>], e.g. nofile=1024:2048. Can be repeated.")
+	flags.IntVar(&opts.OomScoreAdj, "oom-score-adj", 0, "Tune the container's OOM preferences (-1000 to 1000)")
+	flags.StringArrayVar(&opts.SecurityOpts, "security-opt", nil, "Security options: no-new-privileges[=true|false] (default true). Can be repeated.")
 
 	// SetInterspersed to false to support:
 	//  docker run [OPTIONS] IMAGE [COMMAND] [ARG...]
@@ -94,12 +301,39 @@ func runRun(opts runOptions) {
 	slog.Info("[cmd/run] Create and run a new container.", "opts", opts)
 
 	c := &container.Container{
-		Name:      opts.Name,
-		TTY:       opts.Tty || opts.Interactive,
-		ImagePath: opts.Image,
-		Overlay:   !opts.NoOverlay,
-		Command:   opts.Command,
-		Resources: &opts.Resources,
+		Name:          opts.Name,
+		Pod:           opts.Pod,
+		AutoRemove:    opts.Rm,
+		TTY:           opts.Tty || opts.Interactive,
+		ImagePath:     opts.Image,
+		Overlay:       !opts.NoOverlay,
+		ReadOnly:      opts.ReadOnly,
+		StorageDriver: opts.StorageDriver,
+		Mounts:        opts.mounts,
+		Command:       opts.Command,
+		Entrypoint:    opts.entrypoint,
+		Env:           opts.env,
+		WorkingDir:    opts.Workdir,
+		User:          opts.User,
+		Resources:     &opts.Resources,
+
+		Networks:        opts.Networks,
+		NetworkDriver:   opts.NetworkDriver,
+		CNI:             opts.cni,
+		Ports:           opts.ports,
+		Bandwidth:       opts.bandwidth,
+		Hostname:        opts.Hostname,
+		DNS:             opts.DNS,
+		DNSSearch:       opts.DNSSearch,
+		DNSOptions:      opts.DNSOptions,
+		ExtraHosts:      opts.extraHosts,
+		Namespaces:      opts.namespaces,
+		CgroupNamespace: opts.Cgroupns == "private",
+		TimeOffsets:     opts.timeOffsets,
+
+		Rlimits:         opts.rlimits,
+		NoNewPrivileges: opts.noNewPrivileges,
+		OomScoreAdj:     opts.oomScoreAdj,
 	}
 
 	err := container.Run(c)
@@ -108,6 +342,70 @@ func runRun(opts runOptions) {
 	}
 }
 
+// addResourcesFlags adds the flags of the cgroup resources limits.
+func addResourcesFlags(flags *pflag.FlagSet, res *cgroups.Resources) {
+	flags.Int64Var((*int64)(&res.CpuQuotaUs), "cpu-quota-us", 0, "The CPU hardcap limit (in usecs). Allowed cpu time in a given period.")
+	flags.Uint64Var((*uint64)(&res.CpuPeriodUs), "cpu-period-us", 0, "CPU period to be used for hardcapping (in usecs). 0 to use system default.")
+	flags.StringVar((*string)(&res.CpuSetCpus), "cpuset-cpus", "", "The requested CPUs to be used by tasks within this cgroup: 0-4,6,8-10")
+	flags.Uint64Var((*uint64)(&res.MemoryLimitBytes), "memory-limit-bytes", 0, "Memory limit in bytes")
+	flags.Var((*netClsClassidValue)(&res.NetClsClassid), "net-cls-classid", "Tag the network packets with the tc class id: <major>:<minor> in hex (e.g. 10:1), or a number (e.g. 0x100001). Requires the net_cls cgroup.")
+}
+
+// netClsClassidValue is the pflag.Value of a cgroups.NetClsClassid.
+type netClsClassidValue cgroups.NetClsClassid
+
+func (v *netClsClassidValue) Set(s string) error {
+	c, err := cgroups.ParseNetClsClassid(s)
+	if err != nil {
+		return err
+	}
+	*v = netClsClassidValue(c)
+	return nil
+}
+
+func (v *netClsClassidValue) String() string {
+	if *v == 0 {
+		return ""
+	}
+	return cgroups.NetClsClassid(*v).String()
+}
+
+func (v *netClsClassidValue) Type() string {
+	return "classid"
+}
+
+// parseSecurityOpts parses the --security-opt values.
+//
+// Only no-new-privileges is supported now, which is on by default:
+//
+//	no-new-privileges[=true|false]  (docker's "no-new-privileges:false" also works)
+func parseSecurityOpts(securityOpts []string) (noNewPrivileges bool, err error) {
+	noNewPrivileges = true
+
+	for _, opt := range securityOpts {
+		key, value, hasValue := strings.Cut(opt, "=")
+		if !hasValue {
+			key, value, hasValue = strings.Cut(opt, ":")
+		}
+
+		switch key {
+		case "no-new-privileges":
+			if !hasValue {
+				noNewPrivileges = true
+				continue
+			}
+			noNewPrivileges, err = strconv.ParseBool(value)
+			if err != nil {
+				return false, fmt.Errorf("bad security-opt %q: %w", opt, err)
+			}
+		default:
+			return false, fmt.Errorf("unsupported security-opt %q", opt)
+		}
+	}
+
+	return noNewPrivileges, nil
+}
+
 func init() {
 	rootCmd.AddCommand(runCommand())
 }
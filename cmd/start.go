@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"hind/container"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slog"
+)
+
+func startCommand() *cobra.Command {
+	var attach bool
+
+	var cmd = &cobra.Command{
+		Use:   "start [flags] CONTAINER",
+		Short: "Start a stopped container",
+		Long: `Start an exited container again: the same command, with the same config,
+on the rootfs kept from its last run.
+
+With --attach, the container is run in the foreground, with the STDIN,
+STDOUT and STDERR of hind, as "hind run -i" does. Otherwise, it is run
+in the background (without STDIN and STDOUT) and its name is printed.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			c, err := container.LoadContainer(args[0])
+			if err != nil {
+				slog.Error("[cmd/start] load container failed.", "err", err)
+				os.Exit(1)
+			}
+
+			if !attach {
+				if err := container.StartDetached(c); err != nil {
+					slog.Error("[cmd/start] start failed.", "container", args[0], "err", err)
+					os.Exit(1)
+				}
+				fmt.Println(c.Name)
+				return
+			}
+
+			c.Attached = true
+			if err := container.Start(c); err != nil {
+				slog.Error("[cmd/start] start failed.", "container", args[0], "err", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().BoolVarP(&attach, "attach", "a", false, "Run in the foreground, attaching STDIN, STDOUT and STDERR")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(startCommand())
+}
@@ -0,0 +1,486 @@
+package container
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hind/image"
+	"hind/internal/atomicfile"
+	"hind/internal/stringid"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/sys/unix"
+)
+
+// BuildOptions are the options of Build.
+type BuildOptions struct {
+	Context  string    // the dir of the build context: the sources of COPY are in it
+	Hindfile string    // the path of the Hindfile. Default: <Context>/Hindfile
+	Refs     []string  // name[:tag] of the built image
+	NoCache  bool      // if true, the cached steps are not used (but the new ones are cached)
+	Networks []string  // the networks of the RUN containers. Default: bridge
+	Output   io.Writer // where the steps are printed. Default: STDOUT. The output of RUN goes to STDOUT anyway.
+}
+
+// Build builds an image in the store from the Hindfile (see
+// ParseHindfile), as `docker build`:
+//
+//   - FROM starts from an image in the store, or nothing (scratch);
+//   - RUN runs the command in a container of the image so far, and
+//     commits its changes as a new layer;
+//   - COPY copies the files in the context into a new layer, owned by root;
+//   - ENV, WORKDIR, USER, ENTRYPOINT and CMD change the image config,
+//     without a new layer.
+//
+// Each step makes an image, which is cached by the hash of the
+// instruction (and the files copied by COPY) and the image of the last
+// step: the steps are not rebuilt until they, or the ones before them,
+// are changed.
+func Build(opts BuildOptions) (*image.Image, error) {
+	if opts.Hindfile == "" {
+		opts.Hindfile = filepath.Join(opts.Context, "Hindfile")
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	if st, err := os.Stat(opts.Context); err != nil || !st.IsDir() {
+		return nil, fmt.Errorf("%w: the context %s is not a directory", ErrBuildFailed, opts.Context)
+	}
+
+	f, err := os.Open(opts.Hindfile)
+	if err != nil {
+		return nil, err
+	}
+	instructions, err := ParseHindfile(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &builder{opts: opts, store: ImageStore()}
+	if b.cache, err = loadBuildCache(); err != nil {
+		return nil, err
+	}
+
+	for i, inst := range instructions {
+		fmt.Fprintf(opts.Output, "Step %d/%d : %s\n", i+1, len(instructions), inst)
+		if err := b.step(inst); err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", inst.Line, inst.Cmd, err)
+		}
+		fmt.Fprintf(opts.Output, " ---> %s\n", stringid.TruncateID(b.parent))
+	}
+
+	if b.parent == "" {
+		return nil, fmt.Errorf("%w: nothing built from scratch", ErrBuildFailed)
+	}
+	if err := b.store.Tag(b.parent, opts.Refs...); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(opts.Output, "Successfully built %s\n", stringid.TruncateID(b.parent))
+	for _, ref := range opts.Refs {
+		fmt.Fprintf(opts.Output, "Successfully tagged %s\n", ref)
+	}
+	return b.store.Get(b.parent)
+}
+
+// builder is the state of a build: the image of the last step.
+type builder struct {
+	opts   BuildOptions
+	store  *image.Store
+	cache  buildCache
+	parent string       // the id of the image of the last step. "" for scratch.
+	config image.Config // the config of the parent
+	cmdSet bool         // if a CMD is in the Hindfile so far
+}
+
+// step runs the instruction on top of the parent image, or uses the
+// cached image.
+func (b *builder) step(inst Instruction) error {
+	if inst.Cmd == "FROM" {
+		return b.from(inst.Args[0])
+	}
+
+	key, err := b.cacheKey(inst)
+	if err != nil {
+		return err
+	}
+	if id, ok := b.cache[key]; ok && !b.opts.NoCache {
+		if img, err := b.store.Get(id); err == nil {
+			fmt.Fprintln(b.opts.Output, " ---> Using cache")
+			b.setParent(img)
+			b.cmdSet = b.cmdSet || inst.Cmd == "CMD"
+			return nil
+		}
+	}
+
+	var img *image.Image
+	switch inst.Cmd {
+	case "RUN":
+		img, err = b.run(inst)
+	case "COPY":
+		img, err = b.copy(inst)
+	default:
+		img, err = b.commitConfig(inst)
+	}
+	if err != nil {
+		return err
+	}
+	b.setParent(img)
+
+	b.cache[key] = img.ID
+	return saveBuildCache(b.cache)
+}
+
+func (b *builder) from(ref string) error {
+	if ref == "scratch" {
+		b.parent, b.config = "", image.Config{}
+		return nil
+	}
+	img, err := b.store.Get(ref)
+	if errors.Is(err, image.ErrNoSuchImage) {
+		return fmt.Errorf("%w: import or load it into the store first (hind image --help)", err)
+	} else if err != nil {
+		return err
+	}
+	b.setParent(img)
+	return nil
+}
+
+func (b *builder) setParent(img *image.Image) {
+	b.parent, b.config = img.ID, image.Config{}
+	if img.Config != nil {
+		b.config = *img.Config
+	}
+}
+
+// commitConfig makes an image of the parent's layers, with the config
+// changed by the ENV, WORKDIR, USER, ENTRYPOINT or CMD instruction.
+func (b *builder) commitConfig(inst Instruction) (*image.Image, error) {
+	config := b.config
+	switch inst.Cmd {
+	case "ENV":
+		var env []string
+		for i := 0; i+1 < len(inst.Args); i += 2 {
+			env = append(env, inst.Args[i]+"="+inst.Args[i+1])
+		}
+		config.Env = mergeEnv(config.Env, env)
+	case "WORKDIR":
+		dir := inst.Args[0]
+		if !path.IsAbs(dir) {
+			dir = path.Join("/", config.WorkingDir, dir)
+		}
+		config.WorkingDir = path.Clean(dir)
+	case "USER":
+		config.User = inst.Args[0]
+	case "ENTRYPOINT":
+		config.Entrypoint = shellCommand(inst)
+		if !b.cmdSet { // the CMD of the base image is for its ENTRYPOINT
+			config.Cmd = nil
+		}
+	case "CMD":
+		config.Cmd = shellCommand(inst)
+		b.cmdSet = true
+	}
+
+	return b.store.Commit("", image.CommitOptions{Parent: b.parent, Config: &config, CreatedBy: inst.Original})
+}
+
+// run runs the RUN instruction in a container of the parent image, and
+// commits its changes. The container is removed then.
+func (b *builder) run(inst Instruction) (*image.Image, error) {
+	if b.parent == "" {
+		return nil, fmt.Errorf("%w: nothing to run in scratch", ErrBuildFailed)
+	}
+
+	c := &Container{
+		ImagePath:  b.parent,
+		Overlay:    true,
+		Command:    shellCommand(inst),
+		Entrypoint: []string{}, // the command as it is
+		TTY:        true,
+		Networks:   b.opts.Networks,
+	}
+	err := Run(c)
+	if c.ID != "" {
+		defer func() {
+			if err := Remove(c, true); err != nil {
+				slog.Warn("[host] build: failed to remove the container of RUN.", "id", c.ID, "err", err)
+			}
+		}()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.ExitCode != 0 {
+		return nil, fmt.Errorf("%w: %q returned a non-zero code: %d", ErrBuildFailed, strings.Join(c.Command, " "), c.ExitCode)
+	}
+
+	diff, err := c.diffDir()
+	if err != nil {
+		return nil, err
+	}
+	return b.store.Commit(diff, image.CommitOptions{Parent: b.parent, Config: &b.config, CreatedBy: inst.Original})
+}
+
+// copy copies the sources in the context into a new layer on top of the
+// parent image, as COPY does:
+//
+//   - a dir source: its contents are copied into the dest dir;
+//   - a file source: copied into the dest if it is a dir (an existing one,
+//     or ending with "/", or with multiple sources), or as the dest.
+//
+// A relative dest is in the WORKDIR. The missing dirs are made. The
+// copied files are owned by root.
+func (b *builder) copy(inst Instruction) (*image.Image, error) {
+	sources, err := b.copySources(inst)
+	if err != nil {
+		return nil, err
+	}
+	dest := inst.Args[len(inst.Args)-1]
+	destIsDir := strings.HasSuffix(dest, "/") || len(sources) > 1
+	if !path.IsAbs(dest) {
+		dest = path.Join("/", b.config.WorkingDir, dest)
+	}
+
+	layer, err := os.MkdirTemp("", "hind-build-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(layer)
+
+	rootfs := layeredFS{[]string{layer}}
+	if b.parent != "" {
+		img, err := b.store.Get(b.parent)
+		if err != nil {
+			return nil, err
+		}
+		rootfs.layers = append(rootfs.layers, b.store.LowerDirs(img)...)
+	}
+	rel, err := resolveDest(rootfs, dest)
+	if err != nil {
+		return nil, err
+	}
+	if _, st, ok := rootfs.lookup(rel); ok && st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		destIsDir = true
+	}
+
+	for _, src := range sources {
+		fi, err := os.Lstat(src)
+		if err != nil {
+			return nil, err
+		}
+		target := rel
+		if !fi.IsDir() && destIsDir {
+			target = path.Join(rel, filepath.Base(src))
+		}
+
+		if err := rootfs.copyUp(path.Dir(target)); err != nil {
+			return nil, err
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(archiveHostFile(pw, src, target))
+		}()
+		err = image.Extract(pr, layer, image.ExtractOptions{})
+		pr.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err := chownRoot(filepath.Join(layer, target)); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.store.Commit(layer, image.CommitOptions{Parent: b.parent, Config: &b.config, CreatedBy: inst.Original})
+}
+
+// copySources are the files in the context matching the sources of the
+// COPY instruction (with the wildcards of filepath.Match). The parents of
+// a source are resolved: a symlink in the context (e.g. link -> /etc) must
+// not lead out of it. A source that is a symlink is copied as it is.
+func (b *builder) copySources(inst Instruction) ([]string, error) {
+	context, err := filepath.Abs(b.opts.Context)
+	if err != nil {
+		return nil, err
+	}
+	if context, err = filepath.EvalSymlinks(context); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, src := range inst.Args[:len(inst.Args)-1] {
+		matches, err := filepath.Glob(filepath.Join(context, cleanRel(src)))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%w: %s: no such file in the context", ErrBuildFailed, src)
+		}
+		for _, match := range matches {
+			if match == context {
+				files = append(files, match)
+				continue
+			}
+			parent, err := filepath.EvalSymlinks(filepath.Dir(match))
+			if err != nil {
+				return nil, err
+			}
+			if rel, err := filepath.Rel(context, parent); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+				return nil, fmt.Errorf("%w: %s: %s is out of the context", ErrBuildFailed, src, parent)
+			}
+			files = append(files, filepath.Join(parent, filepath.Base(match)))
+		}
+	}
+	return files, nil
+}
+
+// resolveDest resolves the dest path in the rootfs, as resolve does.
+// The missing parents are kept as they are, to be made.
+func resolveDest(rootfs layeredFS, dest string) (string, error) {
+	rel := "."
+	parts := strings.Split(cleanRel(dest), "/")
+	for i, part := range parts {
+		if !rootfs.exists(rel) {
+			return path.Join(append([]string{rel}, parts[i:]...)...), nil
+		}
+		resolved, err := rootfs.resolve(path.Join(rel, part), true)
+		if err != nil {
+			return "", err
+		}
+		rel = resolved
+	}
+	return rel, nil
+}
+
+// chownRoot makes the file (or dir, recursively) owned by root, keeping
+// the modes: chown(2) clears the setuid and setgid bits.
+func chownRoot(file string) error {
+	return filepath.WalkDir(file, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(p, &st); err != nil {
+			return err
+		}
+		if st.Uid == 0 && st.Gid == 0 {
+			return nil
+		}
+		if err := os.Lchown(p, 0, 0); err != nil {
+			return err
+		}
+		if st.Mode&unix.S_IFMT != unix.S_IFLNK {
+			return unix.Chmod(p, st.Mode&07777)
+		}
+		return nil
+	})
+}
+
+// shellCommand is the command of the RUN, ENTRYPOINT or CMD instruction:
+// the exec form as it is, or the shell form run by /bin/sh -c.
+func shellCommand(inst Instruction) []string {
+	if inst.JSON {
+		return inst.Args
+	}
+	return []string{"/bin/sh", "-c", inst.Args[0]}
+}
+
+// -- the build cache --
+
+// buildCache is the cache of the build steps: the cache key -> the id of
+// the image of the step. It is persisted in <DataRoot>/build-cache.json.
+type buildCache map[string]string
+
+func buildCacheFile() string {
+	return path.Join(DataRoot, "build-cache.json")
+}
+
+func loadBuildCache() (buildCache, error) {
+	cache := buildCache{}
+	data, err := os.ReadFile(buildCacheFile())
+	if os.IsNotExist(err) {
+		return cache, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		slog.Warn("[host] bad build cache, start over.", "file", buildCacheFile(), "err", err)
+		return buildCache{}, nil
+	}
+	return cache, nil
+}
+
+// saveBuildCache writes the cache. The file is replaced atomically.
+func saveBuildCache(cache buildCache) error {
+	if err := os.MkdirAll(DataRoot, 0700); err != nil {
+		return err
+	}
+	return atomicfile.WriteJSON(buildCacheFile(), cache)
+}
+
+// cacheKey is the hash of the instruction (with the files copied by COPY)
+// and the parent image.
+func (b *builder) cacheKey(inst Instruction) (string, error) {
+	h := sha256.New()
+	args, _ := json.Marshal(inst.Args)
+	fmt.Fprintf(h, "%s\n%s\n%v\n%s\n", b.parent, inst.Cmd, inst.JSON, args)
+
+	if inst.Cmd == "COPY" {
+		sources, err := b.copySources(inst)
+		if err != nil {
+			return "", err
+		}
+		for _, src := range sources {
+			if err := hashFiles(h, src); err != nil {
+				return "", err
+			}
+		}
+	}
+	if inst.Cmd == "ENTRYPOINT" && !b.cmdSet {
+		fmt.Fprintln(h, "reset cmd")
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFiles writes the names, modes, link targets and contents of the file
+// (or dir, recursively) into the hash.
+func hashFiles(h io.Writer, file string) error {
+	return filepath.WalkDir(file, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(filepath.Dir(file), p)
+		fmt.Fprintf(h, "%s %o %d\n", rel, fi.Mode(), fi.Size())
+
+		switch {
+		case fi.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(h, target)
+		case fi.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
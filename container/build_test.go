@@ -0,0 +1,125 @@
+package container
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestBuild_copy(t *testing.T) {
+	DataRoot = t.TempDir()
+	defer func() { DataRoot = DefaultDataRoot }()
+
+	ctx := t.TempDir()
+	makeDirTree(t, ctx, map[string]string{
+		"Hindfile": "FROM scratch\nWORKDIR /srv\nCOPY app.sh conf ./\nCOPY ../../etc/x /opt/new/\nCMD [\"/srv/app.sh\"]\n",
+		"app.sh":   "#!/bin/sh",
+		"conf/a":   "a",
+		"etc/x":    "x",
+	})
+
+	var out bytes.Buffer
+	img, err := Build(BuildOptions{Context: ctx, Refs: []string{"app:v1"}, Output: &out})
+	if err != nil {
+		t.Fatalf("Build() error = %v\n%s", err, out.String())
+	}
+	if len(img.Layers) != 2 || img.Config == nil || img.Config.WorkingDir != "/srv" || img.Config.Cmd[0] != "/srv/app.sh" {
+		t.Errorf("Build() = %+v, config %+v", img, img.Config)
+	}
+
+	rootfs := layeredFS{ImageStore().LowerDirs(img)}
+	for p, want := range map[string]string{"srv/app.sh": "#!/bin/sh", "srv/a": "a", "opt/new/x": "x"} {
+		file, _, ok := rootfs.lookup(p)
+		if !ok {
+			t.Errorf("%s: not in the image", p)
+			continue
+		}
+		if got, _ := os.ReadFile(file); string(got) != want {
+			t.Errorf("%s = %q, want %q", p, got, want)
+		}
+	}
+
+	// all cached
+	out.Reset()
+	img2, err := Build(BuildOptions{Context: ctx, Output: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img2.ID != img.ID || strings.Count(out.String(), "Using cache") != 4 {
+		t.Errorf("Build() again = %s, want %s all cached:\n%s", img2.ID, img.ID, out.String())
+	}
+
+	// a changed file is copied again
+	os.WriteFile(path.Join(ctx, "etc/x"), []byte("y"), 0644)
+	out.Reset()
+	if img2, err = Build(BuildOptions{Context: ctx, Output: &out}); err != nil {
+		t.Fatal(err)
+	}
+	if img2.ID == img.ID || strings.Count(out.String(), "Using cache") != 2 {
+		t.Errorf("Build() after a change = %s, want rebuilt from the second COPY:\n%s", img2.ID, out.String())
+	}
+}
+
+func TestBuild_copySymlinks(t *testing.T) {
+	DataRoot = t.TempDir()
+	defer func() { DataRoot = DefaultDataRoot }()
+
+	outside := t.TempDir()
+	makeDirTree(t, outside, map[string]string{"secret": "s3cr3t"})
+	ctx := t.TempDir()
+	makeDirTree(t, ctx, map[string]string{
+		"conf/a": "a",
+		"inner":  "->conf",
+		"link":   "->" + outside,
+		"up":     "->..",
+	})
+
+	tests := []struct {
+		name      string
+		hindfile  string
+		wantErrIs error
+		wantFiles map[string]string // path -> content, or "->target" for a symlink
+	}{
+		{"parent_in_context", "FROM scratch\nCOPY inner/a /x\n", nil, map[string]string{"x": "a"}},
+		{"symlink_source", "FROM scratch\nCOPY link /x\n", nil, map[string]string{"x": "->" + outside}},
+		{"parent_out_of_context", "FROM scratch\nCOPY link/secret /x\n", ErrBuildFailed, nil},
+		{"wildcard_out_of_context", "FROM scratch\nCOPY link/* /x/\n", ErrBuildFailed, nil},
+		{"dotdot_symlink", "FROM scratch\nCOPY up/* /x/\n", ErrBuildFailed, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.WriteFile(path.Join(ctx, "Hindfile"), []byte(tt.hindfile), 0644)
+			img, err := Build(BuildOptions{Context: ctx, NoCache: true, Output: &bytes.Buffer{}})
+			if tt.wantErrIs != nil {
+				if !errors.Is(err, tt.wantErrIs) {
+					t.Errorf("Build() error = %v, want %v", err, tt.wantErrIs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+
+			rootfs := layeredFS{ImageStore().LowerDirs(img)}
+			for p, want := range tt.wantFiles {
+				file, _, ok := rootfs.lookup(p)
+				if !ok {
+					t.Errorf("%s: not in the image", p)
+					continue
+				}
+				got, err := os.ReadFile(file)
+				if strings.HasPrefix(want, "->") {
+					var target string
+					target, err = os.Readlink(file)
+					got = []byte("->" + target)
+				}
+				if err != nil || string(got) != want {
+					t.Errorf("%s = %q, %v, want %q", p, got, err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package container
+
+import (
+	"fmt"
+	"hind/network"
+	"os"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/exp/slog"
+)
+
+// Network drivers.
+const (
+	NetworkDriverBridge = "bridge" // the built-in bridges (see network.go)
+	NetworkDriverCNI    = "cni"    // the CNI plugins
+)
+
+// setupCNI attaches the container's network namespace to the cni
+// networks in container.Networks (the first config in the conf dir if
+// empty). The interfaces are eth0, eth1...
+//
+// The netns is kept open until the cleanup: the plugins need it for DEL
+// after the container process exits.
+//
+// This function is executed in the host, before the config is sent.
+func setupCNI(container *Container, ns netns.NsHandle) (cleanUpFunc, error) {
+	cni := container.CNI
+	if cni == nil {
+		cni = network.DefaultCNI()
+		container.CNI = cni
+	}
+
+	held, err := netns.GetFromPid(container.Process.Pid)
+	if err != nil {
+		return func() {}, fmt.Errorf("get netns of container process: %w", err)
+	}
+	// the plugins are the children of this process: they can open our fd
+	nsPath := fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), int(held))
+
+	cleanup := func() {
+		teardownCNI(container, nsPath)
+		held.Close()
+	}
+
+	if err := network.LoopbackUp(ns); err != nil {
+		cleanup()
+		return func() {}, err
+	}
+
+	names := container.Networks
+	if len(names) == 0 {
+		names = []string{""}
+	}
+	container.Networks = nil
+
+	for i, name := range names {
+		list, err := cni.LoadConfList(name)
+		if err != nil {
+			cleanup()
+			return func() {}, err
+		}
+		a, err := cni.Add(list, container.ID, nsPath, fmt.Sprintf("eth%d", i))
+		if err != nil {
+			cleanup()
+			return func() {}, err
+		}
+		container.CNIAttachments = append(container.CNIAttachments, a)
+		container.Networks = append(container.Networks, list.Name)
+
+		slog.Info("[host] container attached to cni network.", "network", list.Name, "ifName", a.IfName, "ips", a.IPs())
+	}
+
+	return cleanup, nil
+}
+
+// teardownCNI detaches the container from the cni networks, in the reverse order.
+func teardownCNI(container *Container, nsPath string) {
+	for i := len(container.CNIAttachments) - 1; i >= 0; i-- {
+		a := container.CNIAttachments[i]
+		if err := container.CNI.Del(a, container.ID, nsPath); err != nil {
+			slog.Warn("[host] Failed to detach from the cni network.", "network", a.Network, "err", err)
+		}
+	}
+	container.CNIAttachments = nil
+}
+
+// CheckNetwork runs the cni CHECK of a running container's attachments.
+func CheckNetwork(containerIdOrName string) error {
+	c, err := LoadContainer(containerIdOrName)
+	if err != nil {
+		return err
+	}
+	if !c.IsRunning() {
+		return fmt.Errorf("%w: %s", ErrContainerNotRunning, c.Name)
+	}
+	if c.NetworkDriver != NetworkDriverCNI {
+		return fmt.Errorf("%w: check is only for the cni network driver", network.ErrBadNetwork)
+	}
+
+	nsPath := fmt.Sprintf("/proc/%d/ns/net", c.Pid)
+	for _, a := range c.CNIAttachments {
+		if err := c.CNI.Check(a, c.ID, nsPath); err != nil {
+			return fmt.Errorf("check cni network %s: %w", a.Network, err)
+		}
+	}
+	return nil
+}
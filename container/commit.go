@@ -0,0 +1,105 @@
+package container
+
+import (
+	"fmt"
+	"hind/image"
+	"os"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// CommitOptions are the options of Commit.
+type CommitOptions struct {
+	Refs []string // name[:tag] of the new image
+	Cmd  []string // the Cmd of the new image. nil for the container's command.
+	Env  []string // KEY=VALUE overriding the container's Env
+}
+
+// Commit makes a new image in the store of the changes in the container's
+// writable layer (the overlay upper dir), on top of the container's image.
+//
+// The config of the new image is the image's, with the Cmd, Env,
+// WorkingDir and User of the container (see commitConfig).
+// The container is not paused: the files being written meanwhile may be
+// committed partially.
+func Commit(c *Container, opts CommitOptions) (*image.Image, error) {
+	if c.Image == "" {
+		return nil, fmt.Errorf("%w: the image %s of the container is not in the store, import it first", image.ErrBadImage, c.ImagePath)
+	}
+	diff, err := c.diffDir()
+	if err != nil {
+		return nil, err
+	}
+
+	config := commitConfig(c)
+	if opts.Cmd != nil {
+		config.Entrypoint, config.Cmd = nil, opts.Cmd
+	}
+	config.Env = mergeEnv(config.Env, opts.Env)
+
+	slog.Info("[host] committing the container.", "id", c.ID, "diff", diff, "image", c.Image)
+	return ImageStore().Commit(diff, image.CommitOptions{
+		Parent:    c.Image,
+		Config:    config,
+		CreatedBy: strings.Join(c.Command, " "),
+	}, opts.Refs...)
+}
+
+// commitConfig is the config of the image committed from the container:
+// the config of its image, with the container's Env, WorkingDir and
+// User. The Cmd is the container's command, after the Entrypoint of the
+// image if the command starts with it; otherwise the Entrypoint is reset.
+func commitConfig(c *Container) *image.Config {
+	config := &image.Config{}
+	if c.ImageConfig != nil {
+		*config = *c.ImageConfig
+	}
+	config.Env = append([]string{}, c.Env...)
+	config.WorkingDir = c.WorkingDir
+	config.User = c.User
+
+	command := append([]string{}, c.Command...)
+	if len(config.Entrypoint) > 0 && hasPrefix(command, config.Entrypoint) {
+		config.Cmd = command[len(config.Entrypoint):]
+	} else {
+		config.Entrypoint, config.Cmd = nil, command
+	}
+	return config
+}
+
+func hasPrefix(s []string, prefix []string) bool {
+	if len(s) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if s[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// diffDir is the dir of the changes the container made to its image: the
+// overlay upper dir. The overlay root dir is kept while the container
+// exists.
+//
+// There is no such dir (ErrNoSnapshot) if the image is the rootfs itself
+// (no overlay), for a read-only container, or with the vfs and reflink
+// storage drivers, which copy the whole image.
+func (c *Container) diffDir() (string, error) {
+	switch {
+	case !c.Overlay:
+		return "", fmt.Errorf("%w: the image is used as the rootfs directly (no overlay)", ErrNoSnapshot)
+	case c.ReadOnly:
+		return "", fmt.Errorf("%w: the container is read-only", ErrNoSnapshot)
+	case c.StorageDriver != "" && c.StorageDriver != StorageDriverOverlay && c.StorageDriver != StorageDriverFuseOverlay:
+		return "", fmt.Errorf("%w: the %s storage driver keeps no separate changes", ErrNoSnapshot, c.StorageDriver)
+	}
+
+	upper := c.overlayUpperDir()
+	if _, err := os.Stat(upper); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrNoSnapshot, err)
+	}
+	return upper, nil
+}
@@ -0,0 +1,64 @@
+package container
+
+import (
+	"errors"
+	"hind/image"
+	"reflect"
+	"testing"
+)
+
+func TestCommitConfig(t *testing.T) {
+	imageConfig := &image.Config{
+		Entrypoint: []string{"/entrypoint.sh"},
+		Cmd:        []string{"serve"},
+		Env:        []string{"PATH=/bin"},
+		Labels:     map[string]string{"foo": "bar"},
+	}
+	tests := []struct {
+		name    string
+		c       *Container
+		wantEP  []string
+		wantCmd []string
+	}{
+		{"no image config", &Container{Command: []string{"sh"}}, nil, []string{"sh"}},
+		{"keep the entrypoint", &Container{ImageConfig: imageConfig, Command: []string{"/entrypoint.sh", "debug"}}, []string{"/entrypoint.sh"}, []string{"debug"}},
+		{"entrypoint overridden", &Container{ImageConfig: imageConfig, Command: []string{"sh", "-c", "ls"}}, nil, []string{"sh", "-c", "ls"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.c.Env = []string{"PATH=/bin", "DEBUG=1"}
+			tt.c.WorkingDir, tt.c.User = "/app", "nobody"
+
+			got := commitConfig(tt.c)
+			if !reflect.DeepEqual(got.Entrypoint, tt.wantEP) || !reflect.DeepEqual(got.Cmd, tt.wantCmd) {
+				t.Errorf("commitConfig() entrypoint %q, cmd %q; want %q, %q", got.Entrypoint, got.Cmd, tt.wantEP, tt.wantCmd)
+			}
+			if !reflect.DeepEqual(got.Env, tt.c.Env) || got.WorkingDir != "/app" || got.User != "nobody" {
+				t.Errorf("commitConfig() = %+v", got)
+			}
+			if tt.c.ImageConfig != nil && got.Labels["foo"] != "bar" {
+				t.Errorf("commitConfig() labels = %v, want the image's", got.Labels)
+			}
+		})
+	}
+	if !reflect.DeepEqual(imageConfig.Cmd, []string{"serve"}) {
+		t.Errorf("the image config is modified: %+v", imageConfig)
+	}
+}
+
+func TestContainer_diffDir(t *testing.T) {
+	tests := []struct {
+		name string
+		c    *Container
+	}{
+		{"no overlay", &Container{}},
+		{"read-only", &Container{Overlay: true, ReadOnly: true}},
+		{"vfs", &Container{Overlay: true, StorageDriver: StorageDriverVFS}},
+		{"removed", &Container{Overlay: true, ID: "removed", WorkDir: t.TempDir()}},
+	}
+	for _, tt := range tests {
+		if _, err := tt.c.diffDir(); !errors.Is(err, ErrNoSnapshot) {
+			t.Errorf("%s: diffDir() error = %v, want %v", tt.name, err, ErrNoSnapshot)
+		}
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"hind/cgroups"
+	"hind/image"
+	"hind/network"
 	"io"
 	"os"
+	"time"
 
 	"golang.org/x/exp/slog"
 )
@@ -18,24 +21,70 @@ type Container struct {
 
 	ID   string
 	Name string
+	Pod  string // the ID (or name before Run) of the pod that the container is a member of
 
 	// InContainerConfig's blueprint
 
-	Command []string
+	Command    []string // the command to run. The Entrypoint and Cmd of the image are merged in by checkContainer.
+	Entrypoint []string // overrides the Entrypoint of the image if not nil (the Cmd of the image is dropped too). Empty but not nil to reset it.
+	Env        []string // KEY=VALUE, overriding the Env of the image
+	WorkingDir string   // the working dir of the command. Default: the WorkingDir of the image, or /
+	User       string   // user[:group] (names or ids) to run the command as. Default: the User of the image, or root
 
 	// Setup config
 
-	WorkDir   string // WorkDir is a dir to do the setup work. NOT the $(pwd) of the container.
-	TTY       bool
-	ImagePath string // directory | tar file
-	Overlay   bool   // if true, use overlayfs to make the image read-only
-	Resources *cgroups.Resources
+	WorkDir       string // WorkDir is a dir to do the setup work. NOT the $(pwd) of the container. Default: <StateDir>/work
+	TTY           bool
+	AutoRemove    bool          // if true, the container (its state and rootfs) is removed after it exits. Otherwise, it is kept to be restarted.
+	ImagePath     string        // directory | tar file | image reference (name[:tag]) or id in the image store. Maybe pinned by a digest: IMAGE@sha256:<hex>
+	ImageDigest   string        // the digest of the tar file ImagePath, if pinned or required to be signed. Empty otherwise.
+	Image         string        // the id of the image in the store. Empty if ImagePath is a path.
+	ImageConfig   *image.Config // the config of the image in the store. nil if none.
+	ImageLayers   []string      // the lower dirs (top first) of a multi-layer image in the store. Empty for a single layer: ImagePath is the lower dir.
+	Overlay       bool          // if true, use overlayfs to make the image read-only
+	ReadOnly      bool          // if true, the rootfs is mounted read-only. No writable container layer is created.
+	StorageDriver string        // overlay | fuse-overlayfs | vfs | reflink. Empty: overlay, falling back to fuse-overlayfs (if installed), reflink then vfs. Set to the driver in use after the setup.
+	Mounts        []Mount
+	Resources     *cgroups.Resources
+
+	// Namespace config
+
+	Namespaces      Namespaces            // private (default) | host | container:<id>
+	Networks        []string              // the networks (names or ids) to connect: bridge (default) | none | user-defined. Only for the private network namespace.
+	NetworkDriver   string                // bridge (default, the built-in bridges) | cni
+	CNI             *network.CNI          // where to find the cni network configs and plugins. Only for the cni driver.
+	Ports           []network.PortMapping // the host ports published to the container. HostPort is the actual one after Run.
+	Bandwidth       *network.Bandwidth    // if not nil, the traffic of each bridge endpoint is limited. Only for the bridge driver.
+	Hostname        string                // the hostname of the private UTS namespace. Default: Name.
+	DNS             []string              // nameservers. Default: the host's, except the loopback ones.
+	DNSSearch       []string              // search domains. Default: the host's.
+	DNSOptions      []string              // resolv.conf options. Default: the host's.
+	ExtraHosts      []HostEntry           // additional lines in /etc/hosts
+	CgroupNamespace bool                  // if true, the container has a private cgroup namespace and a read-only cgroupfs
+	TimeOffsets     *TimeOffsets          // if not nil, the container has a time namespace with the offsets
+
+	// Security config
+
+	Rlimits         []Rlimit // setrlimit(2) by pid 1 before execve
+	NoNewPrivileges bool     // set PR_SET_NO_NEW_PRIVS by pid 1 before execve
+	OomScoreAdj     *int     // written to /proc/<pid>/oom_score_adj by the host. nil to inherit.
 
 	// Runtime config
 
-	Process           *os.Process        // the process of the container
-	InContainerConfig *InContainerConfig // the config sent to the container
-	OverlayConfig     *overlayConfig     // the config of the overlayfs
+	Created           time.Time
+	Started           time.Time // the last time the container was started
+	Finished          time.Time // the last time the container exited
+	Status            ContainerStatus
+	ExitCode          int                          // the exit code of the last run. -1 if killed by a signal.
+	Pid               int                          // the pid (in the host) of the container process
+	PidStartTime      uint64                       // the start time of the process, to tell it from a later one with the same pid. 0 if unknown.
+	NetworkEndpoints  map[string]*network.Endpoint // network name -> the connection to its bridge
+	CNIAttachments    []*network.CNIAttachment     // the attachments to the cni networks
+	FuseOverlayPid    int                          // the pid of the fuse-overlayfs daemon serving the rootfs. 0 if none.
+	Process           *os.Process                  `json:"-"` // the process of the container
+	InContainerConfig *InContainerConfig           `json:"-"` // the config sent to the container
+	OverlayConfig     *overlayConfig               `json:"-"` // the config of the overlayfs
+	Attached          bool                         `json:"-"` // this run has the STDIN, STDOUT and STDERR of hind (hind start --attach), whatever the TTY
 }
 
 // InContainerConfig is the configuration to initialize a container.
@@ -45,8 +94,22 @@ type Container struct {
 //
 // This is exported for json encoding.
 type InContainerConfig struct {
-	RootDir string
-	Command []string
+	RootDir  string
+	Command  []string
+	Hostname string // sethostname if not empty
+
+	Env        []string // KEY=VALUE, set before looking up the command
+	WorkingDir string   // chdir (mkdir -p if missing) if not empty
+	User       string   // user[:group], looked up in the /etc/passwd and /etc/group of the rootfs
+
+	ReadOnly   bool
+	Mounts     []Mount
+	BindMounts []Mount // host files (Source) bind mounted into the rootfs before the pivot_root
+
+	CgroupNamespace bool
+
+	Rlimits         []Rlimit
+	NoNewPrivileges bool
 }
 
 // sendConfig writes the InContainerConfig to the pipe.
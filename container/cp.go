@@ -0,0 +1,243 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"hind/image"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/sys/unix"
+)
+
+// Export writes the rootfs of the container as an uncompressed tar
+// stream, as `docker export`: the image with the changes of the
+// container, flattened. The mounts (volumes, /proc...) are not in it.
+func Export(c *Container, w io.Writer) error {
+	rootfs, err := c.rootFS()
+	if err != nil {
+		return err
+	}
+	if err := rootfs.archive(w, ".", ""); err != nil {
+		return fmt.Errorf("export container %s: %w", c.ID, err)
+	}
+	return nil
+}
+
+// CopyFromContainer copies the file (or dir, recursively) at the path src
+// in the container to dst on the host, as `docker cp CONTAINER:SRC DST`:
+//
+//   - dst is an existing dir: src is copied into it, keeping its name;
+//   - dst does not exist: src is copied as dst, its parent must exist;
+//   - dst is an existing file: overwritten by src, if src is not a dir.
+//
+// The symlinks in src are resolved in the container, never going out of
+// its rootfs. The last element is copied as a symlink, unless followLink.
+// The mounts in a running container are seen as its processes see them.
+func CopyFromContainer(c *Container, src string, dst string, followLink bool) error {
+	rootfs, err := c.processRootFS()
+	if err != nil {
+		return err
+	}
+	rel, err := rootfs.resolve(src, followLink)
+	if err != nil {
+		return err
+	}
+	_, srcSt, ok := rootfs.lookup(rel)
+	if !ok {
+		return fmt.Errorf("%s: %w", src, os.ErrNotExist)
+	}
+	srcIsDir := srcSt.Mode&unix.S_IFMT == unix.S_IFDIR
+
+	dir, name := dst, path.Base(rel)
+	if rel == "." {
+		name = "" // the contents of the rootfs
+	}
+	fi, err := os.Stat(dst)
+	switch {
+	case os.IsNotExist(err):
+		dir, name = filepath.Dir(dst), filepath.Base(dst)
+		if _, err := os.Stat(dir); err != nil {
+			return err
+		}
+		if rel == "." {
+			if err := os.Mkdir(dst, 0755); err != nil {
+				return err
+			}
+			dir, name = dst, ""
+		}
+	case err != nil:
+		return err
+	case !fi.IsDir():
+		if srcIsDir {
+			return fmt.Errorf("cannot copy the directory %s to the file %s", src, dst)
+		}
+		dir, name = filepath.Dir(dst), filepath.Base(dst)
+	}
+
+	slog.Info("[container] copying from container.", "container", c.ID, "src", "/"+rel, "dst", filepath.Join(dir, name))
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(rootfs.archive(pw, rel, name))
+	}()
+	return image.Extract(pr, dir, image.ExtractOptions{})
+}
+
+// CopyToContainer copies the file (or dir, recursively) src on the host
+// to the path dst in the container, as `docker cp SRC CONTAINER:DST`.
+// See CopyFromContainer for the dst forms. The symlinks in dst are
+// resolved in the container.
+//
+// The files go into the writable layer of the container: the root of
+// its processes if it is running (so into the mounts in it too, as
+// theirs), or else its upper dir (the parent dirs are copied up into
+// it, as the overlayfs does). A read-only container can not be copied to.
+//
+// The files are extracted relative to the fds of their parents, opened
+// in the root (see image.Extract): the processes of a running container
+// can not take the copy out of its root by changing the path meanwhile.
+func CopyToContainer(c *Container, src string, dst string, followLink bool) error {
+	if c.ReadOnly {
+		return fmt.Errorf("%w: the container %s is read-only", ErrNoSnapshot, c.ID)
+	}
+	rootfs, err := c.processRootFS()
+	if err != nil {
+		return err
+	}
+
+	if followLink {
+		if src, err = filepath.EvalSymlinks(src); err != nil {
+			return err
+		}
+	}
+	srcFi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	rel, err := rootfs.resolve(dst, true)
+	if err != nil {
+		return err
+	}
+	dir, name := rel, filepath.Base(src)
+	if _, st, ok := rootfs.lookup(rel); !ok || st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		if ok && srcFi.IsDir() {
+			return fmt.Errorf("cannot copy the directory %s to the file %s", src, dst)
+		}
+		if rel == "." {
+			return fmt.Errorf("%s: not a directory", dst)
+		}
+		dir, name = path.Dir(rel), path.Base(rel)
+		if _, st, ok := rootfs.lookup(dir); !ok || st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			return fmt.Errorf("%s: %w", "/"+dir, os.ErrNotExist)
+		}
+	}
+	target := path.Join(dir, name)
+
+	top := rootfs.layers[0]
+	var opaques []string // the whiteouts in the top layer replaced by dirs
+	if len(rootfs.layers) > 1 {
+		if err := rootfs.copyUp(dir); err != nil {
+			return fmt.Errorf("copy up %s: %w", "/"+dir, err)
+		}
+		if opaques, err = findWhiteouts(top, target); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("[container] copying to container.", "container", c.ID, "src", src, "dst", "/"+target, "layer", top)
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(archiveHostFile(pw, src, target))
+	}()
+	if err := image.Extract(pr, top, image.ExtractOptions{}); err != nil {
+		return err
+	}
+
+	// a dir in the place of a deleted one must not show the old files
+	for _, p := range opaques {
+		if fi, err := os.Lstat(filepath.Join(top, p)); err == nil && fi.IsDir() {
+			if err := unix.Lsetxattr(filepath.Join(top, p), overlayOpaqueXattr, []byte("y"), 0); err != nil {
+				return fmt.Errorf("set opaque %s: %w", "/"+p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// copyUp makes the dir and its parents in the top layer, with the owner,
+// mode and xattrs of the ones in the merged view. The ones missing in the
+// merged view are made with the mode 0755.
+func (l layeredFS) copyUp(dir string) error {
+	p := "."
+	for _, part := range strings.Split(cleanRel(dir), "/") {
+		if part == "." {
+			continue
+		}
+		p = path.Join(p, part)
+		up := filepath.Join(l.layers[0], p)
+		if _, err := os.Lstat(up); err == nil {
+			continue
+		}
+		file, st, ok := l.lookup(p)
+		if !ok {
+			if err := os.Mkdir(up, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.Mkdir(up, 0700); err != nil {
+			return err
+		}
+		if err := copyMetadata(file, up, st, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findWhiteouts lists the whiteouts at or under the path in the layer.
+func findWhiteouts(layer string, rel string) ([]string, error) {
+	var whiteouts []string
+	err := filepath.WalkDir(filepath.Join(layer, rel), func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(p, &st); err != nil {
+			return err
+		}
+		if isWhiteout(&st) {
+			sub, _ := filepath.Rel(layer, p)
+			whiteouts = append(whiteouts, sub)
+		}
+		return nil
+	})
+	return whiteouts, err
+}
+
+// archiveHostFile writes the tar of the file (or dir, recursively) on the
+// host, named as the name in the archive.
+func archiveHostFile(w io.Writer, file string, name string) error {
+	a := image.NewArchiver(w)
+	err := filepath.WalkDir(file, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		sub, _ := filepath.Rel(file, p)
+		return a.Add(path.Join(name, filepath.ToSlash(sub)), p)
+	})
+	if err != nil {
+		return err
+	}
+	return a.Close()
+}
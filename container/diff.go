@@ -0,0 +1,96 @@
+package container
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// ChangeKind is the kind of a change to the rootfs.
+type ChangeKind string
+
+const (
+	ChangeModify ChangeKind = "C"
+	ChangeAdd    ChangeKind = "A"
+	ChangeDelete ChangeKind = "D"
+)
+
+// Change is a file added, changed or deleted by the container, as
+// reported by `docker diff`.
+type Change struct {
+	Kind ChangeKind
+	Path string // the absolute path in the container
+}
+
+func (c Change) String() string {
+	return string(c.Kind) + " " + c.Path
+}
+
+// Diff lists the changes the container made to its image, sorted by the
+// path: the files in its writable layer (the overlay upper dir, see
+// diffDir) are added (A), or changed (C) if in the image (the lower dirs).
+// The whiteouts are deleted (D). An opaque dir replacing a dir in the
+// image is changed, and the files of the image in it are deleted.
+//
+// The parents of a changed file are changed too, as the overlayfs
+// copies them up.
+func Diff(c *Container) ([]Change, error) {
+	upper, err := c.diffDir()
+	if err != nil {
+		return nil, err
+	}
+	lowers := layeredFS{c.overlayLowerDirs()}
+
+	var changes []Change
+	err = filepath.WalkDir(upper, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(upper, p)
+		if rel == "." {
+			return nil
+		}
+		name := "/" + rel
+
+		var st unix.Stat_t
+		if err := unix.Lstat(p, &st); err != nil {
+			return err
+		}
+		if isWhiteout(&st) {
+			changes = append(changes, Change{ChangeDelete, name})
+			return nil
+		}
+
+		if !lowers.exists(rel) {
+			changes = append(changes, Change{ChangeAdd, name})
+			return nil
+		}
+		changes = append(changes, Change{ChangeModify, name})
+
+		if d.IsDir() && isOpaqueDir(p) { // the files in the image are hidden
+			for _, child := range lowers.readDir(rel) {
+				if _, err := os.Lstat(filepath.Join(p, child)); os.IsNotExist(err) {
+					changes = append(changes, Change{ChangeDelete, filepath.Join(name, child)})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// isWhiteout reports whether the file is an overlayfs whiteout: a
+// character device 0:0.
+func isWhiteout(st *unix.Stat_t) bool {
+	return st.Mode&unix.S_IFMT == unix.S_IFCHR && st.Rdev == 0
+}
@@ -0,0 +1,110 @@
+package container
+
+import (
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// makeDirTree makes the files (name -> content) in the dir. A name ending
+// with "/" is a dir, a content "->target" is a symlink, and "whiteout" is
+// a 0:0 char device.
+func makeDirTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		switch {
+		case name[len(name)-1] == '/':
+			err = os.MkdirAll(p, 0755)
+		case content == "whiteout":
+			err = unix.Mknod(p, unix.S_IFCHR, 0)
+		case len(content) > 2 && content[:2] == "->":
+			err = os.Symlink(content[2:], p)
+		default:
+			err = os.WriteFile(p, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	base, top := t.TempDir(), t.TempDir()
+	makeDirTree(t, base, map[string]string{
+		"etc/passwd":   "root",
+		"etc/hostname": "foo",
+		"opt/a":        "a",
+		"opt/b":        "b",
+		"var/":         "",
+		"bin":          "->/usr/bin",
+	})
+	makeDirTree(t, top, map[string]string{
+		"etc/group":  "root",
+		"opt/b":      "whiteout", // deleted in the image
+		"opt/c/":     "",
+		"usr/bin/sh": "#!",
+	})
+	if err := unix.Setxattr(path.Join(top, "opt/c"), "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Skipf("no trusted xattrs: %v", err)
+	}
+
+	c := &Container{ID: "diff-test", WorkDir: t.TempDir(), Overlay: true, ImagePath: top, ImageLayers: []string{top, base}}
+	makeDirTree(t, c.overlayUpperDir(), map[string]string{
+		"etc/passwd":  "changed",
+		"etc/group":   "whiteout",
+		"etc/new":     "new",
+		"opt/":        "",
+		"var/log/a":   "log",
+		"bin/sh":      "a dir in the place of the symlink",
+		"usr/bin/sh":  "whiteout",
+		"opt/b":       "re-created",
+		"opt/a/":      "", // a dir replacing a file
+		"opt/a/inner": "x",
+	})
+	unix.Setxattr(path.Join(c.overlayUpperDir(), "opt"), "trusted.overlay.opaque", []byte("y"), 0)
+
+	changes, err := Diff(c)
+	if err != nil {
+		t.Fatalf("Diff() error = %v", err)
+	}
+	var got []string
+	for _, change := range changes {
+		got = append(got, change.String())
+	}
+	want := []string{
+		"C /bin", // a dir copied up in the place of a symlink is still "in the image"
+		"A /bin/sh",
+		"C /etc",
+		"D /etc/group",
+		"A /etc/new",
+		"C /etc/passwd",
+		"C /opt",
+		"C /opt/a",
+		"A /opt/a/inner",
+		"A /opt/b",
+		"D /opt/c",
+		"C /usr",
+		"C /usr/bin",
+		"D /usr/bin/sh",
+		"C /var",
+		"A /var/log",
+		"A /var/log/a",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff() =\n%v\nwant\n%v", got, want)
+	}
+
+	c.StorageDriver = StorageDriverVFS
+	if _, err := Diff(c); !errors.Is(err, ErrNoSnapshot) {
+		t.Errorf("Diff() with vfs error = %v, want %v", err, ErrNoSnapshot)
+	}
+}
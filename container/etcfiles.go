@@ -0,0 +1,224 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"golang.org/x/exp/slog"
+)
+
+// This file generates the /etc files of the container in its state
+// dir, which are bind mounted over the image's copies by pid 1 before
+// the pivot_root:
+//
+//	<DataRoot>/containers/<containerID>/hosts        -> /etc/hosts
+//	<DataRoot>/containers/<containerID>/hostname     -> /etc/hostname
+//	<DataRoot>/containers/<containerID>/resolv.conf  -> /etc/resolv.conf
+//
+// A symlink in the image is followed in the rootfs, and the file is
+// mounted onto its target: e.g. the /etc/resolv.conf of Debian and
+// Ubuntu images -> ../run/systemd/resolve/stub-resolv.conf.
+
+// hostResolvConf is the host's resolv.conf to derive the containers' from.
+var hostResolvConf = "/etc/resolv.conf"
+
+// systemdResolvConf lists the real nameservers behind systemd-resolved's stub (127.0.0.53).
+var systemdResolvConf = "/run/systemd/resolve/resolv.conf"
+
+// defaultNameservers are used if there is no nameserver left after
+// filtering out the loopback ones, as docker does.
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// maxHostnameLen is HOST_NAME_MAX of linux.
+const maxHostnameLen = 64
+
+// hostname is the hostname to set in the container: only for a private UTS namespace.
+func (c *Container) hostname() string {
+	if !c.Namespaces.Uts.IsPrivate() {
+		return ""
+	}
+	return c.Hostname
+}
+
+func (c *Container) hostnameFile() string {
+	return path.Join(c.StateDir(), "hostname")
+}
+
+func (c *Container) resolvConfFile() string {
+	return path.Join(c.StateDir(), "resolv.conf")
+}
+
+// setupEtcFiles writes the hosts, hostname and resolv.conf files of
+// the container, and updates the hosts of the containers on the same
+// networks.
+//
+// This function is executed in the host, after setupNetwork.
+func setupEtcFiles(container *Container) error {
+	// record the endpoints so that the peers can resolve the container
+	if err := saveState(container); err != nil {
+		return err
+	}
+
+	if err := writeHosts(container, nil); err != nil {
+		return err
+	}
+	if container.Namespaces.Net.IsPrivate() {
+		updateHosts(container.Networks)
+	}
+
+	if container.Namespaces.Uts.IsPrivate() {
+		if err := os.WriteFile(container.hostnameFile(), []byte(container.Hostname+"\n"), 0644); err != nil {
+			return fmt.Errorf("write hostname: %w", err)
+		}
+	}
+
+	if err := writeResolvConf(container); err != nil {
+		return err
+	}
+
+	slog.Info("[host] etc files generated.", "dir", container.StateDir())
+	return nil
+}
+
+// bindMounts are the generated files to bind mount into the container.
+// The hostname is only for a private UTS namespace.
+func (c *Container) bindMounts() []Mount {
+	files := []struct{ source, target string }{
+		{c.hostsFile(), "/etc/hosts"},
+		{c.resolvConfFile(), "/etc/resolv.conf"},
+	}
+	if c.Namespaces.Uts.IsPrivate() {
+		files = append(files, struct{ source, target string }{c.hostnameFile(), "/etc/hostname"})
+	}
+
+	var mounts []Mount
+	for _, f := range files {
+		mounts = append(mounts, Mount{Source: f.source, Target: f.target, Type: "bind", Flags: syscall.MS_BIND})
+	}
+	return mounts
+}
+
+// resolvConf is the content of a resolv.conf that we care about.
+type resolvConf struct {
+	Nameservers []string
+	Search      []string
+	Options     []string
+}
+
+// parseResolvConf reads the nameserver, search (domain) and options lines.
+func parseResolvConf(r io.Reader) resolvConf {
+	var conf resolvConf
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			conf.Nameservers = append(conf.Nameservers, fields[1])
+		case "search", "domain": // the last one wins
+			conf.Search = fields[1:]
+		case "options":
+			conf.Options = append(conf.Options, fields[1:]...)
+		}
+	}
+	return conf
+}
+
+// isLoopback reports whether the nameserver is a loopback address,
+// which is unreachable from another network namespace.
+func isLoopback(nameserver string) bool {
+	ip := net.ParseIP(strings.Split(nameserver, "%")[0]) // fe80::1%eth0
+	return ip != nil && ip.IsLoopback()
+}
+
+// containerResolvConf derives the container's resolv.conf from the host's:
+// the loopback nameservers are dropped unless keepLoopback (the host's
+// network namespace), and the DNS* of the container override the host's.
+func containerResolvConf(host resolvConf, c *Container, keepLoopback bool) resolvConf {
+	conf := resolvConf{Nameservers: c.DNS, Search: c.DNSSearch, Options: c.DNSOptions}
+
+	if len(conf.Nameservers) == 0 {
+		for _, ns := range host.Nameservers {
+			if keepLoopback || !isLoopback(ns) {
+				conf.Nameservers = append(conf.Nameservers, ns)
+			}
+		}
+		if len(conf.Nameservers) == 0 {
+			conf.Nameservers = defaultNameservers
+		}
+	}
+	if len(conf.Search) == 0 {
+		conf.Search = host.Search
+	}
+	if len(conf.Options) == 0 {
+		conf.Options = host.Options
+	}
+	return conf
+}
+
+func (conf resolvConf) bytes() []byte {
+	var b bytes.Buffer
+	for _, ns := range conf.Nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	if len(conf.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(conf.Search, " "))
+	}
+	if len(conf.Options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(conf.Options, " "))
+	}
+	return b.Bytes()
+}
+
+// loadHostResolvConf reads the host's resolv.conf. If all its
+// nameservers are loopback (e.g. the systemd-resolved stub), the
+// upstream ones of systemd-resolved are used if available.
+func loadHostResolvConf() resolvConf {
+	var conf resolvConf
+	if f, err := os.Open(hostResolvConf); err == nil {
+		conf = parseResolvConf(f)
+		f.Close()
+	}
+
+	for _, ns := range conf.Nameservers {
+		if !isLoopback(ns) {
+			return conf
+		}
+	}
+	if f, err := os.Open(systemdResolvConf); err == nil {
+		upstream := parseResolvConf(f)
+		f.Close()
+		if len(upstream.Nameservers) > 0 {
+			conf.Nameservers = upstream.Nameservers
+		}
+	}
+	return conf
+}
+
+func writeResolvConf(c *Container) error {
+	conf := containerResolvConf(loadHostResolvConf(), c, c.Namespaces.Net.IsHost())
+	if err := os.WriteFile(c.resolvConfFile(), conf.bytes(), 0644); err != nil {
+		return fmt.Errorf("write resolv.conf: %w", err)
+	}
+	return nil
+}
+
+// checkDNS errors if a nameserver is not an IP address.
+func checkDNS(nameservers []string) error {
+	for _, ns := range nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("%w: nameserver %q is not an IP address", ErrBadDNS, ns)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package container
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testHostResolvConf = `# generated by NetworkManager
+nameserver 127.0.0.53
+nameserver 10.0.0.2
+nameserver ::1
+domain example.org
+search corp.example.com example.com
+options edns0
+options trust-ad
+`
+
+func TestParseResolvConf(t *testing.T) {
+	got := parseResolvConf(strings.NewReader(testHostResolvConf))
+	want := resolvConf{
+		Nameservers: []string{"127.0.0.53", "10.0.0.2", "::1"},
+		Search:      []string{"corp.example.com", "example.com"},
+		Options:     []string{"edns0", "trust-ad"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseResolvConf() = %+v, want %+v", got, want)
+	}
+}
+
+func TestContainerResolvConf(t *testing.T) {
+	host := parseResolvConf(strings.NewReader(testHostResolvConf))
+	loopbackOnly := resolvConf{Nameservers: []string{"127.0.0.53"}}
+
+	tests := []struct {
+		name         string
+		host         resolvConf
+		c            *Container
+		keepLoopback bool
+		want         string
+	}{
+		{"filter_loopback", host, &Container{}, false,
+			"nameserver 10.0.0.2\nsearch corp.example.com example.com\noptions edns0 trust-ad\n"},
+		{"keep_loopback", host, &Container{}, true,
+			"nameserver 127.0.0.53\nnameserver 10.0.0.2\nnameserver ::1\nsearch corp.example.com example.com\noptions edns0 trust-ad\n"},
+		{"default_nameservers", loopbackOnly, &Container{}, false,
+			"nameserver 8.8.8.8\nnameserver 8.8.4.4\n"},
+		{"override", host, &Container{DNS: []string{"1.1.1.1"}, DNSSearch: []string{"svc.local"}, DNSOptions: []string{"ndots:2"}}, false,
+			"nameserver 1.1.1.1\nsearch svc.local\noptions ndots:2\n"},
+		{"override_dns_only", host, &Container{DNS: []string{"127.0.0.1"}}, false,
+			"nameserver 127.0.0.1\nsearch corp.example.com example.com\noptions edns0 trust-ad\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(containerResolvConf(tt.host, tt.c, tt.keepLoopback).bytes())
+			if got != tt.want {
+				t.Errorf("containerResolvConf() = \n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadHostResolvConf(t *testing.T) {
+	dir := t.TempDir()
+	defer func(orig, origSystemd string) {
+		hostResolvConf, systemdResolvConf = orig, origSystemd
+	}(hostResolvConf, systemdResolvConf)
+	hostResolvConf = path.Join(dir, "resolv.conf")
+	systemdResolvConf = path.Join(dir, "systemd-resolv.conf")
+
+	os.WriteFile(hostResolvConf, []byte("nameserver 127.0.0.53\nsearch lan\n"), 0644)
+	if got := loadHostResolvConf(); !reflect.DeepEqual(got.Nameservers, []string{"127.0.0.53"}) {
+		t.Errorf("loadHostResolvConf() without systemd-resolved = %v", got.Nameservers)
+	}
+
+	os.WriteFile(systemdResolvConf, []byte("nameserver 192.168.1.1\n"), 0644)
+	got := loadHostResolvConf()
+	if !reflect.DeepEqual(got.Nameservers, []string{"192.168.1.1"}) || !reflect.DeepEqual(got.Search, []string{"lan"}) {
+		t.Errorf("loadHostResolvConf() behind systemd-resolved = %+v, want the upstream nameservers", got)
+	}
+}
+
+func TestCheckDNS(t *testing.T) {
+	if err := checkDNS([]string{"1.1.1.1", "2606:4700::1111"}); err != nil {
+		t.Errorf("checkDNS() error = %v", err)
+	}
+	if err := checkDNS([]string{"dns.example.com"}); err == nil {
+		t.Errorf("checkDNS() of a domain name: no error")
+	}
+}
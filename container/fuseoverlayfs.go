@@ -0,0 +1,227 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/sys/unix"
+)
+
+// The binaries of fuse-overlayfs, looked up in $PATH.
+var (
+	fuseOverlayfsBinary = "fuse-overlayfs"
+	fusermountBinaries  = []string{"fusermount3", "fusermount"}
+)
+
+// fuseMountTimeout is the time to wait for the fuse-overlayfs daemon to
+// mount, or to exit after unmounted.
+const fuseMountTimeout = 10 * time.Second
+
+// fuseOverlaySnapshotter is the Snapshotter on fuse-overlayfs: the same
+// overlay root dir layout as the overlaySnapshotter (see it), but the
+// merged dir is mounted by a fuse-overlayfs daemon instead of the kernel,
+// which works where the kernel overlayfs is not permitted (rootless,
+// overlayfs on overlayfs...).
+//
+// The daemon runs in the foreground (-f) as a child of hind, logging to
+// fuse-overlayfs.log in the overlay root dir. Its pid is c.FuseOverlayPid,
+// waited after `fusermount -u`.
+type fuseOverlaySnapshotter struct {
+	overlaySnapshotter
+}
+
+// fuseOverlayLogFile is the stderr of the fuse-overlayfs daemon.
+func (c overlayConfig) fuseOverlayLogFile() string {
+	return path.Join(c.overlayRootDir(), "/fuse-overlayfs.log")
+}
+
+// fuseOverlayfsInstalled reports whether the fuse-overlayfs binary is in $PATH.
+func fuseOverlayfsInstalled() bool {
+	_, err := exec.LookPath(fuseOverlayfsBinary)
+	return err == nil
+}
+
+// Mount starts the fuse-overlayfs daemon, and waits until the merged dir
+// is mounted.
+func (f fuseOverlaySnapshotter) Mount(c *Container) (string, error) {
+	if !f.needsMount(c) {
+		return f.overlaySnapshotter.Mount(c) // a read-only bind, no daemon
+	}
+
+	bin, err := exec.LookPath(fuseOverlayfsBinary)
+	if err != nil {
+		return "", fmt.Errorf("fuse-overlayfs not found: %w", err)
+	}
+
+	var upper, work string
+	if !c.ReadOnly {
+		upper, work = c.overlayUpperDir(), c.overlayWorkDir()
+	}
+	data := overlayMountData(c.overlayLowerDirs(), upper, work)
+	if os.Geteuid() == 0 { // the container may switch to another user
+		data += ",allow_other"
+	}
+	merged := c.overlayMergedDir()
+
+	// a file, not a buffer: the daemon is reaped by reapProcess, not cmd.Wait
+	logFile := c.fuseOverlayLogFile()
+	stderr, err := os.Create(logFile)
+	if err != nil {
+		return "", fmt.Errorf("error creating fuse-overlayfs log: %w", err)
+	}
+	defer stderr.Close()
+
+	cmd := exec.Command(bin, "-f", "-o", data, merged)
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("error starting fuse-overlayfs: %w", err)
+	}
+	pid := cmd.Process.Pid
+	slog.Info("[host] fuse-overlayfs: daemon started.", "pid", pid, "mountpoint", merged, "data", data)
+
+	for deadline := time.Now().Add(fuseMountTimeout); ; time.Sleep(10 * time.Millisecond) {
+		if mounted, err := isMountPoint(merged); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return "", err
+		} else if mounted {
+			break
+		}
+		if exited, _ := reapProcess(pid); exited {
+			out, _ := os.ReadFile(logFile)
+			return "", &MountError{Op: "mount", Source: bin, Target: merged, FSType: "fuse-overlayfs", Data: data,
+				Err: fmt.Errorf("fuse-overlayfs exited: %s", bytes.TrimSpace(out))}
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return "", &MountError{Op: "mount", Source: bin, Target: merged, FSType: "fuse-overlayfs", Data: data, Err: unix.ETIMEDOUT}
+		}
+	}
+
+	c.FuseOverlayPid = pid
+	return c.overlayRootFS(), nil
+}
+
+// Unmount unmounts the merged dir by `fusermount -u`, and waits for the
+// daemon to exit (killed after the timeout).
+func (f fuseOverlaySnapshotter) Unmount(c *Container) error {
+	if !f.needsMount(c) {
+		return f.overlaySnapshotter.Unmount(c)
+	}
+
+	merged := c.overlayMergedDir()
+	if mounted, err := isMountPoint(merged); err == nil && mounted {
+		if err := fusermount(merged); err != nil {
+			slog.Error("[host] fuse-overlayfs: error unmounting", "mountpoint", merged, "err", err)
+			return err
+		}
+	}
+
+	if c.FuseOverlayPid != 0 {
+		waitFuseDaemon(c.FuseOverlayPid)
+		c.FuseOverlayPid = 0
+	}
+	return nil
+}
+
+// fusermount unmounts the fuse filesystem: fusermount -u mountpoint.
+func fusermount(mountpoint string) error {
+	var bin string
+	for _, name := range fusermountBinaries {
+		if p, err := exec.LookPath(name); err == nil {
+			bin = p
+			break
+		}
+	}
+	if bin == "" {
+		return &MountError{Op: "umount", Target: mountpoint, Err: fmt.Errorf("no %s in $PATH", strings.Join(fusermountBinaries, " or "))}
+	}
+
+	if out, err := exec.Command(bin, "-u", mountpoint).CombinedOutput(); err != nil {
+		return &MountError{Op: "umount", Target: mountpoint, Err: fmt.Errorf("%s: %w: %s", filepath.Base(bin), err, bytes.TrimSpace(out))}
+	}
+	return nil
+}
+
+// waitFuseDaemon waits for the daemon to exit after unmounted: reaps it
+// if it is a child, or polls it otherwise. Killed after the timeout.
+func waitFuseDaemon(pid int) {
+	for deadline := time.Now().Add(fuseMountTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if exited, _ := reapProcess(pid); exited {
+			return
+		}
+	}
+	slog.Warn("[host] fuse-overlayfs: the daemon does not exit after unmounted, kill it.", "pid", pid)
+	unix.Kill(pid, unix.SIGKILL)
+	reapProcess(pid)
+}
+
+// reapProcess reports whether the process has exited, reaping it if it
+// is a child of this process.
+func reapProcess(pid int) (bool, error) {
+	var ws unix.WaitStatus
+	wpid, err := unix.Wait4(pid, &ws, unix.WNOHANG, nil)
+	switch {
+	case errors.Is(err, unix.ECHILD): // not a child
+		return errors.Is(unix.Kill(pid, 0), unix.ESRCH), nil
+	case err != nil:
+		return false, err
+	}
+	return wpid == pid, nil
+}
+
+// isMountPoint reports whether the dir is a mount point in the mount
+// namespace of this process.
+func isMountPoint(dir string) (bool, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, fmt.Errorf("error reading mountinfo: %w", err)
+	}
+	defer f.Close()
+
+	// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 && unescapeMountInfo(fields[4]) == dir {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// unescapeMountInfo decodes the octal escapes (\040 for a space...) in
+// a path in the mountinfo.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			var c byte
+			if _, err := fmt.Sscanf(s[i+1:i+4], "%03o", &c); err == nil {
+				b.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,124 @@
+package container
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// stubFuseOverlayfs is a fake fuse-overlayfs for the tests: it bind
+// mounts the top lowerdir on the mountpoint instead of a FUSE daemon,
+// and runs until unmounted by the fake fusermount.
+//
+//	fuse-overlayfs -f -o lowerdir=...,upperdir=...,workdir=... mountpoint
+const stubFuseOverlayfs = `#!/bin/sh
+[ "$FAIL" = 1 ] && { echo "stub: failed on purpose" >&2; exit 1; }
+opts="$3"; mountpoint="$4"
+lower="${opts#lowerdir=}"; lower="${lower%%,*}"; lower="${lower%%:*}"
+mount --bind "$lower" "$mountpoint" || exit 1
+while grep -q " $mountpoint " /proc/self/mountinfo; do sleep 0.01; done
+`
+
+const stubFusermount = `#!/bin/sh
+# fusermount -u mountpoint
+umount "$2"
+`
+
+// installStubFuse installs the fake fuse-overlayfs and fusermount into $PATH.
+func installStubFuse(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("root required to bind mount")
+	}
+
+	bin := t.TempDir()
+	os.WriteFile(path.Join(bin, "fuse-overlayfs"), []byte(stubFuseOverlayfs), 0755)
+	os.WriteFile(path.Join(bin, "fusermount"), []byte(stubFusermount), 0755)
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	t.Setenv("FAIL", "")
+
+	orig := fusermountBinaries
+	fusermountBinaries = []string{"fusermount"} // no real fusermount3
+	t.Cleanup(func() { fusermountBinaries = orig })
+}
+
+func TestFuseOverlaySnapshotter(t *testing.T) {
+	installStubFuse(t)
+
+	image := t.TempDir()
+	os.WriteFile(path.Join(image, "hello"), []byte("world"), 0644)
+
+	c := &Container{ID: "fuse-test", WorkDir: t.TempDir(), ImagePath: image, Overlay: true, StorageDriver: StorageDriverFuseOverlay}
+	s := c.snapshotter()
+	if _, ok := s.(fuseOverlaySnapshotter); !ok {
+		t.Fatalf("snapshotter() = %T, want fuseOverlaySnapshotter", s)
+	}
+
+	if err := makeOverlayFS(c); err != nil {
+		t.Fatalf("makeOverlayFS() error = %v", err)
+	}
+	if c.FuseOverlayPid == 0 {
+		t.Errorf("FuseOverlayPid is not set")
+	}
+	pid := c.FuseOverlayPid
+
+	if mounted, err := isMountPoint(c.overlayMergedDir()); err != nil || !mounted {
+		t.Errorf("the merged dir is not mounted: %v, %v", mounted, err)
+	}
+	if got, err := os.ReadFile(path.Join(c.overlayRootFS(), "hello")); err != nil || string(got) != "world" {
+		t.Errorf("rootfs hello = %q, %v", got, err)
+	}
+
+	if err := destroyOverlayFS(c); err != nil {
+		t.Fatalf("destroyOverlayFS() error = %v", err)
+	}
+	if c.FuseOverlayPid != 0 {
+		t.Errorf("FuseOverlayPid = %d after unmounted, want 0", c.FuseOverlayPid)
+	}
+	if err := unix.Kill(pid, 0); !errors.Is(err, unix.ESRCH) {
+		t.Errorf("the daemon %d is still running: %v", pid, err)
+	}
+	if _, err := os.Stat(c.overlayRootDir()); !os.IsNotExist(err) {
+		t.Errorf("the overlay root dir should be removed: %v", err)
+	}
+	if _, err := os.Stat(path.Join(image, "hello")); err != nil {
+		t.Errorf("the image should be kept: %v", err)
+	}
+}
+
+func TestFuseOverlaySnapshotter_daemonFails(t *testing.T) {
+	installStubFuse(t)
+	t.Setenv("FAIL", "1")
+
+	c := &Container{ID: "fuse-fail", WorkDir: t.TempDir(), ImagePath: t.TempDir(), Overlay: true, StorageDriver: StorageDriverFuseOverlay}
+	err := makeOverlayFS(c)
+	var mountErr *MountError
+	if !errors.As(err, &mountErr) || !strings.Contains(err.Error(), "failed on purpose") {
+		t.Errorf("makeOverlayFS() error = %v, want a MountError with the stderr of the daemon", err)
+	}
+	if c.FuseOverlayPid != 0 {
+		t.Errorf("FuseOverlayPid = %d, want 0", c.FuseOverlayPid)
+	}
+	c.snapshotter().Remove(c)
+}
+
+func TestUnescapeMountInfo(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"/mnt/foo", "/mnt/foo"},
+		{`/mnt/foo\040bar`, "/mnt/foo bar"},
+		{`/mnt/a\011b\134c`, "/mnt/a\tb\\c"},
+		{`/mnt/bad\04`, `/mnt/bad\04`},
+	}
+	for _, tt := range tests {
+		if got := unescapeMountInfo(tt.s); got != tt.want {
+			t.Errorf("unescapeMountInfo(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
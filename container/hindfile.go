@@ -0,0 +1,226 @@
+package container
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// This file implements the parser of the Hindfile: the subset of the
+// Dockerfile that Build supports.
+//
+//	# comment
+//	FROM <image>|scratch
+//	RUN <command>                        (run by /bin/sh -c)
+//	RUN ["executable", "arg"...]
+//	COPY <src>... <dest>
+//	COPY ["<src>"..., "<dest>"]
+//	ENV <key>=<value>...
+//	ENV <key> <value>
+//	WORKDIR <path>
+//	USER <user>[:<group>]
+//	ENTRYPOINT <command> | ["executable", "arg"...]
+//	CMD <command> | ["executable", "arg"...]
+//
+// The instructions are case-insensitive. A line ending with "\" is
+// continued by the next one. There is no variable substitution, no
+// flags (e.g. COPY --chown) and a single FROM, the first instruction.
+
+// Instruction is a step of a Hindfile.
+type Instruction struct {
+	Line     int      // the line number in the Hindfile
+	Cmd      string   // the instruction in upper case: FROM, RUN...
+	Args     []string // the arguments. See ParseHindfile.
+	JSON     bool     // the exec form: the Args are a JSON array
+	Original string   // the instruction as written, with the continued lines joined
+}
+
+func (i Instruction) String() string {
+	return i.Original
+}
+
+// ParseHindfile reads the instructions in the Hindfile. The Args are:
+//
+//   - FROM, WORKDIR, USER: the single argument;
+//   - RUN, ENTRYPOINT, CMD: the command line in the shell form, or the
+//     elements of the JSON array in the exec form;
+//   - COPY: the sources and then the dest;
+//   - ENV: the keys and values: key1, value1, key2, value2...
+func ParseHindfile(r io.Reader) ([]Instruction, error) {
+	var instructions []Instruction
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo, start := 0, 0
+	var pending strings.Builder
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") || (line == "" && pending.Len() > 0) {
+			continue // comments and empty lines are skipped, even in a continuation
+		}
+		if pending.Len() == 0 {
+			start = lineNo
+		}
+		if strings.HasSuffix(line, "\\") {
+			pending.WriteString(strings.TrimSuffix(line, "\\"))
+			pending.WriteString(" ")
+			continue
+		}
+		pending.WriteString(line)
+		text := strings.TrimSpace(pending.String())
+		pending.Reset()
+		if text == "" {
+			continue
+		}
+
+		inst, err := parseInstruction(text)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrBadHindfile, start, err)
+		}
+		inst.Line = start
+		instructions = append(instructions, inst)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if pending.Len() > 0 {
+		return nil, fmt.Errorf("%w: line %d: unexpected end of file in a continued line", ErrBadHindfile, start)
+	}
+
+	if len(instructions) == 0 {
+		return nil, fmt.Errorf("%w: no instructions", ErrBadHindfile)
+	}
+	for i, inst := range instructions {
+		if (inst.Cmd == "FROM") != (i == 0) {
+			return nil, fmt.Errorf("%w: line %d: FROM must be the first instruction, and the only one", ErrBadHindfile, inst.Line)
+		}
+	}
+	return instructions, nil
+}
+
+// parseInstruction parses a line (with the continued lines joined).
+func parseInstruction(text string) (Instruction, error) {
+	cmd, rest, _ := strings.Cut(text, " ")
+	inst := Instruction{Cmd: strings.ToUpper(cmd), Original: text}
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return inst, fmt.Errorf("%s requires arguments", inst.Cmd)
+	}
+
+	switch inst.Cmd {
+	case "FROM", "WORKDIR", "USER":
+		inst.Args = []string{rest}
+		if inst.Cmd != "WORKDIR" && strings.ContainsAny(rest, " \t") {
+			return inst, fmt.Errorf("%s requires exactly one argument", inst.Cmd)
+		}
+	case "RUN", "ENTRYPOINT", "CMD":
+		inst.Args, inst.JSON = execForm(rest)
+		if inst.Args == nil {
+			inst.Args = []string{rest}
+		} else if len(inst.Args) == 0 {
+			return inst, fmt.Errorf("%s requires a command", inst.Cmd)
+		}
+	case "COPY":
+		if strings.HasPrefix(rest, "--") {
+			return inst, fmt.Errorf("unsupported flag of COPY: %s", rest)
+		}
+		inst.Args, inst.JSON = execForm(rest)
+		if inst.Args == nil {
+			inst.Args = strings.Fields(rest)
+		}
+		if len(inst.Args) < 2 {
+			return inst, fmt.Errorf("COPY requires at least a source and the dest")
+		}
+	case "ENV":
+		args, err := parseEnvArgs(rest)
+		if err != nil {
+			return inst, err
+		}
+		inst.Args = args
+	default:
+		return inst, fmt.Errorf("unknown instruction %s", inst.Cmd)
+	}
+	return inst, nil
+}
+
+// execForm parses the JSON array of strings. nil if it is not one (the
+// shell form).
+func execForm(s string) ([]string, bool) {
+	if !strings.HasPrefix(s, "[") {
+		return nil, false
+	}
+	args := []string{}
+	if err := json.Unmarshal([]byte(s), &args); err != nil {
+		return nil, false
+	}
+	return args, true
+}
+
+// parseEnvArgs parses "key=value..." (with quotes), or "key value".
+func parseEnvArgs(s string) ([]string, error) {
+	words, err := shellWords(s)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(words[0], "=") { // ENV key value with spaces
+		key, value, _ := strings.Cut(s, " ")
+		return []string{key, strings.TrimSpace(value)}, nil
+	}
+
+	var args []string
+	for _, word := range words {
+		key, value, ok := strings.Cut(word, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("bad ENV %q: expected key=value", word)
+		}
+		args = append(args, key, value)
+	}
+	return args, nil
+}
+
+// shellWords splits the string by the unquoted spaces, as the shell does:
+// "..." and '...' are quoted, and a backslash escapes the next character
+// (except in '...').
+func shellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
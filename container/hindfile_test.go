@@ -0,0 +1,59 @@
+package container
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHindfile(t *testing.T) {
+	hindfile := `# comment
+FROM alpine:3.18
+run apk add \
+    # a comment in a continuation
+    curl
+ENV A=1 B="two words" C=a\ b
+ENV D the rest of the line
+COPY ["a b", "c", "/dst/"]
+COPY x y
+WORKDIR /srv/app
+CMD ["sh", "-c", "echo hi"]
+ENTRYPOINT echo hi
+`
+	got, err := ParseHindfile(strings.NewReader(hindfile))
+	if err != nil {
+		t.Fatalf("ParseHindfile() error = %v", err)
+	}
+	want := []Instruction{
+		{Line: 2, Cmd: "FROM", Args: []string{"alpine:3.18"}, Original: "FROM alpine:3.18"},
+		{Line: 3, Cmd: "RUN", Args: []string{"apk add  curl"}, Original: "run apk add  curl"},
+		{Line: 6, Cmd: "ENV", Args: []string{"A", "1", "B", "two words", "C", "a b"}, Original: `ENV A=1 B="two words" C=a\ b`},
+		{Line: 7, Cmd: "ENV", Args: []string{"D", "the rest of the line"}, Original: "ENV D the rest of the line"},
+		{Line: 8, Cmd: "COPY", Args: []string{"a b", "c", "/dst/"}, JSON: true, Original: `COPY ["a b", "c", "/dst/"]`},
+		{Line: 9, Cmd: "COPY", Args: []string{"x", "y"}, Original: "COPY x y"},
+		{Line: 10, Cmd: "WORKDIR", Args: []string{"/srv/app"}, Original: "WORKDIR /srv/app"},
+		{Line: 11, Cmd: "CMD", Args: []string{"sh", "-c", "echo hi"}, JSON: true, Original: `CMD ["sh", "-c", "echo hi"]`},
+		{Line: 12, Cmd: "ENTRYPOINT", Args: []string{"echo hi"}, Original: "ENTRYPOINT echo hi"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseHindfile() =\n%+v\nwant\n%+v", got, want)
+	}
+
+	for _, bad := range []string{
+		"",
+		"RUN echo hi",
+		"FROM a\nFROM b",
+		"FROM a AS b",
+		"FROM a\nADD x y",
+		"FROM a\nCOPY x",
+		"FROM a\nCOPY --chown=1 x y",
+		"FROM a\nENV A=\"unterminated",
+		"FROM a\nRUN echo \\",
+		"FROM a\nCMD []",
+	} {
+		if _, err := ParseHindfile(strings.NewReader(bad)); !errors.Is(err, ErrBadHindfile) {
+			t.Errorf("ParseHindfile(%q) error = %v, want %v", bad, err, ErrBadHindfile)
+		}
+	}
+}
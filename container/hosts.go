@@ -0,0 +1,153 @@
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"hind/internal/stringid"
+
+	"golang.org/x/exp/slog"
+)
+
+// This file implements the name resolution between containers: each
+// container has a generated hosts file in its state dir, bind mounted
+// to /etc/hosts (see etcfiles.go):
+//
+//	<DataRoot>/containers/<containerID>/hosts
+//
+// It lists the containers on the same networks by name, and the
+// ExtraHosts. The hosts files are rewritten in place (keeping the
+// inode, so the bind mounts see the changes) when a container joins
+// or leaves a network.
+
+// hostsFile is <StateDir>/hosts
+func (c *Container) hostsFile() string {
+	return path.Join(c.StateDir(), "hosts")
+}
+
+// writeHosts generates the hosts file of the container. all is the
+// containers in the store, nil to load them.
+func writeHosts(c *Container, all []*Container) error {
+	if all == nil {
+		var err error
+		if all, err = ListContainers(); err != nil {
+			return err
+		}
+	}
+	content := buildHosts(c, all)
+	if c.Namespaces.Net.IsHost() {
+		content = buildHostNetHosts(c)
+	}
+	if err := os.WriteFile(c.hostsFile(), content, 0644); err != nil {
+		return fmt.Errorf("write hosts: %w", err)
+	}
+	return nil
+}
+
+// updateHosts rewrites the hosts files of the running containers on
+// any of the networks.
+func updateHosts(networks []string) {
+	all, err := ListContainers()
+	if err != nil {
+		slog.Warn("[host] Failed to update hosts files.", "err", err)
+		return
+	}
+	for _, c := range all {
+		if !c.Namespaces.Net.IsPrivate() || !c.IsRunning() {
+			continue
+		}
+		for _, n := range networks {
+			if _, ok := c.NetworkEndpoints[n]; ok {
+				if err := writeHosts(c, all); err != nil {
+					slog.Warn("[host] Failed to update hosts file.", "container", c.ID, "err", err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// HostEntry is a line in /etc/hosts.
+type HostEntry struct {
+	Name string
+	IP   string
+}
+
+// ParseExtraHost parses an --add-host value: name:ip (or name=ip).
+// The ip may be an IPv6 address: the name is before the first colon.
+func ParseExtraHost(s string) (HostEntry, error) {
+	name, ip, ok := strings.Cut(s, "=")
+	if !ok {
+		name, ip, ok = strings.Cut(s, ":")
+	}
+	ip = strings.Trim(ip, "[]")
+	if !ok || name == "" || strings.ContainsAny(name, " \t") || net.ParseIP(ip) == nil {
+		return HostEntry{}, fmt.Errorf("%w: %q: expected name:ip", ErrBadExtraHost, s)
+	}
+	return HostEntry{Name: name, IP: ip}, nil
+}
+
+// buildHosts generates the content of the hosts file of the container c:
+// localhost, c itself, the ExtraHosts, and the running containers on
+// the networks of c.
+func buildHosts(c *Container, all []*Container) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintln(&b, "127.0.0.1\tlocalhost")
+	fmt.Fprintln(&b, "::1\tlocalhost ip6-localhost ip6-loopback")
+
+	names := c.Name
+	if c.Hostname != "" && c.Hostname != c.Name {
+		names = c.Hostname + " " + c.Name
+	}
+	if ip := c.primaryIP(); ip != nil {
+		fmt.Fprintf(&b, "%s\t%s %s\n", ip, names, stringid.TruncateID(c.ID))
+	} else {
+		fmt.Fprintf(&b, "127.0.1.1\t%s %s\n", names, stringid.TruncateID(c.ID))
+	}
+
+	for _, h := range c.ExtraHosts {
+		fmt.Fprintf(&b, "%s\t%s\n", h.IP, h.Name)
+	}
+
+	for _, n := range c.Networks {
+		if _, ok := c.NetworkEndpoints[n]; !ok {
+			continue
+		}
+		fmt.Fprintf(&b, "\n# network %s\n", n)
+		for _, peer := range all {
+			ep, ok := peer.NetworkEndpoints[n]
+			if !ok || peer.ID == c.ID || peer.Status != StatusRunning {
+				continue
+			}
+			fmt.Fprintf(&b, "%s\t%s %s\n", ep.Address.IP, peer.Name, stringid.TruncateID(peer.ID))
+		}
+	}
+
+	return b.Bytes()
+}
+
+// hostHostsFile is the host's hosts file.
+var hostHostsFile = "/etc/hosts"
+
+// buildHostNetHosts is the hosts file of a container in the host's
+// network namespace: the host's one, with the ExtraHosts appended.
+func buildHostNetHosts(c *Container) []byte {
+	data, err := os.ReadFile(hostHostsFile)
+	if err != nil {
+		slog.Warn("[host] Failed to read the host's hosts file.", "err", err)
+	}
+
+	b := bytes.NewBuffer(data)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		b.WriteByte('\n')
+	}
+	for _, h := range c.ExtraHosts {
+		fmt.Fprintf(b, "%s\t%s\n", h.IP, h.Name)
+	}
+	return b.Bytes()
+}
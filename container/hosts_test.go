@@ -0,0 +1,106 @@
+package container
+
+import (
+	"hind/network"
+	"net"
+	"testing"
+)
+
+func TestBuildHosts(t *testing.T) {
+	ep := func(ip string, ifName string) *network.Endpoint {
+		return &network.Endpoint{IfName: ifName, Address: &net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(24, 32)}}
+	}
+
+	web := &Container{
+		ID: "1111111111111111", Name: "web", Status: StatusRunning,
+		Networks: []string{"front", "back"},
+		NetworkEndpoints: map[string]*network.Endpoint{
+			"front": ep("172.30.0.2", "eth0"),
+			"back":  ep("172.30.1.2", "eth1"),
+		},
+	}
+	db := &Container{
+		ID: "2222222222222222", Name: "db", Status: StatusRunning,
+		Networks:         []string{"back"},
+		NetworkEndpoints: map[string]*network.Endpoint{"back": ep("172.30.1.3", "eth0")},
+	}
+	exited := &Container{
+		ID: "3333333333333333", Name: "exited", Status: StatusExited,
+		Networks:         []string{"back"},
+		NetworkEndpoints: map[string]*network.Endpoint{"back": ep("172.30.1.4", "eth0")},
+	}
+	other := &Container{
+		ID: "4444444444444444", Name: "other", Status: StatusRunning,
+		Networks:         []string{"bridge"},
+		NetworkEndpoints: map[string]*network.Endpoint{"bridge": ep("172.29.0.2", "eth0")},
+	}
+	none := &Container{
+		ID: "5555555555555555", Name: "none", Hostname: "box", Networks: []string{"none"},
+		ExtraHosts: []HostEntry{{"db.example.com", "10.0.0.9"}, {"v6", "fd00::1"}},
+	}
+	all := []*Container{web, db, exited, other, none}
+
+	tests := []struct {
+		name string
+		c    *Container
+		want string
+	}{
+		{"web", web, `127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+172.30.0.2	web 111111111111
+
+# network front
+
+# network back
+172.30.1.3	db 222222222222
+`},
+		{"db", db, `127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+172.30.1.3	db 222222222222
+
+# network back
+172.30.1.2	web 111111111111
+`},
+		{"none", none, `127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+127.0.1.1	box none 555555555555
+10.0.0.9	db.example.com
+fd00::1	v6
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(buildHosts(tt.c, all)); got != tt.want {
+				t.Errorf("buildHosts() = \n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExtraHost(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    HostEntry
+		wantErr bool
+	}{
+		{"db:10.0.0.9", HostEntry{"db", "10.0.0.9"}, false},
+		{"db=10.0.0.9", HostEntry{"db", "10.0.0.9"}, false},
+		{"v6:fd00::1", HostEntry{"v6", "fd00::1"}, false},
+		{"v6=[fd00::1]", HostEntry{"v6", "fd00::1"}, false},
+		{"db", HostEntry{}, true},
+		{":10.0.0.9", HostEntry{}, true},
+		{"db:example.com", HostEntry{}, true},
+		{"a b:10.0.0.9", HostEntry{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseExtraHost(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseExtraHost() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseExtraHost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
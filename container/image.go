@@ -0,0 +1,226 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"hind/image"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// ImageStore is the image store in <DataRoot>/images.
+// An image used by a container, running or not, can not be removed.
+func ImageStore() *image.Store {
+	s := image.NewStore(path.Join(DataRoot, "images"))
+	s.InUse = imageInUse
+	return s
+}
+
+// resolveImage finds the image of the container.
+//
+// The ImagePath is used as it is if the path exists (a directory or a tar
+// file). Otherwise, it is looked up in the image store as a reference
+// (name[:tag]) or an image id: the ImagePath is set to the top layer of
+// the image in the store, and the ImageLayers to all the layers, which are
+// stacked directly as the lower dirs of the overlayfs.
+//
+// An image pinned by a digest (IMAGE@sha256:<hex>) must have it: the
+// digest of a tar file, or the id of an image in the store. A directory
+// can not be pinned. The image is verified against the trust policy too,
+// see verifyImageTrust.
+func resolveImage(c *Container) error {
+	if st, err := os.Stat(c.ImagePath); err == nil {
+		return resolveImagePath(c, st, "")
+	}
+
+	ref, pinned, err := image.SplitDigest(c.ImagePath)
+	if err != nil {
+		return err
+	}
+	if st, err := os.Stat(ref); err == nil && pinned != "" {
+		c.ImagePath = ref
+		return resolveImagePath(c, st, pinned)
+	}
+
+	store := ImageStore()
+	img, err := store.Get(ref)
+	if errors.Is(err, image.ErrNoSuchImage) {
+		return fmt.Errorf("%w: %s is neither a path nor an image in the store", image.ErrNoSuchImage, c.ImagePath)
+	} else if err != nil {
+		return err
+	}
+	if pinned != "" && img.ID != pinned {
+		return fmt.Errorf("%w: image %s is %s, not %s", image.ErrDigestMismatch, ref, img.ID, pinned)
+	}
+	if err := store.Verify(img); err != nil {
+		return err
+	}
+	if err := verifyImageTrust(img.ID, storeImageNames(ref, img)...); err != nil {
+		return err
+	}
+
+	if !c.Overlay && !c.ReadOnly {
+		return fmt.Errorf("%w: --no-overlay would modify the image %s in the store, try --read-only", image.ErrBadImage, c.ImagePath)
+	}
+
+	dirs := store.LowerDirs(img)
+	if len(dirs) == 0 {
+		return fmt.Errorf("%w: image %s has no layers", image.ErrBadImage, c.ImagePath)
+	}
+	if len(dirs) > 1 && !c.Overlay {
+		slog.Warn("[host] image has more than one layers. OverlayFS is forced on.", "image", c.ImagePath, "layers", len(dirs))
+		c.Overlay = true
+	}
+
+	c.Image = img.ID
+	c.ImageConfig = img.Config
+	c.ImagePath = dirs[0]
+	if len(dirs) > 1 {
+		c.ImageLayers = dirs
+	}
+	return nil
+}
+
+// resolveImagePath verifies the image at the ImagePath: a tar file is
+// hashed (before extracted) if it is pinned by the digest, or required to
+// be signed by the trust policy. The ImageDigest is set to its digest.
+func resolveImagePath(c *Container, st os.FileInfo, pinned string) error {
+	names, err := pathImageNames(c.ImagePath)
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		if pinned != "" {
+			return fmt.Errorf("%w: the directory %s can not be pinned by a digest, only a tar file or an image in the store", image.ErrBadImage, c.ImagePath)
+		}
+		return verifyImageTrust("", names...)
+	}
+
+	policy, err := TrustStore().Policy()
+	if err != nil {
+		return err
+	}
+	if pinned == "" && !policy.MatchAny(names...) {
+		return nil
+	}
+
+	slog.Info("[host] verifying the digest of the image.", "imagePath", c.ImagePath)
+	digest, err := image.DigestFile(c.ImagePath)
+	if err != nil {
+		return err
+	}
+	if pinned != "" && digest != pinned {
+		return fmt.Errorf("%w: image %s is %s, not %s", image.ErrDigestMismatch, c.ImagePath, digest, pinned)
+	}
+	if err := verifyImageTrust(digest, names...); err != nil {
+		return err
+	}
+	c.ImageDigest = digest
+	return nil
+}
+
+// pathImageNames are the names the image at the path is known by, for the
+// trust policy: the absolute path, and the reference the path reads as. A
+// local file named as a reference (e.g. prod/app:v1) takes the precedence
+// over the image in the store, but not over the policy of the name.
+func pathImageNames(imagePath string) ([]string, error) {
+	abs, err := filepath.Abs(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{abs}
+	if ref, err := image.ParseReference(imagePath); err == nil {
+		names = append(names, ref.String())
+	}
+	return names, nil
+}
+
+// storeImageNames are the names the image in the store is known by, for
+// the trust policy: the reference used, and all the references to it. An
+// image can not escape the policy by its id or another name.
+func storeImageNames(used string, img *image.Image) []string {
+	var names []string
+	if ref, err := image.ParseReference(used); err == nil {
+		names = append(names, ref.String())
+	}
+	return append(names, img.RepoTags...)
+}
+
+// applyImageConfig merges the defaults in the ImageConfig into the container:
+//
+//   - Command: the Entrypoint followed by the Command, or by the Cmd if
+//     no Command is given. A container Entrypoint overrides the image's,
+//     and drops the Cmd of the image, as docker does.
+//   - Env: the Env of the image, overridden by the container's.
+//   - WorkingDir, User: the image's, if not set.
+func applyImageConfig(c *Container) {
+	config := c.ImageConfig
+	if config == nil {
+		config = &image.Config{}
+	}
+
+	entrypoint, cmd := config.Entrypoint, config.Cmd
+	if c.Entrypoint != nil {
+		entrypoint, cmd = c.Entrypoint, nil
+	}
+	if len(c.Command) > 0 {
+		cmd = c.Command
+	}
+	c.Command = append(append([]string{}, entrypoint...), cmd...)
+	c.Entrypoint = nil // merged
+
+	c.Env = mergeEnv(config.Env, c.Env)
+	if c.WorkingDir == "" {
+		c.WorkingDir = config.WorkingDir
+	}
+	if c.User == "" {
+		c.User = config.User
+	}
+}
+
+// mergeEnv returns the KEY=VALUE pairs in the base, overridden (or
+// appended) by the ones in the overrides. A KEY without "=" in the
+// overrides is ignored.
+func mergeEnv(base []string, overrides []string) []string {
+	merged := append([]string{}, base...)
+	index := map[string]int{}
+	for i, kv := range merged {
+		index[envKey(kv)] = i
+	}
+	for _, kv := range overrides {
+		if !strings.Contains(kv, "=") {
+			continue
+		}
+		if i, ok := index[envKey(kv)]; ok {
+			merged[i] = kv
+			continue
+		}
+		index[envKey(kv)] = len(merged)
+		merged = append(merged, kv)
+	}
+	return merged
+}
+
+func envKey(kv string) string {
+	key, _, _ := strings.Cut(kv, "=")
+	return key
+}
+
+// imageInUse reports whether a container uses the image: the layers
+// are the lower dirs of its rootfs, kept after it exits.
+func imageInUse(id string) bool {
+	containers, err := ListContainers()
+	if err != nil {
+		return true // be safe
+	}
+	for _, c := range containers {
+		if c.Image == id {
+			return true
+		}
+	}
+	return false
+}
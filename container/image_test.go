@@ -0,0 +1,218 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"hind/image"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveImage(t *testing.T) {
+	DataRoot = t.TempDir()
+	defer func() { DataRoot = DefaultDataRoot }()
+
+	rootfs := t.TempDir()
+	archive := path.Join(t.TempDir(), "rootfs.tar")
+	if out, err := exec.Command("tar", "-cf", archive, "-C", rootfs, ".").CombinedOutput(); err != nil {
+		t.Fatalf("tar: %v: %s", err, out)
+	}
+	img, err := ImageStore().Import(archive, "foo:v1")
+	if err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	otherDigest := "sha256:" + strings.Repeat("0", 64)
+
+	tests := []struct {
+		name          string
+		container     Container
+		wantImagePath string
+		wantImage     string
+		wantErrIs     error
+	}{
+		{"dir", Container{ImagePath: rootfs, Overlay: true}, rootfs, "", nil},
+		{"tar", Container{ImagePath: archive, Overlay: true}, archive, "", nil},
+		{"ref", Container{ImagePath: "foo:v1", Overlay: true}, ImageStore().LowerDirs(img)[0], img.ID, nil},
+		{"id", Container{ImagePath: img.ID, ReadOnly: true}, ImageStore().LowerDirs(img)[0], img.ID, nil},
+		{"no_overlay", Container{ImagePath: "foo:v1"}, "", "", image.ErrBadImage},
+		{"not_found", Container{ImagePath: "foo:v2", Overlay: true}, "", "", image.ErrNoSuchImage},
+		{"tar_pinned", Container{ImagePath: archive + "@" + img.ID, Overlay: true}, archive, "", nil},
+		{"tar_pin_mismatch", Container{ImagePath: archive + "@" + otherDigest, Overlay: true}, "", "", image.ErrDigestMismatch},
+		{"dir_pinned", Container{ImagePath: rootfs + "@" + img.ID, Overlay: true}, "", "", image.ErrBadImage},
+		{"ref_pinned", Container{ImagePath: "foo:v1@" + img.ID, Overlay: true}, ImageStore().LowerDirs(img)[0], img.ID, nil},
+		{"ref_pin_mismatch", Container{ImagePath: "foo:v1@" + otherDigest, Overlay: true}, "", "", image.ErrDigestMismatch},
+		{"bad_digest", Container{ImagePath: "foo:v1@sha256:abc", Overlay: true}, "", "", image.ErrBadReference},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.container
+			err := resolveImage(&c)
+			if tt.wantErrIs != nil {
+				if !errors.Is(err, tt.wantErrIs) {
+					t.Errorf("resolveImage() error = %v, want %v", err, tt.wantErrIs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveImage() error = %v", err)
+			}
+			if c.ImagePath != tt.wantImagePath || c.Image != tt.wantImage {
+				t.Errorf("resolveImage() = (%q, %q), want (%q, %q)", c.ImagePath, c.Image, tt.wantImagePath, tt.wantImage)
+			}
+		})
+	}
+}
+
+func TestResolveImage_trust(t *testing.T) {
+	DataRoot = t.TempDir()
+	defer func() { DataRoot = DefaultDataRoot }()
+
+	rootfs := t.TempDir()
+	archive := path.Join(t.TempDir(), "rootfs.tar")
+	if out, err := exec.Command("tar", "-cf", archive, "-C", rootfs, ".").CombinedOutput(); err != nil {
+		t.Fatalf("tar: %v: %s", err, out)
+	}
+	img, err := ImageStore().Import(archive, "prod/foo:v1", "dev/foo:v1")
+	if err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	policy := fmt.Sprintf(`{"rules": [{"prefix": "prod/"}, {"prefix": %q}]}`, rootfs)
+	if err := os.MkdirAll(TrustStore().Root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(TrustStore().Root, "policy.json"), []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := func(imagePath string) error {
+		return resolveImage(&Container{ImagePath: imagePath, Overlay: true})
+	}
+	for _, imagePath := range []string{"prod/foo:v1", "dev/foo:v1", img.ID, rootfs} {
+		if err := resolve(imagePath); !errors.Is(err, image.ErrNotSigned) && !errors.Is(err, image.ErrUntrusted) {
+			t.Errorf("resolveImage(%s) unsigned error = %v, want %v", imagePath, err, image.ErrNotSigned)
+		}
+	}
+	if err := resolve(archive); err != nil {
+		t.Errorf("resolveImage(%s) not required to be signed error = %v", archive, err)
+	}
+
+	// a local file named as the reference: the policy of the name applies
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	os.Chdir(t.TempDir())
+	os.MkdirAll("prod", 0755)
+	os.Link(archive, "prod/foo:v1")
+	if err := resolve("prod/foo:v1"); !errors.Is(err, image.ErrNotSigned) {
+		t.Errorf("resolveImage(prod/foo:v1) a local file error = %v, want %v", err, image.ErrNotSigned)
+	}
+
+	if _, err := TrustStore().GenerateKey("release"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TrustStore().Sign(img.ID, "release"); err != nil {
+		t.Fatal(err)
+	}
+	for _, imagePath := range []string{"prod/foo:v1", "dev/foo:v1", img.ID, "./prod/foo:v1"} {
+		if err := resolve(imagePath); err != nil {
+			t.Errorf("resolveImage(%s) signed error = %v", imagePath, err)
+		}
+	}
+	if err := resolve(rootfs); !errors.Is(err, image.ErrUntrusted) {
+		t.Errorf("resolveImage(%s) a directory error = %v, want %v", rootfs, err, image.ErrUntrusted)
+	}
+}
+
+func TestApplyImageConfig(t *testing.T) {
+	config := &image.Config{
+		Entrypoint: []string{"/entrypoint.sh"},
+		Cmd:        []string{"serve"},
+		Env:        []string{"PATH=/usr/bin:/bin", "FOO=image"},
+		WorkingDir: "/app",
+		User:       "app",
+	}
+
+	tests := []struct {
+		name      string
+		container Container
+		want      Container
+	}{
+		{
+			"defaults",
+			Container{ImageConfig: config},
+			Container{Command: []string{"/entrypoint.sh", "serve"}, Env: []string{"PATH=/usr/bin:/bin", "FOO=image"}, WorkingDir: "/app", User: "app"},
+		},
+		{
+			"args to the entrypoint",
+			Container{ImageConfig: config, Command: []string{"migrate", "-v"}},
+			Container{Command: []string{"/entrypoint.sh", "migrate", "-v"}, Env: []string{"PATH=/usr/bin:/bin", "FOO=image"}, WorkingDir: "/app", User: "app"},
+		},
+		{
+			"entrypoint override drops the cmd",
+			Container{ImageConfig: config, Entrypoint: []string{"/bin/sh"}},
+			Container{Command: []string{"/bin/sh"}, Env: []string{"PATH=/usr/bin:/bin", "FOO=image"}, WorkingDir: "/app", User: "app"},
+		},
+		{
+			"entrypoint reset",
+			Container{ImageConfig: config, Entrypoint: []string{}, Command: []string{"ls"}},
+			Container{Command: []string{"ls"}, Env: []string{"PATH=/usr/bin:/bin", "FOO=image"}, WorkingDir: "/app", User: "app"},
+		},
+		{
+			"overrides",
+			Container{ImageConfig: config, Env: []string{"FOO=cli", "BAR=1"}, WorkingDir: "/tmp", User: "0:0"},
+			Container{Command: []string{"/entrypoint.sh", "serve"}, Env: []string{"PATH=/usr/bin:/bin", "FOO=cli", "BAR=1"}, WorkingDir: "/tmp", User: "0:0"},
+		},
+		{
+			"no image config",
+			Container{Command: []string{"sh"}, Env: []string{"FOO=cli"}},
+			Container{Command: []string{"sh"}, Env: []string{"FOO=cli"}},
+		},
+		{
+			"no command",
+			Container{},
+			Container{Command: []string{}, Env: []string{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.container
+			applyImageConfig(&c)
+			c.ImageConfig = nil
+			if !reflect.DeepEqual(c, tt.want) {
+				t.Errorf("applyImageConfig() = %+v, want %+v", c, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractImage_digest(t *testing.T) {
+	rootfs := t.TempDir()
+	archive := path.Join(t.TempDir(), "rootfs.tar")
+	if out, err := exec.Command("tar", "-cf", archive, "-C", rootfs, ".").CombinedOutput(); err != nil {
+		t.Fatalf("tar: %v: %s", err, out)
+	}
+	digest, err := image.DigestFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := extractImage(archive, digest, path.Join(t.TempDir(), "lower")); err != nil {
+		t.Errorf("extractImage() error = %v", err)
+	}
+
+	// replaced after the verification
+	os.WriteFile(path.Join(rootfs, "evil"), []byte("x"), 0644)
+	if out, err := exec.Command("tar", "-cf", archive, "-C", rootfs, ".").CombinedOutput(); err != nil {
+		t.Fatalf("tar: %v: %s", err, out)
+	}
+	target := path.Join(t.TempDir(), "lower")
+	if err := extractImage(archive, digest, target); !errors.Is(err, image.ErrDigestMismatch) {
+		t.Errorf("extractImage() of a replaced archive error = %v, want %v", err, image.ErrDigestMismatch)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("the replaced archive is left extracted: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"hind/image"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/sys/unix"
+)
+
+// Mount is a filesystem mounted by pid 1 after the pivot_root.
+//
+// Target is a path inside the container. Source is the device or
+// the file system name (e.g. "tmpfs") passed to mount(2).
+type Mount struct {
+	Source string
+	Target string
+	Type   string
+	Flags  uintptr
+	Data   string
+}
+
+// defaultTmpfsFlags follows docker: tmpfs mounts are noexec, nosuid and nodev.
+const defaultTmpfsFlags = syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV
+
+// mountFlagOptions are the tmpfs options converted to mount flags.
+// Options that are not listed here are passed as data to mount(2).
+var mountFlagOptions = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"ro":       {false, syscall.MS_RDONLY},
+	"rw":       {true, syscall.MS_RDONLY},
+	"noexec":   {false, syscall.MS_NOEXEC},
+	"exec":     {true, syscall.MS_NOEXEC},
+	"nosuid":   {false, syscall.MS_NOSUID},
+	"suid":     {true, syscall.MS_NOSUID},
+	"nodev":    {false, syscall.MS_NODEV},
+	"dev":      {true, syscall.MS_NODEV},
+	"noatime":  {false, syscall.MS_NOATIME},
+	"atime":    {true, syscall.MS_NOATIME},
+	"relatime": {false, syscall.MS_RELATIME},
+}
+
+// ParseTmpfs parses a tmpfs mount in the docker format:
+//
+//	<container path>[:<options>]
+//
+// e.g. "/run:size=64m,mode=755,exec". The options are comma separated.
+func ParseTmpfs(s string) (Mount, error) {
+	target, options, _ := strings.Cut(s, ":")
+	if !path.IsAbs(target) {
+		return Mount{}, fmt.Errorf("%w: tmpfs target %q is not an absolute path", ErrBadMount, target)
+	}
+
+	m := Mount{
+		Source: "tmpfs",
+		Target: path.Clean(target),
+		Type:   "tmpfs",
+		Flags:  defaultTmpfsFlags,
+	}
+
+	var data []string
+	for _, opt := range strings.Split(options, ",") {
+		if opt == "" {
+			continue
+		}
+		if f, ok := mountFlagOptions[opt]; ok {
+			if f.clear {
+				m.Flags &^= f.flag
+			} else {
+				m.Flags |= f.flag
+			}
+			continue
+		}
+		data = append(data, opt)
+	}
+	m.Data = strings.Join(data, ",")
+
+	return m, nil
+}
+
+// mountAll mounts the mounts in order.
+//
+// The mount points must exist if mkdir is false. Otherwise, they are
+// created. (It is false in a read-only rootfs: we would not like to
+// write anything into the image.)
+//
+// This function is executed in the container (by pid 1), after the pivot_root.
+func mountAll(mounts []Mount, mkdir bool) error {
+	for _, m := range mounts {
+		if _, err := os.Stat(m.Target); os.IsNotExist(err) {
+			if !mkdir {
+				return fmt.Errorf("%w: mount point %s does not exist in the read-only rootfs", ErrBadMount, m.Target)
+			}
+			if err := os.MkdirAll(m.Target, 0755); err != nil {
+				return fmt.Errorf("mkdir mount point %s: %w", m.Target, err)
+			}
+		}
+
+		if err := syscall.Mount(m.Source, m.Target, m.Type, m.Flags, m.Data); err != nil {
+			return fmt.Errorf("mount %s (%s) on %s: %w", m.Source, m.Type, m.Target, err)
+		}
+		slog.Info("[container] pid 1 mounted.", "target", m.Target, "type", m.Type, "data", m.Data)
+	}
+	return nil
+}
+
+// bindMountAll bind mounts the host files (m.Source) onto the targets
+// in the rootDir.
+//
+// A target is resolved in the rootDir (see openInRoot): a symlink in the
+// image, e.g. /etc/resolv.conf -> ../run/systemd/resolve/stub-resolv.conf,
+// is followed as if the rootDir were "/", and never out of it. A missing
+// target is created as an empty file (and its parents) if mkdir is true.
+// Otherwise (a read-only rootfs), the mount is skipped with a warning.
+//
+// This function is executed in the container (by pid 1), before the pivot_root,
+// so the bind mounts are carried into the new root.
+func bindMountAll(rootDir string, mounts []Mount, mkdir bool) error {
+	for _, m := range mounts {
+		target, err := openInRoot(rootDir, m.Target, mkdir)
+		if errors.Is(err, os.ErrNotExist) && !mkdir {
+			slog.Warn("[container] pid 1 skipped bind mount: mount point does not exist in the read-only rootfs.", "target", m.Target)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("mount point %s: %w", m.Target, err)
+		}
+
+		// mount onto the file opened in the root, not the path
+		err = syscall.Mount(m.Source, image.ProcFdPath(target), "", m.Flags|syscall.MS_BIND, "")
+		unix.Close(target)
+		if err != nil {
+			return fmt.Errorf("bind mount %s on %s: %w", m.Source, m.Target, err)
+		}
+		slog.Info("[container] pid 1 bind mounted.", "source", m.Source, "target", m.Target)
+	}
+	return nil
+}
+
+// openInRoot opens the file of the path p in the root with O_PATH,
+// resolved in the root (see image.OpenInRoot): the file opened is never
+// out of the root.
+//
+// If create, a missing file (maybe the target of a dangling symlink) is
+// created as an empty file, with the missing parent dirs (see
+// image.MkdirAllInRoot), never following a symlink.
+func openInRoot(root string, p string, create bool) (int, error) {
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	defer unix.Close(rootFd)
+
+	fd, err := image.OpenInRoot(rootFd, p, 0)
+	if err == nil || !errors.Is(err, unix.ENOENT) || !create {
+		return fd, err
+	}
+
+	resolved, err := image.FollowInRoot(root, p)
+	if err != nil {
+		return -1, err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == "." {
+		return -1, fmt.Errorf("%s is the root", p)
+	}
+	dirFd, err := image.MkdirAllInRoot(rootFd, path.Dir(rel))
+	if err != nil {
+		return -1, err
+	}
+	defer unix.Close(dirFd)
+
+	base := path.Base(rel)
+	f, err := unix.Openat(dirFd, base, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0644)
+	if err != nil {
+		return -1, fmt.Errorf("create %s: %w", rel, err)
+	}
+	unix.Close(f)
+	return unix.Openat(dirFd, base, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+}
+
+// remountRootReadOnly makes / read-only.
+//
+// The / is a bind mount (made by pivotRoot), so it can be remounted
+// with MS_BIND without touching the other mounts (/proc, tmpfs...).
+//
+// This function is executed in the container (by pid 1), after the pivot_root.
+func remountRootReadOnly() error {
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	if err := syscall.Mount("", "/", "", flags, ""); err != nil {
+		return fmt.Errorf("remount / read-only: %w", err)
+	}
+	return nil
+}
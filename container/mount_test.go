@@ -0,0 +1,131 @@
+package container
+
+import (
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseTmpfs(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    Mount
+		wantErr bool
+	}{
+		{"no_options", "/tmp", Mount{Source: "tmpfs", Target: "/tmp", Type: "tmpfs", Flags: defaultTmpfsFlags}, false},
+		{"data_options", "/run:size=64m,mode=755", Mount{Source: "tmpfs", Target: "/run", Type: "tmpfs", Flags: defaultTmpfsFlags, Data: "size=64m,mode=755"}, false},
+		{"flag_options", "/run/:exec,ro", Mount{Source: "tmpfs", Target: "/run", Type: "tmpfs", Flags: syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_RDONLY}, false},
+		{"relative", "tmp:size=1m", Mount{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTmpfs(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseTmpfs() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseTmpfs() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenInRoot(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string // see makeDirTree
+		target   string
+		create   bool
+		wantFile string // the file opened, relative to the root. "" for an error.
+	}{
+		{"exists", map[string]string{"etc/hosts": "x"}, "/etc/hosts", false, "etc/hosts"},
+		{"missing", map[string]string{"etc/": ""}, "/etc/hosts", false, ""},
+		{"create", map[string]string{}, "/etc/hosts", true, "etc/hosts"},
+		{"symlink", map[string]string{"etc/resolv.conf": "->../run/resolv.conf", "run/resolv.conf": "x"}, "/etc/resolv.conf", false, "run/resolv.conf"},
+		{"dangling_symlink", map[string]string{"etc/resolv.conf": "->../run/systemd/resolve/stub-resolv.conf"}, "/etc/resolv.conf", true, "run/systemd/resolve/stub-resolv.conf"},
+		{"absolute_parent", map[string]string{"etc": "->/outside"}, "/etc/hosts", true, "outside/hosts"},
+		{"relative_parent_out", map[string]string{"etc": "->../../../../outside"}, "/etc/hosts", true, "outside/hosts"},
+		{"absolute_target", map[string]string{"etc/hosts": "->/outside/hosts"}, "/etc/hosts", true, "outside/hosts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			root := path.Join(parent, "rootfs")
+			if err := os.Mkdir(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+			makeDirTree(t, root, tt.files)
+
+			fd, err := openInRoot(root, tt.target, tt.create)
+			if tt.wantFile == "" {
+				if !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("openInRoot() error = %v, want %v", err, os.ErrNotExist)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("openInRoot() error = %v", err)
+			}
+			defer unix.Close(fd)
+
+			var got, want unix.Stat_t
+			if err := unix.Fstat(fd, &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := unix.Lstat(path.Join(root, tt.wantFile), &want); err != nil {
+				t.Fatalf("%s is not in the root: %v", tt.wantFile, err)
+			}
+			if got.Ino != want.Ino || got.Mode&unix.S_IFMT != unix.S_IFREG {
+				t.Errorf("openInRoot() opened inode %d (mode %o), want %s (inode %d)", got.Ino, got.Mode, tt.wantFile, want.Ino)
+			}
+			if entries, _ := os.ReadDir(parent); len(entries) != 1 {
+				t.Errorf("files are created out of the root: %v", entries)
+			}
+		})
+	}
+}
+
+func TestBindMountAll_symlink(t *testing.T) {
+	root := path.Join(t.TempDir(), "rootfs")
+	makeDirTree(t, root, map[string]string{
+		"etc/resolv.conf": "->../run/systemd/resolve/stub-resolv.conf",
+		"etc/hosts":       "->/outside/hosts",
+	})
+	source := path.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(source, []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts := []Mount{
+		{Source: source, Target: "/etc/resolv.conf", Type: "bind", Flags: syscall.MS_BIND},
+		{Source: source, Target: "/etc/hosts", Type: "bind", Flags: syscall.MS_BIND},
+	}
+	if err := bindMountAll(root, mounts, true); err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			t.Skipf("bind mount not permitted: %v", err)
+		}
+		t.Fatalf("bindMountAll() error = %v", err)
+	}
+	for _, target := range []string{"run/systemd/resolve/stub-resolv.conf", "outside/hosts"} {
+		defer unix.Unmount(path.Join(root, target), unix.MNT_DETACH)
+	}
+
+	// the symlink is kept, and resolves to the bind mounted file
+	got, err := os.ReadFile(path.Join(root, "run/systemd/resolve/stub-resolv.conf"))
+	if err != nil || string(got) != "nameserver 10.0.0.1\n" {
+		t.Errorf("the target of /etc/resolv.conf = %q, %v", got, err)
+	}
+	if got, err := os.ReadFile(path.Join(root, "outside/hosts")); err != nil || string(got) != "nameserver 10.0.0.1\n" {
+		t.Errorf("the target of /etc/hosts = %q, %v", got, err)
+	}
+	if _, err := os.Lstat("/outside"); err == nil {
+		t.Errorf("/outside is created on the host")
+	}
+}
@@ -0,0 +1,400 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"hind/cgroups"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/sys/unix"
+)
+
+// This file implements the namespaces configuration of containers.
+//
+// By default, NewParentProcess creates new namespaces with the
+// Cloneflags. Namespaces can also be shared with the host (no
+// clone flag) or joined from another container (setns(2) before
+// the container process is started). See Namespaces.
+//
+// Some namespaces can not be simply created by the Cloneflags:
+//
+//   - cgroup namespace: the root of a cgroup namespace is the cgroup
+//     of the process at the time the namespace is created. But the
+//     container process is moved into its cgroup (by setupCgroup)
+//     after it is started. So the pid 1 unshares the cgroup namespace
+//     itself, after the host has applied the cgroup.
+//   - time namespace: the offsets of a time namespace can only be
+//     written before any process enters it, and the process that
+//     unshares CLONE_NEWTIME does not enter it, its children do.
+//     So the host unshares it, writes the offsets and then starts
+//     the container process as a child.
+
+// -- namespace modes --
+
+// NamespaceMode is how a container gets a namespace:
+//
+//	private (or ""): a new namespace, the default
+//	host: share the namespace of the host
+//	container:<id|name>: join the namespace of another running container
+//	pod:<id>: join the namespace of a running pod (set by joinPod)
+type NamespaceMode string
+
+const (
+	NamespacePrivate NamespaceMode = "private"
+	NamespaceHost    NamespaceMode = "host"
+
+	namespaceContainerPrefix = "container:"
+	namespacePodPrefix       = "pod:"
+)
+
+// ParseNamespaceMode parses and validates a NamespaceMode.
+func ParseNamespaceMode(s string) (NamespaceMode, error) {
+	m := NamespaceMode(s)
+	switch {
+	case m == "" || m == NamespacePrivate:
+		return NamespacePrivate, nil
+	case m == NamespaceHost:
+		return m, nil
+	case strings.HasPrefix(s, namespaceContainerPrefix) && m.Container() != "":
+		return m, nil
+	}
+	return "", fmt.Errorf("%w: %q (expected private, host or container:<id|name>)", ErrBadNamespaceMode, s)
+}
+
+func (m NamespaceMode) IsPrivate() bool {
+	return m == "" || m == NamespacePrivate
+}
+
+func (m NamespaceMode) IsHost() bool {
+	return m == NamespaceHost
+}
+
+// Container returns the container id or name to join.
+// Or "" if the mode is not container:<id|name>.
+func (m NamespaceMode) Container() string {
+	if !strings.HasPrefix(string(m), namespaceContainerPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(string(m), namespaceContainerPrefix)
+}
+
+// Pod returns the pod id to join.
+// Or "" if the mode is not pod:<id>.
+func (m NamespaceMode) Pod() string {
+	if !strings.HasPrefix(string(m), namespacePodPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(string(m), namespacePodPrefix)
+}
+
+// Namespaces are the modes of the namespaces that can be shared.
+// The zero value means all private.
+//
+// The mount namespace is always private.
+type Namespaces struct {
+	Net NamespaceMode
+	Pid NamespaceMode
+	Ipc NamespaceMode
+	Uts NamespaceMode
+}
+
+// namespaceEntry is a namespace type with the mode for it.
+type namespaceEntry struct {
+	name string  // the name in /proc/<pid>/ns/<name>
+	flag uintptr // CLONE_NEW*
+	mode NamespaceMode
+}
+
+func (n Namespaces) entries() []namespaceEntry {
+	return []namespaceEntry{
+		{"net", syscall.CLONE_NEWNET, n.Net},
+		{"pid", syscall.CLONE_NEWPID, n.Pid},
+		{"ipc", syscall.CLONE_NEWIPC, n.Ipc},
+		{"uts", syscall.CLONE_NEWUTS, n.Uts},
+	}
+}
+
+// cloneflags returns the Cloneflags for NewParentProcess:
+// CLONE_NEWNS and the flags of the private namespaces.
+func (n Namespaces) cloneflags() uintptr {
+	flags := uintptr(syscall.CLONE_NEWNS)
+	for _, e := range n.entries() {
+		if e.mode.IsPrivate() {
+			flags |= e.flag
+		}
+	}
+	return flags
+}
+
+// namespaceJoin is a namespace to setns(2) into.
+type namespaceJoin struct {
+	path string // /proc/<pid>/ns/<name>
+	flag uintptr
+}
+
+// namespaceJoins resolves the container:<id|name> (and pod:<id>) modes
+// to the namespace files of the running containers (and pod infra
+// processes), with the state store.
+func (n Namespaces) namespaceJoins() ([]namespaceJoin, error) {
+	var joins []namespaceJoin
+	for _, e := range n.entries() {
+		pid, err := e.mode.holderPid()
+		if err != nil {
+			return nil, fmt.Errorf("join %s namespace: %w", e.name, err)
+		}
+		if pid == 0 {
+			continue
+		}
+
+		joins = append(joins, namespaceJoin{
+			path: path.Join("/proc", strconv.Itoa(pid), "ns", e.name),
+			flag: e.flag,
+		})
+	}
+	return joins, nil
+}
+
+// holderPid returns the pid of the process holding the namespace to join:
+// the running container or the infra process of the running pod.
+// Or 0 if there is nothing to join.
+func (m NamespaceMode) holderPid() (int, error) {
+	if target := m.Container(); target != "" {
+		c, err := LoadContainer(target)
+		if err != nil {
+			return 0, err
+		}
+		if !c.IsRunning() {
+			return 0, fmt.Errorf("%w: %s", ErrContainerNotRunning, target)
+		}
+		return c.Pid, nil
+	}
+
+	if target := m.Pod(); target != "" {
+		p, err := LoadPod(target)
+		if err != nil {
+			return 0, err
+		}
+		if !p.IsRunning() {
+			return 0, fmt.Errorf("%w: %s", ErrPodNotRunning, target)
+		}
+		return p.InfraPid, nil
+	}
+
+	return 0, nil
+}
+
+// setns joins the namespaces. The calling thread must be locked.
+func setns(joins []namespaceJoin) error {
+	for _, j := range joins {
+		f, err := os.Open(j.path)
+		if err != nil {
+			return fmt.Errorf("setns: %w", err)
+		}
+		err = unix.Setns(int(f.Fd()), int(j.flag))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("setns %s: %w", j.path, err)
+		}
+		slog.Info("[host] joined namespace.", "ns", j.path)
+	}
+	return nil
+}
+
+// -- time namespace --
+
+// TimeOffsets are the clock offsets of a time namespace.
+// See time_namespaces(7).
+type TimeOffsets struct {
+	Monotonic time.Duration // CLOCK_MONOTONIC
+	Boottime  time.Duration // CLOCK_BOOTTIME
+}
+
+// String formats the offsets in the /proc/<pid>/timens_offsets format:
+//
+//	monotonic <secs> <nanosecs>
+//	boottime  <secs> <nanosecs>
+func (o TimeOffsets) String() string {
+	return timensOffsetLine("monotonic", o.Monotonic) + timensOffsetLine("boottime", o.Boottime)
+}
+
+// timensOffsetLine formats a line of timens_offsets.
+// The nanosecs must be in [0, 999999999], even for a negative offset.
+func timensOffsetLine(clock string, d time.Duration) string {
+	secs := int64(d / time.Second)
+	nsecs := int64(d % time.Second)
+	if nsecs < 0 {
+		secs -= 1
+		nsecs += int64(time.Second)
+	}
+	return fmt.Sprintf("%s %d %d\n", clock, secs, nsecs)
+}
+
+// startParentProcess starts the container process (cmd from NewParentProcess).
+//
+// The process joins the namespaces of other containers, as the
+// container.Namespaces requires. And if container.TimeOffsets is set,
+// it is started in a new time namespace.
+//
+// This function is executed in the host.
+func startParentProcess(container *Container, cmd *exec.Cmd) error {
+	joins, err := container.Namespaces.namespaceJoins()
+	if err != nil {
+		return err
+	}
+
+	if len(joins) == 0 && container.TimeOffsets == nil {
+		return cmd.Start()
+	}
+
+	errCh := make(chan error)
+	go func() {
+		// setns(2) and unshare(CLONE_NEWTIME) only affect the calling
+		// thread, so lock the goroutine to the thread and fork the
+		// container process from it.
+		//
+		// The thread is never unlocked: it is dirty now. Go terminates
+		// a locked thread when its goroutine exits.
+		runtime.LockOSThread()
+
+		if err := setns(joins); err != nil {
+			errCh <- err
+			return
+		}
+		if container.TimeOffsets != nil {
+			if err := unshareTimeNamespace(*container.TimeOffsets); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- cmd.Start()
+	}()
+	return <-errCh
+}
+
+// unshareTimeNamespace must be called with the goroutine locked to its thread.
+func unshareTimeNamespace(offsets TimeOffsets) error {
+	if err := unix.Unshare(unix.CLONE_NEWTIME); err != nil {
+		return fmt.Errorf("unshare(CLONE_NEWTIME): %w", err)
+	}
+
+	// /proc/<tid>: the namespace is of this thread, not the thread group
+	// leader (/proc/self). There is no timens_offsets in /proc/thread-self.
+	offsetsFile := path.Join("/proc", strconv.Itoa(unix.Gettid()), "timens_offsets")
+	if err := os.WriteFile(offsetsFile, []byte(offsets.String()), 0644); err != nil {
+		return fmt.Errorf("write timens_offsets: %w", err)
+	}
+	slog.Info("[host] time namespace created.", "monotonic", offsets.Monotonic, "boottime", offsets.Boottime)
+
+	return nil
+}
+
+// -- cgroup namespace --
+
+// enterCgroupNamespace unshares a new cgroup namespace, whose root is
+// the current cgroup of the process: "/" in /proc/self/cgroup.
+//
+// The namespace belongs to the calling thread, which must be the thread
+// doing the execve.
+//
+// This function is executed in the container (by pid 1), after the
+// host has applied the cgroup.
+func enterCgroupNamespace() error {
+	if err := unix.Unshare(unix.CLONE_NEWCGROUP); err != nil {
+		return fmt.Errorf("unshare(CLONE_NEWCGROUP): %w", err)
+	}
+	return nil
+}
+
+const cgroupfsMountPoint = "/sys/fs/cgroup"
+
+// cgroupfsMounts returns the mounts to make a read-only cgroupfs at
+// /sys/fs/cgroup: a sysfs at /sys, a tmpfs at /sys/fs/cgroup, and the
+// cgroup v1 hierarchies that hind manages.
+//
+// The hierarchies are found in the mounts (/proc/self/mounts) of the host,
+// so the co-mounted controllers (e.g. cpu,cpuacct) are mounted together
+// as they are on the host.
+//
+// Call this function before the pivot_root.
+func cgroupfsMounts(procMounts io.Reader) ([]Mount, error) {
+	const roFlags = syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+
+	mounts := []Mount{
+		{Source: "sysfs", Target: "/sys", Type: "sysfs", Flags: roFlags},
+		{Source: "tmpfs", Target: cgroupfsMountPoint, Type: "tmpfs", Flags: syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, Data: "mode=755"},
+	}
+
+	managed := map[string]bool{}
+	for _, s := range cgroups.V1fsSubsystems() {
+		managed[s] = true
+	}
+
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(procMounts)
+	for scanner.Scan() {
+		// cgroup /sys/fs/cgroup/cpu cgroup rw,nosuid,nodev,noexec,relatime,cpu 0 0
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] != "cgroup" {
+			continue
+		}
+
+		var controllers []string
+		isManaged := false
+		for _, opt := range strings.Split(fields[3], ",") {
+			if _, isMountFlag := mountFlagOptions[opt]; isMountFlag {
+				continue
+			}
+			controllers = append(controllers, opt)
+			isManaged = isManaged || managed[opt]
+		}
+		if !isManaged {
+			continue
+		}
+
+		target := path.Join(cgroupfsMountPoint, path.Base(fields[1]))
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+
+		mounts = append(mounts, Mount{
+			Source: "cgroup",
+			Target: target,
+			Type:   "cgroup",
+			Flags:  roFlags,
+			Data:   strings.Join(controllers, ","),
+		})
+	}
+
+	return mounts, scanner.Err()
+}
+
+// mountCgroupfs mounts the cgroupfs mounts from cgroupfsMounts
+// and makes the /sys/fs/cgroup tmpfs read-only.
+//
+// This function is executed in the container (by pid 1), after the pivot_root.
+func mountCgroupfs(mounts []Mount, mkdir bool) error {
+	if err := mountAll(mounts[:2], mkdir); err != nil {
+		return err
+	}
+	// mount points of the hierarchies are created in the tmpfs
+	if err := mountAll(mounts[2:], true); err != nil {
+		return err
+	}
+
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	if err := syscall.Mount("", cgroupfsMountPoint, "", flags, "mode=755"); err != nil {
+		return fmt.Errorf("remount %s read-only: %w", cgroupfsMountPoint, err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTimeOffsets_String(t *testing.T) {
+	tests := []struct {
+		name    string
+		offsets TimeOffsets
+		want    string
+	}{
+		{"zero", TimeOffsets{}, "monotonic 0 0\nboottime 0 0\n"},
+		{"positive", TimeOffsets{Monotonic: 24 * time.Hour, Boottime: 1500 * time.Millisecond},
+			"monotonic 86400 0\nboottime 1 500000000\n"},
+		{"negative", TimeOffsets{Monotonic: -1500 * time.Millisecond, Boottime: -time.Second},
+			"monotonic -2 500000000\nboottime -1 0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.offsets.String(); got != tt.want {
+				t.Errorf("TimeOffsets.String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_cgroupfsMounts(t *testing.T) {
+	procMounts := `sysfs /sys sysfs rw,nosuid,nodev,noexec,relatime 0 0
+tmpfs /sys/fs/cgroup tmpfs ro,nosuid,nodev,noexec,mode=755 0 0
+cgroup /sys/fs/cgroup/cpu,cpuacct cgroup rw,nosuid,nodev,noexec,relatime,cpu,cpuacct 0 0
+cgroup /sys/fs/cgroup/cpuset cgroup rw,nosuid,nodev,noexec,relatime,cpuset 0 0
+cgroup /sys/fs/cgroup/memory cgroup rw,nosuid,nodev,noexec,relatime,memory 0 0
+cgroup /sys/fs/cgroup/pids cgroup rw,nosuid,nodev,noexec,relatime,pids 0 0
+cgroup2 /sys/fs/cgroup/unified cgroup2 rw,nosuid,nodev,noexec,relatime 0 0
+`
+	got, err := cgroupfsMounts(strings.NewReader(procMounts))
+	if err != nil {
+		t.Fatalf("cgroupfsMounts() error = %v", err)
+	}
+
+	const roFlags = syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+	want := []Mount{
+		{Source: "cgroup", Target: "/sys/fs/cgroup/cpu,cpuacct", Type: "cgroup", Flags: roFlags, Data: "cpu,cpuacct"},
+		{Source: "cgroup", Target: "/sys/fs/cgroup/cpuset", Type: "cgroup", Flags: roFlags, Data: "cpuset"},
+		{Source: "cgroup", Target: "/sys/fs/cgroup/memory", Type: "cgroup", Flags: roFlags, Data: "memory"},
+	}
+
+	if len(got) < 2 || got[0].Target != "/sys" || got[1].Target != cgroupfsMountPoint {
+		t.Fatalf("cgroupfsMounts() should start with /sys and %s, got %+v", cgroupfsMountPoint, got)
+	}
+	if !reflect.DeepEqual(got[2:], want) {
+		t.Errorf("cgroupfsMounts() hierarchies = %+v, want %+v", got[2:], want)
+	}
+}
+
+func TestParseNamespaceMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    NamespaceMode
+		wantErr bool
+	}{
+		{"empty", "", NamespacePrivate, false},
+		{"private", "private", NamespacePrivate, false},
+		{"host", "host", NamespaceHost, false},
+		{"container", "container:foo", NamespaceMode("container:foo"), false},
+		{"container_no_id", "container:", "", true},
+		{"unknown", "bridge", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseNamespaceMode(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseNamespaceMode() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseNamespaceMode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamespaces_cloneflags(t *testing.T) {
+	all := uintptr(syscall.CLONE_NEWNS | syscall.CLONE_NEWNET | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS)
+
+	tests := []struct {
+		name string
+		ns   Namespaces
+		want uintptr
+	}{
+		{"default", Namespaces{}, all},
+		{"host_net", Namespaces{Net: NamespaceHost}, all &^ syscall.CLONE_NEWNET},
+		{"join_pid", Namespaces{Pid: "container:foo", Ipc: NamespacePrivate}, all &^ syscall.CLONE_NEWPID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ns.cloneflags(); got != tt.want {
+				t.Errorf("Namespaces.cloneflags() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamespaces_namespaceJoins(t *testing.T) {
+	DataRoot = t.TempDir()
+	defer func() { DataRoot = DefaultDataRoot }()
+
+	running := &Container{ID: "running-id", Name: "running", Status: StatusRunning, Pid: os.Getpid()}
+	exited := &Container{ID: "exited-id", Name: "exited", Status: StatusExited}
+	for _, c := range []*Container{running, exited} {
+		if err := saveState(c); err != nil {
+			t.Fatalf("saveState() error = %v", err)
+		}
+	}
+
+	joins, err := Namespaces{Net: "container:running", Uts: NamespaceHost}.namespaceJoins()
+	if err != nil {
+		t.Fatalf("namespaceJoins() error = %v", err)
+	}
+	want := []namespaceJoin{{path: fmt.Sprintf("/proc/%d/ns/net", os.Getpid()), flag: syscall.CLONE_NEWNET}}
+	if !reflect.DeepEqual(joins, want) {
+		t.Errorf("namespaceJoins() = %v, want %v", joins, want)
+	}
+
+	if _, err := (Namespaces{Pid: "container:exited"}).namespaceJoins(); !errors.Is(err, ErrContainerNotRunning) {
+		t.Errorf("namespaceJoins() error = %v, want ErrContainerNotRunning", err)
+	}
+	if _, err := (Namespaces{Ipc: "container:nope"}).namespaceJoins(); !errors.Is(err, ErrNoSuchContainer) {
+		t.Errorf("namespaceJoins() error = %v, want ErrNoSuchContainer", err)
+	}
+}
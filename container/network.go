@@ -0,0 +1,422 @@
+package container
+
+import (
+	"fmt"
+	"hind/network"
+	"net"
+	"path"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/exp/slog"
+)
+
+// Network modes of the container's (private) network namespace.
+const (
+	NetworkBridge = "bridge" // connect to the default network (hind0), the default
+	NetworkNone   = "none"   // only the loopback
+)
+
+// setupNetwork brings up the network of the container process:
+//   - none: loopback only
+//   - otherwise: loopback + a veth pair to the bridge of each network in
+//     container.Networks, with an address from the network's subnet.
+//     The first one is eth0 with the default route, the others are eth1,
+//     eth2...
+//
+// Nothing is done if the network namespace is not private (host,
+// or joined from a container or a pod).
+//
+// This function is executed in the host, before the config is sent.
+func setupNetwork(container *Container) (cleanUpFunc, error) {
+	if container == nil || container.Process == nil {
+		panic("setupNetwork: invalid container.")
+	}
+	if !container.Namespaces.Net.IsPrivate() {
+		return func() {}, nil
+	}
+
+	ns, err := netns.GetFromPid(container.Process.Pid)
+	if err != nil {
+		return func() {}, fmt.Errorf("get netns of container process: %w", err)
+	}
+	defer ns.Close()
+
+	if isNoneNetwork(container.Networks) {
+		return func() {}, network.LoopbackUp(ns)
+	}
+	if container.NetworkDriver == NetworkDriverCNI {
+		return setupCNI(container, ns)
+	}
+
+	container.NetworkEndpoints = map[string]*network.Endpoint{}
+	cleanup := func() {
+		teardownNetwork(container)
+	}
+
+	for i, idOrName := range container.Networks {
+		n, err := LoadNetwork(idOrName)
+		if err != nil {
+			cleanup()
+			return func() {}, err
+		}
+		if _, dup := container.NetworkEndpoints[n.Name]; dup {
+			cleanup()
+			return func() {}, fmt.Errorf("%w: network %s is given more than once", network.ErrBadNetwork, n.Name)
+		}
+		container.Networks[i] = n.Name
+
+		ep, err := connectNetwork(ns, n, container.ID, i)
+		if err != nil {
+			cleanup()
+			return func() {}, err
+		}
+		container.NetworkEndpoints[n.Name] = ep
+
+		if err := container.limitBandwidth(ep); err != nil {
+			cleanup()
+			return func() {}, err
+		}
+	}
+
+	return cleanup, nil
+}
+
+// isNoneNetwork reports whether the networks is [none].
+func isNoneNetwork(networks []string) bool {
+	return len(networks) == 1 && networks[0] == NetworkNone
+}
+
+// checkNetworks errors if none is given with other networks,
+// or the driver is unknown.
+func checkNetworks(driver string, networks []string) error {
+	switch driver {
+	case NetworkDriverBridge, NetworkDriverCNI:
+	default:
+		return fmt.Errorf("%w: unknown network driver %q", network.ErrBadNetwork, driver)
+	}
+	for _, n := range networks {
+		if n == NetworkNone && len(networks) > 1 {
+			return fmt.Errorf("%w: network none can not be used with other networks", network.ErrBadNetwork)
+		}
+	}
+	return nil
+}
+
+// checkBandwidth errors if the bandwidth limit is given to a container
+// without its own bridge endpoints.
+func checkBandwidth(c *Container) error {
+	if c.Bandwidth == nil {
+		return nil
+	}
+	if !c.Namespaces.Net.IsPrivate() {
+		return fmt.Errorf("%w: the bandwidth can only be limited for a private network namespace, not %s",
+			ErrBadNamespaceMode, c.Namespaces.Net)
+	}
+	if c.NetworkDriver != NetworkDriverBridge {
+		return fmt.Errorf("%w: the bandwidth can only be limited with the bridge driver (try the cni bandwidth plugin)",
+			network.ErrBadBandwidth)
+	}
+	return nil
+}
+
+// limitBandwidth applies the container's Bandwidth to the endpoint.
+func (c *Container) limitBandwidth(ep *network.Endpoint) error {
+	if c.Bandwidth == nil {
+		return nil
+	}
+	if err := network.LimitBandwidth(ep.HostIf, *c.Bandwidth); err != nil {
+		return fmt.Errorf("limit bandwidth of network %s: %w", ep.Bridge, err)
+	}
+	return nil
+}
+
+// teardownNetwork disconnects the container from all its networks,
+// including the ones connected after it started (hind network connect).
+// The hosts of the peers are updated.
+func teardownNetwork(container *Container) {
+	if stored, err := loadState(container.ID); err == nil && stored.NetworkEndpoints != nil {
+		container.NetworkEndpoints = stored.NetworkEndpoints
+	}
+
+	var names []string
+	for name, ep := range container.NetworkEndpoints {
+		disconnectEndpoint(ep, container.ID)
+		names = append(names, name)
+	}
+
+	container.NetworkEndpoints = nil
+	if err := saveState(container); err == nil {
+		updateHosts(names)
+	}
+}
+
+// connectNetwork connects the netns to the network as the i-th
+// interface (eth<i>), with an address leased to the owner (container
+// or pod id). eth0 gets the default route.
+func connectNetwork(ns netns.NsHandle, n *Network, owner string, i int) (*network.Endpoint, error) {
+	bridge, err := n.bridge()
+	if err != nil {
+		return nil, err
+	}
+	if err := bridge.Setup(); err != nil {
+		return nil, fmt.Errorf("setup bridge: %w", err)
+	}
+
+	ipam := bridgeIPAM(bridge)
+	ip, err := ipam.Allocate(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	var ep *network.Endpoint
+	if i == 0 {
+		ep, err = bridge.Connect(ns, owner, ip)
+	} else {
+		ep, err = bridge.ConnectInterface(ns, owner, fmt.Sprintf("eth%d", i), ip)
+	}
+	if err != nil {
+		ipam.Release(owner)
+		return nil, fmt.Errorf("connect to network %s: %w", n.Name, err)
+	}
+	return ep, nil
+}
+
+// disconnectEndpoint disconnects the endpoint and releases the address of the owner.
+func disconnectEndpoint(ep *network.Endpoint, owner string) {
+	if err := network.Disconnect(ep); err != nil {
+		slog.Warn("[host] Failed to disconnect from the network.", "owner", owner, "bridge", ep.Bridge, "err", err)
+	}
+
+	bridge, err := network.NewBridge(ep.Bridge, ep.Subnet().String())
+	if err == nil {
+		err = bridgeIPAM(bridge).Release(owner)
+	}
+	if err != nil {
+		slog.Warn("[host] Failed to release the address.", "owner", owner, "bridge", ep.Bridge, "err", err)
+	}
+}
+
+// bridgeIPAM is the IPAM of the bridge, with the leases in
+// <DataRoot>/network/ipam. The leases of the containers and pods that
+// no longer exist are reclaimed.
+func bridgeIPAM(bridge *network.Bridge) *network.IPAM {
+	ipam := network.NewIPAM(path.Join(DataRoot, "network", "ipam"), bridge)
+	ipam.Alive = leaseOwnerAlive
+	return ipam
+}
+
+// leaseOwnerAlive reports whether the container or pod with the id exists
+// and is not exited (stopped).
+func leaseOwnerAlive(id string) bool {
+	if c, err := loadState(id); err == nil {
+		return c.Status != StatusExited
+	}
+	if p, err := loadPod(id); err == nil {
+		return p.Status != PodStopped
+	}
+	return false
+}
+
+// ConnectNetwork connects a running container to one more network.
+func ConnectNetwork(containerIdOrName string, networkIdOrName string) error {
+	c, n, err := loadConnection(containerIdOrName, networkIdOrName)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.NetworkEndpoints[n.Name]; ok {
+		return fmt.Errorf("%w: container %s is already connected to network %s", network.ErrBadNetwork, c.Name, n.Name)
+	}
+	if isNoneNetwork(c.Networks) {
+		return fmt.Errorf("%w: container %s is in the network none", network.ErrBadNetwork, c.Name)
+	}
+
+	ns, err := netns.GetFromPid(c.Pid)
+	if err != nil {
+		return fmt.Errorf("get netns of container process: %w", err)
+	}
+	defer ns.Close()
+
+	ep, err := connectNetwork(ns, n, c.ID, c.nextInterface())
+	if err != nil {
+		return err
+	}
+	if err := c.limitBandwidth(ep); err != nil {
+		disconnectEndpoint(ep, c.ID)
+		return err
+	}
+	if c.NetworkEndpoints == nil {
+		c.NetworkEndpoints = map[string]*network.Endpoint{}
+	}
+	c.NetworkEndpoints[n.Name] = ep
+	c.Networks = append(c.Networks, n.Name)
+
+	if err := saveState(c); err != nil {
+		return err
+	}
+	updateHosts([]string{n.Name})
+
+	slog.Info("[host] container connected to network.", "container", c.ID, "network", n.Name, "address", ep.Address)
+	return nil
+}
+
+// DisconnectNetwork disconnects a running container from a network.
+func DisconnectNetwork(containerIdOrName string, networkIdOrName string) error {
+	c, n, err := loadConnection(containerIdOrName, networkIdOrName)
+	if err != nil {
+		return err
+	}
+	ep, ok := c.NetworkEndpoints[n.Name]
+	if !ok {
+		return fmt.Errorf("%w: container %s is not connected to network %s", network.ErrBadNetwork, c.Name, n.Name)
+	}
+
+	disconnectEndpoint(ep, c.ID)
+	delete(c.NetworkEndpoints, n.Name)
+	for i, name := range c.Networks {
+		if name == n.Name {
+			c.Networks = append(c.Networks[:i], c.Networks[i+1:]...)
+			break
+		}
+	}
+
+	if err := saveState(c); err != nil {
+		return err
+	}
+	updateHosts([]string{n.Name})
+	writeHosts(c, nil)
+
+	slog.Info("[host] container disconnected from network.", "container", c.ID, "network", n.Name)
+	return nil
+}
+
+// loadConnection loads the running container with a private network
+// namespace and the network to connect or disconnect.
+func loadConnection(containerIdOrName string, networkIdOrName string) (*Container, *Network, error) {
+	c, err := LoadContainer(containerIdOrName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !c.IsRunning() {
+		return nil, nil, fmt.Errorf("%w: %s", ErrContainerNotRunning, c.Name)
+	}
+	if !c.Namespaces.Net.IsPrivate() {
+		return nil, nil, fmt.Errorf("%w: container %s does not own its network namespace (%s)",
+			ErrBadNamespaceMode, c.Name, c.Namespaces.Net)
+	}
+	if c.NetworkDriver == NetworkDriverCNI {
+		return nil, nil, fmt.Errorf("%w: container %s uses the cni network driver", network.ErrBadNetwork, c.Name)
+	}
+
+	n, err := LoadNetwork(networkIdOrName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, n, nil
+}
+
+// nextInterface is the smallest i that eth<i> is not used by the container.
+func (c *Container) nextInterface() int {
+	used := map[string]bool{}
+	for _, ep := range c.NetworkEndpoints {
+		used[ep.IfName] = true
+	}
+	i := 0
+	for used[fmt.Sprintf("eth%d", i)] {
+		i++
+	}
+	return i
+}
+
+// primaryEndpoint is the endpoint of eth0, or any endpoint if eth0 has
+// been disconnected. nil if the container is not connected to any network.
+func (c *Container) primaryEndpoint() *network.Endpoint {
+	var other *network.Endpoint
+	for _, ep := range c.NetworkEndpoints {
+		if ep.IfName == network.ContainerIfName {
+			return ep
+		}
+		other = ep
+	}
+	return other
+}
+
+// primaryIP is the address of the primary endpoint, or the first
+// address of the cni attachments. nil if there is none.
+func (c *Container) primaryIP() net.IP {
+	if ep := c.primaryEndpoint(); ep != nil {
+		return ep.Address.IP
+	}
+	for _, a := range c.CNIAttachments {
+		if ips := a.IPs(); len(ips) > 0 {
+			return ips[0]
+		}
+	}
+	return nil
+}
+
+// setupPorts publishes the container's Ports with userland proxies
+// running in this (the supervising hind) process. The random host
+// ports are filled in container.Ports.
+//
+// The ports are forwarded to the address of the network namespace of
+// the container: its own bridge endpoint, or the one of the container
+// or pod whose network namespace it joins.
+//
+// This function is executed in the host, after setupNetwork.
+func setupPorts(container *Container) (cleanUpFunc, error) {
+	if len(container.Ports) == 0 {
+		return func() {}, nil
+	}
+
+	ip, err := networkIPOf(container)
+	if err != nil {
+		return func() {}, err
+	}
+
+	var proxies []*network.PortProxy
+	cleanup := func() {
+		for _, p := range proxies {
+			p.Close()
+		}
+	}
+
+	for i, m := range container.Ports {
+		p, err := network.Publish(m, ip)
+		if err != nil {
+			cleanup()
+			return func() {}, err
+		}
+		proxies = append(proxies, p)
+		container.Ports[i] = p.Mapping
+	}
+
+	return cleanup, nil
+}
+
+// networkIPOf finds the (primary) address of the container's network namespace.
+func networkIPOf(container *Container) (net.IP, error) {
+	var ip net.IP
+	switch mode := container.Namespaces.Net; {
+	case mode.IsPrivate():
+		ip = container.primaryIP()
+	case mode.Container() != "":
+		c, err := LoadContainer(mode.Container())
+		if err != nil {
+			return nil, err
+		}
+		ip = c.primaryIP()
+	case mode.Pod() != "":
+		p, err := loadPod(mode.Pod())
+		if err != nil {
+			return nil, err
+		}
+		if p.NetworkEndpoint != nil {
+			ip = p.NetworkEndpoint.Address.IP
+		}
+	}
+
+	if ip == nil {
+		return nil, fmt.Errorf("%w: publishing ports requires a network with an address", network.ErrBadPortMapping)
+	}
+	return ip, nil
+}
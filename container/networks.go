@@ -0,0 +1,310 @@
+package container
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"hind/internal/atomicfile"
+	"hind/network"
+
+	"golang.org/x/exp/slog"
+)
+
+// This file implements the user-defined networks: named bridges with
+// their own subnets. The containers on different networks can not
+// reach each other, while a container can be connected to several
+// networks.
+//
+// The default network "bridge" (hind0, 172.29.0.0/16) is built in.
+// The others are persisted under the data root:
+//
+//	<DataRoot>/network/networks/<networkID>.json
+
+// Network is a bridge network that containers are connected to.
+type Network struct {
+	ID      string
+	Name    string
+	Bridge  string // the bridge device on the host
+	Subnet  string // CIDR
+	Created time.Time
+}
+
+// networkNameRegexp is the valid network names, as docker's.
+var networkNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// defaultNetwork is the built-in network "bridge".
+func defaultNetwork() *Network {
+	return &Network{
+		ID:     NetworkBridge,
+		Name:   NetworkBridge,
+		Bridge: network.DefaultBridgeName,
+		Subnet: network.DefaultSubnet,
+	}
+}
+
+// IsDefault reports whether the network is the built-in one.
+func (n *Network) IsDefault() bool {
+	return n.ID == NetworkBridge
+}
+
+func (n *Network) bridge() (*network.Bridge, error) {
+	return network.NewBridge(n.Bridge, n.Subnet)
+}
+
+// -- store --
+
+func networksDir() string {
+	return path.Join(DataRoot, "network", "networks")
+}
+
+func (n *Network) file() string {
+	return path.Join(networksDir(), n.ID+".json")
+}
+
+func (n *Network) save() error {
+	if err := os.MkdirAll(networksDir(), 0700); err != nil {
+		return fmt.Errorf("save network: %w", err)
+	}
+	if err := atomicfile.WriteJSON(n.file(), n); err != nil {
+		return fmt.Errorf("save network: %w", err)
+	}
+	return nil
+}
+
+func loadNetwork(id string) (*Network, error) {
+	if id == NetworkBridge {
+		return defaultNetwork(), nil
+	}
+
+	data, err := os.ReadFile(path.Join(networksDir(), id+".json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchNetwork, id)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var n Network
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, fmt.Errorf("bad network %s: %w", id, err)
+	}
+	return &n, nil
+}
+
+// ListNetworks returns the default network and the user-defined
+// networks sorted by the creation time.
+func ListNetworks() ([]*Network, error) {
+	networks := []*Network{defaultNetwork()}
+
+	entries, err := os.ReadDir(networksDir())
+	if os.IsNotExist(err) {
+		return networks, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var userDefined []*Network
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		n, err := loadNetwork(id)
+		if err != nil {
+			slog.Warn("[host] ListNetworks: skip bad network.", "id", id, "err", err)
+			continue
+		}
+		userDefined = append(userDefined, n)
+	}
+	sort.Slice(userDefined, func(i, j int) bool {
+		return userDefined[i].Created.Before(userDefined[j].Created)
+	})
+	return append(networks, userDefined...), nil
+}
+
+// LoadNetwork finds a network by the full ID, the name or an unique prefix of the ID.
+func LoadNetwork(idOrName string) (*Network, error) {
+	if idOrName == "" {
+		return nil, fmt.Errorf("%w: empty id or name", ErrNoSuchNetwork)
+	}
+	if n, err := loadNetwork(idOrName); err == nil {
+		return n, nil
+	} else if !errors.Is(err, ErrNoSuchNetwork) {
+		return nil, err
+	}
+
+	networks, err := ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	var found []*Network
+	for _, n := range networks {
+		if n.Name == idOrName {
+			return n, nil
+		}
+		if strings.HasPrefix(n.ID, idOrName) {
+			found = append(found, n)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchNetwork, idOrName)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("ambiguous network id prefix %q: %d matches", idOrName, len(found))
+	}
+}
+
+// -- lifecycle --
+
+// CreateNetwork creates a network with its bridge. If the subnet is
+// empty, a free one is allocated from network.DefaultSubnetPool.
+func CreateNetwork(name string, subnet string) (*Network, error) {
+	if !networkNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("%w: invalid network name %q", network.ErrBadNetwork, name)
+	}
+	switch name {
+	case NetworkBridge, NetworkNone, "host":
+		return nil, fmt.Errorf("%w: network name %q is reserved", network.ErrBadNetwork, name)
+	}
+
+	var requested *net.IPNet
+	if subnet != "" {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid subnet %q: %v", network.ErrBadNetwork, subnet, err)
+		}
+		requested = ipnet
+	}
+
+	networks, err := ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	type usedSubnet struct {
+		network *Network
+		subnet  *net.IPNet
+	}
+	var used []usedSubnet
+	for _, n := range networks {
+		if n.Name == name {
+			return nil, fmt.Errorf("network name %q is already in use", name)
+		}
+		if _, ipnet, err := net.ParseCIDR(n.Subnet); err == nil {
+			used = append(used, usedSubnet{n, ipnet})
+		}
+	}
+
+	if requested == nil {
+		subnets := make([]*net.IPNet, len(used))
+		for i, u := range used {
+			subnets[i] = u.subnet
+		}
+		_, pool, _ := net.ParseCIDR(network.DefaultSubnetPool)
+		ipnet, err := network.NextSubnet(pool, network.DefaultSubnetPrefix, subnets)
+		if err != nil {
+			return nil, err
+		}
+		subnet = ipnet.String()
+	} else {
+		for _, u := range used {
+			if network.Overlaps(requested, u.subnet) {
+				return nil, fmt.Errorf("%w: subnet %s overlaps with network %s (%s)",
+					network.ErrBadNetwork, subnet, u.network.Name, u.subnet)
+			}
+		}
+	}
+
+	n := &Network{
+		ID:      randNetworkID(),
+		Name:    name,
+		Subnet:  subnet,
+		Created: time.Now(),
+	}
+	n.Bridge = "hind-" + n.ID[:10]
+
+	bridge, err := n.bridge()
+	if err != nil {
+		return nil, err
+	}
+	n.Subnet = bridge.Subnet.String()
+
+	if err := bridge.Setup(); err != nil {
+		return nil, fmt.Errorf("setup bridge: %w", err)
+	}
+	if err := n.save(); err != nil {
+		bridge.Teardown()
+		return nil, err
+	}
+
+	slog.Info("[host] network created.", "id", n.ID, "name", n.Name, "bridge", n.Bridge, "subnet", n.Subnet)
+	return n, nil
+}
+
+// randNetworkID is 32 hex digits.
+func randNetworkID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Containers returns the running containers connected to the network.
+func (n *Network) Containers() ([]*Container, error) {
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+	var connected []*Container
+	for _, c := range containers {
+		if _, ok := c.NetworkEndpoints[n.Name]; ok && c.IsRunning() {
+			connected = append(connected, c)
+		}
+	}
+	return connected, nil
+}
+
+// Remove deletes the network with its bridge.
+// The default network and the networks in use can not be removed.
+func (n *Network) Remove() error {
+	if n.IsDefault() {
+		return fmt.Errorf("%w: the default network %q can not be removed", network.ErrBadNetwork, n.Name)
+	}
+
+	containers, err := n.Containers()
+	if err != nil {
+		return err
+	}
+	if len(containers) > 0 {
+		return fmt.Errorf("%w: %s has %d connected containers, e.g. %s",
+			ErrNetworkInUse, n.Name, len(containers), containers[0].Name)
+	}
+
+	bridge, err := n.bridge()
+	if err != nil {
+		return err
+	}
+	if err := bridge.Teardown(); err != nil {
+		return fmt.Errorf("teardown bridge: %w", err)
+	}
+
+	ipam := bridgeIPAM(bridge)
+	for _, f := range []string{".json", ".lock"} {
+		os.Remove(path.Join(ipam.Dir, ipam.Name+f))
+	}
+
+	if err := os.Remove(n.file()); err != nil {
+		return fmt.Errorf("remove network: %w", err)
+	}
+	slog.Info("[host] network removed.", "id", n.ID, "name", n.Name)
+	return nil
+}
@@ -0,0 +1,124 @@
+package container
+
+import (
+	"errors"
+	"hind/network"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadNetwork(t *testing.T) {
+	DataRoot = t.TempDir()
+	defer func() { DataRoot = DefaultDataRoot }()
+
+	networks := []*Network{
+		{ID: "aaaa1111", Name: "foo", Bridge: "hind-aaaa1111", Subnet: "172.30.0.0/24", Created: time.Now()},
+		{ID: "aaaa2222", Name: "bar", Bridge: "hind-aaaa2222", Subnet: "172.30.1.0/24", Created: time.Now().Add(time.Second)},
+	}
+	for _, n := range networks {
+		if err := n.save(); err != nil {
+			t.Fatalf("save() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		idOrName  string
+		wantID    string
+		wantErrIs error
+	}{
+		{"default", "bridge", NetworkBridge, nil},
+		{"full_id", "aaaa2222", "aaaa2222", nil},
+		{"name", "foo", "aaaa1111", nil},
+		{"ambiguous_prefix", "aaaa", "", errAny},
+		{"not_found", "cccc", "", ErrNoSuchNetwork},
+		{"empty", "", "", ErrNoSuchNetwork},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadNetwork(tt.idOrName)
+			if tt.wantErrIs != nil {
+				if err == nil || (tt.wantErrIs != errAny && !errors.Is(err, tt.wantErrIs)) {
+					t.Errorf("LoadNetwork() error = %v, want %v", err, tt.wantErrIs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadNetwork() error = %v", err)
+			}
+			if got.ID != tt.wantID {
+				t.Errorf("LoadNetwork() = %v, want %v", got.ID, tt.wantID)
+			}
+		})
+	}
+
+	all, err := ListNetworks()
+	if err != nil || len(all) != 3 || !all[0].IsDefault() || all[1].Name != "foo" {
+		t.Errorf("ListNetworks() = %v, %v, want [bridge foo bar]", all, err)
+	}
+}
+
+// The requests rejected before setting up any bridge.
+func TestCreateNetwork_Invalid(t *testing.T) {
+	DataRoot = t.TempDir()
+	defer func() { DataRoot = DefaultDataRoot }()
+
+	for _, n := range []*Network{
+		{ID: "aaaa0000", Name: "broken", Bridge: "hind-aaaa0000", Subnet: "bad subnet", Created: time.Now()},
+		{ID: "aaaa1111", Name: "foo", Bridge: "hind-aaaa1111", Subnet: "172.30.0.0/24", Created: time.Now().Add(time.Second)},
+	} {
+		if err := n.save(); err != nil {
+			t.Fatalf("save() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		network   string
+		subnet    string
+		wantErrIs error
+		wantInErr string // the network overlapped
+	}{
+		{"bad_name", "-foo", "", network.ErrBadNetwork, ""},
+		{"reserved", "none", "", network.ErrBadNetwork, ""},
+		{"default", "bridge", "", network.ErrBadNetwork, ""},
+		{"duplicate", "foo", "", errAny, ""},
+		{"overlap", "bar", "172.30.0.128/25", network.ErrBadNetwork, "network foo "},
+		{"overlap_default", "bar", "172.29.1.0/24", network.ErrBadNetwork, "network bridge "},
+		{"bad_subnet", "bar", "172.30.1.0", network.ErrBadNetwork, ""},
+		{"bad_subnet_duplicate", "foo", "172.30.1.0", network.ErrBadNetwork, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CreateNetwork(tt.network, tt.subnet)
+			if err == nil || (tt.wantErrIs != errAny && !errors.Is(err, tt.wantErrIs)) {
+				t.Errorf("CreateNetwork() error = %v, want %v", err, tt.wantErrIs)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantInErr) {
+				t.Errorf("CreateNetwork() error = %v, want %q in it", err, tt.wantInErr)
+			}
+		})
+	}
+}
+
+func TestCheckNetworks(t *testing.T) {
+	tests := []struct {
+		driver   string
+		networks []string
+		wantErr  bool
+	}{
+		{"bridge", []string{"bridge"}, false},
+		{"bridge", []string{"none"}, false},
+		{"bridge", []string{"bridge", "foo"}, false},
+		{"bridge", []string{"none", "foo"}, true},
+		{"cni", nil, false},
+		{"cni", []string{"mynet"}, false},
+		{"macvlan", []string{"bridge"}, true},
+	}
+	for _, tt := range tests {
+		if err := checkNetworks(tt.driver, tt.networks); (err != nil) != tt.wantErr {
+			t.Errorf("checkNetworks(%v, %v) error = %v, wantErr %v", tt.driver, tt.networks, err, tt.wantErr)
+		}
+	}
+}
@@ -1,14 +1,17 @@
 package container
 
 import (
+	"errors"
 	"fmt"
+	"hind/image"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"golang.org/x/exp/slog"
+	"golang.org/x/sys/unix"
 )
 
 // -- helper methods: paths for overlayfs --
@@ -17,14 +20,11 @@ type overlayConfig = Container
 
 // overlayRootDir is a tmp dir to create & mount the overlay filesystem.
 func (c overlayConfig) overlayRootDir() string {
-	return path.Join(c.WorkDir, "/overlay-"+shortID(c.ID, 4))
-}
-
-func shortID(id string, maxLen int) string {
-	if len(id) < maxLen {
-		return id
+	id := c.ID
+	if len(id) > 4 {
+		id = id[:4]
 	}
-	return id[:maxLen]
+	return path.Join(c.WorkDir, "/overlay-"+id)
 }
 
 // overlayLowerDir is the lower directory (read-only image layer)
@@ -48,6 +48,15 @@ func (c overlayConfig) overlayLowerDir() string {
 	return path.Join(c.overlayRootDir(), "/image")
 }
 
+// overlayLowerDirs are the lower directories, top first: the layers of a
+// multi-layer image in the store, or the single overlayLowerDir.
+func (c overlayConfig) overlayLowerDirs() []string {
+	if len(c.ImageLayers) > 0 {
+		return c.ImageLayers
+	}
+	return []string{c.overlayLowerDir()}
+}
+
 // overlayUpperDir is the upper directory (read-write container layer)
 func (c overlayConfig) overlayUpperDir() string {
 	return path.Join(c.overlayRootDir(), "/write")
@@ -64,69 +73,141 @@ func (c overlayConfig) overlayWorkDir() string {
 	// 其实他会自己在 workdir=/work 里面新建一个 /work/work 来作为工作目录，所以，其实后面 .work 可以不用加
 }
 
-// -- make an overlayfs --
+// overlayRootFS is the directory to be used as the rootfs of the container:
+// the merged dir, an overlay mount or a read-only bind mount of the
+// lower dir (see overlaySnapshotter). Never the image dir itself: the
+// container must not change it, even by pivoting into it.
+func (c overlayConfig) overlayRootFS() string {
+	return c.overlayMergedDir()
+}
+
+// -- the overlayfs snapshotter --
 
-// makeOverlayFS create the overlay filesystem for the container.
-// That contains:
-//   - lower directory: read-only image layer
-//   - upper directory: read-write container layer
+// overlaySnapshotter is the Snapshotter on overlayfs: the image (the
+// dir, the extracted tar or the layers in the store) is the lower dir,
+// and a writable layer in the overlay root dir is the upper dir.
+//
+// The overlay root dir is {c.WorkDir}/overlay-{c.ID[:4]}, containing:
+//   - image: the extracted tar image, if ImagePath is a tar file;
+//   - write: the upper dir, the writable container layer;
+//   - .work: the work dir of the overlayfs;
+//   - merge: the mount point of the overlayfs, the rootfs.
 //
-// ATTENTION:
-//   - this function works with the destroyOverlayFS function.
-//     The following "we" refers to both of them;
-//   - we read config.ID, config.ImagePath and config.WorkDir;
-//   - the config.ImagePath is either a directory or a tar file:
-//     (a) if it is a directory, we use it as the lower dir.
-//     We do not copy, modify or delete it. And the Linux overlay
-//     file system guarantees that this directory is not modified
-//     by the container.
-//     (b) if it is a tar file, makeOverlayFS extract it to the
-//     {config.WorkDir}/overlay-{config.ID}/image directory,
-//     and use this directory as the lower dir.
-//     It's destroyOverlayFS's responsibility to delete this directory
-//     after the container exits.
+// The image dir and the layers in the store are used as they are.
+// We do not copy, modify or delete them. And the Linux overlay file
+// system guarantees that they are not modified by the container.
+//
+// A read-only container has no writable layer: the single lower dir is
+// bind mounted read-only onto the merged dir (overlayfs refuses to mount
+// a single lowerdir without upperdir). The layers of a multi-layer image
+// are merged by an overlay mount without upper dir, which is read-only.
 //
 // References:
 //   - https://wiki.archlinux.org/title/Overlay_filesystem (arch wiki yyds)
-func makeOverlayFS(config *overlayConfig) error {
-	if config.ImagePath != config.overlayLowerDir() {
-		err := extractImage(config.ImagePath, config.overlayLowerDir())
-		if err != nil {
-			slog.Error("[host] initOverlayFS: error extracting image", "err", err)
+type overlaySnapshotter struct{}
+
+// needsMount reports whether the snapshot of the container is an overlay
+// mount. Else it is a read-only bind mount of the single lower dir.
+func (overlaySnapshotter) needsMount(c *Container) bool {
+	return !c.ReadOnly || len(c.overlayLowerDirs()) > 1
+}
+
+// Prepare extracts the tar image, and creates the upper, work and
+// merged dirs if needed.
+func (o overlaySnapshotter) Prepare(c *Container) error {
+	if len(c.ImageLayers) == 0 && c.ImagePath != c.overlayLowerDir() {
+		if err := extractImage(c.ImagePath, c.ImageDigest, c.overlayLowerDir()); err != nil {
+			slog.Error("[host] overlayfs: error extracting image", "err", err)
 			return fmt.Errorf("error extracting image: %w", err)
 		}
 	}
 
-	err := os.MkdirAll(config.overlayUpperDir(), 0755)
-	if err != nil {
-		slog.Error("[host] initOverlayFS: error creating writable layer", "err", err)
-		return fmt.Errorf("error creating writable layer: %w", err)
+	dirs := []string{c.overlayMergedDir()}
+	if c.ReadOnly {
+		slog.Info("[host] overlayfs: read-only container, skip creating writable layer.", "rootfs", c.overlayRootFS())
+	} else {
+		dirs = append(dirs, c.overlayUpperDir(), c.overlayWorkDir())
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			slog.Error("[host] overlayfs: error creating dir", "dir", dir, "err", err)
+			return fmt.Errorf("error creating overlay dir: %w", err)
+		}
 	}
+	return nil
+}
 
-	err = os.MkdirAll(config.overlayWorkDir(), 0755)
-	if err != nil {
-		slog.Error("[host] initOverlayFS: error creating overlay work dir", "err", err)
-		return fmt.Errorf("error creating overlay work dir: %w", err)
+// Mount mounts the overlayfs (or the read-only bind), and returns the rootfs.
+func (o overlaySnapshotter) Mount(c *Container) (string, error) {
+	if !o.needsMount(c) {
+		if err := bindMountReadOnly(c.overlayLowerDir(), c.overlayMergedDir()); err != nil {
+			slog.Error("[host] overlayfs: error bind mounting the image", "err", err)
+			return "", err
+		}
+		return c.overlayRootFS(), nil
 	}
 
-	err = os.MkdirAll(config.overlayMergedDir(), 0755)
-	if err != nil {
-		slog.Error("[host] initOverlayFS: error creating mount point", "err", err)
-		return fmt.Errorf("error creating mount point: %w", err)
+	var upper, work string
+	if !c.ReadOnly {
+		upper, work = c.overlayUpperDir(), c.overlayWorkDir()
 	}
+	if err := mountOverlayFS(c.overlayLowerDirs(), upper, work, c.overlayMergedDir()); err != nil {
+		slog.Error("[host] overlayfs: error mounting overlayfs", "err", err)
+		return "", err
+	}
+	return c.overlayRootFS(), nil
+}
 
-	// mount overlayfs
-	err = mountOverlayFS(config.overlayLowerDir(), config.overlayUpperDir(), config.overlayWorkDir(), config.overlayMergedDir())
-	if err != nil {
-		slog.Error("[host] initOverlayFS: error mounting overlayfs", "err", err)
-		return fmt.Errorf("error mounting overlayfs: %w", err)
+// Unmount unmounts the overlayfs (or the read-only bind).
+func (o overlaySnapshotter) Unmount(c *Container) error {
+	if err := unmountOverlayFS(c.overlayMergedDir()); err != nil {
+		slog.Error("[host] overlayfs: error unmounting overlayfs", "err", err)
+		return err
 	}
+	return nil
+}
 
+// Remove removes the overlay root dir: the writable layer and the
+// extracted image.
+func (overlaySnapshotter) Remove(c *Container) error {
+	if err := os.RemoveAll(c.overlayRootDir()); err != nil {
+		slog.Error("[host] overlayfs: error removing overlay tmp dir", "err", err)
+		return fmt.Errorf("error removing overlay dir: %w", err)
+	}
 	return nil
 }
 
-// extractImage extracts the image layer to the target path.
-func extractImage(imagePath string, targetPath string) error {
+// Usage is the disk usage of the upper dir.
+func (overlaySnapshotter) Usage(c *Container) (SnapshotUsage, error) {
+	if c.ReadOnly {
+		return SnapshotUsage{}, nil
+	}
+	return diskUsage(c.overlayUpperDir())
+}
+
+// makeOverlayFS prepares and mounts the overlay filesystem of the
+// container, by the kernel or fuse-overlayfs (StorageDriver).
+// See overlaySnapshotter. Use overlayRootFS() to get the rootfs.
+func makeOverlayFS(config *overlayConfig) error {
+	o := config.snapshotter()
+	if err := o.Prepare(config); err != nil {
+		return err
+	}
+	_, err := o.Mount(config)
+	return err
+}
+
+// extractProgressInterval is the bytes extracted between the progress logs.
+const extractProgressInterval = 64 << 20
+
+// extractImage extracts the image (a tar file, maybe compressed) to the
+// target path, with the pure Go extractor: no tar binary is required.
+//
+// If the digest is not empty, the image extracted must have it: the one
+// verified when the container was created (see resolveImagePath). It is
+// checked on the stream extracted, so the file can not be replaced after
+// the verification. The target path is removed if it differs.
+func extractImage(imagePath string, digest string, targetPath string) error {
 	slog.Info("[host] extracting image", "imagePath", imagePath, "targetPath", targetPath)
 
 	// image file should exist and not be a directory
@@ -146,64 +227,113 @@ func extractImage(imagePath string, targetPath string) error {
 		}
 	}
 
-	// tar -xvf $imagePath -C $mountPath
-	tarCmd := exec.Command("tar", "-xvf", imagePath, "-C", targetPath)
-	if err := tarCmd.Run(); err != nil {
+	start := time.Now()
+	var reported int64
+	err := image.ExtractFile(imagePath, targetPath, image.ExtractOptions{
+		Progress: func(p image.ExtractProgress) {
+			if p.Bytes-reported >= extractProgressInterval {
+				reported = p.Bytes
+				slog.Info("[host] extracting image...", "entries", p.Entries, "bytes", p.Bytes)
+			}
+		},
+		Digest: digest,
+	})
+	if errors.Is(err, image.ErrDigestMismatch) {
+		os.RemoveAll(targetPath)
+	}
+	if err != nil {
 		return fmt.Errorf("error extracting image: %w", err)
 	}
 
+	slog.Info("[host] image extracted.", "targetPath", targetPath, "took", time.Since(start))
 	return nil
 }
 
-// mountOverlayFS mounts the overlay filesystem:
+// mountOverlayFS mounts the overlay filesystem by mount(2):
 //
-//	mount -t overlay overlay -o lowerdir=$lowerdir,upperdir=$upperdir,workdir=$workdir $mountpoint
-func mountOverlayFS(lowerdir string, upperdir string, workdir string, mountpoint string) error {
-	mountCmd := exec.Command(
-		"mount", "-t", "overlay", "overlay",
-		"-o", fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerdir, upperdir, workdir),
-		mountpoint)
+//	mount -t overlay overlay -o lowerdir=$lowerdir1:$lowerdir2,upperdir=$upperdir,workdir=$workdir $mountpoint
+//
+// The lowerdirs are top first. Without the upperdir (""), the overlayfs is
+// read-only, which requires at least two lowerdirs.
+//
+// The mount data is limited to a page. If the lowerdirs are too long,
+// they are opened and referred by the short /proc/self/fd/N paths.
+func mountOverlayFS(lowerdirs []string, upperdir string, workdir string, mountpoint string) error {
+	if len(lowerdirs) > maxOverlayLowerDirs {
+		return fmt.Errorf("%w: %d layers, at most %d", ErrTooManyLayers, len(lowerdirs), maxOverlayLowerDirs)
+	}
+
+	data := overlayMountData(lowerdirs, upperdir, workdir)
+	if len(data) >= unix.Getpagesize() {
+		var fds []string
+		for _, dir := range lowerdirs {
+			fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+			if err != nil {
+				return &MountError{Op: "open", Target: dir, Err: err}
+			}
+			defer unix.Close(fd)
+			fds = append(fds, fmt.Sprintf("/proc/self/fd/%d", fd))
+		}
+		data = overlayMountData(fds, upperdir, workdir)
+		if len(data) >= unix.Getpagesize() {
+			return fmt.Errorf("%w: the mount options are too long (%d bytes)", ErrTooManyLayers, len(data))
+		}
+	}
 
-	slog.Debug("[host] mounting overlayfs.", "command", mountCmd.String())
+	slog.Debug("[host] mounting overlayfs.", "mountpoint", mountpoint, "data", data)
+	if err := unix.Mount("overlay", mountpoint, "overlay", 0, data); err != nil {
+		return &MountError{Op: "mount", Source: "overlay", Target: mountpoint, FSType: "overlay", Data: data, Err: err}
+	}
+	return nil
+}
 
-	if err := mountCmd.Run(); err != nil {
-		return fmt.Errorf("error mounting overlayfs: %w", err)
+// overlayMountData is the options of the overlay mount.
+func overlayMountData(lowerdirs []string, upperdir string, workdir string) string {
+	data := "lowerdir=" + strings.Join(lowerdirs, ":")
+	if upperdir != "" {
+		data += fmt.Sprintf(",upperdir=%s,workdir=%s", upperdir, workdir)
 	}
+	return data
+}
 
+// bindMountReadOnly bind mounts the source dir onto the target, read-only.
+func bindMountReadOnly(source string, target string) error {
+	if err := unix.Mount(source, target, "", unix.MS_BIND, ""); err != nil {
+		return &MountError{Op: "mount", Source: source, Target: target, FSType: "bind", Err: err}
+	}
+	// the flags of a bind mount are only changed by a remount
+	if err := unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		unix.Unmount(target, 0)
+		return &MountError{Op: "remount", Target: target, Err: err}
+	}
 	return nil
 }
 
 // -- destroy an overlayfs --
 
 // destroyOverlayFS cleans up the overlay filesystem:
-//   - unmount overlayfs
+//   - unmount overlayfs (fusermount -u for fuse-overlayfs)
 //   - remove mount point, tmp work dir and the writable layer
+//
+// For a read-only container, the image is mounted by a read-only bind
+// (unless it has more than one layers): it is unmounted, and only the
+// extracted image (if any) is removed.
+// Nothing is removed if the unmount fails: the image may be still mounted.
 func destroyOverlayFS(config *overlayConfig) error {
-	err := unmountOverlayFS(config.overlayMergedDir())
-	if err != nil {
-		slog.Error("[host] cleanupOverlayFS: error unmounting overlayfs", "err", err)
-		return fmt.Errorf("error unmounting overlayfs: %w", err)
+	o := config.snapshotter()
+	if err := o.Unmount(config); err != nil {
+		return err
 	}
-
-	err = os.RemoveAll(config.overlayRootDir())
-	if err != nil {
-		slog.Error("[host] cleanupOverlayFS: error removing overlay tmp dir", "err", err)
-		return fmt.Errorf("error removing mount point: %w", err)
-	}
-
-	return nil
+	return o.Remove(config)
 }
 
-// unmountOverlayFS unmounts the overlay filesystem.
-//
-//	umount $mountpoint
+// unmountOverlayFS unmounts the overlay filesystem (or the read-only
+// bind) by umount(2).
 //
-// Do not call this function directly, use cleanupOverlayFS instead.
+// Do not call this function directly, use destroyOverlayFS instead.
 func unmountOverlayFS(mountpoint string) error {
-	umountCmd := exec.Command("umount", mountpoint)
-	if err := umountCmd.Run(); err != nil {
-		return fmt.Errorf("error unmounting overlayfs: %w", err)
+	if err := unix.Unmount(mountpoint, 0); err != nil {
+		return &MountError{Op: "umount", Target: mountpoint, Err: err}
 	}
-
 	return nil
 }
@@ -112,3 +112,42 @@ func TestOverlayFS4ImageIsDir(t *testing.T) {
 		}
 	})
 }
+
+// read-only containers use a read-only bind of the image dir as the
+// rootfs, in the work dir: no writable layer should be created, and the
+// image dir is not used directly.
+func TestOverlayFSReadOnly(t *testing.T) {
+	imageDir := t.TempDir()
+	if err := os.WriteFile(path.Join(imageDir, "hello"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &Container{
+		ID:        "overlayfstest",
+		WorkDir:   t.TempDir(),
+		ImagePath: imageDir,
+		Overlay:   true,
+		ReadOnly:  true,
+	}
+
+	if err := makeOverlayFS(config); err != nil {
+		t.Fatalf("makeOverlayFS() error = %v", err)
+	}
+	if got := config.overlayRootFS(); got != config.overlayMergedDir() {
+		t.Errorf("overlayRootFS() = %v, want %v", got, config.overlayMergedDir())
+	}
+	if got, err := os.ReadFile(path.Join(config.overlayRootFS(), "hello")); err != nil || string(got) != "world" {
+		t.Errorf("hello in the rootfs = %q, %v", got, err)
+	}
+	if err := os.WriteFile(path.Join(config.overlayRootFS(), "new"), nil, 0644); err == nil {
+		t.Errorf("the rootfs should be read-only")
+	}
+	if _, err := os.Stat(config.overlayUpperDir()); err == nil {
+		t.Errorf("upper dir should not exist")
+	}
+	if err := destroyOverlayFS(config); err != nil {
+		t.Errorf("destroyOverlayFS() error = %v", err)
+	}
+	if entries, err := os.ReadDir(imageDir); err != nil || len(entries) != 1 {
+		t.Errorf("image dir should not be changed: %v, %v", entries, err)
+	}
+}
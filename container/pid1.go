@@ -5,10 +5,9 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"path"
+	"runtime"
 	"syscall"
 
-	"github.com/google/uuid"
 	"golang.org/x/exp/slog"
 )
 
@@ -19,15 +18,14 @@ import (
 func NewParentProcess(container *Container, cmdPipeR *os.File) (cmd *exec.Cmd) {
 	cmd = exec.Command("/proc/self/exe", "init")
 
+	// CLONE_NEWUTS | CLONE_NEWPID | CLONE_NEWNS | CLONE_NEWNET | CLONE_NEWIPC
+	// by default. Except the namespaces shared with the host or joined
+	// from other containers (see startParentProcess).
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS |
-			syscall.CLONE_NEWPID |
-			syscall.CLONE_NEWNS |
-			syscall.CLONE_NEWNET |
-			syscall.CLONE_NEWIPC,
+		Cloneflags: container.Namespaces.cloneflags(),
 	}
 
-	if container.TTY {
+	if container.TTY || container.Attached {
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		cmd.Stdin = os.Stdin
@@ -44,15 +42,50 @@ func NewParentProcess(container *Container, cmdPipeR *os.File) (cmd *exec.Cmd) {
 // It is executed as the PID 1 inside the container.
 // And than core-replaced by the command.
 func RunContainerInitProcess() error {
+	// Some namespaces (e.g. cgroup) are unshared per thread.
+	// Stay on one thread until the execve.
+	runtime.LockOSThread()
+
 	slog.Info("[container] pid 1: bootstrapping...")
 	config, err := recvAndCheckConfig()
 	if err != nil {
 		return err
 	}
 
-	setupMount(config.RootDir)
+	// the host has applied the cgroup before sending the config:
+	// it's time to make the current cgroup the root.
+	if config.CgroupNamespace {
+		if err := enterCgroupNamespace(); err != nil {
+			slog.Error("[container] pid 1 failed to enter cgroup namespace.", "err", err)
+			return err
+		}
+		slog.Info("[container] pid 1 entered a new cgroup namespace.")
+	}
+
+	if config.Hostname != "" {
+		if err := syscall.Sethostname([]byte(config.Hostname)); err != nil {
+			slog.Error("[container] pid 1 failed to set hostname.", "err", err)
+			return err
+		}
+	}
+
+	if err := setupMount(config); err != nil {
+		slog.Error("[container] pid 1 failed to setup mount.", "err", err)
+		return err
+	}
 	slog.Info("[container] pid 1 setup mount.")
 
+	user, err := setupProcess(config)
+	if err != nil {
+		slog.Error("[container] pid 1 failed to setup process.", "err", err)
+		return err
+	}
+
+	if err := setupSecurity(config, user); err != nil {
+		slog.Error("[container] pid 1 failed to setup security.", "err", err)
+		return err
+	}
+
 	return execve(config.Command)
 }
 
@@ -82,12 +115,33 @@ func recvAndCheckConfig() (*InContainerConfig, error) {
 	return config, nil
 }
 
-func setupMount(rootDir string) {
+func setupMount(config *InContainerConfig) error {
 	// 阻断 shared subtree: mount --make-rprivate /
 	syscall.Mount("", "/", "", uintptr(syscall.MS_PRIVATE|syscall.MS_REC), "")
 
-	slog.Info("[container] pid 1 pivot root.", "rootDir", rootDir)
-	pivotRoot(rootDir)
+	// find cgroup hierarchies while the host mounts are still visible
+	var cgroupMounts []Mount
+	if config.CgroupNamespace {
+		procMounts, err := os.Open("/proc/self/mounts")
+		if err != nil {
+			return err
+		}
+		cgroupMounts, err = cgroupfsMounts(procMounts)
+		procMounts.Close()
+		if err != nil {
+			return fmt.Errorf("find cgroup hierarchies: %w", err)
+		}
+	}
+
+	// the host files are still visible
+	if err := bindMountAll(config.RootDir, config.BindMounts, !config.ReadOnly); err != nil {
+		return err
+	}
+
+	slog.Info("[container] pid 1 pivot root.", "rootDir", config.RootDir)
+	if err := pivotRoot(config.RootDir); err != nil {
+		return err
+	}
 
 	// I am not sure if this is necessary after a pivot_root
 	syscall.Mount("", "/", "", uintptr(syscall.MS_PRIVATE|syscall.MS_REC), "")
@@ -97,10 +151,57 @@ func setupMount(rootDir string) {
 
 	// TODO: 隔离设备环境
 	// syscall.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755")
+
+	if config.CgroupNamespace {
+		if err := mountCgroupfs(cgroupMounts, !config.ReadOnly); err != nil {
+			return err
+		}
+	}
+
+	// writable mounts (tmpfs) go before the read-only remount:
+	// the mount points may be created in the (still writable) rootfs.
+	if err := mountAll(config.Mounts, !config.ReadOnly); err != nil {
+		return err
+	}
+
+	if config.ReadOnly {
+		if err := remountRootReadOnly(); err != nil {
+			return err
+		}
+		slog.Info("[container] pid 1 remounted / read-only.")
+	}
+
+	return nil
+}
+
+// setupSecurity applies the process-level restrictions in the config.
+// The user is switched after the rlimits (raising a hard limit needs
+// root), and the no_new_privs flag is set last: it is the closest to
+// the execve.
+func setupSecurity(config *InContainerConfig, user *execUser) error {
+	if err := setRlimits(config.Rlimits); err != nil {
+		return err
+	}
+	// even for root: the supplementary groups of hind on the host are dropped
+	if err := setUser(user); err != nil {
+		return err
+	}
+	slog.Info("[container] pid 1 switched user.", "uid", user.Uid, "gid", user.Gid, "groups", user.Groups)
+	if config.NoNewPrivileges {
+		if err := setNoNewPrivs(); err != nil {
+			return err
+		}
+		slog.Info("[container] pid 1 set no_new_privs.")
+	}
+	return nil
 }
 
 // pivotRoot changes the root file system to the path newRoot.
 // And make old root (the / of host) inaccessible.
+//
+// The old root is put onto the new one by pivot_root(".", "."), and
+// detached from there: no dir is made in the newRoot for it, which may
+// be read-only (or the user's image dir).
 func pivotRoot(newRoot string) error {
 	// 0. Original:
 	//	host root: /
@@ -111,44 +212,24 @@ func pivotRoot(newRoot string) error {
 	if err := syscall.Mount(newRoot, newRoot, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
 		return fmt.Errorf("bind mount rootfs error: %v", err)
 	}
-
-	// 1. Make a directory (in the newRoot) to put the old root:
-	//	hostRoot : /path/to/image/root/.hostroot
-
-	randNameForHostRoot := ".hostroot-" + uuid.NewString()
-	// putOldRootHere is a path to put the old (host) root
-	putOldRootHere := path.Join(newRoot, randNameForHostRoot)
-	if err := os.Mkdir(putOldRootHere, 0777); err != nil {
-		return err
+	if err := syscall.Chdir(newRoot); err != nil {
+		return fmt.Errorf("chdir %s error %v", newRoot, err)
 	}
 
-	// 2. system call pivot_root(newRoot, hostRoot):
+	// 1. system call pivot_root(".", "."):
 	//
-	//	host root (old /) -> /path/to/image/root/.hostroot
 	//	container root (/path/to/image/root/) -> new /
-
-	// "/": host root -> container root
-	// and put the old root (host root) at the hostRoot
-	if err := syscall.PivotRoot(newRoot, putOldRootHere); err != nil {
+	//	host root (old /) -> mounted on top of the new /
+	if err := syscall.PivotRoot(".", "."); err != nil {
 		return fmt.Errorf("pivot_root %v", err)
 	}
 
-	// 3. After pivot_root, the old root is mounted at /path/to/image/root/.hostroot
-	// and we are in the new root (/) (original /path/to/image/root/)
-
-	if err := syscall.Chdir("/"); err != nil {
-		return fmt.Errorf("chdir / error %v", err)
-	}
-
-	// 4. Finally, unmount the old root (mounted at /path/to/image/root/.hostroot).
-
-	oldRootInNewRoot := path.Join("/", randNameForHostRoot)
-
-	if err := syscall.Unmount(oldRootInNewRoot, syscall.MNT_DETACH); err != nil {
+	// 2. Finally, unmount the old root, which is on top of the "." (the
+	// new root) we are still in.
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
 		return fmt.Errorf("unmount pivot_root dir %v", err)
 	}
-
-	return os.Remove(oldRootInNewRoot)
+	return syscall.Chdir("/")
 }
 
 // execve looks for the command and replaces the current process with it.
@@ -172,4 +253,25 @@ var (
 	ErrEmptyCommand = errors.New("empty command")
 	ErrEmptyRootDir = errors.New("empty root dir")
 	ErrNilConfig    = errors.New("nil config")
+	ErrBadRlimit    = errors.New("bad rlimit")
+	ErrBadMount     = errors.New("bad mount")
+	ErrBadUser      = errors.New("bad user")
+
+	ErrTooManyLayers      = errors.New("too many layers")
+	ErrBadStorageDriver   = errors.New("bad storage driver")
+	ErrReflinkUnsupported = errors.New("reflink is not supported")
+	ErrNoSnapshot         = errors.New("no snapshot of the changes")
+	ErrBadHindfile        = errors.New("bad hindfile")
+	ErrBuildFailed        = errors.New("build failed")
+
+	ErrBadNamespaceMode    = errors.New("bad namespace mode")
+	ErrNoSuchContainer     = errors.New("no such container")
+	ErrContainerNotRunning = errors.New("container is not running")
+	ErrContainerRunning    = errors.New("container is running")
+	ErrNoSuchPod           = errors.New("no such pod")
+	ErrPodNotRunning       = errors.New("pod is not running")
+	ErrNoSuchNetwork       = errors.New("no such network")
+	ErrNetworkInUse        = errors.New("network is in use")
+	ErrBadDNS              = errors.New("bad dns")
+	ErrBadExtraHost        = errors.New("bad extra host")
 )
@@ -0,0 +1,418 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"hind/cgroups"
+	"hind/internal/atomicfile"
+	"hind/network"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/exp/slog"
+)
+
+// This file implements pods: groups of containers sharing the
+// network, IPC and UTS namespaces.
+//
+// A pod has an infra process holding the shared namespaces, and a
+// pod-level cgroup that is the parent of the members' cgroups:
+//
+//	/sys/fs/cgroup/<subsystem>/hind/<podID>/<containerID>
+//
+// So the resources limits of the pod apply to all its members.
+//
+// The pods are persisted under the data root (like the containers):
+//
+//	<DataRoot>/pods/<podID>/state.json
+
+// Pod is the host's view of a pod.
+type Pod struct {
+	ID             string
+	Name           string
+	Created        time.Time
+	Status         PodStatus
+	InfraPid       int    // the pid (in the host) of the infra process
+	InfraStartTime uint64 // the start time of the infra process, see Container.PidStartTime
+	Resources      *cgroups.Resources
+
+	NetworkEndpoint *network.Endpoint // the connection of the pod netns to the default network
+}
+
+// PodStatus is the status of a pod.
+type PodStatus string
+
+const (
+	PodCreated PodStatus = "created"
+	PodRunning PodStatus = "running"
+	PodStopped PodStatus = "stopped"
+)
+
+// podNamespaces are the namespaces shared by the members of a pod.
+// Other namespaces of the members are private by default.
+var podNamespaces = []string{"net", "ipc", "uts"}
+
+// -- state store --
+
+func podsDir() string {
+	return path.Join(DataRoot, "pods")
+}
+
+func (p *Pod) stateDir() string {
+	return path.Join(podsDir(), p.ID)
+}
+
+func (p *Pod) save() error {
+	if err := os.MkdirAll(p.stateDir(), 0700); err != nil {
+		return fmt.Errorf("save pod: %w", err)
+	}
+	if err := atomicfile.WriteJSON(path.Join(p.stateDir(), "state.json"), p); err != nil {
+		return fmt.Errorf("save pod: %w", err)
+	}
+	return nil
+}
+
+func loadPod(id string) (*Pod, error) {
+	data, err := os.ReadFile(path.Join(podsDir(), id, "state.json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchPod, id)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var p Pod
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("bad state of pod %s: %w", id, err)
+	}
+	if p.Status == PodRunning && !processAlive(p.InfraPid, p.InfraStartTime) {
+		p.Status = PodStopped
+	}
+	return &p, nil
+}
+
+// ListPods returns all the pods, sorted by the creation time.
+func ListPods() ([]*Pod, error) {
+	entries, err := os.ReadDir(podsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var pods []*Pod
+	for _, e := range entries {
+		p, err := loadPod(e.Name())
+		if err != nil {
+			slog.Warn("[host] ListPods: skip bad pod state.", "id", e.Name(), "err", err)
+			continue
+		}
+		pods = append(pods, p)
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].Created.Before(pods[j].Created)
+	})
+	return pods, nil
+}
+
+// LoadPod finds a pod by the full ID, the name or an unique prefix of the ID.
+func LoadPod(idOrName string) (*Pod, error) {
+	if idOrName == "" {
+		return nil, fmt.Errorf("%w: empty id or name", ErrNoSuchPod)
+	}
+	if p, err := loadPod(idOrName); err == nil {
+		return p, nil
+	} else if !errors.Is(err, ErrNoSuchPod) {
+		return nil, err
+	}
+
+	pods, err := ListPods()
+	if err != nil {
+		return nil, err
+	}
+	var found []*Pod
+	for _, p := range pods {
+		if p.Name == idOrName {
+			return p, nil
+		}
+		if strings.HasPrefix(p.ID, idOrName) {
+			found = append(found, p)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchPod, idOrName)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("ambiguous pod id prefix %q: %d matches", idOrName, len(found))
+	}
+}
+
+// Members returns the containers (in the state store) of the pod.
+func (p *Pod) Members() ([]*Container, error) {
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+	var members []*Container
+	for _, c := range containers {
+		if c.Pod == p.ID {
+			members = append(members, c)
+		}
+	}
+	return members, nil
+}
+
+// IsRunning reports whether the infra process of the pod is alive.
+func (p *Pod) IsRunning() bool {
+	return p.Status == PodRunning && processAlive(p.InfraPid, p.InfraStartTime)
+}
+
+// -- cgroup --
+
+// cgroupName is hind/<podID>
+func (p *Pod) cgroupName() string {
+	return DefaultCgroupHind + "/" + p.ID
+}
+
+// -- lifecycle --
+
+// CreatePod creates a pod with its cgroup. The pod is not started.
+func CreatePod(name string, resources *cgroups.Resources) (*Pod, error) {
+	p := &Pod{
+		ID:        randContainerID(),
+		Name:      name,
+		Created:   time.Now(),
+		Status:    PodCreated,
+		Resources: resources,
+	}
+	if p.Name == "" {
+		p.Name = randContainerName(p.ID)
+	}
+	if p.Resources == nil {
+		p.Resources = &cgroups.Resources{}
+	}
+
+	if _, err := LoadPod(p.Name); err == nil {
+		return nil, fmt.Errorf("pod name %q is already in use", p.Name)
+	}
+
+	// always try to reinit the parent (/sys/fs/cgroup/<subsystem>/hind/)
+	if _, err := cgroups.NewV1fsManager(DefaultCgroupBasePath, DefaultCgroupHind); err != nil {
+		return nil, fmt.Errorf("create pod cgroup: %w", err)
+	}
+	m, err := cgroups.NewV1fsManager(DefaultCgroupBasePath, p.cgroupName())
+	if err != nil {
+		return nil, fmt.Errorf("create pod cgroup: %w", err)
+	}
+	if err := m.Set(*p.Resources); err != nil {
+		m.Destroy()
+		return nil, fmt.Errorf("set pod resources: %w", err)
+	}
+
+	if err := p.save(); err != nil {
+		m.Destroy()
+		return nil, err
+	}
+	slog.Info("[host] pod created.", "id", p.ID, "name", p.Name)
+	return p, nil
+}
+
+// Start starts the infra process of the pod in new net, IPC and
+// UTS namespaces. The infra process is detached: it keeps running
+// (holding the namespaces) after hind exits, until the pod is stopped.
+func (p *Pod) Start() error {
+	if p.IsRunning() {
+		return nil
+	}
+
+	cmd := exec.Command("/proc/self/exe", "infra", p.ID)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		Setsid:     true,
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start pod infra process: %w", err)
+	}
+
+	// the infra process stays in the pod cgroup: hind/<podID>, created
+	// with the resources of the pod by CreatePod
+	m := cgroups.LoadV1fsManager(DefaultCgroupBasePath, p.cgroupName())
+	if err := m.Apply(cmd.Process.Pid); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("apply pod cgroup: %w", err)
+	}
+
+	ns, err := netns.GetFromPid(cmd.Process.Pid)
+	if err == nil {
+		p.NetworkEndpoint, err = connectNetwork(ns, defaultNetwork(), p.ID, 0)
+		ns.Close()
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("setup pod network: %w", err)
+	}
+
+	p.InfraPid = cmd.Process.Pid
+	p.InfraStartTime = processStartTime(p.InfraPid)
+	p.Status = PodRunning
+	cmd.Process.Release()
+
+	slog.Info("[host] pod started.", "id", p.ID, "infraPid", p.InfraPid)
+	return p.save()
+}
+
+// Stop stops the running members and then the infra process of the pod.
+func (p *Pod) Stop(timeout time.Duration) error {
+	members, err := p.Members()
+	if err != nil {
+		return err
+	}
+	for _, c := range members {
+		if c.IsRunning() {
+			slog.Info("[host] stopping pod member.", "pod", p.ID, "container", c.ID)
+			stopProcess(c.Pid, c.PidStartTime, timeout)
+		}
+	}
+
+	if p.IsRunning() {
+		stopProcess(p.InfraPid, p.InfraStartTime, timeout)
+	}
+	if p.NetworkEndpoint != nil {
+		disconnectEndpoint(p.NetworkEndpoint, p.ID)
+	}
+
+	p.Status = PodStopped
+	p.InfraPid = 0
+	p.InfraStartTime = 0
+	p.NetworkEndpoint = nil
+	slog.Info("[host] pod stopped.", "id", p.ID)
+	return p.save()
+}
+
+// Remove deletes a stopped pod with its cgroup, and its (exited) members.
+// If force, a running pod is stopped first.
+func (p *Pod) Remove(force bool) error {
+	if p.IsRunning() {
+		if !force {
+			return fmt.Errorf("pod %s is running: stop it first or force", p.Name)
+		}
+		if err := p.Stop(DefaultStopTimeout); err != nil {
+			return err
+		}
+	}
+
+	members, err := p.Members()
+	if err != nil {
+		return err
+	}
+	for _, c := range members {
+		if c.IsRunning() {
+			return fmt.Errorf("pod %s has a running member: %s", p.Name, c.ID)
+		}
+	}
+	for _, c := range members {
+		if err := Remove(c, false); err != nil {
+			return fmt.Errorf("remove pod member %s: %w", c.Name, err)
+		}
+	}
+
+	cgroups.LoadV1fsManager(DefaultCgroupBasePath, p.cgroupName()).Destroy()
+
+	if err := os.RemoveAll(p.stateDir()); err != nil {
+		return fmt.Errorf("remove pod: %w", err)
+	}
+	slog.Info("[host] pod removed.", "id", p.ID)
+	return nil
+}
+
+// DefaultStopTimeout is the time to wait for a process to exit after SIGTERM,
+// before it is killed.
+const DefaultStopTimeout = 10 * time.Second
+
+// stopProcess sends SIGTERM to the process, and SIGKILL if it
+// does not exit in the timeout. Nothing is sent to another process
+// that reuses the pid (see processAlive).
+func stopProcess(pid int, startTime uint64, timeout time.Duration) {
+	if !processAlive(pid, startTime) {
+		return
+	}
+	syscall.Kill(pid, syscall.SIGTERM)
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !processAlive(pid, startTime) || processZombie(pid) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	syscall.Kill(pid, syscall.SIGKILL)
+}
+
+// processZombie reports whether the process has exited but
+// not been reaped by its parent.
+func processZombie(pid int) bool {
+	fields := procStatFields(pid)
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+// joinPod makes the container a member of its pod (container.Pod):
+// the net, IPC and UTS namespaces are joined from the pod infra process,
+// and the cgroup is nested in the pod cgroup.
+//
+// The pod must be running.
+func joinPod(container *Container) error {
+	if container.Pod == "" {
+		return nil
+	}
+
+	p, err := LoadPod(container.Pod)
+	if err != nil {
+		return err
+	}
+	if !p.IsRunning() {
+		return fmt.Errorf("%w: %s", ErrPodNotRunning, p.Name)
+	}
+	container.Pod = p.ID
+
+	modes := map[string]*NamespaceMode{
+		"net": &container.Namespaces.Net,
+		"ipc": &container.Namespaces.Ipc,
+		"uts": &container.Namespaces.Uts,
+	}
+	for _, ns := range podNamespaces {
+		if !modes[ns].IsPrivate() {
+			return fmt.Errorf("%w: the %s namespace of a pod member is the pod's, got %q",
+				ErrBadNamespaceMode, ns, *modes[ns])
+		}
+		*modes[ns] = NamespaceMode(namespacePodPrefix + p.ID)
+	}
+
+	slog.Info("[host] container joins pod.", "container", container.ID, "pod", p.ID)
+	return nil
+}
+
+// RunPodInfraProcess is the infra process of a pod.
+// It holds the namespaces of the pod and does nothing until
+// it is terminated (SIGTERM or SIGINT).
+func RunPodInfraProcess(podID string) error {
+	slog.Info("[pod] infra process started.", "pod", podID, "pid", os.Getpid())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	s := <-sig
+
+	slog.Info("[pod] infra process exiting.", "pod", podID, "signal", s)
+	return nil
+}
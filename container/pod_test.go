@@ -0,0 +1,72 @@
+package container
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_joinPod(t *testing.T) {
+	DataRoot = t.TempDir()
+	defer func() { DataRoot = DefaultDataRoot }()
+
+	running := &Pod{ID: "pod-running-id", Name: "running", Created: time.Now(), Status: PodRunning, InfraPid: os.Getpid()}
+	stopped := &Pod{ID: "pod-stopped-id", Name: "stopped", Created: time.Now(), Status: PodStopped}
+	for _, p := range []*Pod{running, stopped} {
+		if err := p.save(); err != nil {
+			t.Fatalf("save() error = %v", err)
+		}
+	}
+
+	t.Run("join", func(t *testing.T) {
+		c := &Container{ID: "c1", Pod: "running"}
+		if err := joinPod(c); err != nil {
+			t.Fatalf("joinPod() error = %v", err)
+		}
+		if c.Pod != running.ID {
+			t.Errorf("container.Pod = %v, want %v", c.Pod, running.ID)
+		}
+		want := NamespaceMode(namespacePodPrefix + running.ID)
+		if c.Namespaces.Net != want || c.Namespaces.Ipc != want || c.Namespaces.Uts != want {
+			t.Errorf("container.Namespaces = %+v, want net, ipc and uts %v", c.Namespaces, want)
+		}
+		if !c.Namespaces.Pid.IsPrivate() {
+			t.Errorf("container.Namespaces.Pid = %v, want private", c.Namespaces.Pid)
+		}
+		if got := c.cgroupName(); got != "hind/pod-running-id/c1" {
+			t.Errorf("cgroupName() = %v, want hind/pod-running-id/c1", got)
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		c := &Container{ID: "c2", Pod: "running", Namespaces: Namespaces{Net: NamespaceHost}}
+		if err := joinPod(c); !errors.Is(err, ErrBadNamespaceMode) {
+			t.Errorf("joinPod() error = %v, want ErrBadNamespaceMode", err)
+		}
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		c := &Container{ID: "c3", Pod: "stopped"}
+		if err := joinPod(c); !errors.Is(err, ErrPodNotRunning) {
+			t.Errorf("joinPod() error = %v, want ErrPodNotRunning", err)
+		}
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		c := &Container{ID: "c4", Pod: "nope"}
+		if err := joinPod(c); !errors.Is(err, ErrNoSuchPod) {
+			t.Errorf("joinPod() error = %v, want ErrNoSuchPod", err)
+		}
+	})
+
+	t.Run("members", func(t *testing.T) {
+		if err := saveState(&Container{ID: "c5", Pod: running.ID}); err != nil {
+			t.Fatalf("saveState() error = %v", err)
+		}
+		members, err := running.Members()
+		if err != nil || len(members) != 1 || members[0].ID != "c5" {
+			t.Errorf("Members() = %v, %v, want [c5]", members, err)
+		}
+	})
+}
@@ -0,0 +1,333 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"hind/image"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinks is the limit of symlinks followed resolving a path in the
+// rootfs, as the kernel's MAXSYMLINKS.
+const maxSymlinks = 40
+
+// layeredFS is the merged view of the layers (the top first) in the
+// overlayfs form, as an overlay mount of them, but read from the host
+// without mounting: a whiteout (a 0:0 char device) deletes the file in
+// the layers below, an opaque dir hides the dirs below, and a non-dir
+// hides everything below.
+//
+// A single layer is a plain dir: e.g. the mounted rootfs of a running
+// container.
+//
+// The paths in a layeredFS are relative to its root, cleaned, without
+// the leading "/". The root is ".".
+type layeredFS struct {
+	layers []string
+}
+
+// lookup finds the file of the path in the topmost layer having it.
+func (l layeredFS) lookup(rel string) (file string, st *unix.Stat_t, ok bool) {
+	rel = cleanRel(rel)
+	if rel == "." {
+		if len(l.layers) == 0 {
+			return "", nil, false
+		}
+		st = &unix.Stat_t{}
+		if err := unix.Lstat(l.layers[0], st); err != nil {
+			return "", nil, false
+		}
+		return l.layers[0], st, true
+	}
+
+	parts := strings.Split(rel, "/")
+	for _, layer := range l.layers {
+		p := layer
+		hidden := false // the layers below are hidden by an opaque parent
+		for i, part := range parts {
+			p = filepath.Join(p, part)
+			var st unix.Stat_t
+			if err := unix.Lstat(p, &st); err != nil {
+				break // not in this layer
+			}
+			if isWhiteout(&st) {
+				return "", nil, false
+			}
+			if i == len(parts)-1 {
+				return p, &st, true
+			}
+			if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+				return "", nil, false // a file or symlink in the place of the parent dir
+			}
+			if isOpaqueDir(p) {
+				hidden = true
+			}
+		}
+		if hidden {
+			return "", nil, false
+		}
+	}
+	return "", nil, false
+}
+
+// exists reports whether the path is in the merged view.
+func (l layeredFS) exists(rel string) bool {
+	_, _, ok := l.lookup(rel)
+	return ok
+}
+
+// readDir is the names in the dir in the merged view, sorted.
+func (l layeredFS) readDir(rel string) []string {
+	rel = cleanRel(rel)
+	seen := map[string]bool{}
+	var names []string
+	for _, layer := range l.layers {
+		dir := filepath.Join(layer, rel)
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			if seen[e.Name()] {
+				continue
+			}
+			seen[e.Name()] = true
+			if l.exists(path.Join(rel, e.Name())) {
+				names = append(names, e.Name())
+			}
+		}
+		if st, err := os.Lstat(dir); err == nil && (!st.IsDir() || isOpaqueDir(dir)) {
+			break // hides the layers below
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolve resolves the path (absolute, or relative to the root) in the
+// merged view, following the symlinks as if the root were "/": a path
+// never goes out of the root. The last element is followed if
+// followLast. A missing last element is kept as it is.
+func (l layeredFS) resolve(p string, followLast bool) (string, error) {
+	resolved := "."
+	rest := strings.Split(cleanRel(p), "/")
+	for links := 0; len(rest) > 0; {
+		part := rest[0]
+		rest = rest[1:]
+		if part == "." || part == "" {
+			continue
+		}
+		next := path.Join(resolved, part)
+		if part == ".." {
+			resolved = cleanRel(path.Dir(resolved))
+			continue
+		}
+
+		file, st, ok := l.lookup(next)
+		if !ok {
+			if len(rest) > 0 {
+				return "", fmt.Errorf("%s: %w", "/"+next, os.ErrNotExist)
+			}
+			resolved = next
+			break
+		}
+		if st.Mode&unix.S_IFMT != unix.S_IFLNK || (len(rest) == 0 && !followLast) {
+			if len(rest) > 0 && st.Mode&unix.S_IFMT != unix.S_IFDIR {
+				return "", fmt.Errorf("%s: not a directory", "/"+next)
+			}
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", "/"+next)
+		}
+		target, err := os.Readlink(file)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "."
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return resolved, nil
+}
+
+// walk calls fn for the file of the path and the ones under it (if a
+// dir) in the merged view, the parents first.
+func (l layeredFS) walk(rel string, fn func(rel string, file string, st *unix.Stat_t) error) error {
+	rel = cleanRel(rel)
+	file, st, ok := l.lookup(rel)
+	if !ok {
+		return fmt.Errorf("%s: %w", "/"+rel, os.ErrNotExist)
+	}
+	if err := fn(rel, file, st); err != nil {
+		return err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return nil
+	}
+	for _, name := range l.readDir(rel) {
+		if err := l.walk(path.Join(rel, name), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archive writes the tar of the file of the path, and the ones under it,
+// in the merged view. The file is named as the name in the archive;
+// with an empty name, only the ones under it are archived, relative to it.
+//
+// A single layer may be changed meanwhile (the rootfs of a running
+// container): its files are read through fds, see archiveInRoot.
+func (l layeredFS) archive(w io.Writer, rel string, name string) error {
+	rel = cleanRel(rel)
+	a := image.NewArchiver(w)
+	var err error
+	if len(l.layers) == 1 {
+		err = archiveInRoot(a, l.layers[0], rel, name)
+	} else {
+		err = l.walk(rel, func(p string, file string, st *unix.Stat_t) error {
+			sub, _ := filepath.Rel(rel, p)
+			if name == "" && sub == "." {
+				return nil
+			}
+			return a.Add(path.Join(name, sub), file)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return a.Close()
+}
+
+// archiveInRoot archives the file of the path in the root dir as
+// layeredFS.archive. The file is opened in the root (see
+// image.OpenInRoot), and the ones under it relative to their parent
+// dirs, never following a symlink: a dir replaced by a symlink to "/"
+// meanwhile does not take the archive out of the root.
+func archiveInRoot(a *image.Archiver, root string, rel string, name string) error {
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(rootFd)
+
+	fd, err := image.OpenInRoot(rootFd, rel, unix.O_NOFOLLOW)
+	if err != nil {
+		return fmt.Errorf("%s: %w", "/"+rel, err)
+	}
+	defer unix.Close(fd)
+	return archiveFd(a, fd, name)
+}
+
+// archiveFd archives the file of the O_PATH fd as the name (unless
+// empty), and the ones under it if a dir.
+func archiveFd(a *image.Archiver, fd int, name string) error {
+	if name != "" {
+		if err := a.AddFd(name, fd); err != nil {
+			return err
+		}
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return nil
+	}
+
+	dirFd, err := unix.Openat(fd, ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", "/"+name, err)
+	}
+	dir := os.NewFile(uintptr(dirFd), name)
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, child := range names {
+		childFd, err := unix.Openat(fd, child, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if errors.Is(err, unix.ENOENT) {
+			continue // removed meanwhile
+		} else if err != nil {
+			return fmt.Errorf("open %s: %w", path.Join("/"+name, child), err)
+		}
+		err = archiveFd(a, childFd, path.Join(name, child))
+		unix.Close(childFd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanRel cleans the path relative to the root: "/a/../b/" -> "b".
+func cleanRel(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// hostRootFS is the rootfs of the running container on the host, as
+// mounted by its Snapshotter.
+func (c *Container) hostRootFS() string {
+	switch {
+	case !c.Overlay:
+		return c.ImagePath
+	case c.StorageDriver == StorageDriverVFS || c.StorageDriver == StorageDriverReflink:
+		rootfs, _ := copySnapshotter{}.Mount(c)
+		return rootfs
+	default:
+		return c.overlayRootFS()
+	}
+}
+
+// rootFS is the merged view of the rootfs of the container. The rootfs
+// of a running container is mounted. The one of a stopped container is
+// its writable layer (if any) on top of the image layers, as the overlay
+// mount would be. The top layer is where the changes go.
+func (c *Container) rootFS() (layeredFS, error) {
+	var layers []string
+	switch {
+	case c.IsRunning(), !c.Overlay:
+		layers = []string{c.hostRootFS()}
+	case c.StorageDriver == StorageDriverVFS || c.StorageDriver == StorageDriverReflink:
+		layers = []string{c.hostRootFS()}
+	case c.ReadOnly:
+		layers = c.overlayLowerDirs()
+	default:
+		layers = append([]string{c.overlayUpperDir()}, c.overlayLowerDirs()...)
+	}
+
+	if _, err := os.Stat(layers[0]); err != nil {
+		return layeredFS{}, fmt.Errorf("%w: %v", ErrNoSnapshot, err)
+	}
+	return layeredFS{layers}, nil
+}
+
+// processRootFS is the rootfs of the container as its processes see it:
+// the root of the pid 1 (/proc/<pid>/root), with the mounts in the
+// container (volumes, tmpfs...), if it is running. Else its rootFS.
+func (c *Container) processRootFS() (layeredFS, error) {
+	if !c.IsRunning() {
+		return c.rootFS()
+	}
+	root := fmt.Sprintf("/proc/%d/root", c.Pid)
+	if _, err := os.Stat(root); err != nil {
+		return layeredFS{}, fmt.Errorf("%w: %v", ErrNoSnapshot, err)
+	}
+	return layeredFS{[]string{root}}, nil
+}
@@ -0,0 +1,233 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestLayeredFS_resolve(t *testing.T) {
+	root := t.TempDir()
+	makeDirTree(t, root, map[string]string{
+		"etc/passwd":  "root",
+		"usr/bin/sh":  "#!",
+		"bin":         "->usr/bin",
+		"abs":         "->/etc/passwd",
+		"escape":      "->../../../../etc",
+		"loop":        "->loop",
+		"usr/lib/up":  "->../../etc",
+		"usr/lib/bad": "->passwd/x",
+	})
+	l := layeredFS{[]string{root}}
+
+	tests := []struct {
+		path       string
+		followLast bool
+		want       string
+		wantErr    bool
+	}{
+		{"/", true, ".", false},
+		{"/bin/sh", true, "usr/bin/sh", false},
+		{"/bin", false, "bin", false},
+		{"/bin", true, "usr/bin", false},
+		{"abs", true, "etc/passwd", false},
+		{"/escape/passwd", true, "etc/passwd", false}, // never out of the root
+		{"/../../etc/passwd", true, "etc/passwd", false},
+		{"/usr/lib/up/passwd", true, "etc/passwd", false},
+		{"/etc/new", true, "etc/new", false},
+		{"/nope/new", true, "", true},
+		{"/etc/passwd/x", true, "", true},
+		{"/loop", true, "", true},
+		{"/loop", false, "loop", false},
+	}
+	for _, tt := range tests {
+		got, err := l.resolve(tt.path, tt.followLast)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("resolve(%q, %v) = %q, %v; want %q, error %v", tt.path, tt.followLast, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLayeredFS(t *testing.T) {
+	base, top := t.TempDir(), t.TempDir()
+	makeDirTree(t, base, map[string]string{
+		"etc/passwd": "root",
+		"etc/group":  "root",
+		"opt/a":      "a",
+		"opt/b":      "b",
+		"var/log/x":  "x",
+	})
+	makeDirTree(t, top, map[string]string{
+		"etc/group":   "whiteout",
+		"etc/passwd":  "changed",
+		"opt/c":       "c",
+		"var":         "a file in the place of the dir",
+		"usr/local/":  "",
+		"usr/local/d": "d",
+	})
+	if err := unix.Setxattr(path.Join(top, "opt"), overlayOpaqueXattr, []byte("y"), 0); err != nil {
+		t.Skipf("no trusted xattrs: %v", err)
+	}
+	l := layeredFS{[]string{top, base}}
+
+	for dir, want := range map[string][]string{
+		".":   {"etc", "opt", "usr", "var"},
+		"etc": {"passwd"},
+		"opt": {"c"},
+	} {
+		if got := l.readDir(dir); !reflect.DeepEqual(got, want) {
+			t.Errorf("readDir(%q) = %v, want %v", dir, got, want)
+		}
+	}
+	for _, p := range []string{"etc/group", "opt/a", "var/log/x", "nope"} {
+		if l.exists(p) {
+			t.Errorf("exists(%q) = true, want false", p)
+		}
+	}
+
+	// Export: the merged view
+	c := &Container{ID: "rootfs-test", WorkDir: t.TempDir(), Overlay: true, ImagePath: top, ImageLayers: []string{top, base}}
+	os.MkdirAll(path.Dir(c.overlayUpperDir()), 0755)
+	if err := os.Rename(top, c.overlayUpperDir()); err != nil {
+		t.Fatal(err)
+	}
+	c.ImageLayers = []string{base}
+
+	var buf bytes.Buffer
+	if err := Export(c, &buf); err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		files[hdr.Name] = string(data)
+	}
+	want := map[string]string{
+		"etc/": "", "etc/passwd": "changed",
+		"opt/": "", "opt/c": "c",
+		"usr/": "", "usr/local/": "", "usr/local/d": "d",
+		"var": "a file in the place of the dir",
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("Export() = %v, want %v", files, want)
+	}
+}
+
+func TestCopyToContainer(t *testing.T) {
+	base := t.TempDir()
+	makeDirTree(t, base, map[string]string{
+		"etc/app/old": "old",
+		"srv/www/a":   "a",
+		"lnk":         "->/etc/app",
+	})
+	if err := os.Chmod(path.Join(base, "etc/app"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	c := &Container{ID: "cp-test", WorkDir: t.TempDir(), Overlay: true, ImagePath: base, ImageLayers: []string{base}}
+	makeDirTree(t, c.overlayUpperDir(), map[string]string{"srv/www": "whiteout"})
+
+	src := t.TempDir()
+	makeDirTree(t, src, map[string]string{"conf": "new", "www/b": "b"})
+
+	// into a dir through a symlink: the parents are copied up
+	if err := CopyToContainer(c, path.Join(src, "conf"), "/lnk", false); err != nil {
+		t.Fatalf("CopyToContainer() error = %v", err)
+	}
+	if fi, err := os.Stat(path.Join(c.overlayUpperDir(), "etc/app")); err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("copied up etc/app: %v, %v; want mode 0750", fi, err)
+	}
+	if got, err := os.ReadFile(path.Join(c.overlayUpperDir(), "etc/app/conf")); err != nil || string(got) != "new" {
+		t.Errorf("etc/app/conf = %q, %v", got, err)
+	}
+
+	// a dir in the place of a deleted one
+	if err := CopyToContainer(c, path.Join(src, "www"), "/srv/www", false); err != nil {
+		t.Fatalf("CopyToContainer() error = %v", err)
+	}
+	rootfs, err := c.rootFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rootfs.readDir("srv/www"); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("srv/www = %v, want [b]", got)
+	}
+
+	// and back
+	dst := t.TempDir()
+	if err := CopyFromContainer(c, "/lnk/conf", path.Join(dst, "conf.bak"), false); err != nil {
+		t.Fatalf("CopyFromContainer() error = %v", err)
+	}
+	if got, err := os.ReadFile(path.Join(dst, "conf.bak")); err != nil || string(got) != "new" {
+		t.Errorf("conf.bak = %q, %v", got, err)
+	}
+	if err := CopyFromContainer(c, "/etc", path.Join(dst, "conf.bak"), false); err == nil {
+		t.Errorf("CopyFromContainer() a dir to a file: no error")
+	}
+
+	c.ReadOnly = true
+	if err := CopyToContainer(c, path.Join(src, "conf"), "/", false); err == nil {
+		t.Errorf("CopyToContainer() to a read-only container: no error")
+	}
+}
+
+func TestLayeredFS_archiveSwapped(t *testing.T) {
+	// a running container replaces a dir by a symlink out of its rootfs,
+	// again and again, while the rootfs is archived (docker cp, export)
+	root, outside := t.TempDir(), t.TempDir()
+	files := map[string]string{"link": "->" + outside}
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("a/f%d", i)] = "in"
+		makeDirTree(t, outside, map[string]string{fmt.Sprintf("f%d", i): "outside"})
+	}
+	makeDirTree(t, root, files)
+
+	done := make(chan struct{})
+	swapped := make(chan struct{})
+	go func() {
+		defer close(swapped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				unix.Renameat2(unix.AT_FDCWD, path.Join(root, "a"), unix.AT_FDCWD, path.Join(root, "link"), unix.RENAME_EXCHANGE)
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		<-swapped
+	}()
+
+	l := layeredFS{[]string{root}}
+	for i := 0; i < 300; i++ {
+		var buf bytes.Buffer
+		if err := l.archive(&buf, ".", ""); err != nil {
+			continue // the rootfs is changed meanwhile
+		}
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			if data, _ := io.ReadAll(tr); string(data) == "outside" {
+				t.Fatalf("archive() read %s out of the rootfs", hdr.Name)
+			}
+		}
+	}
+}
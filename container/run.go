@@ -1,10 +1,14 @@
 package container
 
 import (
+	"errors"
 	"fmt"
 	"hind/cgroups"
+	"hind/internal/stringid"
 	"os"
+	"os/exec"
 	"path"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -24,6 +28,98 @@ func Run(container *Container) error {
 		return err
 	}
 
+	if err := joinPod(container); err != nil {
+		slog.Error("[host] failed to join pod.", "err", err)
+		return err
+	}
+
+	container.Created = time.Now()
+	container.Status = StatusCreated
+
+	return start(container)
+}
+
+// Start runs a stopped container again, with the same config, on the
+// rootfs kept from its last run: the changes in it are still there.
+// The container is run in the foreground, as Run does.
+//
+// This function is executed in the host namespace.
+func Start(container *Container) error {
+	slog.Info("[host] start container.", "id", container.ID, "name", container.Name)
+
+	if container.IsRunning() {
+		return fmt.Errorf("%w: %s", ErrContainerRunning, container.Name)
+	}
+	if container.Pod != "" {
+		p, err := LoadPod(container.Pod)
+		if err != nil {
+			return err
+		}
+		if !p.IsRunning() {
+			return fmt.Errorf("%w: %s", ErrPodNotRunning, p.Name)
+		}
+	}
+	if err := verifyContainerImage(container); err != nil {
+		return err
+	}
+
+	// the runtime states of the last run
+	container.Pid = 0
+	container.PidStartTime = 0
+	container.NetworkEndpoints = nil
+	container.CNIAttachments = nil
+	container.FuseOverlayPid = 0
+
+	return start(container)
+}
+
+// StartDetached starts the stopped container in a detached hind process
+// (`hind start --attach`), which supervises it as Start does, and keeps
+// running after this one exits. It returns when the container is running.
+// The STDIN, STDOUT and STDERR of the container are /dev/null.
+func StartDetached(container *Container) error {
+	if container.IsRunning() {
+		return fmt.Errorf("%w: %s", ErrContainerRunning, container.Name)
+	}
+	since := time.Now()
+
+	cmd := exec.Command("/proc/self/exe", "--data-root", DataRoot, "start", "--attach", container.ID)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start the supervisor process: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	for {
+		var exitErr error
+		done := false
+		select {
+		case exitErr = <-exited:
+			done = true
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		c, err := loadState(container.ID)
+		if err == nil && !c.Started.Before(since) { // running, or even exited already
+			*container = *c
+			slog.Info("[host] container started.", "id", c.ID, "pid", c.Pid)
+			return nil
+		}
+		if done {
+			return fmt.Errorf("the container %s failed to start: %v", container.Name, exitErr)
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// start sets up the container, runs its command and waits for it to
+// exit. After that, the container is kept in the state store (with its
+// rootfs) as exited, or removed if AutoRemove.
+func start(container *Container) error {
 	// create pipe to send command to the container
 	cmdPipeR, cmdPipeW, err := os.Pipe()
 	if err != nil {
@@ -33,14 +129,27 @@ func Run(container *Container) error {
 
 	// create container process: PID 1 in the container
 	containerExe := NewParentProcess(container, cmdPipeR)
-	if err := containerExe.Start(); err != nil {
+	if err := startParentProcess(container, containerExe); err != nil {
 		slog.Error("[host] Failed to start the parent process.", "err", err)
+		return err
 	}
 	container.Process = containerExe.Process
+	container.Pid = container.Process.Pid
+	container.PidStartTime = processStartTime(container.Pid)
 	slog.Info("[host] container process started.", "pid", container.Process.Pid)
 
-	// the work dir should be cleaned up at the very end. So it is deferred first.
-	defer cleanupWorkDir(container)
+	// the container is kept (or removed) at the very end, after all the
+	// cleanups. So it is deferred first.
+	defer exitContainer(container)
+
+	container.Started = time.Now()
+	container.Status = StatusRunning
+	container.ExitCode = -1 // until it exits normally
+	if err := saveState(container); err != nil {
+		slog.Error("[host] Failed to save container state. Kill the container.", "err", err)
+		container.Process.Kill()
+		return err
+	}
 
 	// cgroup setup
 	cgroupCleanup, err := setupCgroup(container)
@@ -51,11 +160,51 @@ func Run(container *Container) error {
 	}
 	defer cgroupCleanup()
 
+	networkCleanup, err := setupNetwork(container)
+	if err != nil {
+		slog.Error("[host] Failed to setup network. Kill the container.", "err", err)
+		container.Process.Kill()
+		return err
+	}
+	defer networkCleanup()
+
+	portsCleanup, err := setupPorts(container)
+	if err != nil {
+		slog.Error("[host] Failed to publish ports. Kill the container.", "err", err)
+		container.Process.Kill()
+		return err
+	}
+	defer portsCleanup()
+
+	if err := setupEtcFiles(container); err != nil {
+		slog.Error("[host] Failed to setup etc files. Kill the container.", "err", err)
+		container.Process.Kill()
+		return err
+	}
+
+	if container.OomScoreAdj != nil {
+		if err := setOomScoreAdj(container.Process.Pid, *container.OomScoreAdj); err != nil {
+			slog.Error("[host] Failed to set oom_score_adj. Kill the container.", "err", err)
+			container.Process.Kill()
+			return err
+		}
+	}
+
 	// root dir setup
 
 	container.InContainerConfig = &InContainerConfig{
-		RootDir: container.WorkDir, // will be set later by setupRootDir
-		Command: container.Command,
+		RootDir:         container.WorkDir, // will be set later by setupRootDir
+		Command:         container.Command,
+		Hostname:        container.hostname(),
+		Env:             container.Env,
+		WorkingDir:      container.WorkingDir,
+		User:            container.User,
+		ReadOnly:        container.ReadOnly,
+		Mounts:          container.Mounts,
+		BindMounts:      container.bindMounts(),
+		CgroupNamespace: container.CgroupNamespace,
+		Rlimits:         container.Rlimits,
+		NoNewPrivileges: container.NoNewPrivileges,
 	}
 
 	rootDirCleanup, err := setupRootDir(container)
@@ -66,6 +215,13 @@ func Run(container *Container) error {
 	}
 	defer rootDirCleanup()
 
+	// record the setup results (network endpoint...)
+	if err := saveState(container); err != nil {
+		slog.Error("[host] Failed to save container state. Kill the container.", "err", err)
+		container.Process.Kill()
+		return err
+	}
+
 	// send the command to the container
 
 	sendConfig(container.InContainerConfig, cmdPipeW)
@@ -79,12 +235,92 @@ func Run(container *Container) error {
 		slog.Error("[host] container process wait failed.", "err", err)
 		return err
 	}
+	container.ExitCode = state.ExitCode()
 
 	slog.Info("[host] container process exited.", "state", state)
 
 	return nil
 }
 
+// exitContainer records the exited container in the state store, or
+// removes it (the state and the work dir) if AutoRemove.
+func exitContainer(container *Container) {
+	if container.AutoRemove {
+		removeState(container)
+		cleanupWorkDir(container)
+		return
+	}
+
+	container.Finished = time.Now()
+	container.Status = StatusExited
+	container.Pid = 0
+	container.PidStartTime = 0
+	container.NetworkEndpoints = nil
+	container.CNIAttachments = nil
+	container.FuseOverlayPid = 0
+	if err := saveState(container); err != nil {
+		slog.Error("[host] Failed to save the exited container.", "err", err)
+	}
+}
+
+// Remove deletes the exited container: its rootfs (the writable layer
+// kept from the last run), work dir and state. If force, a running
+// container is killed first.
+func Remove(container *Container, force bool) error {
+	if container.IsRunning() {
+		if !force {
+			return fmt.Errorf("%w: %s: stop it first or force", ErrContainerRunning, container.Name)
+		}
+		if err := killContainer(container); err != nil {
+			return err
+		}
+	}
+
+	if container.Overlay {
+		snapshotter := container.snapshotter()
+		if mounted, _ := isMountPoint(container.overlayMergedDir()); mounted { // the supervisor was gone
+			if err := snapshotter.Unmount(container); err != nil {
+				return fmt.Errorf("unmount the rootfs: %w", err)
+			}
+		}
+		if err := snapshotter.Remove(container); err != nil {
+			return err
+		}
+	}
+	cleanupWorkDir(container)
+	if err := removeState(container); err != nil {
+		return err
+	}
+
+	slog.Info("[host] container removed.", "id", container.ID, "name", container.Name)
+	return nil
+}
+
+// killContainer kills the running container, and waits for the hind
+// process supervising it to clean it up: the container is exited (or
+// removed) in the state store then.
+func killContainer(container *Container) error {
+	stopProcess(container.Pid, container.PidStartTime, 0)
+
+	deadline := time.Now().Add(DefaultStopTimeout)
+	for time.Now().Before(deadline) {
+		c, err := loadState(container.ID)
+		if errors.Is(err, ErrNoSuchContainer) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !c.Finished.Before(container.Started) {
+			*container = *c
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	slog.Warn("[host] the container is killed, but not cleaned up by its supervisor.", "id", container.ID)
+	container.Status = StatusExited
+	return nil
+}
+
 // checkContainer errors if the container misses necessary fields.
 // And sets default values for optional fields.
 func checkContainer(container *Container) error {
@@ -93,12 +329,22 @@ func checkContainer(container *Container) error {
 	if container == nil {
 		return fmt.Errorf("nil container")
 	}
-	if container.Command == nil || len(container.Command) < 1 {
-		return ErrEmptyCommand
-	}
 	if container.ImagePath == "" {
 		return fmt.Errorf("empty image path")
 	}
+	if err := resolveImage(container); err != nil {
+		return err
+	}
+	applyImageConfig(container)
+	if len(container.Command) < 1 {
+		return ErrEmptyCommand
+	}
+	if container.WorkingDir != "" && !path.IsAbs(container.WorkingDir) {
+		return fmt.Errorf("the working dir %q is not an absolute path", container.WorkingDir)
+	}
+	if err := checkStorageDriver(container); err != nil {
+		return err
+	}
 
 	// optional
 
@@ -108,16 +354,51 @@ func checkContainer(container *Container) error {
 	if container.Name == "" {
 		container.Name = randContainerName(container.ID)
 	}
+	if nameInUse(container.Name) {
+		return fmt.Errorf("container name %q is already in use", container.Name)
+	}
+	if container.Hostname == "" {
+		container.Hostname = container.Name
+		if len(container.Hostname) > maxHostnameLen {
+			container.Hostname = stringid.TruncateID(container.ID)
+		}
+	}
+	if err := checkDNS(container.DNS); err != nil {
+		return err
+	}
 	if container.WorkDir == "" {
 		container.WorkDir = defaultWorkDir(container.ID)
 	}
 	if container.Resources == nil {
 		container.Resources = &cgroups.Resources{}
 	}
+	if container.NetworkDriver == "" {
+		container.NetworkDriver = NetworkDriverBridge
+	}
+	if len(container.Networks) == 0 && container.NetworkDriver == NetworkDriverBridge {
+		container.Networks = []string{NetworkBridge}
+	}
+	if err := checkNetworks(container.NetworkDriver, container.Networks); err != nil {
+		return err
+	}
+	if err := checkBandwidth(container); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// nameInUse reports whether a container in the state store has the name.
+func nameInUse(name string) bool {
+	containers, _ := ListContainers()
+	for _, c := range containers {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func randContainerID() string {
 	return uuid.NewString()
 }
@@ -130,8 +411,10 @@ func randContainerName(containerID string) string {
 	return containerID[0:8]
 }
 
+// defaultWorkDir is <DataRoot>/containers/<containerID>/work: it is kept
+// with the state of the container, until the container is removed.
 func defaultWorkDir(containerID string) string {
-	return path.Join(os.TempDir(), "hind", "container", containerID)
+	return path.Join(containersDir(), containerID, "work")
 }
 
 const (
@@ -146,8 +429,8 @@ func setupCgroup(container *Container) (cleanUpFunc, error) {
 
 	res := *container.Resources
 
-	// always try to reinit the parent (/sys/fs/cgroup/<subsystem>/hind/)
-	// echo 0 > {cpuset.cpus, cpuset.mems} to make it available.
+	// always try to reinit the parent (/sys/fs/cgroup/<subsystem>/hind/):
+	// its empty cpuset.cpus and cpuset.mems are copied from the root.
 	_, err := cgroups.NewV1fsManager(DefaultCgroupBasePath, DefaultCgroupHind) // NewV1fsManager contains Create.
 	if err != nil {
 		slog.Error("[host] Failed to create cgroup manager.", "err", err)
@@ -155,16 +438,24 @@ func setupCgroup(container *Container) (cleanUpFunc, error) {
 	}
 
 	// the cgroup for current container: /sys/fs/cgroup/<subsystem>/hind/<containerID>
-	cgroupManager, err := cgroups.NewV1fsManager(DefaultCgroupBasePath,
-		DefaultCgroupHind+"/"+container.ID)
+	// or /sys/fs/cgroup/<subsystem>/hind/<podID>/<containerID> for a pod member.
+	cgroupManager, err := cgroups.NewV1fsManager(DefaultCgroupBasePath, container.cgroupName())
 	if err != nil {
 		slog.Error("[host] Failed to create cgroup manager.", "err", err)
 		return func() {}, err
 	}
 	slog.Info("[host] Cgroup manager created.", "manager", cgroupManager)
 
-	cgroupManager.Set(res)
-	cgroupManager.Apply(container.Process.Pid)
+	if err := cgroupManager.Set(res); err != nil {
+		slog.Error("[host] Failed to set cgroup resources.", "err", err)
+		cgroupManager.Destroy()
+		return func() {}, err
+	}
+	if err := cgroupManager.Apply(container.Process.Pid); err != nil {
+		slog.Error("[host] Failed to apply cgroup.", "err", err)
+		cgroupManager.Destroy()
+		return func() {}, fmt.Errorf("apply cgroup: %w", err)
+	}
 
 	slog.Info("[host] Cgroup setup done.", "pid", container.Process.Pid, "resources", res, "manager", cgroupManager)
 
@@ -175,6 +466,15 @@ func setupCgroup(container *Container) (cleanUpFunc, error) {
 	}, nil
 }
 
+// cgroupName is hind/<containerID>, or hind/<podID>/<containerID> if
+// the container is a member of a pod.
+func (c *Container) cgroupName() string {
+	if c.Pod != "" {
+		return DefaultCgroupHind + "/" + c.Pod + "/" + c.ID
+	}
+	return DefaultCgroupHind + "/" + c.ID
+}
+
 func setupRootDir(container *Container) (cleanUpFunc, error) {
 	if container == nil || container.Process == nil {
 		panic("setupRootDir: invalid container.")
@@ -190,25 +490,96 @@ func setupRootDir(container *Container) (cleanUpFunc, error) {
 	}
 
 	if !container.Overlay {
-		noOverlayAlert(container)
+		if !container.ReadOnly { // a read-only image dir is not dangerous
+			noOverlayAlert(container)
+		}
 		container.InContainerConfig.RootDir = container.ImagePath
 		return func() {}, nil
 	}
 
-	// setup overlayfs
+	// setup the snapshot (overlayfs, or a copy)
 
-	if err := makeOverlayFS(container); err != nil {
-		return func() {}, fmt.Errorf("failed to make overlayfs: %w", err)
+	snapshotter, rootfs, err := setupSnapshot(container)
+	if err != nil {
+		return func() {}, err
 	}
-	container.InContainerConfig.RootDir = container.overlayMergedDir()
-	slog.Info("[host] OverlayFS setup done. InContainerConfig.RootDir -> overlayMergedDir", "mergedDir", container.InContainerConfig.RootDir)
+	container.InContainerConfig.RootDir = rootfs
+	slog.Info("[host] Snapshot setup done. InContainerConfig.RootDir -> rootfs", "rootfs", rootfs)
 
 	return func() {
-		destroyOverlayFS(container)
-		slog.Info("[host] cleanupOverlayFS: overlayfs destroyed.", "removed", container.overlayRootDir())
+		if err := snapshotter.Unmount(container); err != nil {
+			slog.Error("[host] Failed to unmount the rootfs, keep it.", "rootfs", rootfs, "err", err)
+			return
+		}
+		if !container.AutoRemove {
+			slog.Info("[host] Snapshot unmounted, kept for the next start.", "rootfs", rootfs)
+			return
+		}
+		if err := snapshotter.Remove(container); err != nil {
+			slog.Error("[host] Failed to remove the rootfs.", "err", err)
+			return
+		}
+		slog.Info("[host] Snapshot removed.", "rootfs", rootfs)
 	}, nil
 }
 
+// setupSnapshot prepares and mounts the snapshot of the container's
+// StorageDriver. Without a driver specified, overlay is tried first; if
+// the overlayfs can not be mounted, fuse-overlayfs (if installed), then
+// reflink, then vfs. container.StorageDriver is set to the driver in use.
+//
+// The snapshot kept from the last run of the container is mounted again
+// as it is.
+func setupSnapshot(container *Container) (Snapshotter, string, error) {
+	if _, err := os.Stat(container.overlayRootDir()); err == nil && container.StorageDriver != "" {
+		snapshotter := container.snapshotter()
+		rootfs, err := snapshotter.Mount(container)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to mount the rootfs (%s): %w", container.StorageDriver, err)
+		}
+		slog.Info("[host] the snapshot of the last run is mounted.", "driver", container.StorageDriver, "rootfs", rootfs)
+		return snapshotter, rootfs, nil
+	}
+
+	drivers := []string{container.StorageDriver}
+	if container.StorageDriver == "" {
+		drivers = []string{StorageDriverOverlay}
+		if fuseOverlayfsInstalled() {
+			drivers = append(drivers, StorageDriverFuseOverlay)
+		}
+		drivers = append(drivers, StorageDriverReflink, StorageDriverVFS)
+	}
+
+	var err error
+	for i, driver := range drivers {
+		auto := i < len(drivers)-1 // falls back on failure
+
+		snapshotter := newSnapshotter(driver)
+		if err = snapshotter.Prepare(container); err != nil {
+			snapshotter.Remove(container)
+			err = fmt.Errorf("failed to prepare the rootfs (%s): %w", driver, err)
+			if auto && errors.Is(err, ErrReflinkUnsupported) {
+				slog.Warn("[host] reflink is not supported, fall back.", "next", drivers[i+1], "err", err)
+				continue
+			}
+			return nil, "", err
+		}
+		rootfs, err := snapshotter.Mount(container)
+		if err != nil {
+			snapshotter.Remove(container)
+			err = fmt.Errorf("failed to mount the rootfs (%s): %w", driver, err)
+			if auto {
+				slog.Warn("[host] failed to mount the rootfs, fall back.", "driver", driver, "next", drivers[i+1], "err", err)
+				continue
+			}
+			return nil, "", err
+		}
+		container.StorageDriver = driver
+		return snapshotter, rootfs, nil
+	}
+	return nil, "", err
+}
+
 func cleanupWorkDir(container *Container) {
 	if container != nil && container.WorkDir == defaultWorkDir(container.ID) {
 		if err := os.RemoveAll(container.WorkDir); err != nil {
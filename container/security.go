@@ -0,0 +1,162 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/sys/unix"
+)
+
+// This file implements the process-level restrictions that cgroups
+// cannot offer: rlimits, no_new_privs and the OOM score.
+
+// Rlimit is a resource limit (setrlimit(2)) applied to the container command.
+//
+// The Type is the lowercase name of a RLIMIT_* without the prefix,
+// e.g. "nofile" for RLIMIT_NOFILE.
+type Rlimit struct {
+	Type string
+	Soft uint64
+	Hard uint64
+}
+
+// rlimitTypes maps the names accepted by ParseRlimit to RLIMIT_* resources.
+var rlimitTypes = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"rttime":     unix.RLIMIT_RTTIME,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// rlimitUnlimited is the value to write "unlimited" or "-1" as a limit.
+const rlimitUnlimited = ^uint64(0)
+
+// ParseRlimit parses a ulimit in the docker format:
+//
+//	<type>=<soft limit>[:<hard limit>]
+//
+// e.g. "nofile=1024:2048". If the hard limit is omitted,
+// it is the same as the soft limit. "unlimited" or -1 means no limit.
+func ParseRlimit(s string) (Rlimit, error) {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return Rlimit{}, fmt.Errorf("%w: %q (expected <type>=<soft>[:<hard>])", ErrBadRlimit, s)
+	}
+
+	name = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "rlimit_")
+	if _, ok := rlimitTypes[name]; !ok {
+		return Rlimit{}, fmt.Errorf("%w: unknown type %q (supported: %s)",
+			ErrBadRlimit, name, strings.Join(supportedRlimitTypes(), ", "))
+	}
+
+	softStr, hardStr, hasHard := strings.Cut(value, ":")
+	if !hasHard {
+		hardStr = softStr
+	}
+
+	soft, err := parseRlimitValue(softStr)
+	if err != nil {
+		return Rlimit{}, fmt.Errorf("%w: bad soft limit in %q: %v", ErrBadRlimit, s, err)
+	}
+	hard, err := parseRlimitValue(hardStr)
+	if err != nil {
+		return Rlimit{}, fmt.Errorf("%w: bad hard limit in %q: %v", ErrBadRlimit, s, err)
+	}
+	if soft > hard {
+		return Rlimit{}, fmt.Errorf("%w: soft limit %d is greater than hard limit %d in %q",
+			ErrBadRlimit, soft, hard, s)
+	}
+
+	return Rlimit{Type: name, Soft: soft, Hard: hard}, nil
+}
+
+func parseRlimitValue(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "unlimited" || s == "-1" {
+		return rlimitUnlimited, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+func supportedRlimitTypes() []string {
+	types := make([]string, 0, len(rlimitTypes))
+	for t := range rlimitTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// setRlimits applies the rlimits to the current process.
+// The limits are inherited by the command after execve.
+//
+// This function is executed in the container (by pid 1).
+func setRlimits(rlimits []Rlimit) error {
+	for _, rl := range rlimits {
+		resource, ok := rlimitTypes[rl.Type]
+		if !ok {
+			return fmt.Errorf("%w: unknown type %q", ErrBadRlimit, rl.Type)
+		}
+
+		// syscall.Setrlimit (rather than unix.Setrlimit) lets the go runtime
+		// know the new RLIMIT_NOFILE, so it won't restore the original one
+		// on execve.
+		lim := &syscall.Rlimit{Cur: rl.Soft, Max: rl.Hard}
+		if err := syscall.Setrlimit(resource, lim); err != nil {
+			return fmt.Errorf("setrlimit %s=%d:%d: %w", rl.Type, rl.Soft, rl.Hard, err)
+		}
+		slog.Info("[container] pid 1 set rlimit.", "type", rl.Type, "soft", rl.Soft, "hard", rl.Hard)
+	}
+	return nil
+}
+
+// setNoNewPrivs sets PR_SET_NO_NEW_PRIVS for the current process,
+// so that the command (and its children) can not gain privileges
+// through setuid/setgid binaries or file capabilities.
+//
+// This function is executed in the container (by pid 1).
+func setNoNewPrivs() error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %w", err)
+	}
+	return nil
+}
+
+const (
+	OomScoreAdjMin = -1000
+	OomScoreAdjMax = 1000
+)
+
+// setOomScoreAdj writes /proc/<pid>/oom_score_adj.
+//
+// This function is executed in the host, before the config is sent
+// to the container, so the score is settled before the command runs.
+func setOomScoreAdj(pid int, score int) error {
+	if score < OomScoreAdjMin || score > OomScoreAdjMax {
+		return fmt.Errorf("oom_score_adj %d out of range [%d, %d]", score, OomScoreAdjMin, OomScoreAdjMax)
+	}
+
+	p := path.Join("/proc", strconv.Itoa(pid), "oom_score_adj")
+	if err := os.WriteFile(p, []byte(strconv.Itoa(score)), 0644); err != nil {
+		return fmt.Errorf("write %s: %w", p, err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package container
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseRlimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    Rlimit
+		wantErr bool
+	}{
+		{"soft_hard", "nofile=1024:2048", Rlimit{Type: "nofile", Soft: 1024, Hard: 2048}, false},
+		{"soft_only", "nproc=64", Rlimit{Type: "nproc", Soft: 64, Hard: 64}, false},
+		{"unlimited", "core=0:unlimited", Rlimit{Type: "core", Soft: 0, Hard: rlimitUnlimited}, false},
+		{"minus_one", "stack=-1", Rlimit{Type: "stack", Soft: rlimitUnlimited, Hard: rlimitUnlimited}, false},
+		{"prefixed_upper", "RLIMIT_NOFILE=10:20", Rlimit{Type: "nofile", Soft: 10, Hard: 20}, false},
+		{"no_equal", "nofile", Rlimit{}, true},
+		{"unknown_type", "foo=1:2", Rlimit{}, true},
+		{"bad_value", "nofile=abc", Rlimit{}, true},
+		{"soft_gt_hard", "nofile=2048:1024", Rlimit{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRlimit(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseRlimit() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil && !errors.Is(err, ErrBadRlimit) {
+				t.Errorf("ParseRlimit() error = %v, want ErrBadRlimit", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRlimit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test_setOomScoreAdj sets the oom_score_adj of the test process itself.
+// Raising the score is allowed without privileges.
+func Test_setOomScoreAdj(t *testing.T) {
+	orig, err := os.ReadFile("/proc/self/oom_score_adj")
+	if err != nil {
+		t.Skipf("oom_score_adj not available: %v", err)
+	}
+	origScore, _ := strconv.Atoi(strings.TrimSpace(string(orig)))
+
+	want := origScore + 1
+	if want > OomScoreAdjMax {
+		t.Skipf("oom_score_adj already max: %v", origScore)
+	}
+	if err := setOomScoreAdj(os.Getpid(), want); err != nil {
+		t.Fatalf("setOomScoreAdj() error = %v", err)
+	}
+
+	got, _ := os.ReadFile("/proc/self/oom_score_adj")
+	if strings.TrimSpace(string(got)) != strconv.Itoa(want) {
+		t.Errorf("oom_score_adj = %s, want %v", got, want)
+	}
+
+	if err := setOomScoreAdj(os.Getpid(), OomScoreAdjMax+1); err == nil {
+		t.Errorf("setOomScoreAdj() out of range should error")
+	}
+}
@@ -0,0 +1,129 @@
+package container
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"syscall"
+)
+
+// Storage drivers: the Snapshotters.
+const (
+	StorageDriverOverlay     = "overlay"        // overlayfs (see overlayfs.go)
+	StorageDriverFuseOverlay = "fuse-overlayfs" // overlayfs in user space (see fuseoverlayfs.go)
+	StorageDriverVFS         = "vfs"            // a full copy of the image (see vfs.go)
+	StorageDriverReflink     = "reflink"        // a copy of the image cloned by FICLONE: btrfs, xfs...
+)
+
+// maxOverlayLowerDirs is the maximum number of the stacked lower dirs
+// of an overlayfs: OVL_MAX_STACK in the kernel.
+const maxOverlayLowerDirs = 500
+
+// Snapshotter makes the rootfs of a container out of its image: a
+// snapshot of the image, writable (unless ReadOnly) without modifying
+// the image.
+//
+// The life cycle of a snapshot:
+//
+//	Prepare -> Mount -> (the container runs) -> Unmount -> Remove
+type Snapshotter interface {
+	// Prepare creates the snapshot of the container's image, not mounted yet.
+	Prepare(c *Container) error
+	// Mount mounts the prepared snapshot, and returns the rootfs dir.
+	Mount(c *Container) (rootfs string, err error)
+	// Unmount unmounts the snapshot. The changes are kept.
+	Unmount(c *Container) error
+	// Remove removes the (unmounted) snapshot and the changes in it.
+	Remove(c *Container) error
+	// Usage is the disk usage of the changes in the snapshot.
+	Usage(c *Container) (SnapshotUsage, error)
+}
+
+// SnapshotUsage is the disk usage of a snapshot.
+type SnapshotUsage struct {
+	Size   int64 // bytes
+	Inodes int64
+}
+
+// snapshotter is the Snapshotter of the container's StorageDriver:
+// overlay if empty.
+func (c *Container) snapshotter() Snapshotter {
+	return newSnapshotter(c.StorageDriver)
+}
+
+func newSnapshotter(driver string) Snapshotter {
+	switch driver {
+	case StorageDriverFuseOverlay:
+		return fuseOverlaySnapshotter{}
+	case StorageDriverVFS:
+		return copySnapshotter{}
+	case StorageDriverReflink:
+		return copySnapshotter{reflink: true}
+	default:
+		return overlaySnapshotter{}
+	}
+}
+
+// checkStorageDriver checks the StorageDriver of the container.
+func checkStorageDriver(c *Container) error {
+	switch c.StorageDriver {
+	case "", StorageDriverOverlay, StorageDriverFuseOverlay, StorageDriverVFS, StorageDriverReflink:
+	default:
+		return fmt.Errorf("%w: unknown storage driver %q", ErrBadStorageDriver, c.StorageDriver)
+	}
+	if c.StorageDriver != "" && !c.Overlay {
+		return fmt.Errorf("%w: storage driver %q without a snapshot (no overlay)", ErrBadStorageDriver, c.StorageDriver)
+	}
+	return nil
+}
+
+// diskUsage counts the bytes and inodes in the dir, hard links once.
+func diskUsage(dir string) (SnapshotUsage, error) {
+	var usage SnapshotUsage
+	seen := map[uint64]bool{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			if seen[st.Ino] {
+				return nil
+			}
+			seen[st.Ino] = true
+			usage.Size += st.Blocks * 512
+		}
+		usage.Inodes++
+		return nil
+	})
+	if err != nil {
+		return SnapshotUsage{}, fmt.Errorf("disk usage of %s: %w", dir, err)
+	}
+	return usage, nil
+}
+
+// MountError is a failed mount(2) or umount(2), with the errno:
+//
+//	errors.Is(err, unix.EBUSY)
+type MountError struct {
+	Op     string // mount | umount | open
+	Source string
+	Target string
+	FSType string
+	Data   string
+	Err    error // the syscall.Errno
+}
+
+func (e *MountError) Error() string {
+	if e.Op != "mount" {
+		return fmt.Sprintf("%s %s: %v", e.Op, e.Target, e.Err)
+	}
+	return fmt.Sprintf("mount %s (%s) on %s -o %q: %v", e.Source, e.FSType, e.Target, e.Data, e.Err)
+}
+
+func (e *MountError) Unwrap() error {
+	return e.Err
+}
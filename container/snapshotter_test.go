@@ -0,0 +1,118 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOverlaySnapshotter(t *testing.T) {
+	imageDir := t.TempDir()
+	if err := os.WriteFile(path.Join(imageDir, "hello"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &Container{ID: "snapshottertest", WorkDir: t.TempDir(), ImagePath: imageDir, Overlay: true}
+	var s Snapshotter = overlaySnapshotter{}
+
+	if err := s.Prepare(c); err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	rootfs, err := s.Mount(c)
+	if err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	if rootfs != c.overlayMergedDir() {
+		t.Errorf("Mount() = %v, want %v", rootfs, c.overlayMergedDir())
+	}
+
+	if got, err := os.ReadFile(path.Join(rootfs, "hello")); err != nil || string(got) != "hello" {
+		t.Errorf("read the image file in the rootfs = %q, %v", got, err)
+	}
+	if err := os.WriteFile(path.Join(rootfs, "world"), make([]byte, 8192), 0644); err != nil {
+		t.Errorf("write the rootfs: %v", err)
+	}
+	usage, err := s.Usage(c)
+	if err != nil || usage.Size < 8192 || usage.Inodes != 2 { // the upper dir and the file
+		t.Errorf("Usage() = %+v, %v", usage, err)
+	}
+
+	// busy: the typed error with the errno
+	if err := os.Chdir(rootfs); err != nil {
+		t.Fatal(err)
+	}
+	err = s.Unmount(c)
+	os.Chdir("/")
+	var mountErr *MountError
+	if !errors.As(err, &mountErr) || !errors.Is(err, unix.EBUSY) {
+		t.Errorf("Unmount() a busy rootfs error = %v, want a MountError of EBUSY", err)
+	}
+
+	if err := s.Unmount(c); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+	if err := s.Remove(c); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, err := os.Stat(c.overlayRootDir()); !os.IsNotExist(err) {
+		t.Errorf("the overlay root dir should be removed: %v", err)
+	}
+	if _, err := os.Stat(path.Join(imageDir, "hello")); err != nil {
+		t.Errorf("the image should be kept: %v", err)
+	}
+}
+
+// the lowerdirs longer than a page are mounted by the fds.
+func TestMountOverlayFS_longLowerDirs(t *testing.T) {
+	root := t.TempDir()
+	long := strings.Repeat("x", 200)
+
+	var lowerdirs []string
+	for i := 0; i < 40; i++ {
+		dir := path.Join(root, fmt.Sprintf("%s-%02d", long, i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path.Join(dir, fmt.Sprintf("layer-%02d", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		lowerdirs = append(lowerdirs, dir)
+	}
+	if data := overlayMountData(lowerdirs, "", ""); len(data) < unix.Getpagesize() {
+		t.Fatalf("the mount data should be longer than a page: %d", len(data))
+	}
+
+	merged := path.Join(root, "merged")
+	os.Mkdir(merged, 0755)
+	if err := mountOverlayFS(lowerdirs, "", "", merged); err != nil {
+		t.Fatalf("mountOverlayFS() error = %v", err)
+	}
+	defer unmountOverlayFS(merged)
+
+	entries, err := os.ReadDir(merged)
+	if err != nil || len(entries) != len(lowerdirs) {
+		t.Errorf("%d entries in the merged dir, want %d: %v", len(entries), len(lowerdirs), err)
+	}
+}
+
+func TestMountOverlayFS_errors(t *testing.T) {
+	root := t.TempDir()
+
+	err := mountOverlayFS([]string{path.Join(root, "nope"), root}, "", "", root)
+	var mountErr *MountError
+	if !errors.As(err, &mountErr) || mountErr.Op != "mount" || !errors.Is(err, unix.ENOENT) {
+		t.Errorf("mountOverlayFS() a missing lowerdir error = %v, want a MountError of ENOENT", err)
+	}
+
+	if err := mountOverlayFS(make([]string, maxOverlayLowerDirs+1), "", "", root); !errors.Is(err, ErrTooManyLayers) {
+		t.Errorf("mountOverlayFS() too many layers error = %v, want %v", err, ErrTooManyLayers)
+	}
+
+	if err := unmountOverlayFS(root); !errors.Is(err, unix.EINVAL) {
+		t.Errorf("unmountOverlayFS() not mounted error = %v, want %v", err, unix.EINVAL)
+	}
+}
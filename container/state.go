@@ -0,0 +1,225 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"hind/internal/atomicfile"
+
+	"golang.org/x/exp/slog"
+)
+
+// This file implements the state store: the host's records of the
+// containers, persisted as json files under the data root:
+//
+//	<DataRoot>/containers/<containerID>/state.json
+
+// DefaultDataRoot is the default directory to store hind's persistent data.
+const DefaultDataRoot = "/var/lib/hind"
+
+// DataRoot is the directory to store hind's persistent data.
+// Change it before running any container.
+var DataRoot = DefaultDataRoot
+
+// ContainerStatus is the status of a container.
+type ContainerStatus string
+
+const (
+	StatusCreated ContainerStatus = "created"
+	StatusRunning ContainerStatus = "running"
+	StatusExited  ContainerStatus = "exited"
+)
+
+// containersDir is <DataRoot>/containers
+func containersDir() string {
+	return path.Join(DataRoot, "containers")
+}
+
+// StateDir is the directory to keep the states (and other
+// persistent files) of the container: <DataRoot>/containers/<containerID>
+func (c *Container) StateDir() string {
+	return path.Join(containersDir(), c.ID)
+}
+
+func (c *Container) stateFile() string {
+	return path.Join(c.StateDir(), "state.json")
+}
+
+// saveState writes the container to the state store.
+// The file is replaced atomically.
+func saveState(c *Container) error {
+	if c.ID == "" {
+		return fmt.Errorf("saveState: empty container ID")
+	}
+	if err := os.MkdirAll(c.StateDir(), 0700); err != nil {
+		return fmt.Errorf("saveState: %w", err)
+	}
+
+	if err := atomicfile.WriteJSON(c.stateFile(), c); err != nil {
+		return fmt.Errorf("saveState: %w", err)
+	}
+
+	slog.Debug("[host] container state saved.", "id", c.ID, "status", c.Status)
+	return nil
+}
+
+// removeState deletes the state dir of the container from the state store.
+func removeState(c *Container) error {
+	if c.ID == "" {
+		return fmt.Errorf("removeState: empty container ID")
+	}
+	if err := os.RemoveAll(c.StateDir()); err != nil {
+		return fmt.Errorf("removeState: %w", err)
+	}
+	return nil
+}
+
+// loadState reads the state of the container with the full ID.
+func loadState(id string) (*Container, error) {
+	data, err := os.ReadFile(path.Join(containersDir(), id, "state.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrNoSuchContainer, id)
+		}
+		return nil, err
+	}
+
+	var c Container
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("bad state of container %s: %w", id, err)
+	}
+	c.refreshStatus()
+
+	return &c, nil
+}
+
+// ListContainers returns all the containers in the state store,
+// sorted by the creation time.
+func ListContainers() ([]*Container, error) {
+	entries, err := os.ReadDir(containersDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var containers []*Container
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		c, err := loadState(e.Name())
+		if err != nil {
+			slog.Warn("[host] ListContainers: skip bad container state.", "id", e.Name(), "err", err)
+			continue
+		}
+		containers = append(containers, c)
+	}
+
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Created.Before(containers[j].Created)
+	})
+	return containers, nil
+}
+
+// LoadContainer finds a container in the state store by
+// the full ID, the name or an unique prefix of the ID.
+func LoadContainer(idOrName string) (*Container, error) {
+	if idOrName == "" {
+		return nil, fmt.Errorf("%w: empty id or name", ErrNoSuchContainer)
+	}
+	if c, err := loadState(idOrName); err == nil {
+		return c, nil
+	} else if !errors.Is(err, ErrNoSuchContainer) {
+		return nil, err
+	}
+
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []*Container
+	for _, c := range containers {
+		if c.Name == idOrName {
+			return c, nil
+		}
+		if strings.HasPrefix(c.ID, idOrName) {
+			found = append(found, c)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchContainer, idOrName)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("ambiguous container id prefix %q: %d matches", idOrName, len(found))
+	}
+}
+
+// refreshStatus marks a running container whose process has gone as exited.
+// (e.g. the hind process supervising it was killed.)
+func (c *Container) refreshStatus() {
+	if c.Status == StatusRunning && !processAlive(c.Pid, c.PidStartTime) {
+		c.Status = StatusExited
+	}
+}
+
+// IsRunning reports whether the container's process is alive.
+func (c *Container) IsRunning() bool {
+	c.refreshStatus()
+	return c.Status == StatusRunning
+}
+
+// processAlive reports whether the process of the pid is alive. The pid
+// may have been reused by another process since it was saved (e.g. after
+// a reboot): if startTime is not 0, the process must have started then.
+func processAlive(pid int, startTime uint64) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	if err != nil && !errors.Is(err, syscall.EPERM) {
+		return false
+	}
+	return startTime == 0 || processStartTime(pid) == startTime
+}
+
+// processStartTime returns the start time of the process, in clock ticks
+// after the boot: the field 22 of /proc/<pid>/stat. 0 if unknown.
+func processStartTime(pid int) uint64 {
+	fields := procStatFields(pid)
+	if len(fields) < 20 {
+		return 0
+	}
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return startTime
+}
+
+// procStatFields returns the fields of /proc/<pid>/stat after the comm,
+// which may contain spaces: the first one is the state (field 3).
+// nil if the process does not exist.
+func procStatFields(pid int) []string {
+	stat, err := os.ReadFile(path.Join("/proc", fmt.Sprint(pid), "stat"))
+	if err != nil {
+		return nil
+	}
+	// pid (comm) state ...
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return nil
+	}
+	return strings.Fields(string(stat[i+1:]))
+}
@@ -0,0 +1,142 @@
+package container
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadContainer(t *testing.T) {
+	DataRoot = t.TempDir()
+	defer func() { DataRoot = DefaultDataRoot }()
+
+	containers := []*Container{
+		{ID: "aaaa1111", Name: "foo", Created: time.Now()},
+		{ID: "aaaa2222", Name: "bar", Created: time.Now().Add(time.Second)},
+		{ID: "bbbb3333", Name: "baz", Created: time.Now().Add(2 * time.Second)},
+	}
+	for _, c := range containers {
+		if err := saveState(c); err != nil {
+			t.Fatalf("saveState() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		idOrName  string
+		wantID    string
+		wantErrIs error
+	}{
+		{"full_id", "aaaa2222", "aaaa2222", nil},
+		{"name", "baz", "bbbb3333", nil},
+		{"prefix", "bbbb", "bbbb3333", nil},
+		{"ambiguous_prefix", "aaaa", "", errAny},
+		{"not_found", "cccc", "", ErrNoSuchContainer},
+		{"empty", "", "", ErrNoSuchContainer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadContainer(tt.idOrName)
+			if tt.wantErrIs != nil {
+				if err == nil || (tt.wantErrIs != errAny && !errors.Is(err, tt.wantErrIs)) {
+					t.Errorf("LoadContainer() error = %v, want %v", err, tt.wantErrIs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadContainer() error = %v", err)
+			}
+			if got.ID != tt.wantID {
+				t.Errorf("LoadContainer() = %v, want %v", got.ID, tt.wantID)
+			}
+		})
+	}
+
+	list, err := ListContainers()
+	if err != nil || len(list) != 3 || list[0].ID != "aaaa1111" || list[2].ID != "bbbb3333" {
+		t.Errorf("ListContainers() = %v, %v, want 3 containers sorted by created", list, err)
+	}
+
+	if err := removeState(containers[0]); err != nil {
+		t.Fatalf("removeState() error = %v", err)
+	}
+	if _, err := LoadContainer("foo"); !errors.Is(err, ErrNoSuchContainer) {
+		t.Errorf("LoadContainer() after removeState error = %v, want ErrNoSuchContainer", err)
+	}
+}
+
+// running containers without a process are exited
+func TestContainer_IsRunning(t *testing.T) {
+	c := &Container{Status: StatusRunning, Pid: 0}
+	if c.IsRunning() || c.Status != StatusExited {
+		t.Errorf("IsRunning() of a container without process should be false and mark it exited")
+	}
+}
+
+// a pid reused by another process is not alive
+func TestProcessAlive(t *testing.T) {
+	pid := os.Getpid()
+	startTime := processStartTime(pid)
+	if startTime == 0 {
+		t.Fatalf("processStartTime(%d) = 0", pid)
+	}
+
+	tests := []struct {
+		name      string
+		pid       int
+		startTime uint64
+		want      bool
+	}{
+		{"same_process", pid, startTime, true},
+		{"unknown_start_time", pid, 0, true},
+		{"reused_pid", pid, startTime + 1, false},
+		{"no_pid", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := processAlive(tt.pid, tt.startTime); got != tt.want {
+				t.Errorf("processAlive() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+var errAny = errors.New("any error")
+
+func TestRemove(t *testing.T) {
+	DataRoot = t.TempDir()
+	defer func() { DataRoot = DefaultDataRoot }()
+
+	image := t.TempDir()
+	c := &Container{ID: "cccc4444", Name: "exited", Overlay: true, ImagePath: image, StorageDriver: StorageDriverVFS,
+		Status: StatusExited, Created: time.Now()}
+	c.WorkDir = defaultWorkDir(c.ID)
+	if err := saveState(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.snapshotter().Prepare(c); err != nil {
+		t.Fatal(err)
+	}
+	if !nameInUse("exited") || nameInUse("cccc") {
+		t.Errorf("nameInUse() of an exited container: want only by its name")
+	}
+
+	running := &Container{ID: "dddd5555", Name: "running", Status: StatusRunning, Pid: os.Getpid()}
+	if err := Remove(running, false); !errors.Is(err, ErrContainerRunning) {
+		t.Errorf("Remove() a running container error = %v, want %v", err, ErrContainerRunning)
+	}
+
+	if err := Remove(c, false); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, err := os.Stat(c.StateDir()); !os.IsNotExist(err) {
+		t.Errorf("the state dir (with the rootfs) is not removed: %v", err)
+	}
+	if _, err := os.Stat(image); err != nil {
+		t.Errorf("the image is removed: %v", err)
+	}
+	if nameInUse("exited") {
+		t.Errorf("nameInUse() after Remove() = true")
+	}
+}
@@ -0,0 +1,96 @@
+package container
+
+import (
+	"fmt"
+	"hind/image"
+	"os"
+	"path"
+
+	"golang.org/x/exp/slog"
+)
+
+// TrustStore is the trust store of the image signatures in
+// <DataRoot>/trust. Its policy.json requires the images of some names to
+// be signed to run, see image.Policy.
+func TrustStore() *image.Trust {
+	return image.NewTrust(path.Join(DataRoot, "trust"))
+}
+
+// verifyImageTrust verifies the image of the digest, known by the names,
+// against the trust policy. An empty digest is an image that can not be
+// signed: a directory.
+func verifyImageTrust(digest string, names ...string) error {
+	if err := TrustStore().Check(digest, names...); err != nil {
+		return err
+	}
+	slog.Debug("[host] image verified against the trust policy.", "digest", digest, "names", names)
+	return nil
+}
+
+// verifyContainerImage verifies the image of a created container against
+// the trust policy again before it is started: a signature may have been
+// removed, or the policy changed since the container was created.
+func verifyContainerImage(c *Container) error {
+	if c.Image != "" {
+		store := ImageStore()
+		img, err := store.Get(c.Image)
+		if err != nil {
+			return err
+		}
+		if err := store.Verify(img); err != nil {
+			return err
+		}
+		return verifyImageTrust(img.ID, img.RepoTags...)
+	}
+
+	if c.ImageDigest != "" {
+		names, err := pathImageNames(c.ImagePath)
+		if err != nil {
+			return err
+		}
+		return verifyImageTrust(c.ImageDigest, names...)
+	}
+	st, err := os.Stat(c.ImagePath)
+	if err != nil {
+		return err
+	}
+	return resolveImagePath(c, st, "")
+}
+
+// ImageDigest is the digest an image is signed by: the digest of a tar
+// file, or the id of an image in the store (a reference or an id), after
+// verifying the image's config against it. The image may be pinned by a
+// digest (IMAGE@sha256:<hex>), which it must have.
+func ImageDigest(imagePath string) (string, error) {
+	ref, pinned := imagePath, ""
+	if _, err := os.Stat(imagePath); err != nil {
+		if ref, pinned, err = image.SplitDigest(imagePath); err != nil {
+			return "", err
+		}
+	}
+
+	var digest string
+	if st, err := os.Stat(ref); err == nil {
+		if st.IsDir() {
+			return "", fmt.Errorf("%w: the directory %s can not be signed, only a tar file or an image in the store", image.ErrBadImage, ref)
+		}
+		if digest, err = image.DigestFile(ref); err != nil {
+			return "", err
+		}
+	} else {
+		store := ImageStore()
+		img, err := store.Get(ref)
+		if err != nil {
+			return "", err
+		}
+		if err := store.Verify(img); err != nil {
+			return "", err
+		}
+		digest = img.ID
+	}
+
+	if pinned != "" && digest != pinned {
+		return "", fmt.Errorf("%w: image %s is %s, not %s", image.ErrDigestMismatch, ref, digest, pinned)
+	}
+	return digest, nil
+}
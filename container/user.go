@@ -0,0 +1,230 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/exp/slog"
+)
+
+// execUser is the user to run the command as.
+type execUser struct {
+	Uid    int
+	Gid    int
+	Groups []int  // the supplementary groups
+	Home   string // the home dir in the passwd, "/" if unknown
+}
+
+// passwdEntry is a line of /etc/passwd: name:password:uid:gid:gecos:home:shell
+type passwdEntry struct {
+	Name string
+	Uid  int
+	Gid  int
+	Home string
+}
+
+// groupEntry is a line of /etc/group: name:password:gid:user1,user2
+type groupEntry struct {
+	Name    string
+	Gid     int
+	Members []string
+}
+
+// parseUser resolves the user spec (user[:group], by names or ids) with
+// the passwd and group files (nil if missing).
+//
+// A numeric id needs no entry in the files. The group defaults to the
+// primary group of the user in the passwd (0 if unknown). The groups
+// listing the user name as a member are the supplementary groups.
+// An empty spec is root.
+func parseUser(spec string, passwd io.Reader, group io.Reader) (*execUser, error) {
+	userSpec, groupSpec, _ := strings.Cut(spec, ":")
+	u := &execUser{Home: "/"}
+
+	users, err := parsePasswd(passwd)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := parseGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	var name string
+	if userSpec != "" {
+		uid, numeric := parseID(userSpec)
+		found := false
+		for _, e := range users {
+			if (numeric && e.Uid == uid) || (!numeric && e.Name == userSpec) {
+				name, u.Uid, u.Gid, u.Home, found = e.Name, e.Uid, e.Gid, e.Home, true
+				break
+			}
+		}
+		if !found && !numeric {
+			return nil, fmt.Errorf("%w: no user %q in the /etc/passwd", ErrBadUser, userSpec)
+		}
+		if !found {
+			u.Uid = uid
+		}
+	}
+
+	if groupSpec != "" {
+		gid, numeric := parseID(groupSpec)
+		found := false
+		for _, e := range groups {
+			if !numeric && e.Name == groupSpec {
+				gid, found = e.Gid, true
+				break
+			}
+		}
+		if !found && !numeric {
+			return nil, fmt.Errorf("%w: no group %q in the /etc/group", ErrBadUser, groupSpec)
+		}
+		u.Gid = gid
+	}
+
+	if name != "" {
+		for _, e := range groups {
+			for _, m := range e.Members {
+				if m == name && e.Gid != u.Gid {
+					u.Groups = append(u.Groups, e.Gid)
+				}
+			}
+		}
+	}
+
+	return u, nil
+}
+
+// parseID parses a non-negative numeric id.
+func parseID(s string) (int, bool) {
+	id, err := strconv.Atoi(s)
+	return id, err == nil && id >= 0
+}
+
+func parsePasswd(r io.Reader) ([]passwdEntry, error) {
+	var entries []passwdEntry
+	err := parseColonFile(r, func(fields []string) {
+		if len(fields) < 6 {
+			return
+		}
+		uid, ok1 := parseID(fields[2])
+		gid, ok2 := parseID(fields[3])
+		if ok1 && ok2 {
+			entries = append(entries, passwdEntry{Name: fields[0], Uid: uid, Gid: gid, Home: fields[5]})
+		}
+	})
+	return entries, err
+}
+
+func parseGroup(r io.Reader) ([]groupEntry, error) {
+	var entries []groupEntry
+	err := parseColonFile(r, func(fields []string) {
+		if len(fields) < 3 {
+			return
+		}
+		gid, ok := parseID(fields[2])
+		if !ok {
+			return
+		}
+		e := groupEntry{Name: fields[0], Gid: gid}
+		if len(fields) > 3 && fields[3] != "" {
+			e.Members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, e)
+	})
+	return entries, err
+}
+
+// parseColonFile calls fn with the fields of each line (skipping the
+// empty lines and comments) of the colon separated file r, if not nil.
+func parseColonFile(r io.Reader, fn func(fields []string)) error {
+	if r == nil {
+		return nil
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(strings.Split(line, ":"))
+	}
+	return scanner.Err()
+}
+
+// lookupUser resolves the user spec with the /etc/passwd and /etc/group
+// of the (pivoted) rootfs.
+func lookupUser(spec string) (*execUser, error) {
+	var passwd, group io.Reader
+	if f, err := os.Open("/etc/passwd"); err == nil {
+		defer f.Close()
+		passwd = f
+	}
+	if f, err := os.Open("/etc/group"); err == nil {
+		defer f.Close()
+		group = f
+	}
+	return parseUser(spec, passwd, group)
+}
+
+// defaultPathEnv is the PATH of the command, unless set by the image or
+// the container.
+const defaultPathEnv = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// setupProcess sets the environment variables and the working dir of
+// the command, and looks up the user to run as (switched by setupSecurity).
+//
+// The environment is only the one of the container (see processEnv): the
+// variables of hind on the host are cleared, not passed on.
+func setupProcess(config *InContainerConfig) (*execUser, error) {
+	user, err := lookupUser(config.User)
+	if err != nil {
+		return nil, err
+	}
+
+	os.Clearenv()
+	for _, kv := range processEnv(config.Env, user.Home) {
+		key, value, _ := strings.Cut(kv, "=")
+		if err := os.Setenv(key, value); err != nil {
+			return nil, fmt.Errorf("setenv %s: %w", key, err)
+		}
+	}
+
+	if config.WorkingDir != "" {
+		if err := os.MkdirAll(config.WorkingDir, 0755); err != nil {
+			slog.Warn("[container] pid 1 failed to create the working dir.", "dir", config.WorkingDir, "err", err)
+		}
+		if err := os.Chdir(config.WorkingDir); err != nil {
+			return nil, fmt.Errorf("working dir: %w", err)
+		}
+	}
+
+	return user, nil
+}
+
+// processEnv is the environment of the command: the Env of the container
+// (the image's, overridden by the -e ones), on top of the defaults PATH
+// and HOME (the home of the user).
+func processEnv(env []string, home string) []string {
+	return mergeEnv([]string{defaultPathEnv, "HOME=" + home}, env)
+}
+
+// setUser switches to the user: the supplementary groups, gid and uid.
+func setUser(u *execUser) error {
+	if err := syscall.Setgroups(u.Groups); err != nil {
+		return fmt.Errorf("setgroups %v: %w", u.Groups, err)
+	}
+	if err := syscall.Setgid(u.Gid); err != nil {
+		return fmt.Errorf("setgid %d: %w", u.Gid, err)
+	}
+	if err := syscall.Setuid(u.Uid); err != nil {
+		return fmt.Errorf("setuid %d: %w", u.Uid, err)
+	}
+	return nil
+}
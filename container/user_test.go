@@ -0,0 +1,85 @@
+package container
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseUser(t *testing.T) {
+	passwd := `root:x:0:0:root:/root:/bin/sh
+# comment
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin
+app:x:1000:1000::/home/app:/bin/sh
+`
+	group := `root:x:0:
+daemon:x:1:
+wheel:x:10:app,root
+docker:x:999:app
+app:x:1000:
+`
+	tests := []struct {
+		spec      string
+		want      execUser
+		wantErrIs error
+	}{
+		{"", execUser{Uid: 0, Gid: 0, Home: "/"}, nil},
+		{"root", execUser{Uid: 0, Gid: 0, Groups: []int{10}, Home: "/root"}, nil},
+		{"app", execUser{Uid: 1000, Gid: 1000, Groups: []int{10, 999}, Home: "/home/app"}, nil},
+		{"1000", execUser{Uid: 1000, Gid: 1000, Groups: []int{10, 999}, Home: "/home/app"}, nil},
+		{"app:docker", execUser{Uid: 1000, Gid: 999, Groups: []int{10}, Home: "/home/app"}, nil},
+		{"nobody:1", execUser{Uid: 65534, Gid: 1, Home: "/nonexistent"}, nil},
+		{"2000", execUser{Uid: 2000, Gid: 0, Home: "/"}, nil},
+		{"2000:2000", execUser{Uid: 2000, Gid: 2000, Home: "/"}, nil},
+		{"foo", execUser{}, ErrBadUser},
+		{"app:foo", execUser{}, ErrBadUser},
+		{"-1", execUser{}, ErrBadUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseUser(tt.spec, strings.NewReader(passwd), strings.NewReader(group))
+			if tt.wantErrIs != nil {
+				if !errors.Is(err, tt.wantErrIs) {
+					t.Errorf("parseUser() error = %v, want %v", err, tt.wantErrIs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseUser() error = %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("parseUser() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+
+	// no passwd and group files: ids only
+	if got, err := parseUser("1000:1000", nil, nil); err != nil || got.Uid != 1000 || got.Gid != 1000 {
+		t.Errorf("parseUser() without files = %+v, %v", got, err)
+	}
+	if _, err := parseUser("app", nil, nil); !errors.Is(err, ErrBadUser) {
+		t.Errorf("parseUser() by name without files error = %v, want %v", err, ErrBadUser)
+	}
+}
+
+func TestProcessEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  []string
+		home string
+		want []string
+	}{
+		{"defaults", nil, "/root", []string{defaultPathEnv, "HOME=/root"}},
+		{"image_path", []string{"PATH=/usr/bin:/bin", "FOO=bar"}, "/", []string{"PATH=/usr/bin:/bin", "HOME=/", "FOO=bar"}},
+		{"home_set", []string{"HOME=/app"}, "/home/app", []string{defaultPathEnv, "HOME=/app"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := processEnv(tt.env, tt.home); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("processEnv() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/sys/unix"
+)
+
+// overlayXattrPrefix is the prefix of the overlayfs xattrs (the opaque
+// dirs in the layers), which are not copied into a rootfs.
+const overlayXattrPrefix = "trusted.overlay."
+
+// overlayOpaqueXattr marks an opaque dir in a layer.
+const overlayOpaqueXattr = overlayXattrPrefix + "opaque"
+
+// copySnapshotter is the Snapshotter that copies the image into the
+// {c.WorkDir}/overlay-{c.ID[:4]}/rootfs dir: no overlayfs is needed.
+// The vfs driver copies the file contents; the reflink driver clones
+// them by FICLONE (btrfs, xfs...), sharing the blocks with the image.
+//
+// The layers of a multi-layer image are copied one by one, the lowest
+// first, with the whiteouts applied. A tar image is extracted into the
+// rootfs directly. A read-only container of a directory image uses the
+// image as the rootfs, as the overlay driver does.
+type copySnapshotter struct {
+	reflink bool
+}
+
+// copyRootFS is the dir of the copied rootfs.
+func (c overlayConfig) copyRootFS() string {
+	return path.Join(c.overlayRootDir(), "/rootfs")
+}
+
+// needsCopy reports whether the image of the container is copied.
+func (copySnapshotter) needsCopy(c *Container) bool {
+	return !c.ReadOnly || len(c.overlayLowerDirs()) > 1 || c.overlayLowerDir() != c.ImagePath
+}
+
+// Prepare copies the image into the rootfs dir.
+func (s copySnapshotter) Prepare(c *Container) error {
+	if !s.needsCopy(c) {
+		slog.Info("[host] vfs: read-only container, use the image as the rootfs.", "rootfs", c.ImagePath)
+		return nil
+	}
+
+	rootfs := c.copyRootFS()
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return fmt.Errorf("error creating rootfs dir: %w", err)
+	}
+
+	if len(c.ImageLayers) == 0 && c.overlayLowerDir() != c.ImagePath { // a tar file
+		return extractImage(c.ImagePath, c.ImageDigest, rootfs)
+	}
+
+	lowers := c.overlayLowerDirs()
+	for i := len(lowers) - 1; i >= 0; i-- { // the lowest first
+		slog.Info("[host] vfs: copying the image.", "from", lowers[i], "to", rootfs, "reflink", s.reflink)
+		if err := copyTree(lowers[i], rootfs, s.reflink, len(lowers) > 1); err != nil {
+			return fmt.Errorf("error copying image: %w", err)
+		}
+	}
+	return nil
+}
+
+// Mount returns the rootfs: nothing to mount.
+func (s copySnapshotter) Mount(c *Container) (string, error) {
+	if !s.needsCopy(c) {
+		return c.ImagePath, nil
+	}
+	return c.copyRootFS(), nil
+}
+
+// Unmount does nothing: nothing mounted.
+func (copySnapshotter) Unmount(c *Container) error {
+	return nil
+}
+
+// Remove removes the copied rootfs.
+func (copySnapshotter) Remove(c *Container) error {
+	if err := os.RemoveAll(c.overlayRootDir()); err != nil {
+		return fmt.Errorf("error removing rootfs dir: %w", err)
+	}
+	return nil
+}
+
+// Usage is the disk usage of the whole copied rootfs.
+func (s copySnapshotter) Usage(c *Container) (SnapshotUsage, error) {
+	if !s.needsCopy(c) {
+		return SnapshotUsage{}, nil
+	}
+	return diskUsage(c.copyRootFS())
+}
+
+// copyTree copies the files in the src dir into the dst dir, keeping
+// the owners, modes, times, xattrs, hard links, symlinks and device
+// nodes. The existing files in dst are replaced, except a dir by a dir.
+//
+// With reflink, the file contents are cloned by FICLONE, or it fails
+// with ErrReflinkUnsupported. With whiteouts, src is a layer in the
+// overlayfs form: a 0:0 char device deletes the file in dst, and an
+// opaque dir replaces the dir in dst.
+func copyTree(src string, dst string, reflink bool, whiteouts bool) error {
+	links := map[uint64]string{} // the inode in src -> the first copy in dst
+	var dirs []string            // to set the times after the children
+
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, p)
+		target := filepath.Join(dst, rel)
+
+		var st unix.Stat_t
+		if err := unix.Lstat(p, &st); err != nil {
+			return err
+		}
+		mode := st.Mode & unix.S_IFMT
+
+		if whiteouts && isWhiteout(&st) {
+			return os.RemoveAll(target)
+		}
+
+		if fi, err := os.Lstat(target); err == nil && rel != "." {
+			if !(fi.IsDir() && mode == unix.S_IFDIR) || (whiteouts && isOpaqueDir(p)) {
+				if err := os.RemoveAll(target); err != nil {
+					return err
+				}
+			}
+		}
+
+		switch mode {
+		case unix.S_IFDIR:
+			if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+				return err
+			}
+			dirs = append(dirs, p)
+		case unix.S_IFREG:
+			if st.Nlink > 1 {
+				if first, ok := links[st.Ino]; ok {
+					return os.Link(first, target)
+				}
+				links[st.Ino] = target
+			}
+			if err := copyFile(p, target, reflink); err != nil {
+				return err
+			}
+		case unix.S_IFLNK:
+			linkname, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(linkname, target); err != nil {
+				return err
+			}
+		default: // devices, fifos and sockets
+			if err := unix.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+				return fmt.Errorf("mknod %s: %w", target, err)
+			}
+		}
+
+		if mode == unix.S_IFDIR {
+			return copyMetadata(p, target, &st, false)
+		}
+		return copyMetadata(p, target, &st, true)
+	})
+	if err != nil {
+		return err
+	}
+
+	// the deepest first: the parents are modified by setting the children
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, _ := filepath.Rel(src, dirs[i])
+		var st unix.Stat_t
+		if err := unix.Lstat(dirs[i], &st); err != nil {
+			return err
+		}
+		if err := copyTimes(filepath.Join(dst, rel), &st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the content of the regular file, or clones it by
+// FICLONE with reflink.
+func copyFile(src string, dst string, reflink bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if reflink {
+		err = unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+		if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTTY) {
+			err = fmt.Errorf("%w: clone %s: %v", ErrReflinkUnsupported, src, err)
+		}
+	} else {
+		_, err = io.Copy(out, in)
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// copyMetadata copies the owner, mode, xattrs (except the overlayfs
+// ones) and, if withTimes, the times of the file.
+// The owner goes first: chown(2) clears the setuid and setgid bits.
+func copyMetadata(src string, dst string, st *unix.Stat_t, withTimes bool) error {
+	if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFLNK {
+		if err := unix.Chmod(dst, st.Mode&07777); err != nil {
+			return fmt.Errorf("chmod %s: %w", dst, err)
+		}
+	}
+
+	if err := copyXattrs(src, dst); err != nil {
+		return err
+	}
+
+	if withTimes {
+		return copyTimes(dst, st)
+	}
+	return nil
+}
+
+func copyXattrs(src string, dst string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil || size == 0 {
+		return nil // no xattrs, or not supported
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(src, buf); err != nil {
+		return nil
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" || strings.HasPrefix(name, overlayXattrPrefix) {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(src, name, value); err != nil {
+			continue
+		}
+		if err := unix.Lsetxattr(dst, name, value[:vsize], 0); err != nil {
+			slog.Warn("[host] vfs: failed to copy the xattr, skip.", "file", dst, "xattr", name, "err", err)
+		}
+	}
+	return nil
+}
+
+func copyTimes(dst string, st *unix.Stat_t) error {
+	times := []unix.Timespec{st.Atim, st.Mtim}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, dst, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("utimes %s: %w", dst, err)
+	}
+	return nil
+}
+
+// isOpaqueDir reports whether the dir in a layer is opaque: hiding the
+// lower ones.
+func isOpaqueDir(dir string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(dir, overlayOpaqueXattr, buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
@@ -0,0 +1,146 @@
+package container
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyTree(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	os.MkdirAll(path.Join(src, "bin"), 0755)
+	os.WriteFile(path.Join(src, "bin/su"), []byte("#!/bin/sh"), 0644)
+	os.Chown(path.Join(src, "bin/su"), 1000, 1001)
+	unix.Chmod(path.Join(src, "bin/su"), 04755)
+	os.Link(path.Join(src, "bin/su"), path.Join(src, "bin/sudo"))
+	os.Symlink("/bin/su", path.Join(src, "bin/sh"))
+	unix.Mkfifo(path.Join(src, "fifo"), 0600)
+	unix.Lsetxattr(path.Join(src, "bin"), "trusted.overlay.opaque", []byte("y"), 0)
+	unix.Lsetxattr(path.Join(src, "bin/su"), "trusted.foo", []byte("bar"), 0)
+	os.Chtimes(path.Join(src, "bin/su"), mtime, mtime)
+	os.Chtimes(path.Join(src, "bin"), mtime, mtime)
+
+	os.WriteFile(path.Join(dst, "old"), []byte("kept"), 0644)
+
+	if err := copyTree(src, dst, false, false); err != nil {
+		t.Fatalf("copyTree() error = %v", err)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Lstat(path.Join(dst, "bin/su"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode != unix.S_IFREG|04755 || st.Uid != 1000 || st.Gid != 1001 || st.Mtim.Sec != mtime.Unix() || st.Nlink != 2 {
+		t.Errorf("bin/su: mode %o, owner %d:%d, mtime %d, nlink %d", st.Mode, st.Uid, st.Gid, st.Mtim.Sec, st.Nlink)
+	}
+	if got, err := os.ReadFile(path.Join(dst, "bin/sudo")); err != nil || string(got) != "#!/bin/sh" {
+		t.Errorf("bin/sudo = %q, %v", got, err)
+	}
+	buf := make([]byte, 8)
+	if n, err := unix.Lgetxattr(path.Join(dst, "bin/su"), "trusted.foo", buf); err != nil || string(buf[:n]) != "bar" {
+		t.Errorf("bin/su: xattr = %q, %v", buf[:n], err)
+	}
+	if _, err := unix.Lgetxattr(path.Join(dst, "bin"), "trusted.overlay.opaque", buf); err == nil {
+		t.Errorf("bin: the overlay xattr should not be copied")
+	}
+
+	if err := unix.Lstat(path.Join(dst, "bin"), &st); err != nil || st.Mtim.Sec != mtime.Unix() {
+		t.Errorf("bin: mtime %d, %v", st.Mtim.Sec, err)
+	}
+	if target, err := os.Readlink(path.Join(dst, "bin/sh")); err != nil || target != "/bin/su" {
+		t.Errorf("bin/sh: link to %q, %v", target, err)
+	}
+	if err := unix.Lstat(path.Join(dst, "fifo"), &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFIFO {
+		t.Errorf("fifo: mode %o, %v", st.Mode, err)
+	}
+	if got, err := os.ReadFile(path.Join(dst, "old")); err != nil || string(got) != "kept" {
+		t.Errorf("old = %q, %v", got, err)
+	}
+}
+
+func TestCopyTree_whiteouts(t *testing.T) {
+	lower, upper, dst := t.TempDir(), t.TempDir(), t.TempDir()
+
+	for name, content := range map[string]string{"etc/passwd": "root", "etc/hostname": "foo", "opt/a": "a", "var/log": "log"} {
+		os.MkdirAll(path.Dir(path.Join(lower, name)), 0755)
+		os.WriteFile(path.Join(lower, name), []byte(content), 0644)
+	}
+	os.MkdirAll(path.Join(upper, "etc"), 0755)
+	unix.Mknod(path.Join(upper, "etc/passwd"), unix.S_IFCHR, 0) // whiteout
+	os.MkdirAll(path.Join(upper, "opt"), 0755)
+	if err := unix.Lsetxattr(path.Join(upper, "opt"), "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Skipf("no trusted xattrs: %v", err)
+	}
+	os.WriteFile(path.Join(upper, "opt/b"), []byte("b"), 0644)
+	os.WriteFile(path.Join(upper, "var"), []byte("a file replacing the dir"), 0644)
+
+	for _, layer := range []string{lower, upper} {
+		if err := copyTree(layer, dst, false, true); err != nil {
+			t.Fatalf("copyTree(%s) error = %v", layer, err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		content string // "" if not exists
+	}{
+		{"etc/passwd", ""},
+		{"etc/hostname", "foo"},
+		{"opt/a", ""},
+		{"opt/b", "b"},
+		{"var", "a file replacing the dir"},
+	}
+	for _, tt := range tests {
+		got, err := os.ReadFile(path.Join(dst, tt.name))
+		if tt.content == "" && !os.IsNotExist(err) {
+			t.Errorf("%s should be deleted: %q, %v", tt.name, got, err)
+		}
+		if tt.content != "" && string(got) != tt.content {
+			t.Errorf("%s = %q, %v, want %q", tt.name, got, err, tt.content)
+		}
+	}
+}
+
+func TestCopyTree_reflink(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	os.WriteFile(path.Join(src, "foo"), []byte("bar"), 0644)
+
+	err := copyTree(src, dst, true, false)
+	if errors.Is(err, ErrReflinkUnsupported) {
+		t.Skipf("reflink is not supported here: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("copyTree() error = %v", err)
+	}
+	if got, err := os.ReadFile(path.Join(dst, "foo")); err != nil || string(got) != "bar" {
+		t.Errorf("foo = %q, %v", got, err)
+	}
+}
+
+func TestCheckStorageDriver(t *testing.T) {
+	tests := []struct {
+		driver  string
+		overlay bool
+		wantErr bool
+	}{
+		{"", true, false},
+		{"", false, false},
+		{StorageDriverOverlay, true, false},
+		{StorageDriverVFS, true, false},
+		{StorageDriverReflink, true, false},
+		{"zfs", true, true},
+		{StorageDriverVFS, false, true},
+	}
+	for _, tt := range tests {
+		err := checkStorageDriver(&Container{StorageDriver: tt.driver, Overlay: tt.overlay})
+		if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrBadStorageDriver)) {
+			t.Errorf("checkStorageDriver(%q, overlay=%v) error = %v, wantErr %v", tt.driver, tt.overlay, err, tt.wantErr)
+		}
+	}
+}
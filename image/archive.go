@@ -0,0 +1,255 @@
+package image
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ArchiveOptions are the options of Archive.
+type ArchiveOptions struct {
+	// Whiteouts converts the overlayfs whiteouts in the dir (an upper
+	// dir) to the OCI form, the reverse of convertWhiteouts:
+	//
+	//	<name>: a character device 0:0          -> .wh.<name>
+	//	the xattr trusted.overlay.opaque=y      -> <dir>/.wh..wh..opq
+	Whiteouts bool
+}
+
+// Archive writes the files in the dir as an uncompressed tar stream,
+// the reverse of Extract. See Archiver. The names are relative to the
+// dir, which itself is not in the archive.
+func Archive(w io.Writer, dir string, opts ArchiveOptions) error {
+	a := NewArchiver(w)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		var st unix.Stat_t
+		if err := unix.Lstat(p, &st); err != nil {
+			return err
+		}
+		if opts.Whiteouts && st.Mode&unix.S_IFMT == unix.S_IFCHR && st.Rdev == 0 {
+			return a.tw.WriteHeader(whiteoutHeader(filepath.Join(filepath.Dir(rel), whiteoutPrefix+filepath.Base(rel)), &st))
+		}
+
+		if err := a.Add(rel, p); err != nil {
+			return err
+		}
+		if opts.Whiteouts && d.IsDir() && isOpaque(p) {
+			return a.tw.WriteHeader(whiteoutHeader(filepath.Join(rel, whiteoutOpaque), &st))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("archive %s: %w", dir, err)
+	}
+	return a.Close()
+}
+
+// Archiver writes the files on the host into a tar stream: the numeric
+// owners, modes, mtimes, xattrs (except the overlayfs ones), hardlinks,
+// symlinks and device nodes are kept.
+type Archiver struct {
+	tw    *tar.Writer
+	links map[fileID]string // the first name in the archive of a hard linked file
+}
+
+// fileID identifies a file on the host.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// NewArchiver returns an Archiver writing into w. Close it to finish
+// the archive.
+func NewArchiver(w io.Writer) *Archiver {
+	return &Archiver{tw: tar.NewWriter(w), links: map[fileID]string{}}
+}
+
+// Add writes the file (not following a symlink) into the archive as
+// the name. The files linked to a file added before are hardlinks to
+// it. Sockets are skipped.
+func (a *Archiver) Add(name string, file string) error {
+	fd, err := unix.Open(file, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: file, Err: err}
+	}
+	defer unix.Close(fd)
+	return a.AddFd(name, fd)
+}
+
+// AddFd is Add of the file of the fd, opened with O_PATH|O_NOFOLLOW (see
+// OpenInRoot). The file is read through the fd, not by a path: what is
+// archived is the file opened, even if its path is changed meanwhile.
+func (a *Archiver) AddFd(name string, fd int) error {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("stat %s: %w", name, err)
+	}
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(st.Mode & 07777),
+		Uid:     int(st.Uid),
+		Gid:     int(st.Gid),
+		ModTime: time.Unix(st.Mtim.Unix()),
+		Format:  tar.FormatPAX,
+	}
+
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name = strings.TrimSuffix(hdr.Name, "/") + "/"
+	case unix.S_IFREG:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = st.Size
+		if st.Nlink > 1 {
+			id := fileID{uint64(st.Dev), st.Ino}
+			if first, ok := a.links[id]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+			} else {
+				a.links[id] = name
+			}
+		}
+	case unix.S_IFLNK:
+		hdr.Typeflag = tar.TypeSymlink
+		linkname, err := readlinkFd(fd)
+		if err != nil {
+			return fmt.Errorf("readlink %s: %w", name, err)
+		}
+		hdr.Linkname = linkname
+	case unix.S_IFCHR:
+		hdr.Typeflag = tar.TypeChar
+	case unix.S_IFBLK:
+		hdr.Typeflag = tar.TypeBlock
+	case unix.S_IFIFO:
+		hdr.Typeflag = tar.TypeFifo
+	default: // sockets
+		return nil
+	}
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+		hdr.Devmajor, hdr.Devminor = int64(unix.Major(uint64(st.Rdev))), int64(unix.Minor(uint64(st.Rdev)))
+	}
+
+	xattrs, err := listXattrs(ProcFdPath(fd))
+	if err != nil {
+		return err
+	}
+	for key, value := range xattrs {
+		if strings.HasPrefix(key, overlayXattrPrefix) {
+			continue
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[paxXattrPrefix+key] = value
+	}
+
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+		return copyFileTo(a.tw, ProcFdPath(fd), name, hdr.Size)
+	}
+	return nil
+}
+
+// Close finishes the archive, not closing the underlying writer.
+func (a *Archiver) Close() error {
+	return a.tw.Close()
+}
+
+// whiteoutHeader is an empty regular file of the whiteout name, with the
+// owner and mtime of the st.
+func whiteoutHeader(name string, st *unix.Stat_t) *tar.Header {
+	return &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		Uid:      int(st.Uid),
+		Gid:      int(st.Gid),
+		ModTime:  time.Unix(st.Mtim.Unix()),
+		Format:   tar.FormatPAX,
+	}
+}
+
+// isOpaque reports whether the dir is an opaque dir of the overlayfs.
+func isOpaque(dir string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(dir, overlayOpaqueXattr, buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+// copyFileTo copies the size bytes of the file (named as the name in the
+// errors) into w: the size in the header, even if the file is growing
+// meanwhile.
+func copyFileTo(w io.Writer, file string, name string, size int64) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", name, err)
+	}
+	defer f.Close()
+	if _, err := io.CopyN(w, f, size); err != nil {
+		return fmt.Errorf("read %s: %w", name, err)
+	}
+	return nil
+}
+
+// readlinkFd reads the symlink of the O_PATH fd.
+func readlinkFd(fd int) (string, error) {
+	for size := 256; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(fd, "", buf)
+		if err != nil {
+			return "", err
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// listXattrs reads the xattrs of the file of the magic link (see
+// ProcFdPath), which is the file itself, even a symlink.
+// nil if the file system does not support xattrs.
+func listXattrs(name string) (map[string]string, error) {
+	size, err := unix.Listxattr(name, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("listxattr %s: %w", name, err)
+	} else if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Listxattr(name, buf); err != nil {
+		return nil, fmt.Errorf("listxattr %s: %w", name, err)
+	}
+
+	xattrs := map[string]string{}
+	for _, key := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		size, err := unix.Getxattr(name, key, nil)
+		if err != nil {
+			continue // removed meanwhile, or not permitted
+		}
+		value := make([]byte, size)
+		if size, err = unix.Getxattr(name, key, value); err != nil {
+			continue
+		}
+		xattrs[key] = string(value[:size])
+	}
+	return xattrs, nil
+}
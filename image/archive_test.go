@@ -0,0 +1,103 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestArchive(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	archive := makeArchive(t,
+		&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0555, ModTime: mtime},
+		&tar.Header{Name: "bin/su", Typeflag: tar.TypeReg, Mode: 04755, Uid: 1000, Gid: 1001, ModTime: mtime, Linkname: "#!/bin/sh",
+			PAXRecords: map[string]string{paxXattrPrefix + "trusted.foo": "bar"}},
+		&tar.Header{Name: "bin/sudo", Typeflag: tar.TypeLink, Linkname: "bin/su"},
+		&tar.Header{Name: "usr/bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/bin/su"},
+		&tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		&tar.Header{Name: "run/fifo", Typeflag: tar.TypeFifo, Mode: 0600},
+	)
+	src := t.TempDir()
+	if err := Extract(bytes.NewReader(archive), src, ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// round trip: Archive -> Extract
+	var buf bytes.Buffer
+	if err := Archive(&buf, src, ArchiveOptions{}); err != nil {
+		t.Fatalf("Archive() error = %v", err)
+	}
+	dst := t.TempDir()
+	if err := Extract(&buf, dst, ExtractOptions{}); err != nil {
+		t.Fatalf("Extract() the archive error = %v", err)
+	}
+
+	for _, name := range []string{"bin", "bin/su", "bin/sudo", "usr/bin/sh", "dev/null", "run/fifo"} {
+		var want, got unix.Stat_t
+		if err := unix.Lstat(path.Join(src, name), &want); err != nil {
+			t.Fatal(err)
+		}
+		if err := unix.Lstat(path.Join(dst, name), &got); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got.Mode != want.Mode || got.Uid != want.Uid || got.Gid != want.Gid || got.Rdev != want.Rdev || got.Nlink != want.Nlink {
+			t.Errorf("%s: mode %o, owner %d:%d, rdev %d, nlink %d; want mode %o, owner %d:%d, rdev %d, nlink %d", name,
+				got.Mode, got.Uid, got.Gid, got.Rdev, got.Nlink, want.Mode, want.Uid, want.Gid, want.Rdev, want.Nlink)
+		}
+		if name != "usr/bin/sh" && got.Mtim != want.Mtim {
+			t.Errorf("%s: mtime %v, want %v", name, got.Mtim, want.Mtim)
+		}
+	}
+	buf2 := make([]byte, 8)
+	if n, err := unix.Lgetxattr(path.Join(dst, "bin/su"), "trusted.foo", buf2); err != nil || string(buf2[:n]) != "bar" {
+		t.Errorf("bin/su: xattr = %q, %v", buf2[:n], err)
+	}
+	if got, err := os.ReadFile(path.Join(dst, "bin/su")); err != nil || string(got) != "#!/bin/sh" {
+		t.Errorf("bin/su = %q, %v", got, err)
+	}
+}
+
+func TestArchive_whiteouts(t *testing.T) {
+	upper := t.TempDir()
+	os.MkdirAll(path.Join(upper, "etc"), 0755)
+	if err := unix.Mknod(path.Join(upper, "etc/passwd"), unix.S_IFCHR, 0); err != nil {
+		t.Skipf("mknod: %v", err)
+	}
+	os.MkdirAll(path.Join(upper, "opt"), 0755)
+	if err := unix.Setxattr(path.Join(upper, "opt"), overlayOpaqueXattr, []byte("y"), 0); err != nil {
+		t.Skipf("no trusted xattrs: %v", err)
+	}
+	os.WriteFile(path.Join(upper, "opt/b"), []byte("b"), 0644)
+
+	var buf bytes.Buffer
+	if err := Archive(&buf, upper, ArchiveOptions{Whiteouts: true}); err != nil {
+		t.Fatalf("Archive() error = %v", err)
+	}
+
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if _, ok := hdr.PAXRecords[paxXattrPrefix+overlayOpaqueXattr]; ok {
+			t.Errorf("%s: the overlay xattr is archived", hdr.Name)
+		}
+	}
+	want := []string{"etc/", "etc/.wh.passwd", "opt/", "opt/.wh..wh..opq", "opt/b"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("Archive() entries = %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,149 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// CommitOptions are the options of Commit.
+type CommitOptions struct {
+	Parent    string  // the image (reference or id) under the new layer. "" for none.
+	Config    *Config // the config of the new image
+	CreatedBy string  // the history of the new layer, e.g. the command
+}
+
+// Commit makes a new image of the changes in the diff dir (an overlayfs
+// upper dir, with the whiteouts in the overlayfs form) as a new layer
+// on top of the parent image, and tags it with the references.
+//
+// The diff dir is archived with the whiteouts converted to the OCI form,
+// and then unpacked into the store as a loaded layer. The image config
+// is the parent's (if any), with the new Config, diff ids and history.
+//
+// An empty diff makes no new layer: the new image is the parent's layers
+// with the new Config, e.g. an ENV step of a build.
+func (s *Store) Commit(diff string, opts CommitOptions, refs ...string) (*Image, error) {
+	parsed, err := parseReferences(refs)
+	if err != nil {
+		return nil, err
+	}
+
+	parent := &Image{}
+	var parentConfig []byte
+	if opts.Parent != "" {
+		if parent, err = s.Get(opts.Parent); err != nil {
+			return nil, err
+		}
+		parentConfig, err = os.ReadFile(path.Join(s.imageDir(parent.ID), "config.json"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	var layers []*unpackedLayer
+	for _, diffID := range parent.Layers { // verified in the store by commit
+		layers = append(layers, &unpackedLayer{layerInfo: layerInfo{DiffID: diffID}})
+	}
+	diffIDs := append([]string{}, parent.Layers...)
+	img := &Image{Size: parent.Size, Created: time.Now()}
+
+	if diff != "" {
+		layer, err := s.archiveLayer(diff)
+		if err != nil {
+			return nil, fmt.Errorf("commit %s: %w", diff, err)
+		}
+		defer layer.cleanup()
+
+		layers = append(layers, layer)
+		diffIDs = append(diffIDs, layer.DiffID)
+		img.Size += layer.Size
+		img.Source, _ = filepath.Abs(diff)
+	}
+
+	config, err := commitConfig(parentConfig, opts, diffIDs, diff == "")
+	if err != nil {
+		return nil, err
+	}
+	img.ID, img.Layers = digestBytes(config), diffIDs
+
+	if err := s.commit(img, config, layers); err != nil {
+		return nil, err
+	}
+	if err := s.tag(img.ID, parsed); err != nil {
+		return nil, err
+	}
+
+	slog.Info("[image] image committed.", "id", img.ID, "refs", refs, "parent", parent.ID, "layers", len(img.Layers))
+	return s.Get(img.ID)
+}
+
+// archiveLayer archives the diff dir into a layer tar, and unpacks it
+// as a layer out of the store, to be committed.
+func (s *Store) archiveLayer(diff string) (*unpackedLayer, error) {
+	tmp, err := s.tempDir("commit-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	f, err := os.Create(path.Join(tmp, "layer.tar"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := Archive(f, diff, ArchiveOptions{Whiteouts: true}); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	return s.unpackLayer(f, "")
+}
+
+// commitConfig makes the image config of a committed image: the parent
+// config (nil if none) with the Config, the rootfs diff ids, and a new
+// history entry (of an empty layer if emptyLayer). The unknown fields in
+// the parent config are kept.
+func commitConfig(parent []byte, opts CommitOptions, diffIDs []string, emptyLayer bool) ([]byte, error) {
+	config := map[string]any{}
+	if parent != nil {
+		if err := json.Unmarshal(parent, &config); err != nil {
+			return nil, fmt.Errorf("%w: bad parent config: %v", ErrBadImage, err)
+		}
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if _, ok := config["architecture"]; !ok {
+		config["architecture"] = runtime.GOARCH
+	}
+	if _, ok := config["os"]; !ok {
+		config["os"] = runtime.GOOS
+	}
+	config["created"] = now
+	if opts.Config != nil {
+		config["config"] = opts.Config
+	} else {
+		delete(config, "config")
+	}
+	config["rootfs"] = map[string]any{"type": "layers", "diff_ids": diffIDs}
+
+	// the history matches the layers, if the parent has one
+	history, ok := config["history"].([]any)
+	if ok || (emptyLayer && len(diffIDs) == 0) || (!emptyLayer && len(diffIDs) == 1) {
+		entry := map[string]any{"created": now, "created_by": opts.CreatedBy, "comment": "hind commit"}
+		if emptyLayer {
+			entry["empty_layer"] = true
+		}
+		config["history"] = append(history, entry)
+	}
+
+	return json.Marshal(config)
+}
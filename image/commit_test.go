@@ -0,0 +1,105 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestStore_Commit(t *testing.T) {
+	s := NewStore(t.TempDir())
+	w := ociLayoutWriter{t, t.TempDir()}
+	m, _ := w.image([]tarEntry{{"etc/", ""}, {"etc/passwd", "root\n"}, {"opt/", ""}, {"opt/a", "a"}})
+	m.Annotations = map[string]string{annotationRefName: "base:v1"}
+	w.index(m)
+	loaded, err := s.Load(w.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := loaded[0]
+
+	// the upper dir of a container: etc/passwd deleted, opt replaced, usr/c added
+	upper := t.TempDir()
+	os.MkdirAll(path.Join(upper, "etc"), 0755)
+	if err := unix.Mknod(path.Join(upper, "etc/passwd"), unix.S_IFCHR, 0); err != nil {
+		t.Skipf("mknod: %v", err)
+	}
+	os.MkdirAll(path.Join(upper, "opt"), 0755)
+	if err := unix.Setxattr(path.Join(upper, "opt"), overlayOpaqueXattr, []byte("y"), 0); err != nil {
+		t.Skipf("no trusted xattrs: %v", err)
+	}
+	os.MkdirAll(path.Join(upper, "usr"), 0755)
+	os.WriteFile(path.Join(upper, "usr/c"), []byte("c"), 0644)
+
+	config := &Config{Cmd: []string{"sh"}, Env: []string{"FOO=bar"}}
+	img, err := s.Commit(upper, CommitOptions{Parent: "base:v1", Config: config, CreatedBy: "sh"}, "foo:v2")
+	if err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	if len(img.Layers) != 2 || img.Layers[0] != base.Layers[0] {
+		t.Errorf("Layers = %v, want on top of %v", img.Layers, base.Layers)
+	}
+	if !reflect.DeepEqual(img.RepoTags, []string{"foo:v2"}) || !reflect.DeepEqual(img.Config, config) {
+		t.Errorf("Commit() = %+v, config %+v", img, img.Config)
+	}
+
+	// the new layer in the overlayfs form again
+	top := s.LowerDirs(img)[0]
+	var st unix.Stat_t
+	if err := unix.Lstat(path.Join(top, "etc/passwd"), &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFCHR || st.Rdev != 0 {
+		t.Errorf("whiteout etc/passwd: mode %o, rdev %d, %v", st.Mode, st.Rdev, err)
+	}
+	buf := make([]byte, 8)
+	if n, err := unix.Getxattr(path.Join(top, "opt"), overlayOpaqueXattr, buf); err != nil || string(buf[:n]) != "y" {
+		t.Errorf("opaque opt: xattr = %q, %v", buf[:n], err)
+	}
+	if got, err := os.ReadFile(path.Join(top, "usr/c")); err != nil || string(got) != "c" {
+		t.Errorf("usr/c = %q, %v", got, err)
+	}
+
+	// the image config: the diff ids
+	data, err := os.ReadFile(path.Join(s.imageDir(img.ID), "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw imageConfig
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(raw.RootFS.DiffIDs, img.Layers) || digestBytes(data) != img.ID {
+		t.Errorf("config: diff ids %v, digest %s; want %v, %s", raw.RootFS.DiffIDs, digestBytes(data), img.Layers, img.ID)
+	}
+
+	// a config change: no new layer
+	img2, err := s.Commit("", CommitOptions{Parent: img.ID, Config: &Config{WorkingDir: "/srv"}, CreatedBy: "WORKDIR /srv"}, "foo:v3")
+	if err != nil {
+		t.Fatalf("Commit() with no diff error = %v", err)
+	}
+	if !reflect.DeepEqual(img2.Layers, img.Layers) || img2.Size != img.Size || img2.Config.WorkingDir != "/srv" {
+		t.Errorf("Commit() with no diff = %+v, want the layers %v", img2, img.Layers)
+	}
+	if err := s.Tag(img2.ID, "foo:latest"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get("foo:latest"); err != nil || got.ID != img2.ID {
+		t.Errorf("Get() the tag = %v, %v; want %s", got, err, img2.ID)
+	}
+
+	// removing the base image keeps the shared layer
+	if _, _, err := s.Remove("base:v1", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.LowerDirs(img)[1]); err != nil {
+		t.Errorf("the base layer should be kept: %v", err)
+	}
+
+	if _, err := s.Commit(upper, CommitOptions{Parent: "nope"}); !errors.Is(err, ErrNoSuchImage) {
+		t.Errorf("Commit() on no such image error = %v, want %v", err, ErrNoSuchImage)
+	}
+}
@@ -0,0 +1,49 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+// Config is the execution parameters of an image: the defaults to run
+// a container of it. It is the "config" in the OCI image config.
+//
+// See https://github.com/opencontainers/image-spec/blob/main/config.md
+type Config struct {
+	User         string              `json:",omitempty"` // user[:group], by name or id
+	ExposedPorts map[string]struct{} `json:",omitempty"` // port[/tcp|udp]
+	Env          []string            `json:",omitempty"` // KEY=VALUE
+	Entrypoint   []string            `json:",omitempty"`
+	Cmd          []string            `json:",omitempty"`
+	WorkingDir   string              `json:",omitempty"`
+	Labels       map[string]string   `json:",omitempty"`
+	StopSignal   string              `json:",omitempty"`
+}
+
+// imageConfig is the parts of the OCI image config that hind reads.
+type imageConfig struct {
+	Config *Config `json:"config,omitempty"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// config reads the Config in the image config of the image.
+// nil if the image has no config (imported from a rootfs archive).
+func (s *Store) config(id string) (*Config, error) {
+	data, err := os.ReadFile(path.Join(s.imageDir(id), "config.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var config imageConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%w: bad config of image %s: %v", ErrBadImage, id, err)
+	}
+	return config.Config, nil
+}
@@ -0,0 +1,348 @@
+package image
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinks is the limit of symlinks followed resolving a path,
+// as the kernel's MAXSYMLINKS.
+const maxSymlinks = 40
+
+// paxXattrPrefix is the prefix of the xattrs in the PAX records.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// ExtractOptions are the options of Extract.
+type ExtractOptions struct {
+	// Progress is called after each entry is extracted, if not nil.
+	Progress func(ExtractProgress)
+
+	// Digest is the digest (sha256:<hex>) the stream must have, if not
+	// empty. It is computed on the stream extracted, not read again: the
+	// extraction fails with ErrDigestMismatch at the end if the stream
+	// differs, and the files extracted are left to the caller to remove.
+	Digest string
+}
+
+// ExtractProgress is the progress of an extraction.
+type ExtractProgress struct {
+	Name    string // the name of the entry just extracted
+	Entries int    // the number of entries extracted so far
+	Bytes   int64  // the bytes of the regular files extracted so far
+}
+
+// ExtractFile extracts the (maybe compressed) tar file into the dir.
+// See Extract.
+func ExtractFile(name string, dir string, opts ExtractOptions) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := Extract(f, dir, opts); err != nil {
+		return fmt.Errorf("extract %s: %w", name, err)
+	}
+	return nil
+}
+
+// Extract extracts the tar stream into the dir, which is created if
+// missing. The compression (gzip, bzip2, xz or zstd) is detected.
+//
+// The owners (numeric uid/gid, if running as root), modes, mtimes,
+// xattrs, hardlinks, symlinks and device nodes are preserved. The device
+// nodes are skipped if they can not be made (without CAP_MKNOD).
+//
+// An entry never goes out of the dir: a name escaping the dir by ".."
+// is refused (ErrBadArchive), a leading "/" is stripped (as GNU tar
+// does), and the symlinks in the dir are followed as if the dir were
+// the root "/". This holds even if the dir is changed meanwhile, e.g. by
+// the processes of a running container: see extractor.
+func Extract(r io.Reader, dir string, opts ExtractOptions) error {
+	var h hash.Hash
+	if opts.Digest != "" {
+		h = sha256.New()
+		r = io.TeeReader(r, h)
+	}
+
+	tarball, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	defer tarball.Close()
+
+	if err := extractTar(tarball, dir, opts); err != nil {
+		return err
+	}
+	if h == nil {
+		return nil
+	}
+
+	// the rest of the stream: e.g. the padding after the end of the archive
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	if digest := DigestAlgorithm + ":" + hex.EncodeToString(h.Sum(nil)); digest != opts.Digest {
+		return fmt.Errorf("%w: the archive extracted is %s, not %s", ErrDigestMismatch, digest, opts.Digest)
+	}
+	return nil
+}
+
+// extractor extracts a tar stream into the dir.
+//
+// The files are made relative to their parent dirs, opened in the root
+// fd of the dir (see OpenInRoot), by the *at(2) syscalls: the dir may be
+// changed meanwhile (by a later entry, or by the processes of a running
+// container), and nothing is ever made out of it.
+type extractor struct {
+	root     int // the O_PATH fd of the dir
+	opts     ExtractOptions
+	chown    bool
+	progress ExtractProgress
+	dirs     []*tar.Header // applied at the end: extracting the entries in them would change the mtimes
+}
+
+// extractTar extracts the uncompressed tar stream into the dir.
+func extractTar(r io.Reader, dir string, opts ExtractOptions) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	root, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	defer unix.Close(root)
+	x := &extractor{root: root, opts: opts, chown: os.Geteuid() == 0}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBadArchive, err)
+		}
+		if err := x.extractEntry(hdr, tr); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+
+		x.progress.Name = hdr.Name
+		x.progress.Entries++
+		if x.opts.Progress != nil {
+			x.opts.Progress(x.progress)
+		}
+	}
+
+	// the deepest first: the parents are modified by setting the children
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		if err := x.setDirMetadata(x.dirs[i]); err != nil {
+			return fmt.Errorf("%s: %w", x.dirs[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// setDirMetadata sets the metadata of the dir extracted before, if it is
+// still a dir: a later entry may have replaced it (or a parent) by a
+// symlink, which must not be followed.
+func (x *extractor) setDirMetadata(hdr *tar.Header) error {
+	rel, err := cleanName(hdr.Name)
+	if err != nil {
+		return err
+	}
+
+	var fd int
+	if rel == "." {
+		fd, err = unix.Dup(x.root)
+	} else {
+		var parent int
+		if parent, err = OpenInRoot(x.root, path.Dir(rel), unix.O_DIRECTORY); err == nil {
+			fd, err = unix.Openat(parent, path.Base(rel), unix.O_PATH|unix.O_NOFOLLOW|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+			unix.Close(parent)
+		}
+	}
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) || errors.Is(err, unix.ELOOP) {
+		slog.Debug("[image] the dir is replaced, skip its metadata.", "name", hdr.Name, "err", err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	return x.setMetadataFd(fd, hdr)
+}
+
+// extractEntry creates the file of the entry, replacing the existing one
+// (except a dir by a dir). The parents are resolved in the dir (see
+// OpenInRoot), made if missing, and the last element is not followed.
+func (x *extractor) extractEntry(hdr *tar.Header, r io.Reader) error {
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		return nil
+	}
+
+	rel, err := cleanName(hdr.Name)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		if hdr.Typeflag != tar.TypeDir {
+			return fmt.Errorf("%w: the root is not a directory", ErrBadArchive)
+		}
+		x.dirs = append(x.dirs, hdr)
+		return nil
+	}
+
+	parent, err := MkdirAllInRoot(x.root, path.Dir(rel))
+	if errors.Is(err, unix.ELOOP) {
+		return fmt.Errorf("%w: %v", ErrBadArchive, err)
+	} else if err != nil {
+		return err
+	}
+	defer unix.Close(parent)
+	name := path.Base(rel)
+
+	var st unix.Stat_t
+	if err := unix.Fstatat(parent, name, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil && !(st.Mode&unix.S_IFMT == unix.S_IFDIR && hdr.Typeflag == tar.TypeDir) {
+		// through the magic link of the parent: RemoveAll does not follow the symlinks under it
+		if err := os.RemoveAll(path.Join(ProcFdPath(parent), name)); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := unix.Mkdirat(parent, name, 0700); err != nil && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("mkdir: %w", err)
+		}
+		x.dirs = append(x.dirs, hdr)
+		return nil
+	case tar.TypeReg:
+		fd, err := unix.Openat(parent, name, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+		if err != nil {
+			return fmt.Errorf("create: %w", err)
+		}
+		f := os.NewFile(uintptr(fd), hdr.Name)
+		n, err := io.Copy(f, r)
+		x.progress.Bytes += n
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := unix.Symlinkat(hdr.Linkname, parent, name); err != nil {
+			return fmt.Errorf("symlink: %w", err)
+		}
+	case tar.TypeLink:
+		source, err := cleanName(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		sourceParent, err := OpenInRoot(x.root, path.Dir(source), unix.O_DIRECTORY)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(sourceParent)
+		// the metadata is of the source: they share the inode
+		if err := unix.Linkat(sourceParent, path.Base(source), parent, name, 0); err != nil {
+			return fmt.Errorf("link: %w", err)
+		}
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		mode := map[byte]uint32{tar.TypeChar: unix.S_IFCHR, tar.TypeBlock: unix.S_IFBLK, tar.TypeFifo: unix.S_IFIFO}[hdr.Typeflag]
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		err := unix.Mknodat(parent, name, mode|0600, int(dev))
+		if errors.Is(err, unix.EPERM) && hdr.Typeflag != tar.TypeFifo {
+			// no CAP_MKNOD (rootless): skip the device, as docker and containerd do
+			slog.Warn("[image] skip the device in the archive: mknod not permitted.", "name", hdr.Name, "err", err)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("mknod: %w", err)
+		}
+	default:
+		slog.Warn("[image] skip the unsupported entry in the archive.", "name", hdr.Name, "type", string(hdr.Typeflag))
+		return nil
+	}
+
+	fd, err := unix.Openat(parent, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return x.setMetadataFd(fd, hdr)
+}
+
+// setMetadataFd sets the owner, mode, xattrs and times of the file of the
+// O_PATH fd. The owner goes first: chown(2) clears the setuid and setgid
+// bits. The fd is never followed: the file is changed through the magic
+// link /proc/self/fd/N, which refers to the file itself, even a symlink.
+func (x *extractor) setMetadataFd(fd int, hdr *tar.Header) error {
+	if x.chown {
+		if err := unix.Fchownat(fd, "", hdr.Uid, hdr.Gid, unix.AT_EMPTY_PATH); err != nil {
+			return fmt.Errorf("chown: %w", err)
+		}
+	}
+
+	file := ProcFdPath(fd)
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(file, hdr.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range hdr.PAXRecords {
+		name, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok {
+			continue
+		}
+		if err := unix.Setxattr(file, name, []byte(value), 0); err != nil {
+			if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+				slog.Warn("[image] xattr not supported, skip.", "name", hdr.Name, "xattr", name, "err", err)
+				continue
+			}
+			return fmt.Errorf("setxattr %s: %w", name, err)
+		}
+	}
+
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	times := []unix.Timespec{timespec(atime), timespec(hdr.ModTime)}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, file, times, 0); err != nil {
+		return fmt.Errorf("utimes: %w", err)
+	}
+	return nil
+}
+
+func timespec(t time.Time) unix.Timespec {
+	if t.IsZero() {
+		return unix.Timespec{Nsec: unix.UTIME_OMIT}
+	}
+	return unix.NsecToTimespec(t.UnixNano())
+}
+
+// cleanName is the path in the dir of the name in the archive, cleaned,
+// relative to the dir ("." is the dir). A name escaping the dir by ".."
+// is refused, a leading "/" is stripped.
+func cleanName(name string) (string, error) {
+	rel := path.Clean(strings.TrimLeft(name, "/"))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%w: %q is out of the dir", ErrBadArchive, name)
+	}
+	return rel, nil
+}
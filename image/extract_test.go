@@ -0,0 +1,438 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/sys/unix"
+)
+
+// makeArchive makes a tar stream of the headers. The content of a regular
+// file is its Linkname (cleared in the archive).
+func makeArchive(t *testing.T, headers ...*tar.Header) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range headers {
+		hdr := *h
+		content := ""
+		if hdr.Typeflag == tar.TypeReg {
+			content, hdr.Linkname = hdr.Linkname, ""
+			hdr.Size = int64(len(content))
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtract(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	archive := makeArchive(t,
+		&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0555, ModTime: mtime},
+		&tar.Header{Name: "bin/su", Typeflag: tar.TypeReg, Mode: 04755, Uid: 1000, Gid: 1001, ModTime: mtime, Linkname: "#!/bin/sh",
+			PAXRecords: map[string]string{paxXattrPrefix + "trusted.foo": "bar"}},
+		&tar.Header{Name: "bin/sudo", Typeflag: tar.TypeLink, Linkname: "bin/su"},
+		&tar.Header{Name: "usr/bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/bin/su", Uid: 1000, Gid: 1000},
+		&tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		&tar.Header{Name: "run/fifo", Typeflag: tar.TypeFifo, Mode: 0600},
+		&tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Linkname: "old"},
+		&tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Linkname: "new"}, // replaces
+	)
+
+	dir := t.TempDir()
+	var progress []ExtractProgress
+	err := Extract(bytes.NewReader(archive), dir, ExtractOptions{
+		Progress: func(p ExtractProgress) { progress = append(progress, p) },
+	})
+	if err != nil {
+		t.Fatalf("Extract() error = %v", err)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Lstat(path.Join(dir, "bin/su"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode != unix.S_IFREG|04755 || st.Uid != 1000 || st.Gid != 1001 || st.Mtim.Sec != mtime.Unix() || st.Nlink != 2 {
+		t.Errorf("bin/su: mode %o, owner %d:%d, mtime %d, nlink %d", st.Mode, st.Uid, st.Gid, st.Mtim.Sec, st.Nlink)
+	}
+	buf := make([]byte, 8)
+	if n, err := unix.Lgetxattr(path.Join(dir, "bin/su"), "trusted.foo", buf); err != nil || string(buf[:n]) != "bar" {
+		t.Errorf("bin/su: xattr = %q, %v", buf[:n], err)
+	}
+
+	if err := unix.Lstat(path.Join(dir, "bin"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode != unix.S_IFDIR|0555 || st.Mtim.Sec != mtime.Unix() {
+		t.Errorf("bin: mode %o, mtime %d", st.Mode, st.Mtim.Sec)
+	}
+
+	if target, err := os.Readlink(path.Join(dir, "usr/bin/sh")); err != nil || target != "/bin/su" {
+		t.Errorf("usr/bin/sh: link to %q, %v", target, err)
+	}
+	if err := unix.Lstat(path.Join(dir, "usr/bin/sh"), &st); err != nil || st.Uid != 1000 {
+		t.Errorf("usr/bin/sh: owner %d, %v", st.Uid, err)
+	}
+
+	if err := unix.Lstat(path.Join(dir, "dev/null"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode != unix.S_IFCHR|0666 || unix.Major(st.Rdev) != 1 || unix.Minor(st.Rdev) != 3 {
+		t.Errorf("dev/null: mode %o, rdev %d:%d", st.Mode, unix.Major(st.Rdev), unix.Minor(st.Rdev))
+	}
+	if err := unix.Lstat(path.Join(dir, "run/fifo"), &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFIFO {
+		t.Errorf("run/fifo: mode %o, %v", st.Mode, err)
+	}
+
+	if got, err := os.ReadFile(path.Join(dir, "etc/hostname")); err != nil || string(got) != "new" {
+		t.Errorf("etc/hostname = %q, %v", got, err)
+	}
+
+	if len(progress) != 9 {
+		t.Fatalf("Progress called %d times, want 9", len(progress))
+	}
+	if last := progress[len(progress)-1]; last.Entries != 9 || last.Bytes != int64(len("#!/bin/sh")+len("old")+len("new")) || last.Name != "etc/hostname" {
+		t.Errorf("the last progress = %+v", last)
+	}
+}
+
+// withoutCapMknod runs fn on a thread without CAP_MKNOD in its effective
+// capabilities, as a rootless extraction. The capability is kept in the
+// permitted set and raised again after.
+func withoutCapMknod(t *testing.T, fn func()) {
+	t.Helper()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		t.Fatal(err)
+	}
+	if data[0].Effective&(1<<unix.CAP_MKNOD) == 0 {
+		t.Skip("no CAP_MKNOD to drop (not root?)")
+	}
+	orig := data
+	data[0].Effective &^= 1 << unix.CAP_MKNOD
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := unix.Capset(&hdr, &orig[0]); err != nil {
+			t.Errorf("raise CAP_MKNOD again: %v", err)
+		}
+	}()
+
+	fn()
+}
+
+// the devices that can not be made without CAP_MKNOD are skipped
+func TestExtract_devicesNotPermitted(t *testing.T) {
+	archive := makeArchive(t,
+		&tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		&tar.Header{Name: "dev/sda", Typeflag: tar.TypeBlock, Mode: 0660, Devmajor: 8, Devminor: 0},
+		&tar.Header{Name: "run/fifo", Typeflag: tar.TypeFifo, Mode: 0600},
+		&tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Linkname: "host"},
+	)
+
+	dir := t.TempDir()
+	var err error
+	withoutCapMknod(t, func() {
+		err = Extract(bytes.NewReader(archive), dir, ExtractOptions{})
+	})
+	if err != nil {
+		t.Fatalf("Extract() error = %v", err)
+	}
+
+	for _, name := range []string{"dev/null", "dev/sda"} {
+		if _, err := os.Lstat(path.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s: not skipped: %v", name, err)
+		}
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(path.Join(dir, "run/fifo"), &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFIFO {
+		t.Errorf("run/fifo: mode %o, %v", st.Mode, err)
+	}
+	if got, err := os.ReadFile(path.Join(dir, "etc/hostname")); err != nil || string(got) != "host" {
+		t.Errorf("etc/hostname = %q, %v", got, err)
+	}
+}
+
+func TestExtract_compressed(t *testing.T) {
+	archive := makeArchive(t, &tar.Header{Name: "foo", Typeflag: tar.TypeReg, Linkname: "bar"})
+
+	compressCmd := func(name string, args ...string) func([]byte) []byte {
+		return func(data []byte) []byte {
+			if _, err := exec.LookPath(name); err != nil {
+				t.Skipf("no %s: %v", name, err)
+			}
+			cmd := exec.Command(name, args...)
+			cmd.Stdin = bytes.NewReader(data)
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			return out
+		}
+	}
+
+	tests := []struct {
+		name     string
+		compress func([]byte) []byte
+	}{
+		{"none", func(data []byte) []byte { return data }},
+		{"gzip", func(data []byte) []byte {
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			w.Write(data)
+			w.Close()
+			return buf.Bytes()
+		}},
+		{"bzip2", compressCmd("bzip2", "-c")},
+		{"xz", func(data []byte) []byte {
+			var buf bytes.Buffer
+			w, err := xz.NewWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(data)
+			w.Close()
+			return buf.Bytes()
+		}},
+		{"zstd", func(data []byte) []byte {
+			w, err := zstd.NewWriter(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			return w.EncodeAll(data, nil)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := Extract(bytes.NewReader(tt.compress(archive)), dir, ExtractOptions{}); err != nil {
+				t.Fatalf("Extract() error = %v", err)
+			}
+			if got, err := os.ReadFile(path.Join(dir, "foo")); err != nil || string(got) != "bar" {
+				t.Errorf("foo = %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestExtract_digest(t *testing.T) {
+	archive := makeArchive(t, &tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Linkname: "foo"})
+	archive = append(archive, make([]byte, 4096)...) // padding after the end of the archive
+	other := makeArchive(t, &tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Linkname: "evil"})
+
+	tests := []struct {
+		name      string
+		archive   []byte
+		wantErrIs error
+	}{
+		{"same", archive, nil},
+		{"replaced", other, ErrDigestMismatch},
+		{"truncated", archive[:len(archive)-512], ErrDigestMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Extract(bytes.NewReader(tt.archive), t.TempDir(), ExtractOptions{Digest: digestBytes(archive)})
+			if !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("Extract() error = %v, want %v", err, tt.wantErrIs)
+			}
+		})
+	}
+}
+
+func TestExtract_malicious(t *testing.T) {
+	tests := []struct {
+		name      string
+		headers   []*tar.Header
+		wantErrIs error
+		wantFile  string // the file that should be in the dir
+	}{
+		{
+			"dotdot",
+			[]*tar.Header{{Name: "../evil", Typeflag: tar.TypeReg, Linkname: "x"}},
+			ErrBadArchive, "",
+		},
+		{
+			"dotdot in the middle",
+			[]*tar.Header{{Name: "a/../../evil", Typeflag: tar.TypeReg, Linkname: "x"}},
+			ErrBadArchive, "",
+		},
+		{
+			"hardlink out of the dir",
+			[]*tar.Header{{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../../../etc/passwd"}},
+			ErrBadArchive, "",
+		},
+		{
+			"absolute path",
+			[]*tar.Header{{Name: "/evil", Typeflag: tar.TypeReg, Linkname: "x"}},
+			nil, "evil",
+		},
+		{
+			"through an absolute symlink",
+			[]*tar.Header{
+				{Name: "root", Typeflag: tar.TypeSymlink, Linkname: "/"},
+				{Name: "root/evil", Typeflag: tar.TypeReg, Linkname: "x"},
+			},
+			nil, "evil",
+		},
+		{
+			"through a relative symlink",
+			[]*tar.Header{
+				{Name: "a/up", Typeflag: tar.TypeSymlink, Linkname: "../../../../../../tmp"},
+				{Name: "a/up/evil", Typeflag: tar.TypeReg, Linkname: "x"},
+			},
+			nil, "tmp/evil",
+		},
+		{
+			"symlink loop",
+			[]*tar.Header{
+				{Name: "loop", Typeflag: tar.TypeSymlink, Linkname: "loop"},
+				{Name: "loop/evil", Typeflag: tar.TypeReg, Linkname: "x"},
+			},
+			ErrBadArchive, "",
+		},
+		{
+			"overwrite a symlink",
+			[]*tar.Header{
+				{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+				{Name: "passwd", Typeflag: tar.TypeReg, Linkname: "x"},
+			},
+			nil, "passwd",
+		},
+		{
+			"chmod through a dir replaced by a symlink",
+			[]*tar.Header{
+				{Name: "a/", Typeflag: tar.TypeDir, Mode: 0777},
+				{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "../../../victim"},
+			},
+			nil, "",
+		},
+		{
+			"chmod through a parent replaced by a symlink",
+			[]*tar.Header{
+				{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "a/b/", Typeflag: tar.TypeDir, Mode: 0777},
+				{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "../../.."},
+			},
+			nil, "",
+		},
+		{
+			"root is not a dir",
+			[]*tar.Header{{Name: ".", Typeflag: tar.TypeReg, Linkname: "x"}},
+			ErrBadArchive, "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := path.Join(parent, "a", "b", "rootfs")
+			victim := path.Join(parent, "victim")
+			if err := os.WriteFile(victim, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			os.MkdirAll(path.Join(parent, "a", "b"), 0700)
+			err := Extract(bytes.NewReader(makeArchive(t, tt.headers...)), dir, ExtractOptions{})
+			if tt.wantErrIs != nil {
+				if !errors.Is(err, tt.wantErrIs) {
+					t.Errorf("Extract() error = %v, want %v", err, tt.wantErrIs)
+				}
+			} else if err != nil {
+				t.Fatalf("Extract() error = %v", err)
+			}
+
+			if tt.wantFile != "" {
+				var st unix.Stat_t
+				if err := unix.Lstat(path.Join(dir, tt.wantFile), &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFREG {
+					t.Errorf("%s should be a regular file in the dir: mode %o, %v", tt.wantFile, st.Mode, err)
+				}
+			}
+			// nothing out of the dir is changed
+			for _, p := range []string{victim, path.Join(parent, "a"), path.Join(parent, "a", "b")} {
+				if fi, err := os.Stat(p); err != nil || fi.Mode().Perm() != 0700 && fi.Mode().Perm() != 0600 {
+					t.Errorf("%s out of the dir is changed: %v, %v", p, fi.Mode(), err)
+				}
+			}
+			// nothing out of the dir
+			for _, p := range []string{"evil", "a/evil", "a/b/evil", "/tmp/evil"} {
+				if !path.IsAbs(p) {
+					p = path.Join(parent, p)
+				}
+				if _, err := os.Lstat(p); err == nil {
+					t.Errorf("%s is written out of the dir", p)
+					os.Remove(p)
+				}
+			}
+		})
+	}
+}
+
+func TestExtract_swapped(t *testing.T) {
+	// a running container replaces a dir by a symlink out of the dir,
+	// again and again, while the files are extracted into it
+	parent := t.TempDir()
+	dir, outside := path.Join(parent, "rootfs"), path.Join(parent, "outside")
+	for _, d := range []string{path.Join(dir, "a"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	headers := []*tar.Header{}
+	for i := 0; i < 1000; i++ {
+		headers = append(headers, &tar.Header{Name: fmt.Sprintf("a/f%d", i), Typeflag: tar.TypeReg, Linkname: "x"})
+	}
+
+	a, link := path.Join(dir, "a"), path.Join(dir, "link")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	swapped := make(chan struct{})
+	go func() {
+		defer close(swapped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, link, unix.RENAME_EXCHANGE)
+			}
+		}
+	}()
+	Extract(bytes.NewReader(makeArchive(t, headers...)), dir, ExtractOptions{}) // may fail: the dir is changed meanwhile
+	close(done)
+	<-swapped
+
+	if entries, _ := os.ReadDir(outside); len(entries) > 0 {
+		t.Errorf("%d files are written out of the dir, e.g. %s", len(entries), entries[0].Name())
+	}
+}
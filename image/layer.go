@@ -0,0 +1,180 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"hind/internal/atomicfile"
+
+	"golang.org/x/exp/slog"
+)
+
+// layerInfo is the metadata of a layer in the store.
+type layerInfo struct {
+	DiffID string // sha256:<hex> of the uncompressed layer tar
+	Size   int64  // bytes of the unpacked layer
+}
+
+// unpackedLayer is a layer unpacked out of the store, to be committed.
+type unpackedLayer struct {
+	layerInfo
+	tmp string // the temporary dir to move into the store. "" if the layer exists in the store.
+}
+
+// cleanup removes the temporary dir, if not committed.
+func (l *unpackedLayer) cleanup() {
+	if l.tmp != "" {
+		os.RemoveAll(l.tmp)
+	}
+}
+
+func (s *Store) layerDir(diffID string) string {
+	return path.Join(s.Root, "layers", DigestAlgorithm, strings.TrimPrefix(diffID, DigestAlgorithm+":"))
+}
+
+// layerDiffDir is the directory of the unpacked layer: a lower dir.
+func (s *Store) layerDiffDir(diffID string) string {
+	return path.Join(s.layerDir(diffID), "diff")
+}
+
+// loadLayer reads the metadata of the layer.
+func (s *Store) loadLayer(diffID string) (*layerInfo, error) {
+	data, err := os.ReadFile(path.Join(s.layerDir(diffID), "layer.json"))
+	if err != nil {
+		return nil, err
+	}
+	var l layerInfo
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, fmt.Errorf("bad metadata of layer %s: %w", diffID, err)
+	}
+	return &l, nil
+}
+
+// unpackLayer unpacks the (maybe compressed) layer tar to a temporary
+// dir, with the whiteouts converted to the overlayfs form.
+//
+// If the diffID is known (from the image config), it is verified; and
+// nothing is unpacked if the layer exists in the store.
+func (s *Store) unpackLayer(r io.Reader, diffID string) (*unpackedLayer, error) {
+	if diffID != "" {
+		if l, err := s.loadLayer(diffID); err == nil {
+			return &unpackedLayer{layerInfo: *l}, nil
+		}
+	}
+
+	tmp, err := s.tempDir("layer-")
+	if err != nil {
+		return nil, err
+	}
+	layer := &unpackedLayer{tmp: tmp}
+	diff := path.Join(tmp, "diff")
+	if err := os.Mkdir(diff, 0755); err != nil {
+		layer.cleanup()
+		return nil, err
+	}
+
+	zr, err := decompress(r)
+	if err != nil {
+		layer.cleanup()
+		return nil, err
+	}
+	defer zr.Close()
+	h := sha256.New()
+	tarball := io.TeeReader(zr, h)
+
+	if err := extractTar(tarball, diff, ExtractOptions{}); err != nil {
+		layer.cleanup()
+		return nil, fmt.Errorf("%w: extract layer: %v", ErrBadImage, err)
+	}
+	// the padding after the end of archive is in the digest too
+	if _, err := io.Copy(io.Discard, tarball); err != nil {
+		layer.cleanup()
+		return nil, fmt.Errorf("%w: read layer: %v", ErrBadImage, err)
+	}
+
+	layer.DiffID = DigestAlgorithm + ":" + hex.EncodeToString(h.Sum(nil))
+	if diffID != "" && layer.DiffID != diffID {
+		layer.cleanup()
+		return nil, fmt.Errorf("%w: layer diff id mismatch: got %s, want %s", ErrBadImage, layer.DiffID, diffID)
+	}
+
+	if err := convertWhiteouts(diff); err != nil {
+		layer.cleanup()
+		return nil, err
+	}
+
+	if layer.Size, err = dirSize(diff); err != nil {
+		layer.cleanup()
+		return nil, err
+	}
+	if err := atomicfile.WriteJSON(path.Join(tmp, "layer.json"), layer.layerInfo); err != nil {
+		layer.cleanup()
+		return nil, err
+	}
+	return layer, nil
+}
+
+// commitLayer moves the unpacked layer into the store, if not yet there.
+// The store must be locked.
+func (s *Store) commitLayer(l *unpackedLayer) error {
+	if _, err := s.loadLayer(l.DiffID); err == nil {
+		return nil
+	}
+	if l.tmp == "" {
+		// it was in the store when unpacking, but removed meanwhile
+		return fmt.Errorf("%w: layer %s is removed meanwhile, please retry", ErrBadImage, l.DiffID)
+	}
+
+	if err := os.MkdirAll(path.Dir(s.layerDir(l.DiffID)), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(l.tmp, s.layerDir(l.DiffID)); err != nil {
+		return fmt.Errorf("move the layer into the store: %w", err)
+	}
+	l.tmp = ""
+	return nil
+}
+
+// removeUnusedLayers removes the layers used by no image.
+// The store must be locked.
+func (s *Store) removeUnusedLayers() {
+	entries, err := os.ReadDir(path.Join(s.Root, "layers", DigestAlgorithm))
+	if err != nil {
+		return
+	}
+
+	ids, err := s.ids()
+	if err != nil {
+		slog.Warn("[image] failed to list the images, keep all layers.", "err", err)
+		return
+	}
+	used := map[string]bool{}
+	for _, id := range ids {
+		img, err := s.load(id)
+		if err != nil {
+			slog.Warn("[image] bad image, keep all layers.", "id", id, "err", err)
+			return
+		}
+		for _, diffID := range img.Layers {
+			used[diffID] = true
+		}
+	}
+
+	for _, e := range entries {
+		diffID := DigestAlgorithm + ":" + e.Name()
+		if used[diffID] {
+			continue
+		}
+		if err := s.removeDir(s.layerDir(diffID)); err != nil {
+			slog.Warn("[image] failed to remove the unused layer.", "layer", diffID, "err", err)
+			continue
+		}
+		slog.Info("[image] unused layer removed.", "layer", diffID)
+	}
+}
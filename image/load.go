@@ -0,0 +1,430 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// The media types of the manifests and indexes that Load knows.
+const (
+	mediaTypeOCIIndex          = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest       = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerList        = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest    = "application/vnd.docker.distribution.manifest.v2+json"
+	annotationRefName          = "org.opencontainers.image.ref.name"
+	annotationContainerdName   = "io.containerd.image.name"
+	dockerSaveManifestFileName = "manifest.json"
+	ociIndexFileName           = "index.json"
+)
+
+var digestRegexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// descriptor is an OCI content descriptor.
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *platform         `json:"platform,omitempty"`
+}
+
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ociIndex is an OCI image index (index.json), or a docker manifest list.
+type ociIndex struct {
+	MediaType string       `json:"mediaType,omitempty"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// ociManifest is an OCI image manifest, or a docker v2 schema 2 manifest.
+type ociManifest struct {
+	MediaType string       `json:"mediaType,omitempty"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+}
+
+// dockerSaveManifest is an entry of the manifest.json of docker save.
+type dockerSaveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// loadEntry is an image found in an OCI layout or a docker save archive.
+type loadEntry struct {
+	config []byte
+	id     string // the digest of the config
+	layers []layerSource
+	names  []string
+}
+
+// layerSource is where to read a layer blob.
+type layerSource struct {
+	path   string
+	digest string // the digest of the blob to verify. "" if unknown.
+}
+
+// Load loads the images from an OCI image layout or a docker save
+// archive (a directory or a tar file) into the store. The layers are
+// unpacked into the store, except the ones already there.
+//
+// The images are tagged with the names in the layout or archive. And
+// the refs, if given, for the layout or archive of a single image.
+//
+// For a multi-platform index, the image for linux/GOARCH is loaded.
+func (s *Store) Load(src string, refs ...string) ([]*Image, error) {
+	parsed, err := parseReferences(refs)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := os.Stat(src)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadImage, err)
+	}
+	dir := src
+	if !st.IsDir() {
+		tmp, err := s.tempDir("load-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tmp)
+
+		if err := ExtractFile(src, tmp, ExtractOptions{}); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadImage, err)
+		}
+		dir = tmp
+	}
+
+	var entries []*loadEntry
+	if _, err := os.Stat(filepath.Join(dir, dockerSaveManifestFileName)); err == nil {
+		entries, err = readDockerSave(dir)
+		if err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(filepath.Join(dir, ociIndexFileName)); err == nil {
+		entries, err = readOCILayout(dir)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("%w: %s is neither an OCI image layout nor a docker save archive", ErrBadImage, src)
+	}
+
+	if len(parsed) > 0 && len(entries) != 1 {
+		return nil, fmt.Errorf("%w: %d images in %s, can not name them all with %v", ErrBadReference, len(entries), src, refs)
+	}
+
+	abs, _ := filepath.Abs(src)
+	var images []*Image
+	for _, e := range entries {
+		img, err := s.loadImage(e, abs, parsed)
+		if err != nil {
+			return images, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// loadImage unpacks the layers, commits and tags the image.
+func (s *Store) loadImage(e *loadEntry, source string, refs []Reference) (*Image, error) {
+	names, err := parseReferences(e.names)
+	if err != nil {
+		slog.Warn("[image] ignore the bad names in the image.", "id", e.id, "names", e.names, "err", err)
+		names = nil
+	}
+	refs = append(names, refs...)
+
+	if _, err := s.load(e.id); err == nil {
+		slog.Info("[image] image exists, tag only.", "id", e.id, "refs", refs)
+		if err := s.tag(e.id, refs); err != nil {
+			return nil, err
+		}
+		return s.Get(e.id)
+	}
+
+	var config imageConfig
+	if err := json.Unmarshal(e.config, &config); err != nil {
+		return nil, fmt.Errorf("%w: bad config %s: %v", ErrBadImage, e.id, err)
+	}
+	diffIDs := config.RootFS.DiffIDs
+	if len(diffIDs) != len(e.layers) {
+		return nil, fmt.Errorf("%w: image %s has %d layers but %d diff ids", ErrBadImage, e.id, len(e.layers), len(diffIDs))
+	}
+
+	img := &Image{ID: e.id, Created: time.Now(), Source: source}
+	var layers []*unpackedLayer
+	defer func() {
+		for _, l := range layers {
+			l.cleanup()
+		}
+	}()
+	for i, src := range e.layers {
+		if !digestRegexp.MatchString(diffIDs[i]) {
+			return nil, fmt.Errorf("%w: bad diff id %q", ErrBadImage, diffIDs[i])
+		}
+		l, err := s.unpackLayerFile(src, diffIDs[i])
+		if err != nil {
+			return nil, fmt.Errorf("layer %d of image %s: %w", i, e.id, err)
+		}
+		layers = append(layers, l)
+		img.Layers = append(img.Layers, l.DiffID)
+		img.Size += l.Size
+	}
+
+	if err := s.commit(img, e.config, layers); err != nil {
+		return nil, err
+	}
+	if err := s.tag(img.ID, refs); err != nil {
+		return nil, err
+	}
+
+	slog.Info("[image] image loaded.", "id", img.ID, "refs", refs, "layers", len(img.Layers), "source", source)
+	return s.Get(img.ID)
+}
+
+// unpackLayerFile unpacks the layer blob, verifying the blob digest if known.
+func (s *Store) unpackLayerFile(src layerSource, diffID string) (*unpackedLayer, error) {
+	f, err := os.Open(src.path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadImage, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	var h hash.Hash
+	if src.digest != "" {
+		h = sha256.New()
+		r = io.TeeReader(f, h)
+	}
+
+	l, err := s.unpackLayer(r, diffID)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil || l.tmp == "" { // nothing read if the layer exists
+		return l, nil
+	}
+
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		l.cleanup()
+		return nil, err
+	}
+	if got := DigestAlgorithm + ":" + hex.EncodeToString(h.Sum(nil)); got != src.digest {
+		l.cleanup()
+		return nil, fmt.Errorf("%w: blob digest mismatch: got %s, want %s", ErrBadImage, got, src.digest)
+	}
+	return l, nil
+}
+
+// readDockerSave reads the images in the manifest.json of docker save.
+func readDockerSave(dir string) ([]*loadEntry, error) {
+	data, err := os.ReadFile(filepath.Join(dir, dockerSaveManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	var manifests []dockerSaveManifest
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		return nil, fmt.Errorf("%w: bad %s: %v", ErrBadImage, dockerSaveManifestFileName, err)
+	}
+
+	var entries []*loadEntry
+	for _, m := range manifests {
+		config, err := os.ReadFile(inDir(dir, m.Config))
+		if err != nil {
+			return nil, fmt.Errorf("%w: read config: %v", ErrBadImage, err)
+		}
+		e := &loadEntry{config: config, id: digestBytes(config), names: m.RepoTags}
+		for _, l := range m.Layers {
+			// blobs/sha256/<hex> in the newer docker, or <id>/layer.tar
+			e.layers = append(e.layers, layerSource{path: inDir(dir, l), digest: blobDigest(l)})
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// readOCILayout reads the images in the index.json of an OCI layout.
+func readOCILayout(dir string) ([]*loadEntry, error) {
+	var index ociIndex
+	if err := readJSON(filepath.Join(dir, ociIndexFileName), &index); err != nil {
+		return nil, err
+	}
+
+	manifests, err := selectManifests(dir, index.Manifests)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*loadEntry
+	for _, desc := range manifests {
+		var m ociManifest
+		if err := readBlobJSON(dir, desc.Digest, &m); err != nil {
+			return nil, err
+		}
+		config, err := readBlob(dir, m.Config.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		e := &loadEntry{config: config, id: m.Config.Digest}
+		if name := refName(desc.Annotations); name != "" {
+			e.names = []string{name}
+		}
+		for _, l := range m.Layers {
+			if !digestRegexp.MatchString(l.Digest) {
+				return nil, fmt.Errorf("%w: bad layer digest %q", ErrBadImage, l.Digest)
+			}
+			e.layers = append(e.layers, layerSource{path: blobPath(dir, l.Digest), digest: l.Digest})
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// selectManifests resolves the descriptors to the image manifests:
+// the nested indexes (multi-platform) are resolved to the manifest for
+// the current platform. The names (annotations) of the outer
+// descriptors are kept.
+func selectManifests(dir string, descs []descriptor) ([]descriptor, error) {
+	// a multi-platform list: keep only the current platform
+	var matched []descriptor
+	hasPlatform := false
+	for _, d := range descs {
+		if d.Platform == nil {
+			matched = append(matched, d)
+			continue
+		}
+		hasPlatform = true
+		if d.Platform.OS == "linux" && d.Platform.Architecture == runtime.GOARCH {
+			matched = append(matched, d)
+		}
+	}
+	if hasPlatform && len(matched) == 0 {
+		return nil, fmt.Errorf("%w: no image for linux/%s", ErrBadImage, runtime.GOARCH)
+	}
+	if hasPlatform {
+		matched = matched[:1] // the variants of the same platform: take the first
+	}
+
+	var manifests []descriptor
+	for _, d := range matched {
+		switch d.MediaType {
+		case mediaTypeOCIIndex, mediaTypeDockerList:
+			var nested ociIndex
+			if err := readBlobJSON(dir, d.Digest, &nested); err != nil {
+				return nil, err
+			}
+			resolved, err := selectManifests(dir, nested.Manifests)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range resolved {
+				if refName(r.Annotations) == "" {
+					r.Annotations = d.Annotations
+				}
+				manifests = append(manifests, r)
+			}
+		case mediaTypeOCIManifest, mediaTypeDockerManifest, "":
+			manifests = append(manifests, d)
+		default:
+			slog.Warn("[image] skip unknown manifest.", "mediaType", d.MediaType, "digest", d.Digest)
+		}
+	}
+	return manifests, nil
+}
+
+// refName is the image name in the annotations, if it is a full
+// reference (name:tag). A bare tag (e.g. "latest") is ignored.
+func refName(annotations map[string]string) string {
+	if name := annotations[annotationContainerdName]; name != "" {
+		return name
+	}
+	name := annotations[annotationRefName]
+	if strings.ContainsAny(name, ":/") {
+		return name
+	}
+	return ""
+}
+
+// readBlob reads the blob and verifies its digest.
+func readBlob(dir string, digest string) ([]byte, error) {
+	if !digestRegexp.MatchString(digest) {
+		return nil, fmt.Errorf("%w: bad digest %q", ErrBadImage, digest)
+	}
+	data, err := os.ReadFile(blobPath(dir, digest))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadImage, err)
+	}
+	if got := digestBytes(data); got != digest {
+		return nil, fmt.Errorf("%w: blob digest mismatch: got %s, want %s", ErrBadImage, got, digest)
+	}
+	return data, nil
+}
+
+func readBlobJSON(dir string, digest string, v any) error {
+	data, err := readBlob(dir, digest)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: bad blob %s: %v", ErrBadImage, digest, err)
+	}
+	return nil
+}
+
+func readJSON(name string, v any) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadImage, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: bad %s: %v", ErrBadImage, filepath.Base(name), err)
+	}
+	return nil
+}
+
+// blobPath is <dir>/blobs/sha256/<hex>.
+func blobPath(dir string, digest string) string {
+	algorithm, hexDigest, _ := strings.Cut(digest, ":")
+	return filepath.Join(dir, "blobs", algorithm, hexDigest)
+}
+
+// blobDigest is the digest of a blobs/sha256/<hex> path, or "".
+func blobDigest(p string) string {
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(p)), "/")
+	if len(parts) != 3 || parts[0] != "blobs" {
+		return ""
+	}
+	if d := parts[1] + ":" + parts[2]; digestRegexp.MatchString(d) {
+		return d
+	}
+	return ""
+}
+
+// inDir joins the relative path p to the dir, never escaping the dir.
+func inDir(dir string, p string) string {
+	return filepath.Join(dir, filepath.Clean("/"+p))
+}
+
+func digestBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return DigestAlgorithm + ":" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,249 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// tarEntry is a file (content != "") or a directory (name ends with "/").
+type tarEntry struct {
+	name    string
+	content string
+}
+
+// makeLayer makes a layer tar of the entries, gzip compressed if compress.
+// Returns the blob and the diff id.
+func makeLayer(t *testing.T, entries []tarEntry, compress bool) ([]byte, string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		if e.name[len(e.name)-1] == '/' {
+			hdr.Mode, hdr.Typeflag = 0755, tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	diffID := digestBytes(buf.Bytes())
+	if !compress {
+		return buf.Bytes(), diffID
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(buf.Bytes())
+	zw.Close()
+	return gz.Bytes(), diffID
+}
+
+// ociLayoutWriter writes blobs into an OCI image layout dir.
+type ociLayoutWriter struct {
+	t   *testing.T
+	dir string
+}
+
+func (w ociLayoutWriter) blob(data []byte) descriptor {
+	w.t.Helper()
+	d := digestBytes(data)
+	if err := os.MkdirAll(path.Join(w.dir, "blobs", DigestAlgorithm), 0755); err != nil {
+		w.t.Fatal(err)
+	}
+	if err := os.WriteFile(blobPath(w.dir, d), data, 0644); err != nil {
+		w.t.Fatal(err)
+	}
+	return descriptor{Digest: d, Size: int64(len(data))}
+}
+
+func (w ociLayoutWriter) json(v any) descriptor {
+	w.t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		w.t.Fatal(err)
+	}
+	return w.blob(data)
+}
+
+// image writes the layers, config and manifest, returns the manifest descriptor.
+func (w ociLayoutWriter) image(layers ...[]tarEntry) (manifest descriptor, configDigest string) {
+	w.t.Helper()
+	var m ociManifest
+	var config imageConfig
+	config.RootFS.Type = "layers"
+	for _, entries := range layers {
+		blob, diffID := makeLayer(w.t, entries, true)
+		m.Layers = append(m.Layers, w.blob(blob))
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+	}
+	m.Config = w.json(config)
+	m.MediaType = mediaTypeOCIManifest
+	manifest = w.json(m)
+	manifest.MediaType = mediaTypeOCIManifest
+	return manifest, m.Config.Digest
+}
+
+func (w ociLayoutWriter) index(manifests ...descriptor) {
+	w.t.Helper()
+	data, _ := json.Marshal(ociIndex{MediaType: mediaTypeOCIIndex, Manifests: manifests})
+	if err := os.WriteFile(path.Join(w.dir, ociIndexFileName), data, 0644); err != nil {
+		w.t.Fatal(err)
+	}
+}
+
+func TestStore_Load_OCILayout(t *testing.T) {
+	s := NewStore(t.TempDir())
+	w := ociLayoutWriter{t, t.TempDir()}
+
+	base := []tarEntry{{"etc/", ""}, {"etc/hostname", "base\n"}, {"etc/passwd", "root\n"}, {"opt/", ""}, {"opt/a", "a"}}
+	top := []tarEntry{{"etc/", ""}, {"etc/.wh.passwd", ""}, {"opt/", ""}, {"opt/.wh..wh..opq", ""}, {"opt/b", "b"}}
+	other := []tarEntry{{"usr/", ""}, {"usr/c", "c"}}
+
+	m1, id1 := w.image(base, top)
+	m1.Annotations = map[string]string{annotationRefName: "foo:v1"}
+	m2, id2 := w.image(base, other)
+	m2.Annotations = map[string]string{annotationRefName: "bar:v1"}
+	w.index(m1, m2)
+
+	images, err := s.Load(w.dir)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(images) != 2 || images[0].ID != id1 || images[1].ID != id2 {
+		t.Fatalf("Load() = %+v, want images %s, %s", images, id1, id2)
+	}
+	foo, bar := images[0], images[1]
+	if !reflect.DeepEqual(foo.RepoTags, []string{"foo:v1"}) || !reflect.DeepEqual(bar.RepoTags, []string{"bar:v1"}) {
+		t.Errorf("RepoTags = %v, %v", foo.RepoTags, bar.RepoTags)
+	}
+
+	// the base layer is shared
+	if len(foo.Layers) != 2 || len(bar.Layers) != 2 || foo.Layers[0] != bar.Layers[0] {
+		t.Errorf("Layers = %v, %v, want the base layer shared", foo.Layers, bar.Layers)
+	}
+	if entries, _ := os.ReadDir(path.Join(s.Root, "layers", DigestAlgorithm)); len(entries) != 3 {
+		t.Errorf("%d layers in the store, want 3", len(entries))
+	}
+
+	dirs := s.LowerDirs(foo)
+	if len(dirs) != 2 || dirs[1] != s.layerDiffDir(foo.Layers[0]) || dirs[0] != s.layerDiffDir(foo.Layers[1]) {
+		t.Errorf("LowerDirs() = %v, want top first", dirs)
+	}
+
+	// whiteout: a 0:0 char device
+	var st unix.Stat_t
+	if err := unix.Lstat(path.Join(dirs[0], "etc/passwd"), &st); err != nil {
+		t.Errorf("whiteout etc/passwd: %v", err)
+	} else if st.Mode&unix.S_IFMT != unix.S_IFCHR || st.Rdev != 0 {
+		t.Errorf("whiteout etc/passwd: mode %o, rdev %d, want a 0:0 char device", st.Mode, st.Rdev)
+	}
+	if _, err := os.Lstat(path.Join(dirs[0], "etc/.wh.passwd")); !os.IsNotExist(err) {
+		t.Errorf("etc/.wh.passwd should be converted: %v", err)
+	}
+
+	// opaque dir: the xattr
+	buf := make([]byte, 8)
+	if n, err := unix.Getxattr(path.Join(dirs[0], "opt"), "trusted.overlay.opaque", buf); err != nil || string(buf[:n]) != "y" {
+		t.Errorf("opaque opt: xattr = %q, %v", buf[:n], err)
+	}
+	if _, err := os.Lstat(path.Join(dirs[0], "opt/.wh..wh..opq")); !os.IsNotExist(err) {
+		t.Errorf("opt/.wh..wh..opq should be converted: %v", err)
+	}
+
+	// load again: nothing new, tag only
+	again, err := s.Load(w.dir)
+	if err != nil || len(again) != 2 {
+		t.Errorf("Load() again = %v, %v", again, err)
+	}
+
+	// refs only for a single image
+	if _, err := s.Load(w.dir, "baz"); !errors.Is(err, ErrBadReference) {
+		t.Errorf("Load() with refs error = %v, want %v", err, ErrBadReference)
+	}
+
+	// removing an image keeps the shared layer
+	if _, _, err := s.Remove("foo:v1", false); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(path.Join(s.Root, "layers", DigestAlgorithm)); len(entries) != 2 {
+		t.Errorf("%d layers in the store after removing foo, want 2", len(entries))
+	}
+	if _, err := os.Stat(path.Join(s.LowerDirs(bar)[1], "etc/hostname")); err != nil {
+		t.Errorf("the shared layer should be kept: %v", err)
+	}
+}
+
+func TestStore_Load_DockerSave(t *testing.T) {
+	s := NewStore(t.TempDir())
+	dir := t.TempDir()
+
+	l1, diff1 := makeLayer(t, []tarEntry{{"a", "a"}}, false)
+	l2, diff2 := makeLayer(t, []tarEntry{{"b", "b"}}, false)
+	os.WriteFile(path.Join(dir, "l1.tar"), l1, 0644)
+	os.WriteFile(path.Join(dir, "l2.tar"), l2, 0644)
+
+	var config imageConfig
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = []string{diff1, diff2}
+	config.Config = &Config{Cmd: []string{"sh"}, Labels: map[string]string{"foo": "bar"}}
+	configData, _ := json.Marshal(config)
+	os.WriteFile(path.Join(dir, "config.json"), configData, 0644)
+
+	manifest, _ := json.Marshal([]dockerSaveManifest{{Config: "config.json", RepoTags: []string{"foo:v1"}, Layers: []string{"l1.tar", "l2.tar"}}})
+	os.WriteFile(path.Join(dir, dockerSaveManifestFileName), manifest, 0644)
+
+	images, err := s.Load(dir, "bar")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(images) != 1 {
+		t.Fatalf("Load() = %d images, want 1", len(images))
+	}
+	img := images[0]
+	if img.ID != digestBytes(configData) || !reflect.DeepEqual(img.Layers, []string{diff1, diff2}) {
+		t.Errorf("Load() = %+v", img)
+	}
+	if !reflect.DeepEqual(img.RepoTags, []string{"bar:latest", "foo:v1"}) {
+		t.Errorf("RepoTags = %v", img.RepoTags)
+	}
+	if !reflect.DeepEqual(img.Config, config.Config) {
+		t.Errorf("Config = %+v, want %+v", img.Config, config.Config)
+	}
+
+	// a bad diff id (not in the store: the existing layers are not unpacked again)
+	config.RootFS.DiffIDs = []string{digestBytes([]byte("bad")), diff2}
+	configData, _ = json.Marshal(config)
+	os.WriteFile(path.Join(dir, "config.json"), configData, 0644)
+	if _, err := s.Load(dir); !errors.Is(err, ErrBadImage) {
+		t.Errorf("Load() with bad diff id error = %v, want %v", err, ErrBadImage)
+	}
+}
+
+func TestSelectManifests(t *testing.T) {
+	descs := []descriptor{
+		{Digest: "sha256:1", MediaType: mediaTypeOCIManifest, Platform: &platform{OS: "linux", Architecture: "not-" + runtime.GOARCH}},
+		{Digest: "sha256:2", MediaType: mediaTypeOCIManifest, Platform: &platform{OS: "linux", Architecture: runtime.GOARCH}},
+		{Digest: "sha256:3", MediaType: mediaTypeOCIManifest, Platform: &platform{OS: "windows", Architecture: runtime.GOARCH}},
+	}
+	got, err := selectManifests(t.TempDir(), descs)
+	if err != nil || len(got) != 1 || got[0].Digest != "sha256:2" {
+		t.Errorf("selectManifests() = %v, %v, want sha256:2", got, err)
+	}
+}
@@ -0,0 +1,64 @@
+package image
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultTag is the tag of a reference without one.
+const DefaultTag = "latest"
+
+var (
+	// path components separated by "/", e.g. library/busybox.
+	// An optional registry host (with a port) may come first.
+	nameRegexp = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*(:[0-9]+)?/)?[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$`)
+	tagRegexp  = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+)
+
+// Reference is a human readable name of an image: name:tag.
+type Reference struct {
+	Name string
+	Tag  string
+}
+
+// ParseReference parses "name[:tag]". The tag is "latest" if omitted.
+func ParseReference(s string) (Reference, error) {
+	name, tag := s, DefaultTag
+	// the tag is after the last colon, if the colon is not in the
+	// registry host: localhost:5000/foo
+	if i := strings.LastIndex(s, ":"); i > strings.LastIndex(s, "/") {
+		name, tag = s[:i], s[i+1:]
+	}
+
+	if !nameRegexp.MatchString(name) {
+		return Reference{}, fmt.Errorf("%w: invalid name %q", ErrBadReference, s)
+	}
+	if !tagRegexp.MatchString(tag) {
+		return Reference{}, fmt.Errorf("%w: invalid tag %q", ErrBadReference, s)
+	}
+	return Reference{Name: name, Tag: tag}, nil
+}
+
+// String is name:tag.
+func (r Reference) String() string {
+	return r.Name + ":" + r.Tag
+}
+
+// SplitDigest splits "image@sha256:<hex>" into the image (a reference,
+// an id or a path) and the digest pinning it. The digest is empty if
+// there is no "@".
+func SplitDigest(s string) (string, string, error) {
+	i := strings.LastIndex(s, "@")
+	if i < 0 {
+		return s, "", nil
+	}
+	name, digest := s[:i], s[i+1:]
+	if name == "" {
+		return "", "", fmt.Errorf("%w: no image before the digest %q", ErrBadReference, s)
+	}
+	if !digestRegexp.MatchString(digest) {
+		return "", "", fmt.Errorf("%w: invalid digest %q, want %s:<64 hex digits>", ErrBadReference, digest, DigestAlgorithm)
+	}
+	return name, digest, nil
+}
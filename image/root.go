@@ -0,0 +1,145 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The files of a root dir (an image rootfs, a dir being extracted, the
+// rootfs of a running container...) are opened relative to an O_PATH fd
+// of the root, by openat(2) and openat2(2), not by joined paths: a path
+// resolved before may be changed meanwhile, e.g. a dir replaced by a
+// symlink to "/", and a joined path would follow it out of the root.
+
+// OpenInRoot opens the file of the path p in the root (an fd of a dir)
+// with O_PATH and the flags (e.g. O_NOFOLLOW not to follow the last
+// element, O_DIRECTORY). The symlinks are resolved by openat2(2) with
+// RESOLVE_IN_ROOT, as if the root were "/": the file opened is never out
+// of the root, even if the path is changed meanwhile.
+func OpenInRoot(rootFd int, p string, flags int) (int, error) {
+	how := &unix.OpenHow{
+		Flags:   uint64(unix.O_PATH | unix.O_CLOEXEC | flags),
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	for {
+		fd, err := unix.Openat2(rootFd, p, how)
+		if errors.Is(err, unix.EAGAIN) {
+			continue // a rename or a mount raced with a "..": safe to retry
+		}
+		return fd, wrapOpenat2Error(err)
+	}
+}
+
+// MkdirAllInRoot opens the dir of the path p in the root (an fd of a dir)
+// with O_PATH, as OpenInRoot, making it and the missing parents (0755).
+// The missing dirs are made in the path resolved in the root (see
+// FollowInRoot), one element at a time, never following a symlink.
+func MkdirAllInRoot(rootFd int, p string) (int, error) {
+	fd, err := OpenInRoot(rootFd, p, unix.O_DIRECTORY)
+	if !errors.Is(err, unix.ENOENT) {
+		return fd, err
+	}
+
+	root := ProcFdPath(rootFd)
+	resolved, err := FollowInRoot(root, p)
+	if err != nil {
+		return -1, err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil {
+		return -1, err
+	}
+
+	dirFd, err := unix.Dup(rootFd)
+	if err != nil {
+		return -1, err
+	}
+	if rel == "." {
+		return dirFd, nil
+	}
+	noFollow := &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS,
+	}
+	for _, name := range strings.Split(rel, "/") {
+		if err := unix.Mkdirat(dirFd, name, 0755); err != nil && !errors.Is(err, unix.EEXIST) {
+			unix.Close(dirFd)
+			return -1, fmt.Errorf("mkdir %s: %w", name, err)
+		}
+		next, err := unix.Openat2(dirFd, name, noFollow)
+		unix.Close(dirFd)
+		if err != nil {
+			return -1, fmt.Errorf("open %s: %w", name, wrapOpenat2Error(err))
+		}
+		dirFd = next
+	}
+	return dirFd, nil
+}
+
+// wrapOpenat2Error explains the ENOSYS of openat2(2), which is new in
+// Linux 5.6.
+func wrapOpenat2Error(err error) error {
+	if errors.Is(err, unix.ENOSYS) {
+		return fmt.Errorf("openat2 (Linux 5.6+) is required: %w", err)
+	}
+	return err
+}
+
+// ProcFdPath is the magic link to the file of the fd: a path of the file
+// itself (even a symlink or an O_PATH fd), never resolved again.
+func ProcFdPath(fd int) string {
+	return "/proc/self/fd/" + strconv.Itoa(fd)
+}
+
+// FollowInRoot resolves the path p (relative to the root) to the real
+// path in the root, following the symlinks as if the root were "/":
+// an absolute target is relative to the root, and ".." stops at the
+// root. So the result never leaves the root.
+// The missing elements are taken as they are (dirs to be created).
+func FollowInRoot(root string, p string) (string, error) {
+	resolved := "" // relative to the root, clean
+	todo := p
+	links := 0
+	for todo != "" {
+		var elem string
+		elem, todo, _ = strings.Cut(todo, "/")
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if resolved = path.Dir(resolved); resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := path.Join(resolved, elem)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) || (err == nil && fi.Mode()&os.ModeSymlink == 0) {
+			resolved = next
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("%w: too many levels of symbolic links: %s", ErrBadArchive, p)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = ""
+		}
+		todo = target + "/" + todo
+	}
+	return filepath.Join(root, resolved), nil
+}
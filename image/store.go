@@ -0,0 +1,563 @@
+// Package image implements the local image store: the images are
+// unpacked once when imported or loaded, and the layer directories are
+// used directly as the (read-only) lower dirs of the containers'
+// overlayfs.
+//
+// The store is content-addressed. An image is identified by the sha256
+// digest of its config (or of the archive it is imported from), and a
+// layer is identified by its diff id: the digest of the uncompressed
+// layer tar. The layers shared between images are stored once.
+// The human readable references (name:tag) point to the image ids.
+//
+//	<Root>/repositories.json                 name:tag -> sha256:<hex>
+//	<Root>/sha256/<hex>/image.json           the metadata (Image)
+//	<Root>/sha256/<hex>/config.json          the image config, if loaded
+//	<Root>/layers/sha256/<hex>/layer.json    the metadata of a layer
+//	<Root>/layers/sha256/<hex>/diff/         the unpacked layer
+//	<Root>/tmp/                              unpacking in progress
+//	<Root>/store.lock                        flock(2) for the writers
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"hind/internal/atomicfile"
+	"hind/internal/stringid"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/sys/unix"
+)
+
+// DigestAlgorithm is the only supported digest algorithm.
+const DigestAlgorithm = "sha256"
+
+// Image is the metadata of an image in the store.
+type Image struct {
+	ID       string    // sha256:<hex>, the digest of the config, or of the imported archive
+	RepoTags []string  `json:",omitempty"` // the references (name:tag) to the image. Filled by the Store.
+	Layers   []string  // the diff ids of the layers, the lowest first
+	Size     int64     // bytes of the unpacked layers
+	Created  time.Time // when the image is imported or loaded
+	Source   string    // the path of the imported archive or the loaded image
+	Config   *Config   `json:",omitempty"` // the defaults to run the image. Filled by the Store. nil if none (imported).
+}
+
+// Store is the image store in the Root directory.
+type Store struct {
+	Root string
+
+	// InUse reports whether the image with the id is used by a container.
+	// An image in use can not be removed. nil for never.
+	InUse func(id string) bool
+}
+
+// NewStore returns the image store in the root dir.
+// The directory is created when the first image is imported.
+func NewStore(root string) *Store {
+	return &Store{Root: root}
+}
+
+// LowerDirs are the directories of the unpacked layers of the image,
+// the top first: the order of the lowerdir option of overlayfs.
+func (s *Store) LowerDirs(img *Image) []string {
+	dirs := make([]string, len(img.Layers))
+	for i, diffID := range img.Layers {
+		dirs[len(dirs)-1-i] = s.layerDiffDir(diffID)
+	}
+	return dirs
+}
+
+func (s *Store) imageDir(id string) string {
+	return path.Join(s.Root, DigestAlgorithm, strings.TrimPrefix(id, DigestAlgorithm+":"))
+}
+
+func (s *Store) repositoriesFile() string {
+	return path.Join(s.Root, "repositories.json")
+}
+
+// Import unpacks the tar archive of a rootfs into the store as an
+// image of a single layer, and tags it with the references (name[:tag]).
+// If the same archive (by digest) has been imported, it is only tagged.
+func (s *Store) Import(archive string, refs ...string) (*Image, error) {
+	parsed, err := parseReferences(refs)
+	if err != nil {
+		return nil, err
+	}
+
+	if st, err := os.Stat(archive); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadImage, err)
+	} else if !st.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: %s is not a tar archive", ErrBadImage, archive)
+	}
+
+	id, err := DigestFile(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.load(id); err == nil {
+		slog.Info("[image] image exists, tag only.", "id", id, "refs", refs)
+		if err := s.tag(id, parsed); err != nil {
+			return nil, err
+		}
+		return s.Get(id)
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// unpack out of the lock: it may take a while
+	layer, err := s.unpackLayer(f, "")
+	if err != nil {
+		return nil, fmt.Errorf("import %s: %w", archive, err)
+	}
+	defer layer.cleanup()
+
+	abs, _ := filepath.Abs(archive)
+	img := &Image{ID: id, Layers: []string{layer.DiffID}, Size: layer.Size, Created: time.Now(), Source: abs}
+	if err := s.commit(img, nil, []*unpackedLayer{layer}); err != nil {
+		return nil, err
+	}
+
+	if err := s.tag(id, parsed); err != nil {
+		return nil, err
+	}
+
+	slog.Info("[image] image imported.", "id", id, "refs", refs, "source", archive)
+	return s.Get(id)
+}
+
+// commit moves the unpacked layers into the store (if not yet), and
+// writes the image with its config (nil if none).
+func (s *Store) commit(img *Image, config []byte, layers []*unpackedLayer) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, l := range layers {
+		if err := s.commitLayer(l); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(s.imageDir(img.ID)); err == nil {
+		return nil // loaded by someone else meanwhile
+	}
+
+	tmp, err := s.tempDir("image-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp) // nothing left if renamed
+
+	if err := atomicfile.WriteJSON(path.Join(tmp, "image.json"), img); err != nil {
+		return err
+	}
+	if config != nil {
+		if err := os.WriteFile(path.Join(tmp, "config.json"), config, 0600); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(s.imageDir(img.ID)), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.imageDir(img.ID)); err != nil {
+		return fmt.Errorf("move the image into the store: %w", err)
+	}
+	return nil
+}
+
+// tempDir makes a temporary directory in <Root>/tmp: on the same file
+// system as the store, so that it can be renamed into the store.
+func (s *Store) tempDir(pattern string) (string, error) {
+	tmpRoot := path.Join(s.Root, "tmp")
+	if err := os.MkdirAll(tmpRoot, 0700); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(tmpRoot, pattern)
+}
+
+// Get finds the image by a reference (name[:tag]), the id, or an
+// unique prefix of the id (with or without "sha256:").
+func (s *Store) Get(refOrID string) (*Image, error) {
+	id, err := s.resolve(refOrID)
+	if err != nil {
+		return nil, err
+	}
+	img, err := s.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	repos, err := s.repositories()
+	if err != nil {
+		return nil, err
+	}
+	img.RepoTags = tagsOf(repos, id)
+
+	if img.Config, err = s.config(id); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// Verify checks the content of the image against its id: the config of
+// a loaded or committed image is the one its id is the digest of. The
+// config is what the id (and so a signature of it, see Trust) refers to:
+// the diff ids of the layers, the entrypoint, env... An imported image has
+// no config, and its id is the digest of the archive, which is not kept.
+func (s *Store) Verify(img *Image) error {
+	name := path.Join(s.imageDir(img.ID), "config.json")
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		return nil
+	}
+	digest, err := DigestFile(name)
+	if err != nil {
+		return err
+	}
+	if digest != img.ID {
+		return fmt.Errorf("%w: the config of image %s has the digest %s", ErrDigestMismatch, img.ID, digest)
+	}
+	return nil
+}
+
+// resolve finds the id of the image.
+func (s *Store) resolve(refOrID string) (string, error) {
+	if ref, err := ParseReference(refOrID); err == nil {
+		repos, err := s.repositories()
+		if err != nil {
+			return "", err
+		}
+		if id, ok := repos[ref.String()]; ok {
+			return id, nil
+		}
+	}
+
+	prefix := strings.TrimPrefix(refOrID, DigestAlgorithm+":")
+	if prefix == "" {
+		return "", fmt.Errorf("%w: empty reference", ErrNoSuchImage)
+	}
+	ids, err := s.ids()
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, id := range ids {
+		if strings.HasPrefix(strings.TrimPrefix(id, DigestAlgorithm+":"), prefix) {
+			found = append(found, id)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%w: %s", ErrNoSuchImage, refOrID)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("ambiguous image id prefix %q: %d matches", refOrID, len(found))
+	}
+}
+
+// List returns all the images in the store, the newest first.
+func (s *Store) List() ([]*Image, error) {
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+	repos, err := s.repositories()
+	if err != nil {
+		return nil, err
+	}
+
+	var images []*Image
+	for _, id := range ids {
+		img, err := s.load(id)
+		if err != nil {
+			slog.Warn("[image] List: skip bad image.", "id", id, "err", err)
+			continue
+		}
+		img.RepoTags = tagsOf(repos, id)
+		images = append(images, img)
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Created.After(images[j].Created)
+	})
+	return images, nil
+}
+
+// Remove removes a reference, or an image by the id (prefix).
+//
+// Removing a reference untags it; and the image is deleted too if no
+// other reference points to it. Removing by the id deletes the image
+// with all its references, which requires force if there are more
+// than one references. An image in use can not be deleted.
+//
+// It returns the untagged references and the id of the deleted image
+// ("" if not deleted).
+func (s *Store) Remove(refOrID string, force bool) (untagged []string, deleted string, err error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, "", err
+	}
+	defer unlock()
+
+	repos, err := s.repositories()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var id string
+	if ref, err := ParseReference(refOrID); err == nil && repos[ref.String()] != "" {
+		id = repos[ref.String()]
+		untagged = []string{ref.String()}
+	} else {
+		if id, err = s.resolve(refOrID); err != nil {
+			return nil, "", err
+		}
+		untagged = tagsOf(repos, id)
+		if len(untagged) > 1 && !force {
+			return nil, "", fmt.Errorf("%w: image %s is referenced by %s, remove the references or force",
+				ErrImageInUse, stringid.TruncateID(id), strings.Join(untagged, ", "))
+		}
+	}
+
+	deleteImage := len(tagsOf(repos, id)) == len(untagged)
+	if deleteImage && s.InUse != nil && s.InUse(id) {
+		return nil, "", fmt.Errorf("%w: image %s is used by a container", ErrImageInUse, stringid.TruncateID(id))
+	}
+
+	for _, ref := range untagged {
+		delete(repos, ref)
+	}
+	if err := atomicfile.WriteJSON(s.repositoriesFile(), repos); err != nil {
+		return nil, "", err
+	}
+	if !deleteImage {
+		return untagged, "", nil
+	}
+
+	if err := s.removeDir(s.imageDir(id)); err != nil {
+		return untagged, "", fmt.Errorf("remove image %s: %w", id, err)
+	}
+	s.removeUnusedLayers()
+
+	slog.Info("[image] image removed.", "id", id, "untagged", untagged)
+	return untagged, id, nil
+}
+
+// removeDir renames the dir into <Root>/tmp first, and then removes
+// it: a half removed image or layer is never visible.
+func (s *Store) removeDir(dir string) error {
+	trash, err := s.tempDir("remove-")
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(dir, path.Join(trash, "removed")); err != nil {
+		os.Remove(trash)
+		return err
+	}
+	if err := os.RemoveAll(trash); err != nil {
+		slog.Warn("[image] failed to clean up the removed dir.", "dir", dir, "trash", trash, "err", err)
+	}
+	return nil
+}
+
+// Tag points the references (name[:tag]) to the image.
+func (s *Store) Tag(refOrID string, refs ...string) error {
+	parsed, err := parseReferences(refs)
+	if err != nil {
+		return err
+	}
+	id, err := s.resolve(refOrID)
+	if err != nil {
+		return err
+	}
+	return s.tag(id, parsed)
+}
+
+// tag points the references to the image.
+func (s *Store) tag(id string, refs []Reference) error {
+	if len(refs) == 0 {
+		return nil
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	repos, err := s.repositories()
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if old, ok := repos[ref.String()]; ok && old != id {
+			slog.Info("[image] reference moved to the new image.", "ref", ref.String(), "old", old, "new", id)
+		}
+		repos[ref.String()] = id
+	}
+	return atomicfile.WriteJSON(s.repositoriesFile(), repos)
+}
+
+// repositories reads the name:tag -> id map.
+func (s *Store) repositories() (map[string]string, error) {
+	repos := map[string]string{}
+	data, err := os.ReadFile(s.repositoriesFile())
+	if os.IsNotExist(err) {
+		return repos, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &repos); err != nil {
+		return nil, fmt.Errorf("bad repositories file: %w", err)
+	}
+	return repos, nil
+}
+
+// ids lists the ids of the images in the store.
+func (s *Store) ids() ([]string, error) {
+	entries, err := os.ReadDir(path.Join(s.Root, DigestAlgorithm))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() {
+			ids = append(ids, DigestAlgorithm+":"+e.Name())
+		}
+	}
+	return ids, nil
+}
+
+// load reads the metadata of the image with the full id.
+func (s *Store) load(id string) (*Image, error) {
+	data, err := os.ReadFile(path.Join(s.imageDir(id), "image.json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchImage, id)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var img Image
+	if err := json.Unmarshal(data, &img); err != nil {
+		return nil, fmt.Errorf("bad metadata of image %s: %w", id, err)
+	}
+	return &img, nil
+}
+
+// lock takes the store lock: <Root>/store.lock
+func (s *Store) lock() (unlock func(), err error) {
+	if err := os.MkdirAll(s.Root, 0700); err != nil {
+		return nil, err
+	}
+	name := path.Join(s.Root, "store.lock")
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("flock %s: %w", name, err)
+	}
+	return func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// parseReferences parses the references, see ParseReference.
+func parseReferences(refs []string) ([]Reference, error) {
+	var parsed []Reference
+	for _, r := range refs {
+		ref, err := ParseReference(r)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, ref)
+	}
+	return parsed, nil
+}
+
+// tagsOf returns the sorted references to the id.
+func tagsOf(repos map[string]string, id string) []string {
+	var tags []string
+	for ref, refID := range repos {
+		if refID == id {
+			tags = append(tags, ref)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// DigestFile returns sha256:<hex> of the file content.
+func DigestFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("digest %s: %w", name, err)
+	}
+	return DigestAlgorithm + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// dirSize is the total size of the regular files in the dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+var (
+	ErrNoSuchImage  = errors.New("no such image")
+	ErrBadImage     = errors.New("bad image")
+	ErrBadReference = errors.New("bad image reference")
+	ErrImageInUse   = errors.New("image is in use")
+	ErrBadArchive   = errors.New("bad archive")
+
+	ErrDigestMismatch = errors.New("digest mismatch")
+	ErrBadKey         = errors.New("bad key")
+	ErrNoSuchKey      = errors.New("no such key")
+	ErrKeyExists      = errors.New("key exists")
+	ErrNotSigned      = errors.New("image is not signed")
+	ErrUntrusted      = errors.New("image is not trusted")
+)
@@ -0,0 +1,226 @@
+package image
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// makeTar makes a tar archive of a rootfs with the files (name -> content).
+func makeTar(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		p := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archive := path.Join(t.TempDir(), "rootfs.tar")
+	if out, err := exec.Command("tar", "-cf", archive, "-C", dir, ".").CombinedOutput(); err != nil {
+		t.Fatalf("tar: %v: %s", err, out)
+	}
+	return archive
+}
+
+func TestStore_Import(t *testing.T) {
+	s := NewStore(t.TempDir())
+	archive := makeTar(t, map[string]string{"etc/hostname": "foo\n", "bin/sh": "#!"})
+
+	img, err := s.Import(archive, "foo:v1", "foo")
+	if err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	if want := []string{"foo:latest", "foo:v1"}; !reflect.DeepEqual(img.RepoTags, want) {
+		t.Errorf("RepoTags = %v, want %v", img.RepoTags, want)
+	}
+	if img.Size != int64(len("foo\n")+len("#!")) {
+		t.Errorf("Size = %v, want %v", img.Size, len("foo\n")+len("#!"))
+	}
+	if len(img.Layers) != 1 {
+		t.Fatalf("Layers = %v, want 1 layer", img.Layers)
+	}
+	if got, err := os.ReadFile(path.Join(s.LowerDirs(img)[0], "etc/hostname")); err != nil || string(got) != "foo\n" {
+		t.Errorf("rootfs etc/hostname = %q, %v", got, err)
+	}
+
+	// the same archive: tag only
+	again, err := s.Import(archive, "bar")
+	if err != nil {
+		t.Fatalf("Import() again error = %v", err)
+	}
+	if again.ID != img.ID || len(again.RepoTags) != 3 {
+		t.Errorf("Import() again = %+v, want the same image with 3 tags", again)
+	}
+	if entries, _ := os.ReadDir(path.Join(s.Root, "tmp")); len(entries) != 0 {
+		t.Errorf("tmp dir is not cleaned up: %v", entries)
+	}
+
+	for _, refOrID := range []string{"foo", "foo:v1", "bar:latest", img.ID, img.ID[:len("sha256:")+6], img.ID[len("sha256:"):][:6]} {
+		got, err := s.Get(refOrID)
+		if err != nil {
+			t.Errorf("Get(%q) error = %v", refOrID, err)
+			continue
+		}
+		if got.ID != img.ID {
+			t.Errorf("Get(%q) = %v, want %v", refOrID, got.ID, img.ID)
+		}
+	}
+	for _, refOrID := range []string{"foo:v2", "baz", "/tmp/rootfs", ""} {
+		if _, err := s.Get(refOrID); !errors.Is(err, ErrNoSuchImage) {
+			t.Errorf("Get(%q) error = %v, want %v", refOrID, err, ErrNoSuchImage)
+		}
+	}
+
+	if _, err := s.Import(archive, "Bad:tag"); !errors.Is(err, ErrBadReference) {
+		t.Errorf("Import() with bad ref error = %v, want %v", err, ErrBadReference)
+	}
+	if _, err := s.Import(t.TempDir()); !errors.Is(err, ErrBadImage) {
+		t.Errorf("Import() a dir error = %v, want %v", err, ErrBadImage)
+	}
+}
+
+func TestStore_Remove(t *testing.T) {
+	s := NewStore(t.TempDir())
+	inUse := map[string]bool{}
+	s.InUse = func(id string) bool { return inUse[id] }
+
+	img, err := s.Import(makeTar(t, map[string]string{"a": "a"}), "foo:v1", "foo:v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.Import(makeTar(t, map[string]string{"b": "b"}), "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// by the id with more than one references: force required
+	if _, _, err := s.Remove(img.ID, false); !errors.Is(err, ErrImageInUse) {
+		t.Errorf("Remove(id) error = %v, want %v", err, ErrImageInUse)
+	}
+
+	// untag only
+	untagged, deleted, err := s.Remove("foo:v1", false)
+	if err != nil || !reflect.DeepEqual(untagged, []string{"foo:v1"}) || deleted != "" {
+		t.Errorf("Remove(foo:v1) = %v, %q, %v", untagged, deleted, err)
+	}
+
+	// the last reference of an image in use
+	inUse[img.ID] = true
+	if _, _, err := s.Remove("foo:v2", false); !errors.Is(err, ErrImageInUse) {
+		t.Errorf("Remove(foo:v2) in use error = %v, want %v", err, ErrImageInUse)
+	}
+	if _, err := s.Get("foo:v2"); err != nil {
+		t.Errorf("foo:v2 should be kept: %v", err)
+	}
+	inUse[img.ID] = false
+
+	untagged, deleted, err = s.Remove("foo:v2", false)
+	if err != nil || !reflect.DeepEqual(untagged, []string{"foo:v2"}) || deleted != img.ID {
+		t.Errorf("Remove(foo:v2) = %v, %q, %v", untagged, deleted, err)
+	}
+	if _, err := os.Stat(s.LowerDirs(img)[0]); !os.IsNotExist(err) {
+		t.Errorf("the layer should be deleted: %v", err)
+	}
+	if _, err := os.Stat(s.LowerDirs(other)[0]); err != nil {
+		t.Errorf("the layer of the other image should be kept: %v", err)
+	}
+
+	images, err := s.List()
+	if err != nil || len(images) != 1 || images[0].ID != other.ID {
+		t.Errorf("List() = %v, %v, want only %v", images, err, other.ID)
+	}
+
+	if _, _, err := s.Remove("foo:v2", false); !errors.Is(err, ErrNoSuchImage) {
+		t.Errorf("Remove() again error = %v, want %v", err, ErrNoSuchImage)
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{"busybox", "busybox:latest", false},
+		{"busybox:1.36", "busybox:1.36", false},
+		{"library/busybox:musl", "library/busybox:musl", false},
+		{"localhost:5000/foo", "localhost:5000/foo:latest", false},
+		{"localhost:5000/foo:bar", "localhost:5000/foo:bar", false},
+		{"my-app_2", "my-app_2:latest", false},
+		{"Busybox", "", true},
+		{"foo:", "", true},
+		{"foo:-bar", "", true},
+		{"/tmp/rootfs", "", true},
+		{"./rootfs.tar", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseReference(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseReference() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("ParseReference() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitDigest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	tests := []struct {
+		s          string
+		wantName   string
+		wantDigest string
+		wantErr    bool
+	}{
+		{"busybox", "busybox", "", false},
+		{"busybox:1.36@" + digest, "busybox:1.36", digest, false},
+		{"/tmp/rootfs.tar@" + digest, "/tmp/rootfs.tar", digest, false},
+		{"/tmp/a@b/rootfs.tar@" + digest, "/tmp/a@b/rootfs.tar", digest, false},
+		{"busybox@sha256:abc", "", "", true},
+		{"busybox@md5:" + strings.Repeat("ab", 16), "", "", true},
+		{"@" + digest, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			name, digest, err := SplitDigest(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SplitDigest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if name != tt.wantName || digest != tt.wantDigest {
+				t.Errorf("SplitDigest() = (%q, %q), want (%q, %q)", name, digest, tt.wantName, tt.wantDigest)
+			}
+		})
+	}
+}
+
+func TestStore_Verify(t *testing.T) {
+	s := NewStore(t.TempDir())
+	img, err := s.Commit(t.TempDir(), CommitOptions{Config: &Config{Cmd: []string{"sh"}}})
+	if err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if err := s.Verify(img); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+
+	config := path.Join(s.imageDir(img.ID), "config.json")
+	if err := os.WriteFile(config, []byte(`{"config":{"Cmd":["evil"]}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(img); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("Verify() of a tampered config error = %v, want %v", err, ErrDigestMismatch)
+	}
+}
@@ -0,0 +1,344 @@
+package image
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"hind/internal/atomicfile"
+
+	"golang.org/x/exp/slog"
+)
+
+// Trust is the local trust store of the image signatures in the Root
+// directory. An image is signed by its digest: the id of an image in the
+// store (see Store.Verify), or the digest of a tar archive. A signature is
+// made with an ed25519 private key, and verified by the public key of the
+// same name.
+//
+//	<Root>/keys/<name>.key                      the private key (PKCS #8, PEM)
+//	<Root>/keys/<name>.pub                      the public key (PKIX, PEM)
+//	<Root>/signatures/sha256/<hex>/<name>.sig   the signature by the key (Signature)
+//	<Root>/policy.json                          the images required to be signed (Policy)
+//
+// A public key of others is trusted by copying it to the keys dir, and
+// their signatures to the signatures dir.
+type Trust struct {
+	Root string
+}
+
+// NewTrust returns the trust store in the root dir.
+// The directories are created when the first key is generated.
+func NewTrust(root string) *Trust {
+	return &Trust{Root: root}
+}
+
+// Signature is a signature of an image digest.
+type Signature struct {
+	Digest    string    // sha256:<hex> of the image
+	Key       string    // the name of the key
+	Signature []byte    // ed25519 signature of the signedPayload
+	Created   time.Time // when signed
+}
+
+// Policy is the rules of the images required to be signed.
+//
+//	{
+//	  "rules": [
+//	    {"prefix": "prod/", "keys": ["release"]},
+//	    {"prefix": "/opt/images/"}
+//	  ]
+//	}
+//
+// A rule applies to the image names (name:tag references of an image in
+// the store, or absolute paths of the tar archives) starting with the
+// prefix. The longest matching prefix wins. An image matching a rule must
+// be signed by one of the keys of the rule, or by any trusted key if none
+// is given. An empty prefix matches all the images: the directories, which
+// can not be signed, are refused then.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule requires the images starting with the Prefix to be signed.
+type PolicyRule struct {
+	Prefix string   `json:"prefix"`
+	Keys   []string `json:"keys,omitempty"` // the keys accepted. Any trusted key if empty.
+}
+
+// Match returns the rule of the name with the longest prefix.
+// nil if no rule applies.
+func (p *Policy) Match(name string) *PolicyRule {
+	var matched *PolicyRule
+	for i, rule := range p.Rules {
+		if strings.HasPrefix(name, rule.Prefix) && (matched == nil || len(rule.Prefix) > len(matched.Prefix)) {
+			matched = &p.Rules[i]
+		}
+	}
+	return matched
+}
+
+// MatchAny reports whether a rule applies to any of the names.
+func (p *Policy) MatchAny(names ...string) bool {
+	for _, name := range names {
+		if p.Match(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// a key name: [a-zA-Z0-9][a-zA-Z0-9_.-]*
+var keyNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,127}$`)
+
+func (t *Trust) keysDir() string {
+	return path.Join(t.Root, "keys")
+}
+
+func (t *Trust) signaturesDir(digest string) string {
+	return path.Join(t.Root, "signatures", DigestAlgorithm, strings.TrimPrefix(digest, DigestAlgorithm+":"))
+}
+
+func (t *Trust) policyFile() string {
+	return path.Join(t.Root, "policy.json")
+}
+
+// GenerateKey generates the ed25519 key pair of the name.
+// It returns the path of the public key, which is to be shared with the
+// ones verifying the signatures.
+func (t *Trust) GenerateKey(name string) (string, error) {
+	if !keyNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("%w: invalid key name %q", ErrBadKey, name)
+	}
+	privFile := path.Join(t.keysDir(), name+".key")
+	pubFile := path.Join(t.keysDir(), name+".pub")
+	for _, f := range []string{privFile, pubFile} {
+		if _, err := os.Stat(f); err == nil {
+			return "", fmt.Errorf("%w: %s", ErrKeyExists, f)
+		}
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(t.keysDir(), 0700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(privFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644); err != nil {
+		return "", err
+	}
+	slog.Info("[image] key generated.", "key", name, "public", pubFile)
+	return pubFile, nil
+}
+
+// Sign signs the image digest with the private key of the name.
+// A signature by the same key is replaced.
+func (t *Trust) Sign(digest string, key string) (*Signature, error) {
+	if !digestRegexp.MatchString(digest) {
+		return nil, fmt.Errorf("%w: invalid digest %q", ErrBadReference, digest)
+	}
+	priv, err := t.privateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	sig := &Signature{
+		Digest:    digest,
+		Key:       key,
+		Signature: ed25519.Sign(priv, signedPayload(digest)),
+		Created:   time.Now(),
+	}
+	dir := t.signaturesDir(digest)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := atomicfile.WriteJSON(path.Join(dir, key+".sig"), sig); err != nil {
+		return nil, err
+	}
+	slog.Info("[image] image signed.", "digest", digest, "key", key)
+	return sig, nil
+}
+
+// Verify returns the valid signatures of the digest by the keys, or by
+// any trusted key if no keys are given. It errors with ErrNotSigned if
+// there is no signature at all, and ErrUntrusted if none is valid.
+func (t *Trust) Verify(digest string, keys ...string) ([]*Signature, error) {
+	entries, err := os.ReadDir(t.signaturesDir(digest))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotSigned, digest)
+	}
+
+	var valid []*Signature
+	var reasons []string
+	for _, e := range entries {
+		key, ok := strings.CutSuffix(e.Name(), ".sig")
+		if !ok {
+			continue
+		}
+		if len(keys) > 0 && !contains(keys, key) {
+			reasons = append(reasons, key+": not accepted")
+			continue
+		}
+		sig, err := t.verifySignature(digest, key)
+		if err != nil {
+			reasons = append(reasons, key+": "+err.Error())
+			continue
+		}
+		valid = append(valid, sig)
+	}
+	if len(valid) == 0 {
+		return nil, fmt.Errorf("%w: no valid signature of %s (%s)", ErrUntrusted, digest, strings.Join(reasons, "; "))
+	}
+	return valid, nil
+}
+
+// verifySignature verifies the signature of the digest by the key.
+func (t *Trust) verifySignature(digest string, key string) (*Signature, error) {
+	data, err := os.ReadFile(path.Join(t.signaturesDir(digest), key+".sig"))
+	if err != nil {
+		return nil, err
+	}
+	var sig Signature
+	if err := json.Unmarshal(data, &sig); err != nil {
+		return nil, fmt.Errorf("bad signature: %w", err)
+	}
+	if sig.Digest != digest || sig.Key != key {
+		return nil, fmt.Errorf("the signature is of %s by %s", sig.Digest, sig.Key)
+	}
+
+	pub, err := t.publicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(pub, signedPayload(digest), sig.Signature) {
+		return nil, errors.New("bad signature")
+	}
+	return &sig, nil
+}
+
+// Policy reads the policy. Empty if there is no policy file.
+func (t *Trust) Policy() (*Policy, error) {
+	data, err := os.ReadFile(t.policyFile())
+	if os.IsNotExist(err) {
+		return &Policy{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("bad policy %s: %w", t.policyFile(), err)
+	}
+	return &p, nil
+}
+
+// Check verifies the image against the policy: the image of the digest
+// is known by the names, and it must be signed as the rule of each name
+// requires. An empty digest is an image that can not be signed (a
+// directory), which is refused if a rule applies.
+func (t *Trust) Check(digest string, names ...string) error {
+	policy, err := t.Policy()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		rule := policy.Match(name)
+		if rule == nil {
+			continue
+		}
+		if digest == "" {
+			return fmt.Errorf("%w: %s requires a signature (policy prefix %q), but can not be signed", ErrUntrusted, name, rule.Prefix)
+		}
+		if _, err := t.Verify(digest, rule.Keys...); err != nil {
+			return fmt.Errorf("%s (policy prefix %q): %w", name, rule.Prefix, err)
+		}
+	}
+	return nil
+}
+
+// privateKey reads the private key of the name.
+func (t *Trust) privateKey(name string) (ed25519.PrivateKey, error) {
+	key, err := t.readKey(name+".key", "PRIVATE KEY", x509.ParsePKCS8PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not an ed25519 private key", ErrBadKey, name)
+	}
+	return priv, nil
+}
+
+// publicKey reads the public key of the name.
+func (t *Trust) publicKey(name string) (ed25519.PublicKey, error) {
+	key, err := t.readKey(name+".pub", "PUBLIC KEY", x509.ParsePKIXPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not an ed25519 public key", ErrBadKey, name)
+	}
+	return pub, nil
+}
+
+// readKey reads the PEM block of the type in the file in the keys dir.
+func (t *Trust) readKey(file string, blockType string, parse func([]byte) (any, error)) (any, error) {
+	if !keyNameRegexp.MatchString(strings.TrimSuffix(file, path.Ext(file))) {
+		return nil, fmt.Errorf("%w: invalid key name %q", ErrBadKey, file)
+	}
+	data, err := os.ReadFile(path.Join(t.keysDir(), file))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchKey, file)
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%w: %s: no %s PEM block", ErrBadKey, file, blockType)
+	}
+	key, err := parse(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrBadKey, file, err)
+	}
+	return key, nil
+}
+
+// signedPayload is what a signature signs: the digest, in a context that
+// a signature of something else can not be taken for.
+func signedPayload(digest string) []byte {
+	return []byte("hind image signature v1\n" + digest)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
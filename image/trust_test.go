@@ -0,0 +1,124 @@
+package image
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestTrust_SignVerify(t *testing.T) {
+	trust := NewTrust(t.TempDir())
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	other := "sha256:" + strings.Repeat("cd", 32)
+
+	if _, err := trust.Sign(digest, "release"); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("Sign() without the key error = %v, want %v", err, ErrNoSuchKey)
+	}
+	for _, key := range []string{"release", "dev"} {
+		if _, err := trust.GenerateKey(key); err != nil {
+			t.Fatalf("GenerateKey(%s) error = %v", key, err)
+		}
+	}
+	if _, err := trust.GenerateKey("release"); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("GenerateKey() again error = %v, want %v", err, ErrKeyExists)
+	}
+	if _, err := trust.GenerateKey("../evil"); !errors.Is(err, ErrBadKey) {
+		t.Errorf("GenerateKey(../evil) error = %v, want %v", err, ErrBadKey)
+	}
+
+	if _, err := trust.Verify(digest); !errors.Is(err, ErrNotSigned) {
+		t.Errorf("Verify() unsigned error = %v, want %v", err, ErrNotSigned)
+	}
+	if _, err := trust.Sign(digest, "release"); err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		digest    string
+		keys      []string
+		wantErrIs error
+	}{
+		{"any_key", digest, nil, nil},
+		{"accepted_key", digest, []string{"dev", "release"}, nil},
+		{"not_accepted_key", digest, []string{"dev"}, ErrUntrusted},
+		{"other_image", other, nil, ErrNotSigned},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sigs, err := trust.Verify(tt.digest, tt.keys...)
+			if !errors.Is(err, tt.wantErrIs) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErrIs)
+			}
+			if err == nil && (len(sigs) != 1 || sigs[0].Key != "release" || sigs[0].Digest != digest) {
+				t.Errorf("Verify() = %+v, want the signature by release", sigs)
+			}
+		})
+	}
+
+	// a signature copied to another image
+	sig, _ := os.ReadFile(path.Join(trust.signaturesDir(digest), "release.sig"))
+	os.MkdirAll(trust.signaturesDir(other), 0700)
+	os.WriteFile(path.Join(trust.signaturesDir(other), "release.sig"), sig, 0600)
+	if _, err := trust.Verify(other); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("Verify() of a copied signature error = %v, want %v", err, ErrUntrusted)
+	}
+
+	// the public key replaced
+	pub, _ := os.ReadFile(path.Join(trust.keysDir(), "dev.pub"))
+	os.WriteFile(path.Join(trust.keysDir(), "release.pub"), pub, 0644)
+	if _, err := trust.Verify(digest); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("Verify() by another public key error = %v, want %v", err, ErrUntrusted)
+	}
+}
+
+func TestTrust_Check(t *testing.T) {
+	trust := NewTrust(t.TempDir())
+	signed := "sha256:" + strings.Repeat("ab", 32)
+	unsigned := "sha256:" + strings.Repeat("cd", 32)
+	if _, err := trust.GenerateKey("dev"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := trust.Sign(signed, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	// no policy: anything goes
+	if err := trust.Check(unsigned, "prod/app:v1"); err != nil {
+		t.Errorf("Check() without a policy error = %v", err)
+	}
+
+	policy := `{"rules": [
+		{"prefix": "prod/"},
+		{"prefix": "prod/secure/", "keys": ["release"]},
+		{"prefix": "/opt/images/"}
+	]}`
+	if err := os.WriteFile(trust.policyFile(), []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		digest    string
+		names     []string
+		wantErrIs error
+	}{
+		{"not_required", unsigned, []string{"dev/app:v1"}, nil},
+		{"signed", signed, []string{"prod/app:v1"}, nil},
+		{"unsigned", unsigned, []string{"prod/app:v1"}, ErrNotSigned},
+		{"another_name_required", unsigned, []string{"dev/app:v1", "prod/app:v1"}, ErrNotSigned},
+		{"longest_prefix_keys", signed, []string{"prod/secure/app:v1"}, ErrUntrusted},
+		{"archive", signed, []string{"/opt/images/app.tar"}, nil},
+		{"directory", "", []string{"/opt/images/rootfs"}, ErrUntrusted},
+		{"directory_not_required", "", []string{"/tmp/rootfs"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := trust.Check(tt.digest, tt.names...); !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("Check() error = %v, want %v", err, tt.wantErrIs)
+			}
+		})
+	}
+}
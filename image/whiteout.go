@@ -0,0 +1,76 @@
+package image
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The whiteouts in the layer tars (the AUFS form, in the OCI image spec):
+//
+//	.wh.<name>     <name> is deleted
+//	.wh..wh..opq   the dir is opaque: the lower ones are hidden
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+	// overlayXattrPrefix is the prefix of the xattrs of the overlayfs.
+	overlayXattrPrefix = "trusted.overlay."
+	// overlayOpaqueXattr marks an opaque dir of the overlayfs.
+	overlayOpaqueXattr = overlayXattrPrefix + "opaque"
+)
+
+// convertWhiteouts converts the whiteouts in the unpacked layer dir to
+// the overlayfs form:
+//
+//	.wh.<name>     -> <name>: a character device 0:0
+//	.wh..wh..opq   -> the xattr trusted.overlay.opaque=y on the dir
+//
+// Other .wh..wh.* files (e.g. AUFS hard link dirs) are removed.
+func convertWhiteouts(dir string) error {
+	var whiteouts []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), whiteoutPrefix) {
+			whiteouts = append(whiteouts, p)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, wh := range whiteouts {
+		parent, name := filepath.Split(wh)
+		if err := os.RemoveAll(wh); err != nil {
+			return err
+		}
+
+		switch {
+		case name == whiteoutOpaque:
+			if err := unix.Setxattr(parent, overlayOpaqueXattr, []byte("y"), 0); err != nil {
+				return fmt.Errorf("mark %s opaque: %w", parent, err)
+			}
+		case strings.HasPrefix(name, whiteoutPrefix+whiteoutPrefix):
+			// meta files of AUFS, not whiteouts
+		default:
+			target := filepath.Join(parent, strings.TrimPrefix(name, whiteoutPrefix))
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			if err := unix.Mknod(target, unix.S_IFCHR, 0); err != nil {
+				return fmt.Errorf("make whiteout %s: %w", target, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Package atomicfile replaces files atomically, for the JSON state files
+// of hind (containers, pods, networks, leases, images...).
+package atomicfile
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+)
+
+// WriteJSON writes v to the file atomically: it is written to a temp
+// file in the same dir, synced, then renamed over the file, and the dir
+// is synced so that the rename survives a crash. A reader sees either
+// the old file or the new one, never a partial one.
+func WriteJSON(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := path.Dir(name)
+	f, err := os.CreateTemp(dir, path.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op once renamed
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir fsyncs the dir, to persist the entries created or renamed in it.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,42 @@
+package atomicfile
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWriteJSON(t *testing.T) {
+	dir := t.TempDir()
+	name := path.Join(dir, "state.json")
+	for _, v := range []string{"old", "new"} {
+		if err := WriteJSON(name, map[string]string{"v": v}); err != nil {
+			t.Fatalf("WriteJSON(%q) error = %v", v, err)
+		}
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(data, &got); err != nil || got["v"] != "new" {
+		t.Errorf("WriteJSON() wrote %s, want v = new", data)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("WriteJSON() mode = %v, want 0600", info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("WriteJSON() left %d files in the dir, want only the file", len(entries))
+	}
+
+	if err := WriteJSON(path.Join(dir, "no-such-dir", "state.json"), "v"); err == nil {
+		t.Errorf("WriteJSON() in a missing dir error = nil, want an error")
+	}
+}
@@ -0,0 +1,20 @@
+// Package stringid shortens the ids of hind (containers, pods, networks,
+// images) to show them.
+package stringid
+
+import "strings"
+
+// shortLen is the length of a short id, as docker does.
+const shortLen = 12
+
+// TruncateID returns the short form of the id: its first 12 characters,
+// without the algorithm prefix of a digest (sha256:).
+func TruncateID(id string) string {
+	if i := strings.IndexByte(id, ':'); i >= 0 {
+		id = id[i+1:]
+	}
+	if len(id) > shortLen {
+		return id[:shortLen]
+	}
+	return id
+}
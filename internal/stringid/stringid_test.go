@@ -0,0 +1,23 @@
+package stringid
+
+import "testing"
+
+func TestTruncateID(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want string
+	}{
+		{"uuid", "7b491a7a-63aa-413e-9ad3-b84474b6e300", "7b491a7a-63a"},
+		{"digest", "sha256:38835bb6c7d2f1e0b6a5f1d3c1c1f0e9d8c7b6a5", "38835bb6c7d2"},
+		{"short", "bridge", "bridge"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TruncateID(tt.id); got != tt.want {
+				t.Errorf("TruncateID(%q) = %q, want %q", tt.id, got, tt.want)
+			}
+		})
+	}
+}
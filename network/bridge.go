@@ -0,0 +1,199 @@
+// Package network implements the container networking:
+// a bridge on the host, and a veth pair per container connecting
+// the container's network namespace to the bridge.
+//
+//	container netns             host netns
+//	+------------+     +----------------------------+
+//	| lo         |     |                            |
+//	| eth0 <-----+-----+-> veth<id> --> hind0 (br)  |--NAT--> outside
+//	| default via gateway              gateway addr |
+//	+------------+     +----------------------------+
+//
+// Everything is done with netlink, except the NAT rules (iptables).
+//
+// The host side functions work in the network namespace of the calling
+// thread. It is the host's netns in hind. Tests may lock the thread
+// to a throwaway netns to avoid messing up the host.
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	DefaultBridgeName = "hind0"
+	DefaultSubnet     = "172.29.0.0/16"
+
+	// DefaultSubnetPool is where the subnets of the user-defined
+	// networks are allocated from, if not specified.
+	DefaultSubnetPool   = "172.30.0.0/15"
+	DefaultSubnetPrefix = 24
+)
+
+// Bridge is a linux bridge on the host, with an IPv4 subnet.
+// The first address of the subnet is the gateway (assigned to the bridge).
+type Bridge struct {
+	Name   string
+	Subnet *net.IPNet
+}
+
+// NewBridge returns a Bridge with the name and subnet (CIDR).
+// The bridge is not set up.
+func NewBridge(name string, subnet string) (*Bridge, error) {
+	if name == "" {
+		return nil, fmt.Errorf("%w: empty bridge name", ErrBadNetwork)
+	}
+	if len(name) > maxIfNameLen {
+		return nil, fmt.Errorf("%w: bridge name %q is too long (max %d)", ErrBadNetwork, name, maxIfNameLen)
+	}
+
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadNetwork, err)
+	}
+	if ipnet.IP.To4() == nil {
+		return nil, fmt.Errorf("%w: only IPv4 subnet is supported: %s", ErrBadNetwork, subnet)
+	}
+	if ones, bits := ipnet.Mask.Size(); bits-ones < 2 {
+		return nil, fmt.Errorf("%w: subnet %s is too small", ErrBadNetwork, subnet)
+	}
+
+	return &Bridge{Name: name, Subnet: ipnet}, nil
+}
+
+// DefaultBridge is hind0 with the subnet 172.29.0.0/16.
+func DefaultBridge() *Bridge {
+	b, _ := NewBridge(DefaultBridgeName, DefaultSubnet)
+	return b
+}
+
+// Gateway is the first address of the subnet, e.g. 172.29.0.1/16.
+func (b *Bridge) Gateway() *net.IPNet {
+	return &net.IPNet{IP: nthIP(b.Subnet, 1), Mask: b.Subnet.Mask}
+}
+
+// Setup makes sure the bridge exists with the gateway address and is up.
+// It also enables IP forwarding and the masquerade (SNAT) for the subnet.
+//
+// It is idempotent: call it before connecting any container.
+func (b *Bridge) Setup() error {
+	link, err := netlink.LinkByName(b.Name)
+	if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = b.Name
+		link = &netlink.Bridge{LinkAttrs: attrs}
+		if err := netlink.LinkAdd(link); err != nil {
+			return fmt.Errorf("create bridge %s: %w", b.Name, err)
+		}
+		slog.Info("[network] bridge created.", "bridge", b.Name)
+	} else if err != nil {
+		return fmt.Errorf("find bridge %s: %w", b.Name, err)
+	} else if link.Type() != "bridge" {
+		return fmt.Errorf("%w: %s exists and is not a bridge (%s)", ErrBadNetwork, b.Name, link.Type())
+	}
+
+	if err := ensureAddr(link, b.Gateway()); err != nil {
+		return fmt.Errorf("assign gateway address to bridge %s: %w", b.Name, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("set bridge %s up: %w", b.Name, err)
+	}
+
+	if err := enableIPForward(); err != nil {
+		return err
+	}
+	if err := b.setupMasquerade(); err != nil {
+		if !errors.Is(err, ErrNoIptables) {
+			return err
+		}
+		slog.Warn("[network] no iptables, the containers can not reach outside the host.", "bridge", b.Name, "err", err)
+	}
+	if err := b.setupIsolation(); err != nil {
+		if !errors.Is(err, ErrNoIptables) {
+			return err
+		}
+		slog.Warn("[network] no iptables, the bridge is not isolated from the others.", "bridge", b.Name, "err", err)
+	}
+
+	return nil
+}
+
+// Teardown deletes the bridge, the masquerade and isolation rules.
+func (b *Bridge) Teardown() error {
+	if err := b.teardownMasquerade(); err != nil && !errors.Is(err, ErrNoIptables) {
+		slog.Warn("[network] failed to delete the masquerade rules.", "bridge", b.Name, "err", err)
+	}
+	if err := b.teardownIsolation(); err != nil && !errors.Is(err, ErrNoIptables) {
+		slog.Warn("[network] failed to delete the isolation rules.", "bridge", b.Name, "err", err)
+	}
+
+	link, err := netlink.LinkByName(b.Name)
+	if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return netlink.LinkDel(link)
+}
+
+// Overlaps reports whether the two subnets share any address.
+func Overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// NextSubnet returns the first subnet with the prefix length in the
+// pool that overlaps none of the used subnets.
+func NextSubnet(pool *net.IPNet, prefix int, used []*net.IPNet) (*net.IPNet, error) {
+	poolOnes, bits := pool.Mask.Size()
+	if bits != 32 || prefix < poolOnes || prefix > 30 {
+		return nil, fmt.Errorf("%w: can not split %s into /%d", ErrBadNetwork, pool, prefix)
+	}
+
+	mask := net.CIDRMask(prefix, 32)
+	step := uint32(1) << (32 - prefix)
+	n := uint32(1) << (prefix - poolOnes)
+
+next:
+	for i := uint32(0); i < n; i++ {
+		subnet := &net.IPNet{IP: nthIP(pool, i*step), Mask: mask}
+		for _, u := range used {
+			if Overlaps(subnet, u) {
+				continue next
+			}
+		}
+		return subnet, nil
+	}
+	return nil, fmt.Errorf("%w: no free /%d subnet in %s", ErrNoAvailableAddress, prefix, pool)
+}
+
+// ensureAddr adds the addr to the link if not yet assigned.
+func ensureAddr(link netlink.Link, addr *net.IPNet) error {
+	err := netlink.AddrAdd(link, &netlink.Addr{IPNet: addr})
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	return err
+}
+
+// nthIP returns the n-th address in the subnet.
+func nthIP(subnet *net.IPNet, n uint32) net.IP {
+	v := ipToUint32(subnet.IP) + n
+	return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v)).To4()
+}
+
+const maxIfNameLen = 15 // IFNAMSIZ - 1
+
+var (
+	ErrBadNetwork = errors.New("bad network")
+	ErrNoIptables = errors.New("iptables not found")
+
+	ErrNoAvailableAddress = errors.New("no available address")
+	ErrBadPortMapping     = errors.New("bad port mapping")
+	ErrBadBandwidth       = errors.New("bad bandwidth")
+)
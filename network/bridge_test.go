@@ -0,0 +1,254 @@
+package network
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// withThrowawayNetns runs fn with the thread locked in a new network
+// namespace (as the "host"), so the tests never touch the real host.
+//
+// REQUIREMENT: run as root. Otherwise the test is skipped.
+func withThrowawayNetns(t *testing.T, fn func(host netns.NsHandle)) {
+	t.Helper()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		t.Fatalf("get current netns: %v", err)
+	}
+	defer orig.Close()
+	defer netns.Set(orig)
+
+	host, err := netns.New()
+	if err != nil {
+		t.Skipf("can not create netns (not root?): %v", err)
+	}
+	defer host.Close()
+
+	fn(host)
+}
+
+// newContainerNetns creates a netns and switches back to the host netns.
+func newContainerNetns(t *testing.T, host netns.NsHandle) netns.NsHandle {
+	t.Helper()
+
+	ns, err := netns.New()
+	if err != nil {
+		t.Fatalf("create container netns: %v", err)
+	}
+	if err := netns.Set(host); err != nil {
+		t.Fatalf("switch back to host netns: %v", err)
+	}
+	return ns
+}
+
+func TestNewBridge(t *testing.T) {
+	tests := []struct {
+		name        string
+		bridge      string
+		subnet      string
+		wantGateway string
+		wantErr     bool
+	}{
+		{"default", DefaultBridgeName, DefaultSubnet, "172.29.0.1/16", false},
+		{"not_network_addr", "br0", "10.1.2.3/24", "10.1.2.1/24", false},
+		{"ipv6", "br0", "fd00::/64", "", true},
+		{"too_small", "br0", "10.0.0.0/31", "", true},
+		{"long_name", "a-very-long-bridge-name", "10.0.0.0/24", "", true},
+		{"bad_cidr", "br0", "10.0.0.0", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := NewBridge(tt.bridge, tt.subnet)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewBridge() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := b.Gateway().String(); got != tt.wantGateway {
+				t.Errorf("Gateway() = %v, want %v", got, tt.wantGateway)
+			}
+		})
+	}
+}
+
+func TestBridge_Connect(t *testing.T) {
+	withThrowawayNetns(t, func(host netns.NsHandle) {
+		b, err := NewBridge("hindtest0", "10.99.0.0/24")
+		if err != nil {
+			t.Fatalf("NewBridge() error = %v", err)
+		}
+
+		if err := b.Setup(); err != nil {
+			t.Fatalf("Setup() error = %v", err)
+		}
+		if err := b.Setup(); err != nil {
+			t.Fatalf("Setup() again error = %v", err)
+		}
+		defer b.Teardown()
+
+		containerNs := newContainerNetns(t, host)
+		defer containerNs.Close()
+
+		ep, err := b.Connect(containerNs, "0123456789abcdef", net.ParseIP("10.99.0.2"))
+		if err != nil {
+			t.Fatalf("Connect() error = %v", err)
+		}
+		if ep.HostIf != "veth0123456789a" {
+			t.Errorf("HostIf = %v, want veth0123456789a", ep.HostIf)
+		}
+
+		// the container side
+		h, err := netlink.NewHandleAt(containerNs)
+		if err != nil {
+			t.Fatalf("NewHandleAt() error = %v", err)
+		}
+		defer h.Close()
+
+		for _, name := range []string{"lo", ContainerIfName} {
+			link, err := h.LinkByName(name)
+			if err != nil {
+				t.Fatalf("%s not found in container: %v", name, err)
+			}
+			if link.Attrs().Flags&net.FlagUp == 0 {
+				t.Errorf("%s is not up in container", name)
+			}
+		}
+		routes, err := h.RouteList(nil, netlink.FAMILY_V4)
+		if err != nil {
+			t.Fatalf("RouteList() error = %v", err)
+		}
+		hasDefault := false
+		for _, r := range routes {
+			isDefault := r.Dst == nil || r.Dst.IP.IsUnspecified()
+			hasDefault = hasDefault || (isDefault && r.Gw.Equal(b.Gateway().IP))
+		}
+		if !hasDefault {
+			t.Errorf("no default route via %v in container: %v", b.Gateway().IP, routes)
+		}
+
+		// host -> container through the bridge
+		if err := netns.Set(containerNs); err != nil {
+			t.Fatalf("switch to container netns: %v", err)
+		}
+		l, err := net.Listen("tcp", "10.99.0.2:0")
+		netns.Set(host)
+		if err != nil {
+			t.Fatalf("listen in container: %v", err)
+		}
+		defer l.Close()
+		go func() {
+			if conn, err := l.Accept(); err == nil {
+				conn.Write([]byte("hello"))
+				conn.Close()
+			}
+		}()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("dial container from host: %v", err)
+		}
+		got, _ := io.ReadAll(conn)
+		conn.Close()
+		if string(got) != "hello" {
+			t.Errorf("read from container = %q, want hello", got)
+		}
+
+		if err := Disconnect(ep); err != nil {
+			t.Errorf("Disconnect() error = %v", err)
+		}
+		if _, err := netlink.LinkByName(ep.HostIf); err == nil {
+			t.Errorf("veth %s still exists after Disconnect", ep.HostIf)
+		}
+		if err := Disconnect(ep); err != nil {
+			t.Errorf("Disconnect() again error = %v", err)
+		}
+	})
+}
+
+func TestBridge_ConnectInterface(t *testing.T) {
+	withThrowawayNetns(t, func(host netns.NsHandle) {
+		b, err := NewBridge("hindtest1", "10.98.0.0/24")
+		if err != nil {
+			t.Fatalf("NewBridge() error = %v", err)
+		}
+		if err := b.Setup(); err != nil {
+			t.Fatalf("Setup() error = %v", err)
+		}
+		defer b.Teardown()
+
+		containerNs := newContainerNetns(t, host)
+		defer containerNs.Close()
+
+		ep, err := b.ConnectInterface(containerNs, "0123456789abcdef", "eth1", net.ParseIP("10.98.0.2"))
+		if err != nil {
+			t.Fatalf("ConnectInterface() error = %v", err)
+		}
+		defer Disconnect(ep)
+		if ep.HostIf != "veth012345678_1" || ep.IfName != "eth1" {
+			t.Errorf("HostIf, IfName = %v, %v, want veth012345678_1, eth1", ep.HostIf, ep.IfName)
+		}
+		if got := ep.Subnet().String(); got != "10.98.0.0/24" {
+			t.Errorf("Subnet() = %v, want 10.98.0.0/24", got)
+		}
+
+		h, err := netlink.NewHandleAt(containerNs)
+		if err != nil {
+			t.Fatalf("NewHandleAt() error = %v", err)
+		}
+		defer h.Close()
+
+		if _, err := h.LinkByName("eth1"); err != nil {
+			t.Fatalf("eth1 not found in container: %v", err)
+		}
+		routes, _ := h.RouteList(nil, netlink.FAMILY_V4)
+		for _, r := range routes {
+			if r.Gw != nil {
+				t.Errorf("unexpected route via gateway: %v", r)
+			}
+		}
+	})
+}
+
+func TestNextSubnet(t *testing.T) {
+	cidr := func(s string) *net.IPNet {
+		_, ipnet, _ := net.ParseCIDR(s)
+		return ipnet
+	}
+
+	tests := []struct {
+		name    string
+		pool    string
+		prefix  int
+		used    []*net.IPNet
+		want    string
+		wantErr bool
+	}{
+		{"empty", "172.30.0.0/15", 24, nil, "172.30.0.0/24", false},
+		{"skip_used", "172.30.0.0/15", 24, []*net.IPNet{cidr("172.30.0.0/24"), cidr("172.30.1.0/24")}, "172.30.2.0/24", false},
+		{"skip_bigger", "172.30.0.0/15", 24, []*net.IPNet{cidr("172.30.0.0/16")}, "172.31.0.0/24", false},
+		{"skip_smaller", "172.30.0.0/15", 24, []*net.IPNet{cidr("172.30.0.128/25")}, "172.30.1.0/24", false},
+		{"full", "10.0.0.0/23", 24, []*net.IPNet{cidr("10.0.0.0/16")}, "", true},
+		{"bad_prefix", "10.0.0.0/24", 16, nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NextSubnet(cidr(tt.pool), tt.prefix, tt.used)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NextSubnet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("NextSubnet() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package network
+
+// This file implements the container networking with CNI plugins
+// (https://github.com/containernetworking/cni/blob/main/SPEC.md),
+// as an alternative to the built-in bridge.
+//
+// A network is a CNI network configuration list in the ConfDir.
+// The plugins of the list are executed one by one, with the CNI_*
+// environment variables and the plugin's config (name, cniVersion and
+// prevResult injected) on stdin. The result of ADD is read from stdout.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultCNIConfDir = "/etc/cni/net.d"
+	DefaultCNIPath    = "/opt/cni/bin"
+)
+
+// CNI commands.
+const (
+	CNIAdd   = "ADD"
+	CNIDel   = "DEL"
+	CNICheck = "CHECK"
+)
+
+// CNI finds network configurations in the ConfDir and
+// plugin binaries in the Path.
+type CNI struct {
+	ConfDir string
+	Path    []string
+}
+
+// DefaultCNI looks for the configs in /etc/cni/net.d and the plugins in /opt/cni/bin.
+func DefaultCNI() *CNI {
+	return &CNI{ConfDir: DefaultCNIConfDir, Path: []string{DefaultCNIPath}}
+}
+
+// CNIConfList is a network configuration list. Plugins are the raw
+// configs of the plugins, with at least a "type" (the plugin binary).
+type CNIConfList struct {
+	CNIVersion string            `json:"cniVersion"`
+	Name       string            `json:"name"`
+	Plugins    []json.RawMessage `json:"plugins"`
+}
+
+// CNIAttachment is a container's attachment to a CNI network,
+// kept to tear it down (DEL) and CHECK it later.
+type CNIAttachment struct {
+	Network string
+	IfName  string
+	Config  *CNIConfList    // the config list used to ADD
+	Result  json.RawMessage // the result of ADD
+}
+
+// CNIError is the error returned by a plugin.
+type CNIError struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	Details string `json:"details,omitempty"`
+}
+
+func (e *CNIError) Error() string {
+	if e.Details != "" {
+		return fmt.Sprintf("cni error %d: %s: %s", e.Code, e.Msg, e.Details)
+	}
+	return fmt.Sprintf("cni error %d: %s", e.Code, e.Msg)
+}
+
+// LoadConfList finds the network configuration list with the name in
+// the ConfDir: *.conflist, or *.conf / *.json of a single plugin. An
+// empty name is the first config (in the lexical order of the files).
+func (c *CNI) LoadConfList(name string) (*CNIConfList, error) {
+	var files []string
+	for _, ext := range []string{"*.conflist", "*.conf", "*.json"} {
+		matches, err := filepath.Glob(path.Join(c.ConfDir, ext))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+
+	for _, f := range files {
+		list, err := loadConfFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" || list.Name == name {
+			return list, nil
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%w: no cni network config in %s", ErrBadNetwork, c.ConfDir)
+	}
+	return nil, fmt.Errorf("%w: cni network %q not found in %s", ErrBadNetwork, name, c.ConfDir)
+}
+
+// loadConfFile reads a conflist, or a single plugin conf as a list of one plugin.
+func loadConfFile(file string) (*CNIConfList, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var list CNIConfList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%w: bad cni config %s: %v", ErrBadNetwork, file, err)
+	}
+	if path.Ext(file) != ".conflist" {
+		list.Plugins = []json.RawMessage{data}
+	}
+	if list.Name == "" || len(list.Plugins) == 0 {
+		return nil, fmt.Errorf("%w: cni config %s has no name or plugins", ErrBadNetwork, file)
+	}
+	return &list, nil
+}
+
+// Add attaches the container to the network: ADD with each plugin in
+// order, passing the result of one to the next as prevResult.
+// If any plugin fails, the attachment is torn down (DEL) before
+// returning the error.
+func (c *CNI) Add(list *CNIConfList, containerID string, netnsPath string, ifName string) (*CNIAttachment, error) {
+	a := &CNIAttachment{Network: list.Name, IfName: ifName, Config: list}
+
+	var result json.RawMessage
+	for _, plugin := range list.Plugins {
+		out, err := c.exec(CNIAdd, list, plugin, result, containerID, netnsPath, ifName)
+		if err != nil {
+			c.Del(a, containerID, netnsPath)
+			return nil, err
+		}
+		result = out
+	}
+	a.Result = result
+	return a, nil
+}
+
+// Del detaches the container from the network: DEL with each plugin
+// in the reverse order. All plugins are called even if some fail.
+func (c *CNI) Del(a *CNIAttachment, containerID string, netnsPath string) error {
+	var errs []error
+	for i := len(a.Config.Plugins) - 1; i >= 0; i-- {
+		_, err := c.exec(CNIDel, a.Config, a.Config.Plugins[i], a.Result, containerID, netnsPath, a.IfName)
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Check asks each plugin in order to check the attachment.
+// It requires cniVersion 0.4.0 or later.
+func (c *CNI) Check(a *CNIAttachment, containerID string, netnsPath string) error {
+	switch v := a.Config.CNIVersion; {
+	case v == "" || strings.HasPrefix(v, "0.1.") || strings.HasPrefix(v, "0.2.") || strings.HasPrefix(v, "0.3."):
+		return fmt.Errorf("%w: CHECK is not supported by cniVersion %q", ErrBadNetwork, v)
+	}
+	for _, plugin := range a.Config.Plugins {
+		if _, err := c.exec(CNICheck, a.Config, plugin, a.Result, containerID, netnsPath, a.IfName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exec executes the plugin with the command, returning its stdout.
+func (c *CNI) exec(command string, list *CNIConfList, plugin json.RawMessage, prevResult json.RawMessage,
+	containerID string, netnsPath string, ifName string) (json.RawMessage, error) {
+
+	// the plugin config with name, cniVersion and prevResult injected
+	var conf map[string]any
+	if err := json.Unmarshal(plugin, &conf); err != nil {
+		return nil, fmt.Errorf("%w: bad plugin config of %s: %v", ErrBadNetwork, list.Name, err)
+	}
+	conf["name"] = list.Name
+	conf["cniVersion"] = list.CNIVersion
+	if prevResult != nil {
+		conf["prevResult"] = prevResult
+	}
+	stdin, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	pluginType, _ := conf["type"].(string)
+	bin, err := c.findPlugin(pluginType)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(bin)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+containerID,
+		"CNI_NETNS="+netnsPath,
+		"CNI_IFNAME="+ifName,
+		"CNI_ARGS=",
+		"CNI_PATH="+strings.Join(c.Path, string(os.PathListSeparator)),
+	)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		var cniErr CNIError
+		if json.Unmarshal(stdout.Bytes(), &cniErr) == nil && cniErr.Msg != "" {
+			return nil, fmt.Errorf("cni plugin %s %s: %w", pluginType, command, &cniErr)
+		}
+		return nil, fmt.Errorf("cni plugin %s %s: %w: %s", pluginType, command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	if command != CNIAdd {
+		return nil, nil
+	}
+	if !json.Valid(stdout.Bytes()) {
+		return nil, fmt.Errorf("cni plugin %s %s: bad result: %q", pluginType, command, stdout.String())
+	}
+	return json.RawMessage(bytes.TrimSpace(stdout.Bytes())), nil
+}
+
+// findPlugin finds the executable of the plugin type in the Path.
+func (c *CNI) findPlugin(pluginType string) (string, error) {
+	if pluginType == "" || strings.Contains(pluginType, "/") {
+		return "", fmt.Errorf("%w: bad cni plugin type %q", ErrBadNetwork, pluginType)
+	}
+	for _, dir := range c.Path {
+		bin := path.Join(dir, pluginType)
+		if st, err := os.Stat(bin); err == nil && !st.IsDir() && st.Mode()&0111 != 0 {
+			return bin, nil
+		}
+	}
+	return "", fmt.Errorf("%w: cni plugin %q not found in %v", ErrBadNetwork, pluginType, c.Path)
+}
+
+// IPs are the addresses in the result of ADD.
+// Both the 0.3+ (ips) and the 0.1/0.2 (ip4) result formats are understood.
+func (a *CNIAttachment) IPs() []net.IP {
+	var result struct {
+		IPs []struct {
+			Address string `json:"address"`
+		} `json:"ips"`
+		IP4 *struct {
+			IP string `json:"ip"`
+		} `json:"ip4"`
+	}
+	if json.Unmarshal(a.Result, &result) != nil {
+		return nil
+	}
+
+	var addrs []string
+	for _, ip := range result.IPs {
+		addrs = append(addrs, ip.Address)
+	}
+	if result.IP4 != nil {
+		addrs = append(addrs, result.IP4.IP)
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ip, _, err := net.ParseCIDR(addr); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
@@ -0,0 +1,190 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// fakePlugin is a cni plugin logging the calls to calls.log, and the
+// stdin to stdin-<command>-<plugin>. ADD prints <plugin>.result, or
+// fails with a cni error if <plugin>.fail exists.
+const fakePlugin = `#!/bin/sh
+dir=$(dirname "$0")
+name=$(basename "$0")
+stdin=$(cat)
+echo "$CNI_COMMAND $name $CNI_CONTAINERID $CNI_NETNS $CNI_IFNAME" >> "$dir/calls.log"
+echo "$stdin" > "$dir/stdin-$CNI_COMMAND-$name"
+if [ "$CNI_COMMAND" = ADD ]; then
+	if [ -f "$dir/$name.fail" ]; then
+		echo '{"code": 11, "msg": "boom"}'
+		exit 1
+	fi
+	cat "$dir/$name.result"
+fi
+`
+
+const fakeBridgeResult = `{"cniVersion":"1.0.0","interfaces":[{"name":"eth0"}],"ips":[{"address":"10.1.0.5/24","gateway":"10.1.0.1","interface":0}]}`
+
+// newFakeCNI sets up a conf dir with the files, and a bin dir with
+// the fake plugins fakebr and fakeport.
+func newFakeCNI(t *testing.T, confs map[string]string) (cni *CNI, binDir string) {
+	t.Helper()
+
+	confDir, binDir := t.TempDir(), t.TempDir()
+	for name, conf := range confs {
+		if err := os.WriteFile(path.Join(confDir, name), []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, plugin := range []string{"fakebr", "fakeport"} {
+		if err := os.WriteFile(path.Join(binDir, plugin), []byte(fakePlugin), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(path.Join(binDir, "fakebr.result"), []byte(fakeBridgeResult), 0644)
+	os.WriteFile(path.Join(binDir, "fakeport.result"), []byte(fakeBridgeResult), 0644)
+
+	return &CNI{ConfDir: confDir, Path: []string{t.TempDir(), binDir}}, binDir
+}
+
+func readCalls(t *testing.T, binDir string) []string {
+	data, _ := os.ReadFile(path.Join(binDir, "calls.log"))
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+const testConfList = `{
+  "cniVersion": "1.0.0",
+  "name": "testnet",
+  "plugins": [
+    {"type": "fakebr", "bridge": "cni0"},
+    {"type": "fakeport", "capabilities": {"portMappings": true}}
+  ]
+}`
+
+func TestCNI_LoadConfList(t *testing.T) {
+	cni, _ := newFakeCNI(t, map[string]string{
+		"10-testnet.conflist": testConfList,
+		"20-single.conf":      `{"cniVersion": "0.4.0", "name": "single", "type": "fakebr"}`,
+		"99-ignored.txt":      `not a config`,
+	})
+
+	tests := []struct {
+		name        string
+		want        string
+		wantPlugins int
+		wantErr     bool
+	}{
+		{"", "testnet", 2, false},
+		{"testnet", "testnet", 2, false},
+		{"single", "single", 1, false},
+		{"nonexist", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cni.LoadConfList(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.Name != tt.want || len(got.Plugins) != tt.wantPlugins {
+				t.Errorf("LoadConfList() = %v with %d plugins, want %v with %d plugins",
+					got.Name, len(got.Plugins), tt.want, tt.wantPlugins)
+			}
+		})
+	}
+
+	empty := &CNI{ConfDir: t.TempDir()}
+	if _, err := empty.LoadConfList(""); !errors.Is(err, ErrBadNetwork) {
+		t.Errorf("LoadConfList() of an empty dir error = %v, want ErrBadNetwork", err)
+	}
+}
+
+func TestCNI_AddCheckDel(t *testing.T) {
+	cni, binDir := newFakeCNI(t, map[string]string{"10-testnet.conflist": testConfList})
+
+	list, err := cni.LoadConfList("testnet")
+	if err != nil {
+		t.Fatalf("LoadConfList() error = %v", err)
+	}
+
+	a, err := cni.Add(list, "c1", "/proc/1/ns/net", "eth0")
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if got := a.IPs(); len(got) != 1 || got[0].String() != "10.1.0.5" {
+		t.Errorf("IPs() = %v, want [10.1.0.5]", got)
+	}
+
+	// the plugin config with the injected fields
+	var stdin map[string]any
+	data, _ := os.ReadFile(path.Join(binDir, "stdin-ADD-fakeport"))
+	if err := json.Unmarshal(data, &stdin); err != nil {
+		t.Fatalf("bad stdin of the plugin: %v: %s", err, data)
+	}
+	if stdin["name"] != "testnet" || stdin["cniVersion"] != "1.0.0" || stdin["type"] != "fakeport" {
+		t.Errorf("stdin of the plugin = %v, want name, cniVersion and type", stdin)
+	}
+	if prev, _ := json.Marshal(stdin["prevResult"]); !strings.Contains(string(prev), "10.1.0.5/24") {
+		t.Errorf("prevResult = %s, want the result of fakebr", prev)
+	}
+
+	if err := cni.Check(a, "c1", "/proc/1/ns/net"); err != nil {
+		t.Errorf("Check() error = %v", err)
+	}
+	if err := cni.Del(a, "c1", "/proc/1/ns/net"); err != nil {
+		t.Errorf("Del() error = %v", err)
+	}
+
+	want := []string{
+		"ADD fakebr c1 /proc/1/ns/net eth0",
+		"ADD fakeport c1 /proc/1/ns/net eth0",
+		"CHECK fakebr c1 /proc/1/ns/net eth0",
+		"CHECK fakeport c1 /proc/1/ns/net eth0",
+		"DEL fakeport c1 /proc/1/ns/net eth0",
+		"DEL fakebr c1 /proc/1/ns/net eth0",
+	}
+	if got := readCalls(t, binDir); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("calls = %q, want %q", got, want)
+	}
+
+	old := &CNIAttachment{Config: &CNIConfList{CNIVersion: "0.3.1", Plugins: list.Plugins}}
+	if err := cni.Check(old, "c1", "/proc/1/ns/net"); !errors.Is(err, ErrBadNetwork) {
+		t.Errorf("Check() of cniVersion 0.3.1 error = %v, want ErrBadNetwork", err)
+	}
+}
+
+func TestCNI_AddError(t *testing.T) {
+	cni, binDir := newFakeCNI(t, map[string]string{"10-testnet.conflist": testConfList})
+	os.WriteFile(path.Join(binDir, "fakeport.fail"), nil, 0644)
+
+	list, _ := cni.LoadConfList("")
+	_, err := cni.Add(list, "c1", "/proc/1/ns/net", "eth0")
+
+	var cniErr *CNIError
+	if !errors.As(err, &cniErr) || cniErr.Code != 11 || cniErr.Msg != "boom" {
+		t.Fatalf("Add() error = %v, want the cni error 11 boom", err)
+	}
+
+	// torn down
+	want := []string{
+		"ADD fakebr c1 /proc/1/ns/net eth0",
+		"ADD fakeport c1 /proc/1/ns/net eth0",
+		"DEL fakeport c1 /proc/1/ns/net eth0",
+		"DEL fakebr c1 /proc/1/ns/net eth0",
+	}
+	if got := readCalls(t, binDir); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("calls = %q, want %q", got, want)
+	}
+
+	os.Remove(path.Join(binDir, "fakeport.fail"))
+	list.Plugins = append(list.Plugins, json.RawMessage(`{"type": "nonexist"}`))
+	if _, err := cni.Add(list, "c1", "/proc/1/ns/net", "eth0"); !errors.Is(err, ErrBadNetwork) {
+		t.Errorf("Add() with a missing plugin error = %v, want ErrBadNetwork", err)
+	}
+}
@@ -0,0 +1,197 @@
+package network
+
+// This file connects containers' network namespaces to the bridge.
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/exp/slog"
+)
+
+// ContainerIfName is the name of the interface in the container.
+const ContainerIfName = "eth0"
+
+// Endpoint is a container's connection to a bridge.
+type Endpoint struct {
+	Bridge  string     // the bridge name on the host
+	HostIf  string     // the host side of the veth pair, attached to the bridge
+	IfName  string     // the container side of the veth pair
+	Address *net.IPNet // the address of IfName
+	Gateway net.IP     // the default gateway of the container
+	MAC     string     // the hardware address of IfName
+}
+
+// hostIfName is "veth" + a prefix of the id: veth1a2b3c4d5e6.
+// The other interfaces than eth0 get the number suffixed after an
+// underscore (which is never in an id): veth1a2b3c4d5_1 for eth1.
+func hostIfName(id string, ifName string) string {
+	suffix := ""
+	if ifName != ContainerIfName {
+		suffix = "_" + strings.TrimPrefix(ifName, "eth")
+	}
+	if max := maxIfNameLen - len("veth") - len(suffix); len(id) > max {
+		id = id[:max]
+	}
+	return "veth" + id + suffix
+}
+
+// Connect creates a veth pair, attaches one end to the bridge and moves
+// the other end into the container's network namespace as eth0 with the
+// address. The default route of the container goes to the gateway
+// of the bridge. The loopback in the container is brought up too.
+//
+// The id (container id) names the host side of the veth pair.
+// The bridge must have been set up.
+func (b *Bridge) Connect(containerNs netns.NsHandle, id string, address net.IP) (*Endpoint, error) {
+	return b.connectInterface(containerNs, id, ContainerIfName, address, true)
+}
+
+// ConnectInterface is Connect for a container connected to more than one
+// bridge: the other end of the veth pair is named ifName (e.g. eth1)
+// and no default route is added.
+func (b *Bridge) ConnectInterface(containerNs netns.NsHandle, id string, ifName string, address net.IP) (*Endpoint, error) {
+	return b.connectInterface(containerNs, id, ifName, address, false)
+}
+
+func (b *Bridge) connectInterface(containerNs netns.NsHandle, id string, ifName string, address net.IP, defaultRoute bool) (*Endpoint, error) {
+	if !b.Subnet.Contains(address) {
+		return nil, fmt.Errorf("%w: address %s is not in the subnet %s", ErrBadNetwork, address, b.Subnet)
+	}
+
+	br, err := netlink.LinkByName(b.Name)
+	if err != nil {
+		return nil, fmt.Errorf("find bridge %s: %w", b.Name, err)
+	}
+
+	ep := &Endpoint{
+		Bridge:  b.Name,
+		HostIf:  hostIfName(id, ifName),
+		IfName:  ifName,
+		Address: &net.IPNet{IP: address, Mask: b.Subnet.Mask},
+		Gateway: b.Gateway().IP,
+	}
+
+	// the peer is created in the host with a temporary unique name,
+	// and renamed to eth0 after moved into the container.
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = ep.HostIf
+	attrs.MasterIndex = br.Attrs().Index
+	veth := &netlink.Veth{LinkAttrs: attrs, PeerName: "p" + ep.HostIf[1:]}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return nil, fmt.Errorf("create veth pair %s: %w", ep.HostIf, err)
+	}
+
+	if err := b.connect(containerNs, ep, veth.PeerName, defaultRoute); err != nil {
+		netlink.LinkDel(veth) // the peer is deleted together
+		return nil, err
+	}
+
+	slog.Info("[network] container connected.", "bridge", b.Name, "hostIf", ep.HostIf, "address", ep.Address)
+	return ep, nil
+}
+
+func (b *Bridge) connect(containerNs netns.NsHandle, ep *Endpoint, peerName string, defaultRoute bool) error {
+	hostIf, err := netlink.LinkByName(ep.HostIf)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(hostIf); err != nil {
+		return fmt.Errorf("set %s up: %w", ep.HostIf, err)
+	}
+
+	peer, err := netlink.LinkByName(peerName)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetNsFd(peer, int(containerNs)); err != nil {
+		return fmt.Errorf("move %s into container netns: %w", peerName, err)
+	}
+
+	// -- in the container netns --
+
+	h, err := netlink.NewHandleAt(containerNs)
+	if err != nil {
+		return fmt.Errorf("netlink handle in container netns: %w", err)
+	}
+	defer h.Close()
+
+	if err := loopbackUp(h); err != nil {
+		return err
+	}
+
+	peer, err = h.LinkByName(peerName)
+	if err != nil {
+		return err
+	}
+	if err := h.LinkSetName(peer, ep.IfName); err != nil {
+		return fmt.Errorf("rename %s to %s: %w", peerName, ep.IfName, err)
+	}
+	if err := h.AddrAdd(peer, &netlink.Addr{IPNet: ep.Address}); err != nil {
+		return fmt.Errorf("assign %s to %s: %w", ep.Address, ep.IfName, err)
+	}
+	if err := h.LinkSetUp(peer); err != nil {
+		return fmt.Errorf("set %s up: %w", ep.IfName, err)
+	}
+	ep.MAC = peer.Attrs().HardwareAddr.String()
+
+	if !defaultRoute {
+		return nil
+	}
+	route := &netlink.Route{LinkIndex: peer.Attrs().Index, Gw: ep.Gateway}
+	if err := h.RouteAdd(route); err != nil {
+		return fmt.Errorf("add default route via %s: %w", ep.Gateway, err)
+	}
+
+	return nil
+}
+
+// Disconnect deletes the veth pair of the endpoint, and the ifb device
+// if the bandwidth is limited (see LimitBandwidth).
+// It is fine if the veth is gone (deleted with the container netns).
+func Disconnect(ep *Endpoint) error {
+	if err := UnlimitBandwidth(ep.HostIf); err != nil {
+		slog.Warn("[network] failed to delete the ifb.", "hostIf", ep.HostIf, "err", err)
+	}
+
+	link, err := netlink.LinkByName(ep.HostIf)
+	if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("delete veth %s: %w", ep.HostIf, err)
+	}
+	slog.Info("[network] container disconnected.", "bridge", ep.Bridge, "hostIf", ep.HostIf)
+	return nil
+}
+
+// LoopbackUp brings up the lo in the network namespace.
+func LoopbackUp(ns netns.NsHandle) error {
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return fmt.Errorf("netlink handle in container netns: %w", err)
+	}
+	defer h.Close()
+	return loopbackUp(h)
+}
+
+func loopbackUp(h *netlink.Handle) error {
+	lo, err := h.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("find lo: %w", err)
+	}
+	if err := h.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("set lo up: %w", err)
+	}
+	return nil
+}
+
+// Subnet is the subnet of the bridge that the endpoint is connected to.
+func (ep *Endpoint) Subnet() *net.IPNet {
+	return &net.IPNet{IP: ep.Address.IP.Mask(ep.Address.Mask), Mask: ep.Address.Mask}
+}
@@ -0,0 +1,243 @@
+package network
+
+// This file implements the IP address management (IPAM):
+// allocating addresses of a subnet to owners (containers, pods).
+//
+// The leases are persisted in a json file, and guarded by a file lock
+// (flock(2)), so concurrent hind processes never hand out the same
+// address twice:
+//
+//	<Dir>/<Name>.json  the leases
+//	<Dir>/<Name>.lock  the lock file
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+
+	"hind/internal/atomicfile"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/sys/unix"
+)
+
+// IPAM allocates the addresses of the Subnet.
+//
+// The network address, the broadcast address and the Reserved
+// addresses (e.g. the gateway) are never allocated.
+type IPAM struct {
+	Dir      string // the directory of the leases and lock files
+	Name     string // the name of the address pool (e.g. the bridge name)
+	Subnet   *net.IPNet
+	Reserved []net.IP
+
+	// Alive reports whether the owner of a lease still exists.
+	// Leases of the owners that are gone are reclaimed on Allocate.
+	// nil to never reclaim.
+	Alive func(owner string) bool
+}
+
+// ipamLeases is the content of the leases file.
+type ipamLeases struct {
+	Subnet string
+	Last   string            // the last allocated address, to allocate round-robin
+	Leases map[string]string // address -> owner
+}
+
+// NewIPAM returns the IPAM of the bridge, storing the leases in the dir.
+// The gateway of the bridge is reserved.
+func NewIPAM(dir string, bridge *Bridge) *IPAM {
+	return &IPAM{
+		Dir:      dir,
+		Name:     bridge.Name,
+		Subnet:   bridge.Subnet,
+		Reserved: []net.IP{bridge.Gateway().IP},
+	}
+}
+
+func (a *IPAM) leasesFile() string {
+	return path.Join(a.Dir, a.Name+".json")
+}
+
+func (a *IPAM) lockFile() string {
+	return path.Join(a.Dir, a.Name+".lock")
+}
+
+// Allocate leases an address to the owner.
+//
+// It is idempotent: the owner gets its existing lease if any.
+// The addresses are allocated round-robin, so a released address
+// is not reused immediately.
+func (a *IPAM) Allocate(owner string) (net.IP, error) {
+	if owner == "" {
+		return nil, fmt.Errorf("%w: empty lease owner", ErrBadNetwork)
+	}
+
+	var allocated net.IP
+	err := a.update(func(l *ipamLeases) error {
+		for ip, o := range l.Leases {
+			if o == owner {
+				allocated = net.ParseIP(ip).To4()
+				return nil
+			}
+		}
+
+		a.reclaim(l)
+
+		ip, err := a.next(l)
+		if err != nil {
+			return err
+		}
+		l.Leases[ip.String()] = owner
+		l.Last = ip.String()
+		allocated = ip
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("[network] IPAM address allocated.", "pool", a.Name, "owner", owner, "address", allocated)
+	return allocated, nil
+}
+
+// Release releases the leases of the owner.
+// It is fine if the owner has no lease.
+func (a *IPAM) Release(owner string) error {
+	return a.update(func(l *ipamLeases) error {
+		for ip, o := range l.Leases {
+			if o == owner {
+				delete(l.Leases, ip)
+				slog.Info("[network] IPAM address released.", "pool", a.Name, "owner", owner, "address", ip)
+			}
+		}
+		return nil
+	})
+}
+
+// Reclaim releases the leases whose owners are not Alive.
+// It returns the number of reclaimed leases.
+func (a *IPAM) Reclaim() (n int, err error) {
+	err = a.update(func(l *ipamLeases) error {
+		n = a.reclaim(l)
+		return nil
+	})
+	return n, err
+}
+
+// Leases returns the leased addresses and their owners.
+func (a *IPAM) Leases() (map[string]string, error) {
+	var leases map[string]string
+	err := a.update(func(l *ipamLeases) error {
+		leases = l.Leases
+		return nil
+	})
+	return leases, err
+}
+
+func (a *IPAM) reclaim(l *ipamLeases) int {
+	if a.Alive == nil {
+		return 0
+	}
+
+	n := 0
+	for ip, owner := range l.Leases {
+		if !a.Alive(owner) {
+			delete(l.Leases, ip)
+			n++
+			slog.Info("[network] IPAM lease reclaimed.", "pool", a.Name, "owner", owner, "address", ip)
+		}
+	}
+	return n
+}
+
+// next finds the next free address after the last allocated one.
+func (a *IPAM) next(l *ipamLeases) (net.IP, error) {
+	ones, bits := a.Subnet.Mask.Size()
+	size := uint32(1) << (bits - ones)
+
+	reserved := map[string]bool{}
+	for _, ip := range a.Reserved {
+		reserved[ip.String()] = true
+	}
+
+	start := uint32(0)
+	if last := net.ParseIP(l.Last); last != nil && a.Subnet.Contains(last) {
+		start = ipToUint32(last) - ipToUint32(a.Subnet.IP)
+	}
+
+	for i := uint32(1); i <= size; i++ {
+		offset := (start + i) % size
+		if offset == 0 || offset == size-1 { // the network and broadcast address
+			continue
+		}
+		ip := nthIP(a.Subnet, offset)
+		if _, leased := l.Leases[ip.String()]; !leased && !reserved[ip.String()] {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s (%s)", ErrNoAvailableAddress, a.Subnet, a.Name)
+}
+
+// update loads the leases, calls fn and saves the leases if fn
+// returns nil. All of these are done holding the file lock.
+func (a *IPAM) update(fn func(l *ipamLeases) error) error {
+	if err := os.MkdirAll(a.Dir, 0700); err != nil {
+		return fmt.Errorf("ipam: %w", err)
+	}
+
+	unlock, err := lockFile(a.lockFile())
+	if err != nil {
+		return fmt.Errorf("ipam: %w", err)
+	}
+	defer unlock()
+
+	l := &ipamLeases{Subnet: a.Subnet.String(), Leases: map[string]string{}}
+	if data, err := os.ReadFile(a.leasesFile()); err == nil {
+		if err := json.Unmarshal(data, l); err != nil {
+			return fmt.Errorf("ipam: bad leases file %s: %w", a.leasesFile(), err)
+		}
+		if l.Leases == nil {
+			l.Leases = map[string]string{}
+		}
+		if l.Subnet != a.Subnet.String() {
+			return fmt.Errorf("%w: leases of %s are for the subnet %s, not %s",
+				ErrBadNetwork, a.Name, l.Subnet, a.Subnet)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("ipam: %w", err)
+	}
+
+	if err := fn(l); err != nil {
+		return err
+	}
+
+	if err := atomicfile.WriteJSON(a.leasesFile(), l); err != nil {
+		return fmt.Errorf("ipam: %w", err)
+	}
+	return nil
+}
+
+// lockFile takes an exclusive flock(2) on the file, blocking until
+// it is available. Call the returned func to unlock.
+func lockFile(name string) (unlock func(), err error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("flock %s: %w", name, err)
+	}
+	return func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	ip = ip.To4()
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
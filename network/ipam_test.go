@@ -0,0 +1,151 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+)
+
+func testIPAM(t *testing.T, subnet string) *IPAM {
+	t.Helper()
+	b, err := NewBridge("hindtest0", subnet)
+	if err != nil {
+		t.Fatalf("NewBridge() error = %v", err)
+	}
+	return NewIPAM(t.TempDir(), b)
+}
+
+func TestIPAM_Allocate(t *testing.T) {
+	ipam := testIPAM(t, "10.99.0.0/29") // .1 gateway, .2 - .6 available
+
+	var got []string
+	for i := 0; i < 5; i++ {
+		ip, err := ipam.Allocate(fmt.Sprint("c", i))
+		if err != nil {
+			t.Fatalf("Allocate() error = %v", err)
+		}
+		got = append(got, ip.String())
+	}
+	want := []string{"10.99.0.2", "10.99.0.3", "10.99.0.4", "10.99.0.5", "10.99.0.6"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Allocate() = %v, want %v", got, want)
+	}
+
+	// idempotent
+	if ip, err := ipam.Allocate("c2"); err != nil || ip.String() != "10.99.0.4" {
+		t.Errorf("Allocate() again = %v, %v, want 10.99.0.4", ip, err)
+	}
+
+	// exhausted
+	if _, err := ipam.Allocate("c5"); !errors.Is(err, ErrNoAvailableAddress) {
+		t.Errorf("Allocate() error = %v, want ErrNoAvailableAddress", err)
+	}
+
+	// released address is reused (the only one available)
+	if err := ipam.Release("c1"); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if ip, err := ipam.Allocate("c5"); err != nil || ip.String() != "10.99.0.3" {
+		t.Errorf("Allocate() after Release = %v, %v, want 10.99.0.3", ip, err)
+	}
+
+	// persisted
+	another := &IPAM{Dir: ipam.Dir, Name: ipam.Name, Subnet: ipam.Subnet}
+	leases, err := another.Leases()
+	if err != nil || len(leases) != 5 || leases["10.99.0.3"] != "c5" {
+		t.Errorf("Leases() of another IPAM = %v, %v, want 5 leases", leases, err)
+	}
+
+	// the subnet must not change
+	changed := &IPAM{Dir: ipam.Dir, Name: ipam.Name, Subnet: &net.IPNet{IP: net.IPv4(10, 98, 0, 0), Mask: net.CIDRMask(24, 32)}}
+	if _, err := changed.Allocate("c6"); !errors.Is(err, ErrBadNetwork) {
+		t.Errorf("Allocate() with another subnet error = %v, want ErrBadNetwork", err)
+	}
+}
+
+func TestIPAM_RoundRobin(t *testing.T) {
+	ipam := testIPAM(t, "10.99.0.0/24")
+
+	a, _ := ipam.Allocate("a")
+	ipam.Release("a")
+	b, _ := ipam.Allocate("b")
+	if a.Equal(b) {
+		t.Errorf("released address %v is reused immediately", a)
+	}
+}
+
+func TestIPAM_Reclaim(t *testing.T) {
+	ipam := testIPAM(t, "10.99.0.0/29")
+
+	alive := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		owner := fmt.Sprint("c", i)
+		if _, err := ipam.Allocate(owner); err != nil {
+			t.Fatalf("Allocate() error = %v", err)
+		}
+		alive[owner] = i%2 == 0 // c1, c3 are gone
+	}
+	ipam.Alive = func(owner string) bool { return alive[owner] }
+
+	n, err := ipam.Reclaim()
+	if err != nil || n != 2 {
+		t.Errorf("Reclaim() = %v, %v, want 2", n, err)
+	}
+	leases, _ := ipam.Leases()
+	for _, owner := range leases {
+		if !alive[owner] {
+			t.Errorf("lease of dead owner %v is not reclaimed", owner)
+		}
+	}
+
+	// dead leases are also reclaimed on Allocate
+	for _, owner := range []string{"c5", "c6"} {
+		alive[owner] = true
+		if _, err := ipam.Allocate(owner); err != nil {
+			t.Fatalf("Allocate() error = %v", err)
+		}
+	}
+	alive["c0"] = false
+	if ip, err := ipam.Allocate("c7"); err != nil || ip.String() != "10.99.0.2" {
+		t.Errorf("Allocate() with a dead lease = %v, %v, want 10.99.0.2", ip, err)
+	}
+}
+
+// concurrent allocations (each with its own IPAM, as separate hind
+// processes) never get duplicate addresses.
+func TestIPAM_Concurrent(t *testing.T) {
+	ipam := testIPAM(t, "10.99.0.0/24")
+
+	const n = 100
+	ips := make([]net.IP, n)
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a := &IPAM{Dir: ipam.Dir, Name: ipam.Name, Subnet: ipam.Subnet, Reserved: ipam.Reserved}
+			ips[i], errs[i] = a.Allocate(fmt.Sprint("c", i))
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]int{}
+	for i, ip := range ips {
+		if errs[i] != nil {
+			t.Fatalf("Allocate() error = %v", errs[i])
+		}
+		if j, dup := seen[ip.String()]; dup {
+			t.Errorf("duplicate address %v for c%d and c%d", ip, i, j)
+		}
+		seen[ip.String()] = i
+	}
+
+	leases, _ := ipam.Leases()
+	if len(leases) != n {
+		t.Errorf("len(Leases()) = %v, want %v", len(leases), n)
+	}
+}
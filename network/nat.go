@@ -0,0 +1,161 @@
+package network
+
+// This file implements the NAT of the bridge, and the isolation
+// between the bridges, with iptables.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// masqueradeRule: the packets from the subnet to outside of the bridge
+// are masqueraded with the address of the outgoing interface.
+//
+//	iptables -t nat -A POSTROUTING -s $subnet ! -o $bridge -j MASQUERADE
+func (b *Bridge) masqueradeRule() []string {
+	return []string{"POSTROUTING", "-s", b.Subnet.String(), "!", "-o", b.Name, "-j", "MASQUERADE"}
+}
+
+// forwardRules accept the packets forwarded from and to the bridge
+// (in case the default FORWARD policy is DROP, e.g. docker is installed).
+func (b *Bridge) forwardRules() [][]string {
+	return [][]string{
+		{"FORWARD", "-i", b.Name, "-j", "ACCEPT"},
+		{"FORWARD", "-o", b.Name, "-j", "ACCEPT"},
+	}
+}
+
+func (b *Bridge) setupMasquerade() error {
+	if err := ensureRule("nat", b.masqueradeRule()); err != nil {
+		return err
+	}
+	for _, rule := range b.forwardRules() {
+		if err := ensureRule("filter", rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bridge) teardownMasquerade() error {
+	var errs []error
+	errs = append(errs, deleteRule("nat", b.masqueradeRule()))
+	for _, rule := range b.forwardRules() {
+		errs = append(errs, deleteRule("filter", rule))
+	}
+	return errors.Join(errs...)
+}
+
+// The isolation between bridges takes two stages, as docker does:
+//
+//	FORWARD            -j HIND-ISOLATION-1       (inserted at the top)
+//	HIND-ISOLATION-1   -i $bridge ! -o $bridge -j HIND-ISOLATION-2
+//	HIND-ISOLATION-2   -o $bridge -j DROP
+//
+// A packet from a bridge to any other bridge of hind is dropped, while
+// the packets to the outside (and the replies) pass.
+const (
+	isolationChain1 = "HIND-ISOLATION-1"
+	isolationChain2 = "HIND-ISOLATION-2"
+)
+
+func (b *Bridge) isolationRules() [][]string {
+	return [][]string{
+		{isolationChain1, "-i", b.Name, "!", "-o", b.Name, "-j", isolationChain2},
+		{isolationChain2, "-o", b.Name, "-j", "DROP"},
+	}
+}
+
+func (b *Bridge) setupIsolation() error {
+	for _, chain := range []string{isolationChain2, isolationChain1} {
+		if err := ensureChain("filter", chain); err != nil {
+			return err
+		}
+	}
+	jump := []string{"FORWARD", "-j", isolationChain1}
+	if err := iptables(append([]string{"-t", "filter", "-C"}, jump...)...); err != nil {
+		if errors.Is(err, ErrNoIptables) {
+			return err
+		}
+		// before the ACCEPT rules of the bridges
+		if err := iptables("-t", "filter", "-I", "FORWARD", "1", "-j", isolationChain1); err != nil {
+			return err
+		}
+	}
+	for _, rule := range b.isolationRules() {
+		if err := ensureRule("filter", rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bridge) teardownIsolation() error {
+	var errs []error
+	for _, rule := range b.isolationRules() {
+		errs = append(errs, deleteRule("filter", rule))
+	}
+	return errors.Join(errs...)
+}
+
+// ensureChain creates the chain in the table, if it does not exist yet.
+func ensureChain(table string, chain string) error {
+	if err := iptables("-t", table, "-L", chain, "-n"); err == nil {
+		return nil // exists
+	} else if errors.Is(err, ErrNoIptables) {
+		return err
+	}
+	return iptables("-t", table, "-N", chain)
+}
+
+// ensureRule appends the rule (chain and rule-specification) to the table,
+// if it does not exist yet.
+func ensureRule(table string, rule []string) error {
+	if err := iptables(append([]string{"-t", table, "-C"}, rule...)...); err == nil {
+		return nil // exists
+	} else if errors.Is(err, ErrNoIptables) {
+		return err
+	}
+	return iptables(append([]string{"-t", table, "-A"}, rule...)...)
+}
+
+// deleteRule deletes the rule if it exists.
+func deleteRule(table string, rule []string) error {
+	if err := iptables(append([]string{"-t", table, "-C"}, rule...)...); err != nil {
+		if errors.Is(err, ErrNoIptables) {
+			return err
+		}
+		return nil // not exists
+	}
+	return iptables(append([]string{"-t", table, "-D"}, rule...)...)
+}
+
+// iptables runs iptables with the args. -w: wait for the xtables lock.
+func iptables(args ...string) error {
+	path, err := exec.LookPath("iptables")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNoIptables, err)
+	}
+
+	cmd := exec.Command(path, append([]string{"-w"}, args...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("iptables %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// enableIPForward: echo 1 > /proc/sys/net/ipv4/ip_forward
+func enableIPForward() error {
+	const ipForward = "/proc/sys/net/ipv4/ip_forward"
+
+	if v, err := os.ReadFile(ipForward); err == nil && strings.TrimSpace(string(v)) == "1" {
+		return nil
+	}
+	if err := os.WriteFile(ipForward, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("enable ip forward: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package network
+
+// This file implements the port publishing: forwarding the host's
+// ports to the container with a userland proxy.
+//
+// The proxy runs in the hind process supervising the container, so the
+// mappings live exactly as long as the container. It works without
+// iptables, and for the connections from the host itself (which do not
+// go through the PREROUTING chain where a DNAT rule would be).
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Protocols of the port mappings.
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// udpIdleTimeout: a udp "connection" (a client address) is forgotten
+// after being idle for this long.
+const udpIdleTimeout = 90 * time.Second
+
+// PortMapping publishes the ContainerPort to the HostPort of the HostIP.
+type PortMapping struct {
+	HostIP        string `json:",omitempty"` // empty for all addresses
+	HostPort      uint16 // 0 for a random port
+	ContainerPort uint16
+	Protocol      string // tcp | udp
+}
+
+// ParsePortMapping parses a port mapping in the docker format:
+//
+//	[[hostIP:]hostPort:]containerPort[/protocol]
+//
+// e.g. "8080:80", "127.0.0.1:5353:53/udp". An omitted (or empty)
+// hostPort means a random port. The protocol defaults to tcp.
+func ParsePortMapping(s string) (PortMapping, error) {
+	m := PortMapping{Protocol: ProtocolTCP}
+
+	ports, proto, hasProto := strings.Cut(s, "/")
+	if hasProto {
+		m.Protocol = strings.ToLower(proto)
+	}
+	if m.Protocol != ProtocolTCP && m.Protocol != ProtocolUDP {
+		return m, fmt.Errorf("%w: %q: unknown protocol %q", ErrBadPortMapping, s, proto)
+	}
+
+	var hostPort, containerPort string
+	switch fields := strings.Split(ports, ":"); len(fields) {
+	case 1:
+		containerPort = fields[0]
+	case 2:
+		hostPort, containerPort = fields[0], fields[1]
+	case 3:
+		m.HostIP, hostPort, containerPort = fields[0], fields[1], fields[2]
+	default:
+		return m, fmt.Errorf("%w: %q", ErrBadPortMapping, s)
+	}
+
+	if m.HostIP != "" {
+		ip := net.ParseIP(m.HostIP)
+		if ip == nil || ip.To4() == nil {
+			return m, fmt.Errorf("%w: %q: bad host IPv4 address %q", ErrBadPortMapping, s, m.HostIP)
+		}
+	}
+
+	var err error
+	if m.ContainerPort, err = parsePort(containerPort); err != nil || m.ContainerPort == 0 {
+		return m, fmt.Errorf("%w: %q: bad container port %q", ErrBadPortMapping, s, containerPort)
+	}
+	if hostPort != "" {
+		if m.HostPort, err = parsePort(hostPort); err != nil {
+			return m, fmt.Errorf("%w: %q: bad host port %q", ErrBadPortMapping, s, hostPort)
+		}
+	}
+
+	return m, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	return uint16(port), err
+}
+
+// String formats the mapping as docker port does: 80/tcp -> 0.0.0.0:8080
+func (m PortMapping) String() string {
+	hostIP := m.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	return fmt.Sprintf("%d/%s -> %s", m.ContainerPort, m.Protocol,
+		net.JoinHostPort(hostIP, strconv.Itoa(int(m.HostPort))))
+}
+
+// hostAddr is the address to listen on the host.
+func (m PortMapping) hostAddr() string {
+	return net.JoinHostPort(m.HostIP, strconv.Itoa(int(m.HostPort)))
+}
+
+// PortProxy forwards the connections (tcp) or datagrams (udp) to the
+// host port of the Mapping to the container port.
+type PortProxy struct {
+	Mapping PortMapping // with the actual HostPort if a random one was asked
+	backend string      // containerIP:containerPort
+
+	listener net.Listener   // tcp
+	conn     net.PacketConn // udp
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[io.Closer]struct{} // active connections to close on Close
+	wg     sync.WaitGroup
+}
+
+// Publish starts a proxy forwarding the host port of the mapping
+// to the container port of the containerIP.
+func Publish(m PortMapping, containerIP net.IP) (*PortProxy, error) {
+	p := &PortProxy{
+		Mapping: m,
+		backend: net.JoinHostPort(containerIP.String(), strconv.Itoa(int(m.ContainerPort))),
+		conns:   map[io.Closer]struct{}{},
+	}
+
+	var err error
+	switch m.Protocol {
+	case ProtocolTCP:
+		p.listener, err = net.Listen("tcp4", m.hostAddr())
+		if err == nil {
+			p.Mapping.HostPort = uint16(p.listener.Addr().(*net.TCPAddr).Port)
+			p.wg.Add(1)
+			go p.serveTCP()
+		}
+	case ProtocolUDP:
+		p.conn, err = net.ListenPacket("udp4", m.hostAddr())
+		if err == nil {
+			p.Mapping.HostPort = uint16(p.conn.LocalAddr().(*net.UDPAddr).Port)
+			p.wg.Add(1)
+			go p.serveUDP()
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown protocol %q", ErrBadPortMapping, m.Protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("publish %s: %w", m, err)
+	}
+
+	slog.Info("[network] port published.", "mapping", p.Mapping.String(), "backend", p.backend)
+	return p, nil
+}
+
+// Close stops the proxy and closes all the connections.
+func (p *PortProxy) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+
+	var err error
+	if p.listener != nil {
+		err = p.listener.Close()
+	}
+	if p.conn != nil {
+		err = p.conn.Close()
+	}
+	for c := range p.conns {
+		c.Close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	slog.Info("[network] port unpublished.", "mapping", p.Mapping.String())
+	return err
+}
+
+// track adds the connection to be closed on Close.
+// It returns false if the proxy has been closed.
+func (p *PortProxy) track(c io.Closer) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[c] = struct{}{}
+	return true
+}
+
+func (p *PortProxy) untrack(c io.Closer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, c)
+}
+
+func (p *PortProxy) serveTCP() {
+	defer p.wg.Done()
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Warn("[network] port proxy: accept failed.", "mapping", p.Mapping.String(), "err", err)
+			}
+			return
+		}
+		p.wg.Add(1)
+		go p.proxyTCP(client)
+	}
+}
+
+// proxyTCP copies between the client and the backend until both
+// directions are done.
+func (p *PortProxy) proxyTCP(client net.Conn) {
+	defer p.wg.Done()
+	defer client.Close()
+
+	backend, err := net.DialTimeout("tcp4", p.backend, 10*time.Second)
+	if err != nil {
+		slog.Warn("[network] port proxy: dial container failed.", "backend", p.backend, "err", err)
+		return
+	}
+	defer backend.Close()
+
+	if !p.track(client) || !p.track(backend) {
+		return
+	}
+	defer p.untrack(client)
+	defer p.untrack(backend)
+
+	var wg sync.WaitGroup
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		// half close: pass the EOF on
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}
+	wg.Add(2)
+	go pipe(backend, client)
+	go pipe(client, backend)
+	wg.Wait()
+}
+
+// serveUDP forwards the datagrams from each client address with a
+// dedicated socket to the backend, so the replies can be sent back.
+func (p *PortProxy) serveUDP() {
+	defer p.wg.Done()
+
+	var mu sync.Mutex
+	backends := map[string]net.Conn{} // client addr -> conn to the backend
+
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Warn("[network] port proxy: read failed.", "mapping", p.Mapping.String(), "err", err)
+			}
+			return
+		}
+
+		mu.Lock()
+		backend, ok := backends[client.String()]
+		if !ok {
+			backend, err = net.Dial("udp4", p.backend)
+			if err != nil {
+				mu.Unlock()
+				slog.Warn("[network] port proxy: dial container failed.", "backend", p.backend, "err", err)
+				continue
+			}
+			if !p.track(backend) {
+				// the proxy is closed
+				mu.Unlock()
+				backend.Close()
+				return
+			}
+			backends[client.String()] = backend
+
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				p.replyUDP(backend, client)
+
+				mu.Lock()
+				delete(backends, client.String())
+				mu.Unlock()
+				p.untrack(backend)
+				backend.Close()
+			}()
+		}
+		mu.Unlock()
+
+		backend.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		if _, err := backend.Write(buf[:n]); err != nil {
+			slog.Warn("[network] port proxy: write to container failed.", "backend", p.backend, "err", err)
+		}
+	}
+}
+
+// replyUDP sends the replies from the backend back to the client,
+// until the backend is idle for udpIdleTimeout or closed.
+func (p *PortProxy) replyUDP(backend net.Conn, client net.Addr) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := backend.Read(buf)
+		if err != nil {
+			return
+		}
+		backend.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		if _, err := p.conn.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
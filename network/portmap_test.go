@@ -0,0 +1,151 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    PortMapping
+		wantErr bool
+	}{
+		{"80", PortMapping{ContainerPort: 80, Protocol: "tcp"}, false},
+		{"8080:80", PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}, false},
+		{":80", PortMapping{ContainerPort: 80, Protocol: "tcp"}, false},
+		{"5353:53/udp", PortMapping{HostPort: 5353, ContainerPort: 53, Protocol: "udp"}, false},
+		{"127.0.0.1:8080:80/TCP", PortMapping{HostIP: "127.0.0.1", HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}, false},
+		{"127.0.0.1::80", PortMapping{HostIP: "127.0.0.1", ContainerPort: 80, Protocol: "tcp"}, false},
+		{"", PortMapping{}, true},
+		{"0", PortMapping{}, true},
+		{"8080:80/sctp", PortMapping{}, true},
+		{"70000:80", PortMapping{}, true},
+		{"8080:http", PortMapping{}, true},
+		{"::1:8080:80", PortMapping{}, true},
+		{"localhost:8080:80", PortMapping{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParsePortMapping(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePortMapping() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrBadPortMapping) {
+					t.Errorf("ParsePortMapping() error = %v, want ErrBadPortMapping", err)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParsePortMapping() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortMapping_String(t *testing.T) {
+	m := PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}
+	if got, want := m.String(), "80/tcp -> 0.0.0.0:8080"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+// the "container" is an echo server on the loopback.
+func TestPublish_TCP(t *testing.T) {
+	backend, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+
+	m := PortMapping{
+		HostIP:        "127.0.0.1",
+		ContainerPort: uint16(backend.Addr().(*net.TCPAddr).Port),
+		Protocol:      ProtocolTCP,
+	}
+	p, err := Publish(m, net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if p.Mapping.HostPort == 0 {
+		t.Fatalf("Publish() got no random host port")
+	}
+
+	c, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(p.Mapping.HostPort))))
+	if err != nil {
+		t.Fatalf("dial published port: %v", err)
+	}
+	c.Write([]byte("hello"))
+	c.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(c)
+	if err != nil || string(got) != "hello" {
+		t.Errorf("echo = %q, %v, want hello", got, err)
+	}
+	c.Close()
+
+	if err := p.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if _, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(p.Mapping.HostPort)))); err == nil {
+		t.Errorf("the port is still published after Close")
+	}
+}
+
+func TestPublish_UDP(t *testing.T) {
+	backend, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	m := PortMapping{
+		HostIP:        "127.0.0.1",
+		ContainerPort: uint16(backend.LocalAddr().(*net.UDPAddr).Port),
+		Protocol:      ProtocolUDP,
+	}
+	p, err := Publish(m, net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	defer p.Close()
+
+	c, err := net.Dial("udp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(p.Mapping.HostPort))))
+	if err != nil {
+		t.Fatalf("dial published port: %v", err)
+	}
+	defer c.Close()
+
+	for _, msg := range []string{"ping", "pong"} {
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte(msg))
+		buf := make([]byte, 1500)
+		n, err := c.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Errorf("echo = %q, %v, want %q", buf[:n], err, msg)
+		}
+	}
+}
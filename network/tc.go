@@ -0,0 +1,249 @@
+package network
+
+// This file limits the bandwidth of the containers with tc (netlink):
+//
+//	-> container: tbf qdisc on the host side veth
+//	container ->: host side veth ingress --redirect--> ifb: tbf qdisc
+//
+// All are on the host side of the veth pair, where the container
+// (even with CAP_NET_ADMIN) can not remove them.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/exp/slog"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// minBurst is the default (and minimal) burst: enough for a few
+	// full size frames, otherwise the tbf can never send anything.
+	minBurst = 32 * 1024
+
+	// tbfLatency is how long a packet may wait in the tbf queue.
+	tbfLatency = 50 // ms
+)
+
+// Bandwidth limits the traffic of a container in each direction.
+type Bandwidth struct {
+	Rate  uint64 // bytes per second
+	Burst uint32 // bytes. 0 for the default: the larger of 10ms at the Rate and 32kb.
+}
+
+// burst is the Burst, or the default.
+func (bw Bandwidth) burst() uint32 {
+	if bw.Burst != 0 {
+		return bw.Burst
+	}
+	b := bw.Rate / 100
+	if b < minBurst {
+		return minBurst
+	}
+	if b > 1<<31 {
+		return 1 << 31
+	}
+	return uint32(b)
+}
+
+// rateUnits are the tc(8) rate units in bytes per second.
+// A bare number is in bits per second.
+var rateUnits = map[string]float64{
+	"":    1.0 / 8,
+	"bit": 1.0 / 8, "kbit": 1e3 / 8, "mbit": 1e6 / 8, "gbit": 1e9 / 8, "tbit": 1e12 / 8,
+	"kibit": 1024.0 / 8, "mibit": (1 << 20) / 8.0, "gibit": (1 << 30) / 8.0, "tibit": (1 << 40) / 8.0,
+	"bps": 1, "kbps": 1e3, "mbps": 1e6, "gbps": 1e9, "tbps": 1e12,
+	"kibps": 1 << 10, "mibps": 1 << 20, "gibps": 1 << 30, "tibps": 1 << 40,
+}
+
+// sizeUnits are the tc(8) size units in bytes.
+// A bare number is in bytes.
+var sizeUnits = map[string]float64{
+	"": 1, "b": 1,
+	"k": 1 << 10, "kb": 1 << 10, "m": 1 << 20, "mb": 1 << 20, "g": 1 << 30, "gb": 1 << 30,
+	"kbit": 1024.0 / 8, "mbit": (1 << 20) / 8.0, "gbit": (1 << 30) / 8.0,
+}
+
+// ParseRate parses a rate in the tc(8) style into bytes per second,
+// e.g. 10mbit, 1gbit, 500kbps.
+func ParseRate(s string) (uint64, error) {
+	v, err := parseUnit(s, rateUnits)
+	if err != nil || v < 1 || v > 1<<53 {
+		return 0, fmt.Errorf("%w: bad rate %q", ErrBadBandwidth, s)
+	}
+	return uint64(v), nil
+}
+
+// ParseSize parses a size in the tc(8) style into bytes,
+// e.g. 32kb, 1mb, 1500.
+func ParseSize(s string) (uint32, error) {
+	v, err := parseUnit(s, sizeUnits)
+	if err != nil || v < 1 || v > 1<<31 {
+		return 0, fmt.Errorf("%w: bad size %q", ErrBadBandwidth, s)
+	}
+	return uint32(v), nil
+}
+
+// parseUnit parses "<number><unit>" with the factors of the units.
+func parseUnit(s string, units map[string]float64) (float64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, err
+	}
+	factor, ok := units[s[i:]]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", s[i:])
+	}
+	return n * factor, nil
+}
+
+// LimitBandwidth shapes the traffic of the container in both directions
+// with tbf qdiscs:
+//   - to the container: on the egress of the host side veth hostIf.
+//   - from the container: the ingress of hostIf is redirected to an ifb
+//     device (see ifbName), and shaped on the egress of the ifb.
+//
+// The qdiscs are replaced if exist. They are gone with the veth pair,
+// the ifb device is deleted by Disconnect or UnlimitBandwidth.
+func LimitBandwidth(hostIf string, bw Bandwidth) error {
+	if bw.Rate == 0 {
+		return fmt.Errorf("%w: zero rate", ErrBadBandwidth)
+	}
+	link, err := netlink.LinkByName(hostIf)
+	if err != nil {
+		return fmt.Errorf("find %s: %w", hostIf, err)
+	}
+
+	if err := addTbf(link, bw); err != nil {
+		return err
+	}
+
+	ifb, err := ensureIfb(ifbName(hostIf))
+	if err != nil {
+		return err
+	}
+	if err := addTbf(ifb, bw); err != nil {
+		return err
+	}
+	if err := redirectIngress(link, ifb); err != nil {
+		return err
+	}
+
+	slog.Info("[network] bandwidth limited.", "hostIf", hostIf, "ifb", ifb.Attrs().Name, "rate", bw.Rate, "burst", bw.burst())
+	return nil
+}
+
+// UnlimitBandwidth deletes the ifb device of the hostIf. The qdiscs on
+// hostIf are left: they are deleted together with the veth pair.
+func UnlimitBandwidth(hostIf string) error {
+	link, err := netlink.LinkByName(ifbName(hostIf))
+	if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return netlink.LinkDel(link)
+}
+
+// ifbName is "ifb" + the suffix of the hostIf after "veth":
+// veth1a2b3c4d5e6 -> ifb1a2b3c4d5e6.
+func ifbName(hostIf string) string {
+	return "ifb" + strings.TrimPrefix(hostIf, "veth")
+}
+
+// ensureIfb creates the ifb device if not exists, and sets it up.
+func ensureIfb(name string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = name
+		if err := netlink.LinkAdd(&netlink.Ifb{LinkAttrs: attrs}); err != nil {
+			return nil, fmt.Errorf("create ifb %s: %w", name, err)
+		}
+		link, err = netlink.LinkByName(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("find ifb %s: %w", name, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("set %s up: %w", name, err)
+	}
+	return link, nil
+}
+
+// addTbf replaces the root qdisc of the link with a tbf.
+func addTbf(link netlink.Link, bw Bandwidth) error {
+	burst := bw.burst()
+	tbf := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   bw.Rate,
+		Buffer: netlink.Xmittime(bw.Rate, burst),
+		Limit:  tbfLimit(bw.Rate, burst),
+	}
+	if err := netlink.QdiscReplace(tbf); err != nil {
+		return fmt.Errorf("add tbf qdisc to %s: %w", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// redirectIngress redirects all the packets received by the link to
+// the egress of the target:
+//
+//	tc qdisc add dev <link> ingress
+//	tc filter add dev <link> parent ffff: protocol all u32 match u32 0 0 \
+//		action mirred egress redirect dev <target>
+func redirectIngress(link netlink.Link, target netlink.Link) error {
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	// the ingress qdisc can not be replaced: EINVAL
+	if err := netlink.QdiscAdd(ingress); err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("add ingress qdisc to %s: %w", link.Attrs().Name, err)
+	}
+
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    ingress.Handle,
+			Handle:    netlink.MakeHandle(0x8000, 0x800), // 800::800, the first node: replaced if exists
+			Priority:  1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		// no Sel: match all
+		Actions: []netlink.Action{netlink.NewMirredAction(target.Attrs().Index)},
+	}
+	if err := netlink.FilterReplace(filter); err != nil {
+		return fmt.Errorf("redirect %s to %s: %w", link.Attrs().Name, target.Attrs().Name, err)
+	}
+	return nil
+}
+
+// tbfLimit is the queue length of the tbf in bytes: the burst plus what
+// arrives in tbfLatency at the rate.
+func tbfLimit(rate uint64, burst uint32) uint32 {
+	limit := rate*tbfLatency/1000 + uint64(burst)
+	if limit > 1<<31 {
+		return 1 << 31
+	}
+	return uint32(limit)
+}
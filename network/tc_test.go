@@ -0,0 +1,149 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    uint64
+		wantErr bool
+	}{
+		{"8000", 1000, false}, // bare number: bit/s
+		{"10mbit", 1250000, false},
+		{"10Mbit", 1250000, false},
+		{"1gbit", 125000000, false},
+		{"1.5mbit", 187500, false},
+		{"8kibit", 1024, false},
+		{"500kbps", 500000, false},
+		{"1mibps", 1 << 20, false},
+		{"", 0, true},
+		{"mbit", 0, true},
+		{"10mbits", 0, true},
+		{"1bit", 0, true}, // less than a byte per second
+		{"-1mbit", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseRate(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseRate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    uint32
+		wantErr bool
+	}{
+		{"1500", 1500, false},
+		{"1500b", 1500, false},
+		{"32kb", 32 << 10, false},
+		{"32k", 32 << 10, false},
+		{"1mb", 1 << 20, false},
+		{"8kbit", 1024, false},
+		{"4gb", 0, true},
+		{"0", 0, true},
+		{"1kib", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseSize(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBandwidth_burst(t *testing.T) {
+	tests := []struct {
+		name string
+		bw   Bandwidth
+		want uint32
+	}{
+		{"given", Bandwidth{Rate: 1 << 30, Burst: 1500}, 1500},
+		{"min", Bandwidth{Rate: 125000}, minBurst},
+		{"10ms", Bandwidth{Rate: 125000000}, 1250000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.bw.burst(); got != tt.want {
+				t.Errorf("burst() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// REQUIREMENT: run as root.
+func TestLimitBandwidth(t *testing.T) {
+	withThrowawayNetns(t, func(host netns.NsHandle) {
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = "vethtc"
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: attrs, PeerName: "pethtc"}); err != nil {
+			t.Fatalf("create veth pair: %v", err)
+		}
+
+		bw := Bandwidth{Rate: 1250000} // 10mbit
+		if err := LimitBandwidth("vethtc", bw); err != nil {
+			t.Fatalf("LimitBandwidth() error = %v", err)
+		}
+		// idempotent
+		if err := LimitBandwidth("vethtc", bw); err != nil {
+			t.Fatalf("LimitBandwidth() again error = %v", err)
+		}
+
+		for _, name := range []string{"vethtc", "ifbtc"} {
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				t.Fatalf("find %s: %v", name, err)
+			}
+			qdiscs, err := netlink.QdiscList(link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			shaped := false
+			for _, q := range qdiscs {
+				if tbf, ok := q.(*netlink.Tbf); ok && tbf.Rate == bw.Rate {
+					shaped = true
+				}
+			}
+			if !shaped {
+				t.Errorf("%s: want a tbf qdisc with rate %v, got %+v", name, bw.Rate, qdiscs)
+			}
+		}
+
+		link, _ := netlink.LinkByName("vethtc")
+		filters, err := netlink.FilterList(link, netlink.MakeHandle(0xffff, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(filters) != 1 {
+			t.Errorf("want the redirect filter on the ingress, got %+v", filters)
+		}
+
+		if err := Disconnect(&Endpoint{HostIf: "vethtc"}); err != nil {
+			t.Fatalf("Disconnect() error = %v", err)
+		}
+		if _, err := netlink.LinkByName("ifbtc"); err == nil {
+			t.Errorf("ifbtc should be deleted by Disconnect")
+		}
+
+		if err := LimitBandwidth("nonexist", bw); err == nil {
+			t.Errorf("LimitBandwidth() on a missing link: want error")
+		}
+	})
+}